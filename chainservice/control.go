@@ -0,0 +1,72 @@
+package chainservice
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+)
+
+/*
+Pause 暂停执行委托,用于处理公链或者账户的问题.
+暂停期间仍然接收链上事件并安排执行计划,但是不处理新块,已经开始的tx不受影响.
+暂停状态不保存,重启以后自动恢复
+*/
+func (ce *ChainEvents) Pause() {
+	if atomic.CompareAndSwapInt32(&ce.paused, 0, 1) {
+		log.Warn(fmt.Sprintf("delegate execution paused at block %d", ce.GetBlockNumber()))
+	}
+}
+
+//Resume 恢复执行,暂停期间错过的块在下一个新块到来时补齐
+func (ce *ChainEvents) Resume() {
+	if atomic.CompareAndSwapInt32(&ce.paused, 1, 0) {
+		// 暂停期间没有处理新块,watchdog不应该认为事件源停止了
+		atomic.StoreInt64(&ce.lastBlockTime, time.Now().UnixNano())
+		log.Warn(fmt.Sprintf("delegate execution resumed from block %d", ce.GetBlockNumber()))
+	}
+}
+
+//Paused returns true if delegate execution is paused
+func (ce *ChainEvents) Paused() bool {
+	return atomic.LoadInt32(&ce.paused) == 1
+}
+
+//checkRescan 只能回到已经处理过的块,不能跳过还没有处理的块
+func checkRescan(fromBlockNumber, processed int64) error {
+	if fromBlockNumber <= 0 || fromBlockNumber > processed+1 {
+		return fmt.Errorf("rescan from %d out of range, must between 1 and %d", fromBlockNumber, processed+1)
+	}
+	return nil
+}
+
+/*
+Rescan 从fromBlockNumber重新扫描链上事件并补齐执行计划,用于事件源丢失事件以后的修复.
+这些块会重新处理,已经开始执行的Monitor已经标记,不会重复执行,只执行补上的Monitor;
+重复收到的事件也不会重复添加Monitor
+*/
+func (ce *ChainEvents) Rescan(fromBlockNumber int64) error {
+	err := checkRescan(fromBlockNumber, ce.GetBlockNumber())
+	if err != nil {
+		return err
+	}
+	select {
+	case ce.rescanChan <- fromBlockNumber:
+	default:
+		return fmt.Errorf("another rescan is pending")
+	}
+	return nil
+}
+
+//doRescan 在loop中执行,避免和正在处理的块冲突
+func (ce *ChainEvents) doRescan(fromBlockNumber int64) {
+	processed := ce.GetBlockNumber()
+	if checkRescan(fromBlockNumber, processed) != nil {
+		return
+	}
+	log.Warn(fmt.Sprintf("rescan from block %d, last processed block=%d", fromBlockNumber, processed))
+	ce.blockNumber.Store(fromBlockNumber - 1)
+	ce.db.SaveLatestBlockNumber(fromBlockNumber - 1)
+	ce.restartEvents()
+}
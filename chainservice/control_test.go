@@ -0,0 +1,28 @@
+package chainservice
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPauseAndRescan(t *testing.T) {
+	ast := assert.New(t)
+	ce := &ChainEvents{blockNumber: new(atomic.Value), rescanChan: make(chan int64, 1)}
+	ce.blockNumber.Store(int64(100))
+	ce.Pause()
+	ast.True(ce.WatchdogStatus().Paused)
+	// 暂停期间不处理新块
+	ce.handleBlockNumber(101)
+	ast.EqualValues(100, ce.GetBlockNumber())
+	ce.Resume()
+	ast.False(ce.Paused())
+
+	ast.NotNil(ce.Rescan(0))
+	ast.NotNil(ce.Rescan(102))
+	ast.Nil(ce.Rescan(50))
+	// 上一次还没有处理
+	ast.NotNil(ce.Rescan(60))
+	ast.EqualValues(50, <-ce.rescanChan)
+}
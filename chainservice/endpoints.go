@@ -0,0 +1,442 @@
+package chainservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// endpoint 一个公链节点及其健康状况
+type endpoint struct {
+	url         string
+	client      *rpc.Client
+	eth         *ethclient.Client
+	healthy     bool
+	blockNumber int64
+	lastAdvance time.Time // 块高最后一次变化的时间
+	err         error
+}
+
+//EndpointStatus 公链节点的健康状况
+type EndpointStatus struct {
+	URL         string `json:"url"`
+	Healthy     bool   `json:"healthy"`
+	BlockNumber int64  `json:"block_number"`
+	Error       string `json:"error,omitempty"`
+}
+
+/*
+EndpointPool 管理多个公链节点,并在本地提供一个JSON-RPC代理,
+SafeEthClient,blockchain.Events等都连接这个代理,不需要知道有多个节点:
+	1. 普通请求发给第一个健康的节点,连接失败或者超时换下一个
+	2. eth_sendRawTransaction广播给所有节点
+	3. 定期检查节点,落后太多或者块高长时间不变的节点标记为不健康
+单个节点卡住时PMS不会再悄无声息地错过执行时间
+*/
+type EndpointPool struct {
+	lock      sync.RWMutex
+	endpoints []*endpoint
+	listener  net.Listener
+	quitChan  chan struct{}
+}
+
+//NewEndpointPool connect to all urls, endpoints not responding are marked unhealthy
+func NewEndpointPool(urls []string) (*EndpointPool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no eth rpc endpoint")
+	}
+	p := &EndpointPool{
+		quitChan: make(chan struct{}),
+	}
+	for _, url := range urls {
+		ctx, cancel := context.WithTimeout(context.Background(), params.EndpointCallTimeout)
+		client, err := rpc.DialContext(ctx, url)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("dial %s err %s", url, err)
+		}
+		p.endpoints = append(p.endpoints, &endpoint{
+			url:         url,
+			client:      client,
+			eth:         ethclient.NewClient(client),
+			healthy:     true,
+			lastAdvance: time.Now(),
+		})
+	}
+	p.checkHealth()
+	return p, nil
+}
+
+//Start the local proxy and health check, returns url of the proxy
+func (p *EndpointPool) Start() (url string, err error) {
+	p.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	go func() {
+		err := http.Serve(p.listener, p)
+		select {
+		case <-p.quitChan:
+		default:
+			log.Error(fmt.Sprintf("eth rpc proxy quit err %s", err))
+		}
+	}()
+	go p.checkLoop()
+	return "http://" + p.listener.Addr().String(), nil
+}
+
+//Stop proxy and health check
+func (p *EndpointPool) Stop() {
+	close(p.quitChan)
+	if p.listener != nil {
+		err := p.listener.Close()
+		if err != nil {
+			log.Error(fmt.Sprintf("close eth rpc proxy err %s", err))
+		}
+	}
+	for _, e := range p.endpoints {
+		e.client.Close()
+	}
+}
+
+func (p *EndpointPool) checkLoop() {
+	for {
+		select {
+		case <-p.quitChan:
+			return
+		case <-time.After(params.EndpointCheckInterval):
+			p.checkHealth()
+		}
+	}
+}
+
+/*
+checkHealth 同时查询所有节点的块高,出错,比最高的节点落后超过EndpointMaxLag,
+或者块高EndpointStallTimeout没有变化的节点都是不健康的
+*/
+func (p *EndpointPool) checkHealth() {
+	type result struct {
+		number int64
+		err    error
+	}
+	results := make([]result, len(p.endpoints))
+	var wg sync.WaitGroup
+	for i, e := range p.endpoints {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), params.EndpointCallTimeout)
+			defer cancel()
+			var n hexutil.Uint64
+			err := e.client.CallContext(ctx, &n, "eth_blockNumber")
+			results[i] = result{int64(n), err}
+		}(i, e)
+	}
+	wg.Wait()
+	var best int64
+	for _, r := range results {
+		if r.err == nil && r.number > best {
+			best = r.number
+		}
+	}
+	now := time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, e := range p.endpoints {
+		r := results[i]
+		var err error
+		switch {
+		case r.err != nil:
+			err = r.err
+		case best-r.number > params.EndpointMaxLag:
+			err = fmt.Errorf("block number %d is %d blocks behind", r.number, best-r.number)
+		}
+		if r.err == nil {
+			if r.number != e.blockNumber {
+				e.lastAdvance = now
+			}
+			e.blockNumber = r.number
+			if err == nil && now.Sub(e.lastAdvance) > params.EndpointStallTimeout {
+				err = fmt.Errorf("block number %d unchanged since %s", r.number, e.lastAdvance.Format(time.RFC3339))
+			}
+		}
+		p.setHealthy(e, err)
+	}
+}
+
+// setHealthy 状态变化时记录日志,调用者持有锁
+func (p *EndpointPool) setHealthy(e *endpoint, err error) {
+	healthy := err == nil
+	if healthy != e.healthy {
+		if healthy {
+			log.Info(fmt.Sprintf("eth rpc endpoint %s recovered", e.url))
+		} else {
+			log.Warn(fmt.Sprintf("eth rpc endpoint %s unhealthy : %s", e.url, err))
+		}
+	}
+	e.healthy = healthy
+	e.err = err
+}
+
+func (p *EndpointPool) markUnhealthy(e *endpoint, err error) {
+	p.lock.Lock()
+	p.setHealthy(e, err)
+	p.lock.Unlock()
+}
+
+//candidates 按配置顺序,健康的节点在前,不健康的作为最后的选择
+func (p *EndpointPool) candidates() (es []*endpoint) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	var unhealthy []*endpoint
+	for _, e := range p.endpoints {
+		if e.healthy {
+			es = append(es, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	return append(es, unhealthy...)
+}
+
+//HealthyClients clients of healthy endpoints, used for quorum reads
+func (p *EndpointPool) HealthyClients() (clients []*ethclient.Client) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, e := range p.endpoints {
+		if e.healthy {
+			clients = append(clients, e.eth)
+		}
+	}
+	return
+}
+
+//Status of all endpoints
+func (p *EndpointPool) Status() (ss []*EndpointStatus) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, e := range p.endpoints {
+		s := &EndpointStatus{
+			URL:         e.url,
+			Healthy:     e.healthy,
+			BlockNumber: e.blockNumber,
+		}
+		if e.err != nil {
+			s.Error = e.err.Error()
+		}
+		ss = append(ss, s)
+	}
+	return
+}
+
+func (e *endpoint) call(ctx context.Context, method string, args []interface{}) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, params.EndpointCallTimeout)
+	defer cancel()
+	var result json.RawMessage
+	err := e.client.CallContext(ctx, &result, method, args...)
+	return result, err
+}
+
+/*
+forward 依次尝试每个节点,节点返回的JSON-RPC错误(比如合约执行失败)直接返回,
+只有连接错误和超时才换下一个节点
+*/
+func (p *EndpointPool) forward(ctx context.Context, method string, args []interface{}) (result json.RawMessage, err error) {
+	for _, e := range p.candidates() {
+		result, err = e.call(ctx, method, args)
+		if err == nil {
+			return
+		}
+		if _, ok := err.(rpc.Error); ok {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		p.markUnhealthy(e, err)
+	}
+	return
+}
+
+//broadcast 发给所有节点,只要有一个接受就算成功,避免tx因为单个节点的问题没有被打包
+func (p *EndpointPool) broadcast(ctx context.Context, method string, args []interface{}) (result json.RawMessage, err error) {
+	es := p.candidates()
+	type answer struct {
+		result json.RawMessage
+		err    error
+	}
+	answers := make([]answer, len(es))
+	var wg sync.WaitGroup
+	for i, e := range es {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			r, err := e.call(ctx, method, args)
+			answers[i] = answer{r, err}
+		}(i, e)
+	}
+	wg.Wait()
+	for i, a := range answers {
+		if a.err == nil {
+			return a.result, nil
+		}
+		log.Warn(fmt.Sprintf("%s to %s err %s", method, es[i].url, a.err))
+	}
+	return nil, answers[0].err
+}
+
+type jsonrpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type jsonrpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+// 和go-ethereum的限制一致
+const maxRequestContentLength = 1024 * 128
+
+//ServeHTTP local JSON-RPC proxy, only single requests are supported, ethclient never sends batch
+func (p *EndpointPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := &jsonrpcResponse{Version: "2.0"}
+	defer func() {
+		w.Header().Set("content-type", "application/json")
+		err := json.NewEncoder(w).Encode(res)
+		if err != nil {
+			log.Error(fmt.Sprintf("write eth rpc proxy response err %s", err))
+		}
+	}()
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestContentLength))
+	if err != nil {
+		res.Error = &jsonrpcError{Code: -32700, Message: err.Error()}
+		return
+	}
+	var req jsonrpcRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		res.Error = &jsonrpcError{Code: -32600, Message: fmt.Sprintf("invalid request %s", err)}
+		return
+	}
+	res.ID = req.ID
+	var raws []json.RawMessage
+	if len(req.Params) > 0 {
+		err = json.Unmarshal(req.Params, &raws)
+		if err != nil {
+			res.Error = &jsonrpcError{Code: -32602, Message: fmt.Sprintf("invalid params %s", err)}
+			return
+		}
+	}
+	args := make([]interface{}, len(raws))
+	for i, raw := range raws {
+		args[i] = raw
+	}
+	var result json.RawMessage
+	if req.Method == "eth_sendRawTransaction" {
+		result, err = p.broadcast(r.Context(), req.Method, args)
+	} else {
+		result, err = p.forward(r.Context(), req.Method, args)
+	}
+	if err != nil {
+		res.Error = &jsonrpcError{Code: -32000, Message: err.Error()}
+		if e, ok := err.(rpc.Error); ok {
+			res.Error.Code = e.ErrorCode()
+		}
+		return
+	}
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	res.Result = result
+}
+
+//SetEndpointPool enable quorum reads of channel info on endpoints in pool
+func (ce *ChainEvents) SetEndpointPool(pool *EndpointPool) {
+	ce.pool = pool
+}
+
+// channelInfo 通道在链上的信息,GetChannelInfoByChannelIdentifier的返回值
+type channelInfo struct {
+	settleBlockNumber uint64
+	openBlockNumber   uint64
+	state             uint8
+	settleTimeout     uint64
+}
+
+/*
+getChannelInfo 读取通道信息,设置了EndpointQuorum时要求至少EndpointQuorum个健康的节点返回一致的结果,
+避免因为某个节点数据错误接受无效的委托或者在错误的时间执行
+*/
+func (ce *ChainEvents) getChannelInfo(channelIdentifier common.Hash) (ci *channelInfo, err error) {
+	if ce.pool == nil || params.EndpointQuorum <= 1 {
+		ci = &channelInfo{}
+		ci.settleBlockNumber, ci.openBlockNumber, ci.state, ci.settleTimeout, err = ce.bcs.RegistryProxy.GetContract().GetChannelInfoByChannelIdentifier(nil, channelIdentifier)
+		return
+	}
+	clients := ce.pool.HealthyClients()
+	if len(clients) < params.EndpointQuorum {
+		return nil, fmt.Errorf("only %d healthy endpoints, quorum is %d", len(clients), params.EndpointQuorum)
+	}
+	infos := make([]*channelInfo, len(clients))
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *ethclient.Client) {
+			defer wg.Done()
+			contract, err := contracts.NewTokensNetwork(ce.bcs.RegistryProxy.Address, client)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			info := &channelInfo{}
+			info.settleBlockNumber, info.openBlockNumber, info.state, info.settleTimeout, errs[i] = contract.GetChannelInfoByChannelIdentifier(nil, channelIdentifier)
+			infos[i] = info
+		}(i, client)
+	}
+	wg.Wait()
+	return agreeChannelInfo(infos, errs, params.EndpointQuorum)
+}
+
+//agreeChannelInfo 返回至少quorum个节点一致的结果
+func agreeChannelInfo(infos []*channelInfo, errs []error, quorum int) (*channelInfo, error) {
+	counts := make(map[channelInfo]int)
+	var lastErr error
+	for i, info := range infos {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			continue
+		}
+		counts[*info]++
+		if counts[*info] >= quorum {
+			return info, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("endpoints don't agree on channel info, quorum is %d, last err %s", quorum, lastErr)
+	}
+	return nil, fmt.Errorf("endpoints don't agree on channel info, quorum is %d, %d different answers", quorum, len(counts))
+}
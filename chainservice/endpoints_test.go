@@ -0,0 +1,115 @@
+package chainservice
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+//FakeEth 模拟公链节点的eth接口,rpc.Server要求是导出的类型
+type FakeEth struct {
+	lock  sync.Mutex
+	block uint64
+	txs   []hexutil.Bytes
+}
+
+//BlockNumber eth_blockNumber
+func (f *FakeEth) BlockNumber() hexutil.Uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return hexutil.Uint64(f.block)
+}
+
+//SendRawTransaction eth_sendRawTransaction
+func (f *FakeEth) SendRawTransaction(data hexutil.Bytes) (common.Hash, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.txs = append(f.txs, data)
+	return utils.Sha3(data), nil
+}
+
+func newFakeEndpoint(t *testing.T, block uint64) (*FakeEth, *httptest.Server) {
+	f := &FakeEth{block: block}
+	srv := rpc.NewServer()
+	err := srv.RegisterName("eth", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, httptest.NewServer(srv)
+}
+
+func TestEndpointPool(t *testing.T) {
+	ast := assert.New(t)
+	f1, s1 := newFakeEndpoint(t, 100)
+	f2, s2 := newFakeEndpoint(t, 100)
+	defer s2.Close()
+	pool, err := NewEndpointPool([]string{s1.URL, s2.URL})
+	ast.Nil(err)
+	url, err := pool.Start()
+	ast.Nil(err)
+	defer pool.Stop()
+	client, err := rpc.Dial(url)
+	ast.Nil(err)
+	defer client.Close()
+
+	var n hexutil.Uint64
+	ast.Nil(client.Call(&n, "eth_blockNumber"))
+	ast.EqualValues(100, n)
+
+	// 交易广播给所有节点
+	var hash common.Hash
+	ast.Nil(client.Call(&hash, "eth_sendRawTransaction", hexutil.Bytes{1, 2, 3}))
+	ast.EqualValues(1, len(f1.txs))
+	ast.EqualValues(1, len(f2.txs))
+
+	// 落后太多的节点不健康
+	f1.lock.Lock()
+	f1.block = 90
+	f1.lock.Unlock()
+	pool.checkHealth()
+	ss := pool.Status()
+	ast.False(ss[0].Healthy)
+	ast.True(ss[1].Healthy)
+	ast.EqualValues(1, len(pool.HealthyClients()))
+	f1.lock.Lock()
+	f1.block = 100
+	f1.lock.Unlock()
+	pool.checkHealth()
+	ast.True(pool.Status()[0].Healthy)
+
+	// 第一个节点断开以后自动切换
+	s1.Close()
+	f2.lock.Lock()
+	f2.block = 101
+	f2.lock.Unlock()
+	ast.Nil(client.Call(&n, "eth_blockNumber"))
+	ast.EqualValues(101, n)
+	ast.False(pool.Status()[0].Healthy)
+	ast.Nil(client.Call(&hash, "eth_sendRawTransaction", hexutil.Bytes{4, 5, 6}))
+	ast.EqualValues(2, len(f2.txs))
+
+	// 节点返回的错误直接返回,不切换
+	err = client.Call(&n, "eth_notExist")
+	ast.NotNil(err)
+}
+
+func TestAgreeChannelInfo(t *testing.T) {
+	ast := assert.New(t)
+	a := &channelInfo{settleBlockNumber: 0, openBlockNumber: 3, state: 1, settleTimeout: 100}
+	b := &channelInfo{settleBlockNumber: 0, openBlockNumber: 4, state: 1, settleTimeout: 100}
+	a2 := *a
+	ci, err := agreeChannelInfo([]*channelInfo{a, b, &a2}, []error{nil, nil, nil}, 2)
+	ast.Nil(err)
+	ast.Equal(a, ci)
+	_, err = agreeChannelInfo([]*channelInfo{a, b}, []error{nil, nil}, 2)
+	ast.NotNil(err)
+	_, err = agreeChannelInfo([]*channelInfo{a, nil}, []error{nil, errors.New("timeout")}, 2)
+	ast.NotNil(err)
+}
@@ -1,9 +1,10 @@
 package chainservice
 
 import (
-	"crypto/ecdsa"
+	"context"
 	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
 	"math/big"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
 	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
 	"github.com/SmartMeshFoundation/Photon/blockchain"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/network/helper"
@@ -27,6 +29,7 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 /*
@@ -35,22 +38,49 @@ ChainEvents block chain operations
 type ChainEvents struct {
 	client                 *helper.SafeEthClient
 	be                     *blockchain.Events
+	beLock                 sync.RWMutex
+	eventsChangedChan      chan struct{} // watchdog重启了事件源,loop需要从新的StateChangeChannel读取
 	bcs                    *rpc.BlockChainService
-	key                    *ecdsa.PrivateKey
 	db                     *models.ModelDB
 	quitChan               chan struct{}
+	loopQuitChan           chan struct{}
 	stopped                bool
+	stopping               int32 // 1 表示正在退出,不再接受新的委托执行
+	executeWaitGroup       sync.WaitGroup
 	blockNumber            *atomic.Value
 	secretRegisterContract *contracts.SecretRegistry
+	pool                   *EndpointPool // 多个公链节点时用于一致性检查,可以为空
+	chainID                *big.Int      // 同一进程中可能有多条链,不能使用全局的params.ChainID
+	lastBlockTime          int64         // 最后一次处理新块的时间,UnixNano
+	headBlockNumber        int64         // watchdog独立查询到的公链最新块
+	restarts               int64
+	lastRestartTime        int64
+	paused                 int32      // 1 表示运维暂停了执行,不处理新块
+	rescanChan             chan int64 // 运维要求从某一块重新扫描,由loop处理
+	priceFeed              models.PriceFeed
 }
 
-//NewChainEvents create chain events
-func NewChainEvents(key *ecdsa.PrivateKey, client *helper.SafeEthClient, tokenNetworkRegistryAddress common.Address, db *models.ModelDB) *ChainEvents {
+//NewChainEvents create chain events of network n, all transactions are signed by n.Signer
+func NewChainEvents(n *params.Network, client *helper.SafeEthClient, db *models.ModelDB, feed models.PriceFeed) *ChainEvents {
+	s, tokenNetworkRegistryAddress := n.Signer, n.RegistryAddress
 	log.Trace(fmt.Sprintf("tokenNetworkRegistryAddress %s", tokenNetworkRegistryAddress.String()))
-	bcs, err := rpc.NewBlockChainService(key, tokenNetworkRegistryAddress, client, &notify.Handler{}, &mockTxInfoDao{})
+	// BlockChainService必须有私钥,给它一个临时的,再替换成signer,PMS的私钥不需要出现在内存中
+	tempKey, err := crypto.GenerateKey()
 	if err != nil {
 		panic(err)
 	}
+	bcs, err := rpc.NewBlockChainService(tempKey, tokenNetworkRegistryAddress, client, &notify.Handler{}, &mockTxInfoDao{})
+	if err != nil {
+		panic(err)
+	}
+	auth := signer.NewTransactor(s)
+	if params.ShadowMode {
+		auth = newShadowTransactor(client, s.Address())
+	}
+	auth.GasPrice = bcs.Auth.GasPrice
+	bcs.Auth = auth
+	bcs.NodeAddress = s.Address()
+	bcs.PrivKey = nil
 	_, err = bcs.Registry(tokenNetworkRegistryAddress, true)
 	if err != nil {
 		panic("startup error : cannot get registry")
@@ -63,36 +93,151 @@ func NewChainEvents(key *ecdsa.PrivateKey, client *helper.SafeEthClient, tokenNe
 		client:                 client,
 		be:                     blockchain.NewBlockChainEvents(client, bcs, &mockChainEventRecordDao{}),
 		bcs:                    bcs,
-		key:                    key,
 		db:                     db,
+		eventsChangedChan:      make(chan struct{}, 1),
+		rescanChan:             make(chan int64, 1),
 		quitChan:               make(chan struct{}),
+		loopQuitChan:           make(chan struct{}),
 		blockNumber:            new(atomic.Value),
 		secretRegisterContract: secretRegistryContract,
+		chainID:                n.ChainID,
+		priceFeed:              feed,
 	}
 }
 
 //Start moniter blockchain
 func (ce *ChainEvents) Start() error {
-	ce.be.Start(ce.db.GetLatestBlockNumber())
+	lastBlockNumber := ce.db.GetLatestBlockNumber()
+	// 上次退出时没有执行完的委托以及锁定的费用,必须在开始处理新块之前修正
+	ce.reconcileInterrupted(lastBlockNumber)
+	if lastBlockNumber > 0 {
+		// 已经处理过的块不再重复处理,停机期间错过的块会在handleBlockNumber中补齐
+		ce.blockNumber.Store(lastBlockNumber)
+	}
+	atomic.StoreInt64(&ce.lastBlockTime, time.Now().UnixNano())
+	ce.be.Start(lastBlockNumber)
 	go ce.loop()
+	go ce.pruneArchiveLoop()
+	go ce.watchdogLoop()
 	return nil
 }
 
+//pruneArchiveLoop 每天清理一次超过params.ArchiveRetention的历史委托,为0表示永久保留
+func (ce *ChainEvents) pruneArchiveLoop() {
+	if params.ArchiveRetention <= 0 {
+		return
+	}
+	for {
+		n, err := ce.db.PruneDelegateArchives(time.Now().Add(-params.ArchiveRetention))
+		if err != nil {
+			log.Error(fmt.Sprintf("PruneDelegateArchives err %s", err))
+		} else if n > 0 {
+			log.Info(fmt.Sprintf("pruned %d archived delegates", n))
+		}
+		select {
+		case <-time.After(24 * time.Hour):
+		case <-ce.quitChan:
+			return
+		}
+	}
+}
+
 //Stop service
 func (ce *ChainEvents) Stop() {
-	ce.be.Stop()
+	if !atomic.CompareAndSwapInt32(&ce.stopping, 0, 1) {
+		return
+	}
+	ce.events().Stop()
 	close(ce.quitChan)
 }
 
+/*
+Shutdown 停止接受新的委托执行,并且等待正在执行中的tx结束,直到ctx超时.
+超时返回时仍在执行的委托会保持Running状态,下次启动时由reconcileInterrupted修正.
+*/
+func (ce *ChainEvents) Shutdown(ctx context.Context) error {
+	ce.Stop()
+	done := make(chan struct{})
+	go func() {
+		<-ce.loopQuitChan
+		ce.executeWaitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Info("all in-flight delegate executions finished")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("wait in-flight delegate executions err %s", ctx.Err())
+	}
+}
+
+func (ce *ChainEvents) isStopping() bool {
+	return atomic.LoadInt32(&ce.stopping) == 1
+}
+
+/*
+goExecute 在新的goroutine中执行委托,Shutdown会等待这些goroutine结束.
+只能在loop中调用,保证Shutdown开始等待以后不会再有新的执行加入.
+returns false if it's stopping and f is not executed
+*/
+func (ce *ChainEvents) goExecute(f func()) bool {
+	if ce.isStopping() {
+		return false
+	}
+	ce.executeWaitGroup.Add(1)
+	go func() {
+		defer ce.executeWaitGroup.Done()
+		f()
+	}()
+	return true
+}
+
+//dispatchMonitor 执行monitor对应的委托,开始执行以后标记,重新扫描这个块时不会重复执行
+func (ce *ChainEvents) dispatchMonitor(monitor *models.DelegateMonitor, f func()) {
+	if !ce.goExecute(f) {
+		return
+	}
+	err := ce.db.MarkDelegateMonitorDone(monitor)
+	if err != nil {
+		log.Error(fmt.Sprintf("MarkDelegateMonitorDone err %s", err))
+	}
+}
+
+/*
+reconcileInterrupted 修正上次没有正常退出时遗留的状态:
+1. 处于Running状态的委托,如果还没有到settle,重新安排在下一块执行,否则标记为失败
+2. 启动时不可能有正在执行的tx,所有锁定的费用都是遗留的,直接释放
+*/
+func (ce *ChainEvents) reconcileInterrupted(lastBlockNumber int64) {
+	n, err := ce.db.RescheduleInterruptedDelegates(lastBlockNumber)
+	if err != nil {
+		log.Error(fmt.Sprintf("RescheduleInterruptedDelegates err %s", err))
+	} else if n > 0 {
+		log.Warn(fmt.Sprintf("%d interrupted delegates reconciled", n))
+	}
+	n, err = ce.db.AccountReleaseAllLockedSmt()
+	if err != nil {
+		log.Error(fmt.Sprintf("AccountReleaseAllLockedSmt err %s", err))
+	} else if n > 0 {
+		log.Warn(fmt.Sprintf("released dangling locked smt of %d accounts", n))
+	}
+}
+
 func (ce *ChainEvents) loop() {
+	defer close(ce.loopQuitChan)
 	for {
 		select {
-		case st, ok := <-ce.be.StateChangeChannel:
+		case st, ok := <-ce.events().StateChangeChannel:
 			if !ok {
 				log.Info("StateChangeChannel closed")
 				return
 			}
 			ce.handleStateChange(st)
+		case <-ce.eventsChangedChan:
+			log.Info("chain event feed restarted")
+		case from := <-ce.rescanChan:
+			ce.doRescan(from)
 		case <-ce.quitChan:
 			return
 		}
@@ -101,7 +246,7 @@ func (ce *ChainEvents) loop() {
 
 /*
 一个通道关闭了,主要进行的就是设置
-todo 限制锁的数量不能超过settle_timeout/2或者这里的 unlock 以及updatebalanceproof 用并行模式
+委托时已经限制锁的数量不超过settle_timeout/2,unlock tx也是连续发送,不逐个等待打包
 考虑到实际交易过程中,App可能会随时切换到无网状态,为了保证利益,委托应该设计成这样.
 1. 通道关闭的时候,记录下需要在settleBlockNumber减去RevealTimeout进行进行updateBalanceProof,
 2. 如果需要,同时记录下,需要在settleBlockNumber减去RevealTimeout进行unlock
@@ -132,14 +277,14 @@ func (ce *ChainEvents) handleClosedStateChange(st2 *mediatedtransfer.ContractClo
 		log.Error(fmt.Sprintf("create token network  error for token %s", ds[0].TokenAddressStr))
 		return
 	}
-	settleBlockNumber, _, _, _, err := tokenNetwork.GetContract().GetChannelInfoByChannelIdentifier(nil, st2.ChannelIdentifier)
+	ci, err := ce.getChannelInfo(st2.ChannelIdentifier)
 	if err != nil {
 		log.Error(fmt.Sprintf("channel %s get settle timeout err %s", st2.ChannelIdentifier.String(), err))
 		return
 	}
 	for _, d := range ds {
 		// 1.  更新委托的信息
-		d.SettleBlockNumber = int64(settleBlockNumber)
+		d.SettleBlockNumber = int64(ci.settleBlockNumber)
 		// 不管是不是自己关闭,都尝试去做,如果用户自己做了,无非就是失败而已,没有负面影响
 		// 考虑到用户丢失photon数据之后,需要自己强制关闭通道来提取通道中的钱,而数据丢失的话,提交的一定的nonce=0的BalanceProof
 		// 这时候就需要PMS来帮忙提交最新的
@@ -149,11 +294,55 @@ func (ce *ChainEvents) handleClosedStateChange(st2 *mediatedtransfer.ContractClo
 		//	d.Error = "delegator closed channel"
 		//}
 		ce.db.UpdateObject(d)
-		// 2. 添加monitor
+		// 2. 对方关闭时提交的balance proof已经不比委托的旧,就不用再updateBalanceProof了
+		if d.Status == models.DelegateStatusInit && d.DelegatorAddress() != st2.ClosingAddress {
+			ce.checkUpdateBalanceProofNecessary(tokenNetwork.GetContract(), d)
+		}
+		// 3. 添加monitor
 		ce.db.AddDelegateMonitor(d)
 	}
 }
 
+/*
+checkUpdateBalanceProofNecessary 读取链上关闭方(委托人的对手)已经提交的balance proof的nonce,
+如果不小于委托的nonce,updateBalanceProofDelegate必然失败,标记状态以后只做unlock
+*/
+func (ce *ChainEvents) checkUpdateBalanceProofNecessary(contract *contracts.TokensNetwork, d *models.Delegate) {
+	du := d.UpdateBalanceProof()
+	if du.Nonce <= 0 {
+		return
+	}
+	_, _, nonce, err := contract.GetChannelParticipantInfo(nil, d.TokenAddress(), d.PartnerAddress(), d.DelegatorAddress())
+	if err != nil {
+		//读取失败就按原来的逻辑执行,最多是tx失败
+		log.Error(fmt.Sprintf("GetChannelParticipantInfo of channel %s err %s", d.ChannelIdentifierStr, err))
+		return
+	}
+	status, reason := classifyBalanceProofUpdate(du.Nonce, nonce)
+	if status == models.DelegateStatusInit {
+		return
+	}
+	log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] skip UpdateTransfer : %s", d.ChannelIdentifierStr, d.DelegatorAddressStr, reason))
+	err = ce.db.SkipUpdateBalanceProof(d, status, reason)
+	if err != nil {
+		log.Error(fmt.Sprintf("SkipUpdateBalanceProof %s err %s", d.ChannelIdentifierStr, err))
+	}
+}
+
+/*
+classifyBalanceProofUpdate 合约要求updateBalanceProofDelegate的nonce必须大于链上的nonce
+*/
+func classifyBalanceProofUpdate(delegatedNonce int64, onChainNonce uint64) (status models.DelegateStatus, reason string) {
+	switch {
+	case uint64(delegatedNonce) > onChainNonce:
+		return models.DelegateStatusInit, ""
+	case uint64(delegatedNonce) == onChainNonce:
+		return models.DelegateStatusUpdateUnnecessary, fmt.Sprintf("balance proof with nonce %d already on chain", onChainNonce)
+	default:
+		return models.DelegateStatusStaleDelegation, fmt.Sprintf("stale delegation, delegated nonce=%d, but nonce on chain=%d", delegatedNonce, onChainNonce)
+	}
+}
+
 //如果发生了 balance proof update, 第三方服务就不用进行了,有可能是委托方自己做了
 // 自己close对方update的话,已经在close中处理了,这里都不用做
 // 对方close自己update的话,需要在这里标记状态
@@ -176,6 +365,35 @@ func (ce *ChainEvents) handleBalanceProofUpdatedStateChange(st2 *mediatedtransfe
 	}
 }
 
+/*
+handleUnlockStateChange 对方在委托人的balance proof上unlock了一个锁,
+如果委托人已经委托了这个锁的放弃声明,说明对方作弊,在下一个块惩罚
+*/
+func (ce *ChainEvents) handleUnlockStateChange(st2 *mediatedtransfer.ContractUnlockStateChange) {
+	key := models.BuildDelegateKey(st2.ChannelIdentifier, st2.Participant)
+	d, err := ce.db.GetDelegateByKey(key)
+	if err == gorm.ErrRecordNotFound {
+		// 无需处理
+		return
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("db GetDelegateByKey err : %s", err.Error()))
+		return
+	}
+	dps, err := ce.db.GetDelegatePunishListByDelegateKey(key)
+	if err != nil {
+		log.Error(fmt.Sprintf("GetDelegatePunishListByDelegateKey err %s", err))
+		return
+	}
+	for _, dp := range dps {
+		if dp.LockHash() == st2.LockHash {
+			log.Info(fmt.Sprintf("partner %s unlocked disposed lock %s on channel %s", d.PartnerAddressStr, st2.LockHash.String(), st2.ChannelIdentifier.String()))
+			ce.db.AddDelegatePunishLockMonitor(d, ce.GetBlockNumber()+1, st2.LockHash)
+			return
+		}
+	}
+}
+
 /*
 通道settle
 暂时先删除记录,后续根据需要再做修改
@@ -187,19 +405,13 @@ func (ce *ChainEvents) handleSettledStateChange(st2 *mediatedtransfer.ContractSe
 	}
 	if len(ds) > 0 {
 		log.Info(fmt.Sprintf("recevied ContractSettledStateChange %s", utils.StringInterface(st2, 3)))
-		// 1. 标记删除
-		for _, d := range ds {
-			err = ce.db.DeleteDelegate(d.Key)
-			if err != nil {
-				log.Error(fmt.Sprintf("DeleteDelegate err %s", err.Error()))
-			}
-		}
-		log.Info(fmt.Sprintf("%d delegate of channel %s deleted", len(ds), st2.ChannelIdentifier.String()))
+		// 1. 归档
+		ce.archiveDelegates(ds, models.ArchiveEventSettled, st2.GetBlockNumber())
 	}
 }
 
 /*
-合作关闭通道,以前的委托都可以删掉了,因为是合作 settle,
+合作关闭通道,以前的委托都可以归档了,因为是合作 settle,
 说明没有纠纷,因此也不需要提交证明了,并且因为通道 open block number 改变,原来的委托肯定也作废了
 */
 func (ce *ChainEvents) handleCooperativeSettledStateChange(st2 *mediatedtransfer.ContractCooperativeSettledStateChange) {
@@ -209,19 +421,13 @@ func (ce *ChainEvents) handleCooperativeSettledStateChange(st2 *mediatedtransfer
 	}
 	if len(ds) > 0 {
 		log.Info(fmt.Sprintf("recevied ContractCooperativeSettledStateChange %s", utils.StringInterface(st2, 3)))
-		// 1. 标记删除
-		for _, d := range ds {
-			err = ce.db.DeleteDelegate(d.Key)
-			if err != nil {
-				log.Error(fmt.Sprintf("DeleteDelegate err %s", err.Error()))
-			}
-		}
-		log.Info(fmt.Sprintf("%d delegate of channel %s deleted", len(ds), st2.ChannelIdentifier.String()))
+		// 1. 归档
+		ce.archiveDelegates(ds, models.ArchiveEventCooperativeSettled, st2.GetBlockNumber())
 	}
 }
 
 /*
-合作 withdraw,以前的委托都可以删掉了,因为是合作 withdraw,
+合作 withdraw,以前的委托都可以归档了,因为是合作 withdraw,
 说明没有纠纷,因此也不需要提交证明了,并且因为通道 open block number 改变,原来的委托肯定也作废了
 */
 func (ce *ChainEvents) handleWithdrawStateChange(st2 *mediatedtransfer.ContractChannelWithdrawStateChange) {
@@ -231,14 +437,23 @@ func (ce *ChainEvents) handleWithdrawStateChange(st2 *mediatedtransfer.ContractC
 	}
 	if len(ds) > 0 {
 		log.Info(fmt.Sprintf("recevied ContractChannelWithdrawStateChange %s", utils.StringInterface(st2, 3)))
-		// 1. 标记删除
-		for _, d := range ds {
-			err = ce.db.DeleteDelegate(d.Key)
-			if err != nil {
-				log.Error(fmt.Sprintf("DeleteDelegate err %s", err.Error()))
-			}
+		// 1. 归档
+		ce.archiveDelegates(ds, models.ArchiveEventWithdraw, st2.GetBlockNumber())
+	}
+}
+
+/*
+archiveDelegates 委托已经结束,归档以后删除,用户仍然可以通过/history查询PMS为他做了什么
+*/
+func (ce *ChainEvents) archiveDelegates(ds []*models.Delegate, event models.ArchiveEvent, blockNumber int64) {
+	for _, d := range ds {
+		da, err := ce.db.ArchiveDelegate(d, event, blockNumber)
+		if err != nil {
+			log.Error(fmt.Sprintf("ArchiveDelegate err %s", err.Error()))
+			continue
 		}
-		log.Info(fmt.Sprintf("%d delegate of channel %s deleted", len(ds), st2.ChannelIdentifier.ChannelIdentifier.String()))
+		log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] archived because of %s, outcome: %s",
+			d.ChannelIdentifierStr, d.DelegatorAddressStr, event, da.Outcome))
 	}
 }
 
@@ -281,22 +496,42 @@ func (ce *ChainEvents) handleStateChange(st transfer.StateChange) {
 		ce.handleSettledStateChange(st2)
 	case *mediatedtransfer.ContractTokenAddedStateChange:
 		ce.handleTokenAddedStateChange(st2)
-		//punish不是在收到unlock的时候发生,而是在通道可以settle的时候发生,
+	case *mediatedtransfer.ContractUnlockStateChange:
+		//对方unlock了委托人声明放弃的锁,立即惩罚,不用等到settle
+		ce.handleUnlockStateChange(st2)
+	case *transfer.EffectiveChainStateChange:
+		if !st2.IsEffective {
+			//连接断开时事件源会停止轮询,由watchdog负责重启
+			log.Warn(fmt.Sprintf("chain event feed lost connection at block %d", st2.LastBlockNumber))
+		}
 		//default:
 		//	log.Trace(fmt.Sprintf("receive state change: %s", utils.StringInterface(st2, 3)))
 	}
 }
 
 func (ce *ChainEvents) handleBlockNumber(n int64) {
+	if ce.Paused() || ce.isStopping() {
+		//暂停期间或者正在退出时不记录处理过的块,恢复或者下次启动以后错过的块会补齐
+		return
+	}
 	lastBlockNumber := ce.GetBlockNumber()
+	if lastBlockNumber != 0 && n <= lastBlockNumber {
+		//重启以后会重新收到已经处理过的块,不能重复执行
+		return
+	}
 	if lastBlockNumber != 0 && lastBlockNumber < n-1 {
 		//有可能通知的BlockNumber并不是严格连续的,比如1,3,4,7,跳过了5,6,除了启动以外,在正常情况下也有可能出现这种情形.
 		log.Info(fmt.Sprintf("not continue blocknumber last=%d,current=%d", lastBlockNumber, n))
 		for i := lastBlockNumber + 1; i <= n-1; i++ {
 			ce.handleBlockNumber(i)
 		}
+		if ce.isStopping() {
+			//补齐的块没有处理完,已经保存了最后处理完的块
+			return
+		}
 	}
 	ce.blockNumber.Store(n)
+	atomic.StoreInt64(&ce.lastBlockTime, time.Now().UnixNano())
 	// 1. 处理密码注册委托
 	ce.doDelegateSecrets(lastBlockNumber)
 	// 2. 处理其余委托
@@ -319,33 +554,52 @@ func (ce *ChainEvents) handleBlockNumber(n int64) {
 			switch monitor.Type {
 			case models.MonitorTypeUnlockAndUpdateBalanceProof:
 				//unlock 以及 updateBalanceProof
-				if d.Status == models.DelegateStatusSuccessFinishedByOther {
+				if d.UpdateBalanceProofSkipped() {
 					log.Info(fmt.Sprintf("handle delegate ,but it's status=%d, delegate=%s", d.Status, utils.StringInterface(d, 4)))
 					//无论委托人是关闭方还是因为用户自己做了updateBalanceProof,解锁都会重新做一遍,大不了都失败而已.
-					go ce.doDelegateUnlocks(d)
+					ce.dispatchMonitor(monitor, func() {
+						ce.doDelegateUnlocks(d)
+					})
 					continue
 				} else {
 					if d.Status != models.DelegateStatusInit {
 						log.Error(fmt.Sprintf("handle delegate error,it's status=%d,delegate=%s", d.Status, utils.StringInterface(d, 4)))
 						continue
 					}
+					if ce.isStopping() {
+						//正在退出,保持Init状态,n没有处理完,下次启动时从n开始补齐
+						ce.db.SaveLatestBlockNumber(n - 1)
+						return
+					}
 					err = ce.db.UpdateDelegateStatus(d, models.DelegateStatusRunning)
 					if err != nil {
 						log.Error(fmt.Sprintf("UpdateDelegateStatus  %s err %s", d.Key, err))
 						continue
 					}
-					go func() {
+					ce.dispatchMonitor(monitor, func() {
 						//先updateBalanceProof,无论成功与否都尝试进行unlock,就算是unlock尝试全部失败也要尝试.
 						ce.doDelegateUpdateBalanceProof(d)
 						ce.doDelegateUnlocks(d)
-					}()
+					})
 				}
 			case models.MonitorTypePunish:
 				// punish
-				go ce.doDelegatePunishes(d)
+				ce.dispatchMonitor(monitor, func() {
+					ce.doDelegatePunishes(d, utils.EmptyHash)
+				})
+			case models.MonitorTypePunishLock:
+				lockHash := monitor.LockHash()
+				ce.dispatchMonitor(monitor, func() {
+					ce.doDelegatePunishes(d, lockHash)
+				})
 			}
 		}
 	}
+	if ce.isStopping() {
+		//正在退出时goExecute不再执行委托,n中的委托可能没有全部开始执行
+		ce.db.SaveLatestBlockNumber(n - 1)
+		return
+	}
 	ce.db.SaveLatestBlockNumber(n)
 }
 
@@ -359,6 +613,10 @@ func (ce *ChainEvents) handleBlockNumber(n int64) {
 func (ce *ChainEvents) doDelegateSecrets(lastBlockNumber int64) {
 	ds := ce.db.GetAllDelegate()
 	for _, d := range ds {
+		if ce.isStopping() {
+			return
+		}
+		fees := ce.db.FeesOf(d)
 		for _, delegateSecret := range d.Secrets() {
 			if delegateSecret.RegisterBlock > lastBlockNumber {
 				// 没到需要注册的时间,跳过
@@ -371,25 +629,25 @@ func (ce *ChainEvents) doDelegateSecrets(lastBlockNumber int64) {
 			}
 			// 1. 锁定费用,这里费用不足锁定失败直接跳过,因为执行密码注册委托-执行后续委托中间可能存在挺长时间,用户如果在此期间充值了,后续委托仍可以正常执行
 			// 所以密码注册失败直接跳过,确保不影响更为重要的后续委托
-			err := ce.db.AccountLockSmt(d.DelegatorAddress(), params.SmtSecret)
+			err := ce.db.AccountLockSmt(d.DelegatorAddress(), fees.Secret)
 			if err != nil {
-				log.Error(fmt.Sprintf("delegate [channel=%s delegator=%s secret=%s] Secret Register failed because delegator has no enough balance,ignore", d.ChannelIdentifierStr, d.DelegatorAddressStr, delegateSecret.Secret))
+				log.Error(fmt.Sprintf("delegate [channel=%s delegator=%s secrethash=%s] Secret Register failed because delegator has no enough balance,ignore", d.ChannelIdentifierStr, d.DelegatorAddressStr, utils.ShaSecret(delegateSecret.GetSecret().Bytes()).String()))
 				continue
 			}
 			// 2. 执行tx
 			r := ce.doRegisterSecret(d, delegateSecret)
 			// 如果失败不扣费,这里失败只可能是被其他用户注册了,跳过即可
 			if r.Status != models.ExecuteStatusSuccessFinished {
-				log.Error(fmt.Sprintf("delegate [channel=%s delegator=%s secret=%s] Secret Register failed,maybe someone register first,ignore", d.ChannelIdentifierStr, d.DelegatorAddressStr, delegateSecret.Secret))
-				err = ce.db.AccountUnlockSmt(d.DelegatorAddress(), params.SmtSecret)
+				log.Error(fmt.Sprintf("delegate [channel=%s delegator=%s secrethash=%s] Secret Register failed,maybe someone register first,ignore", d.ChannelIdentifierStr, d.DelegatorAddressStr, utils.ShaSecret(delegateSecret.GetSecret().Bytes()).String()))
+				err = ce.db.AccountUnlockSmt(d.DelegatorAddress(), fees.Secret)
 				if err != nil {
 					log.Error(fmt.Sprintf("AccountUnlockSmt err %s", err))
 				}
 				continue
 			}
-			log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s secret=%s] Secret Register SUCCESS", d.ChannelIdentifierStr, d.DelegatorAddressStr, delegateSecret.Secret))
+			log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s secrethash=%s] Secret Register SUCCESS", d.ChannelIdentifierStr, d.DelegatorAddressStr, utils.ShaSecret(delegateSecret.GetSecret().Bytes()).String()))
 			// 3. 扣除
-			err = ce.db.AccountUseSmt(d.DelegatorAddress(), params.SmtSecret)
+			err = ce.db.AccountUseSmt(d.DelegatorAddress(), fees.Secret)
 			if err != nil {
 				log.Error(fmt.Sprintf("AccountUseSmt err %s", err))
 			}
@@ -403,7 +661,7 @@ func (ce *ChainEvents) doRegisterSecret(d *models.Delegate, delegateSecret *mode
 	defer ce.db.SaveDelegateExecuteRecord(r)
 	tx, err := ce.secretRegisterContract.RegisterSecret(ce.bcs.Auth, delegateSecret.GetSecret())
 	if err != nil {
-		r.Error = fmt.Sprintf("create tx err : %s", err.Error())
+		ce.txCreateFailed(r, err)
 		return
 	}
 	r.Status = models.ExecuteStatusErrorFinished // 默认失败
@@ -443,8 +701,9 @@ func (ce *ChainEvents) doDelegateUpdateBalanceProof(d *models.Delegate) {
 		log.Info("delegate [channel=%s delegator=%s] UpdateTransfer no need because nonce = 0 ", d.ChannelIdentifierStr, d.DelegatorAddressStr)
 		return
 	}
-	// 1. 锁定费用
-	err := ce.db.AccountLockSmt(d.DelegatorAddress(), params.SmtUpdateTransfer)
+	// 1. 锁定费用,锁定,扣除和释放都按接受委托时的收费
+	fees := ce.db.FeesOf(d)
+	err := ce.db.AccountLockSmt(d.DelegatorAddress(), fees.UpdateTransfer)
 	if err != nil {
 		d.Status = models.DelegateStatusFailed
 		d.Error = fmt.Sprintf("smt not enough,err=%s", err)
@@ -455,7 +714,7 @@ func (ce *ChainEvents) doDelegateUpdateBalanceProof(d *models.Delegate) {
 	r := ce.doUpdateBalanceProof(d, du)
 	// 3. 如果失败更新delegate,不扣费
 	if r.Status != models.ExecuteStatusSuccessFinished {
-		err = ce.db.AccountUnlockSmt(d.DelegatorAddress(), params.SmtUpdateTransfer)
+		err = ce.db.AccountUnlockSmt(d.DelegatorAddress(), fees.UpdateTransfer)
 		if err != nil {
 			log.Error(fmt.Sprintf("AccountUnlockSmt err %s", err))
 		}
@@ -467,7 +726,7 @@ func (ce *ChainEvents) doDelegateUpdateBalanceProof(d *models.Delegate) {
 	}
 	log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] UpdateTransfer called SUCCESS", d.ChannelIdentifierStr, d.DelegatorAddressStr))
 	// 3. 扣除
-	err = ce.db.AccountUseSmt(d.DelegatorAddress(), params.SmtUpdateTransfer)
+	err = ce.db.AccountUseSmt(d.DelegatorAddress(), fees.UpdateTransfer)
 	if err != nil {
 		log.Error(fmt.Sprintf("AccountUseSmt err %s", err))
 	}
@@ -488,7 +747,7 @@ func (ce *ChainEvents) doUpdateBalanceProof(d *models.Delegate, du *models.Deleg
 	log.Trace(fmt.Sprintf("signer=%s, doDelegateUpdateBalanceProof=%s", utils.APex(ce.bcs.Auth.From), utils.StringInterface(&du, 4)))
 	tx, err := tokenNetwork.GetContract().UpdateBalanceProofDelegate(ce.bcs.Auth, d.TokenAddress(), d.PartnerAddress(), d.DelegatorAddress(), du.TransferAmount(), du.Locksroot(), uint64(du.Nonce), du.ExtraHash(), closingSignature, nonClosingSignature)
 	if err != nil {
-		r.Error = fmt.Sprintf("create tx err : %s", err.Error())
+		ce.txCreateFailed(r, err)
 		return
 	}
 	r.Status = models.ExecuteStatusErrorFinished // 默认失败
@@ -536,7 +795,36 @@ func (ce *ChainEvents) doDelegateUnlocks(d *models.Delegate) {
 	if err != nil {
 		panic(err)
 	}
-	costSMT := new(big.Int).Mul(params.SmtUnlock, big.NewInt(int64(len(dus))))
+	// 0.5 gas花费超过锁价值的unlock跳过或者放到最后
+	uds := models.DecideUnlocks(ce.priceFeed, d.TokenAddress(), dus)
+	dus = nil
+	skipped := 0
+	for _, ud := range uds {
+		if ud.Action != models.UnlockActionSkip {
+			dus = append(dus, ud.Unlock())
+			continue
+		}
+		skipped++
+		r := models.NewDelegateExecuteRecord(d, models.DelegateTypeUnlock, ud.Unlock())
+		r.Status = models.ExecuteStatusSkipped
+		r.Error = ud.Reason
+		ce.db.SaveDelegateExecuteRecord(r)
+	}
+	if skipped > 0 {
+		log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] skip %d uneconomic unlocks", d.ChannelIdentifierStr, d.DelegatorAddressStr, skipped))
+		err = ce.db.SkipUnlocks(d, skipped)
+		if err != nil {
+			log.Error(fmt.Sprintf("db SkipUnlocks err : %s", err.Error()))
+		}
+	}
+	if len(dus) == 0 {
+		d.Status = models.DelegateStatusSuccessFinished
+		d.Error = fmt.Sprintf("all %d unlocks skipped because gas cost exceeds value", skipped)
+		ce.db.UpdateObject(d)
+		return
+	}
+	fees := ce.db.FeesOf(d)
+	costSMT := new(big.Int).Mul(fees.Unlock, big.NewInt(int64(len(dus))))
 	// 1. 锁定费用
 	err = ce.db.AccountLockSmt(d.DelegatorAddress(), costSMT)
 	if err != nil {
@@ -548,17 +836,17 @@ func (ce *ChainEvents) doDelegateUnlocks(d *models.Delegate) {
 	// 2. 执行Unlock
 	hasErr := false
 	hasSuccess := false
-	for _, du := range dus {
-		r := ce.doUnlock(d, du, dUpdateBalanceProof.TransferAmount(), das)
+	rs := ce.doUnlocks(d, dus, dUpdateBalanceProof.TransferAmount(), das)
+	for _, r := range rs {
 		if r.Status != models.ExecuteStatusSuccessFinished {
 			hasErr = true
-			err = ce.db.AccountUnlockSmt(d.DelegatorAddress(), params.SmtUnlock)
+			err = ce.db.AccountUnlockSmt(d.DelegatorAddress(), fees.Unlock)
 			if err != nil {
 				log.Error(fmt.Sprintf("db AccountUnlockSmt err : %s", err.Error()))
 			}
 		} else {
 			hasSuccess = true
-			err = ce.db.AccountUseSmt(d.DelegatorAddress(), params.SmtUnlock)
+			err = ce.db.AccountUseSmt(d.DelegatorAddress(), fees.Unlock)
 			if err != nil {
 				log.Error(fmt.Sprintf("db AccountUseSmt err : %s", err.Error()))
 			}
@@ -576,15 +864,46 @@ func (ce *ChainEvents) doDelegateUnlocks(d *models.Delegate) {
 		log.Error(fmt.Sprintf("delegate [channel=%s delegator=%s] Unlock called Failed : %s", d.ChannelIdentifierStr, d.DelegatorAddressStr, utils.StringInterface(dus, 3)))
 	} else {
 		d.Status = models.DelegateStatusSuccessFinished
+		if skipped > 0 {
+			d.Error = fmt.Sprintf("%d unlocks skipped because gas cost exceeds value", skipped)
+		}
 		log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] Unlock called SUCCESS", d.ChannelIdentifierStr, d.DelegatorAddressStr))
 	}
 	ce.db.UpdateObject(d)
 }
 
-func (ce *ChainEvents) doUnlock(d *models.Delegate, du *models.DelegateUnlock, transferAmount *big.Int, das []*models.DelegateAnnounceDispose) (r *models.DelegateExecuteRecord) {
-	r = models.NewDelegateExecuteRecord(d, models.DelegateTypeUnlock, du)
-	defer ce.db.SaveDelegateExecuteRecord(r)
+/*
+doUnlocks 按dus的顺序连续发送unlock tx,不等待每个tx打包,
+全部发送以后再并行等待结果,避免逐个WaitMined导致在settle之前来不及全部unlock.
+返回的记录和dus一一对应
+*/
+func (ce *ChainEvents) doUnlocks(d *models.Delegate, dus []*models.DelegateUnlock, transferAmount *big.Int, das []*models.DelegateAnnounceDispose) (rs []*models.DelegateExecuteRecord) {
+	txs := make([]*types.Transaction, len(dus))
+	for i, du := range dus {
+		var r *models.DelegateExecuteRecord
+		r, txs[i] = ce.sendUnlock(d, du, transferAmount, das)
+		rs = append(rs, r)
+	}
+	wg := sync.WaitGroup{}
+	for i, tx := range txs {
+		if tx == nil {
+			ce.db.SaveDelegateExecuteRecord(rs[i])
+			continue
+		}
+		wg.Add(1)
+		go func(r *models.DelegateExecuteRecord, tx *types.Transaction) {
+			defer wg.Done()
+			ce.waitUnlock(d, r, tx)
+			ce.db.SaveDelegateExecuteRecord(r)
+		}(rs[i], tx)
+	}
+	wg.Wait()
+	return
+}
 
+//sendUnlock 只发送tx,不等待打包,不需要发送或者发送失败时tx为nil
+func (ce *ChainEvents) sendUnlock(d *models.Delegate, du *models.DelegateUnlock, transferAmount *big.Int, das []*models.DelegateAnnounceDispose) (r *models.DelegateExecuteRecord, tx *types.Transaction) {
+	r = models.NewDelegateExecuteRecord(d, models.DelegateTypeUnlock, du)
 	for _, da := range das {
 		if da.LockSecretHash() == du.LockSecretHash() {
 			r.Status = models.ExecuteStatusSuccessFinished
@@ -592,7 +911,6 @@ func (ce *ChainEvents) doUnlock(d *models.Delegate, du *models.DelegateUnlock, t
 			return
 		}
 	}
-	channelAddr := d.ChannelIdentifier()
 	tokenNetwork, err := ce.bcs.TokenNetwork(d.TokenAddress())
 	if err != nil {
 		r.Error = fmt.Sprintf("TokenNetwork err : %s", err.Error())
@@ -602,15 +920,20 @@ func (ce *ChainEvents) doUnlock(d *models.Delegate, du *models.DelegateUnlock, t
 	//if lock.Expiration <= ce.GetBlockNumber() {
 	//	return fmt.Errorf("lock has expired, expration=%d,currentBlockNumber=%d", lock.Expiration, ce.GetBlockNumber())
 	//}
-	tx, err := tokenNetwork.GetContract().UnlockDelegate(ce.bcs.Auth, d.TokenAddress(), d.PartnerAddress(), d.DelegatorAddress(), transferAmount, big.NewInt(du.Expiration), du.Amount(), du.LockSecretHash(), du.MerkleProof, du.Signature)
+	tx, err = tokenNetwork.GetContract().UnlockDelegate(ce.bcs.Auth, d.TokenAddress(), d.PartnerAddress(), d.DelegatorAddress(), transferAmount, big.NewInt(du.Expiration), du.Amount(), du.LockSecretHash(), du.MerkleProof, du.Signature)
 	if err != nil {
-		r.Error = fmt.Sprintf("create tx err : %s", err.Error())
+		ce.txCreateFailed(r, err)
 		return
 	}
 	r.Status = models.ExecuteStatusErrorFinished // 默认失败
 	r.TxHashStr = tx.Hash().String()
 	r.TxCreateBlockNumber = ce.blockNumber.Load().(int64)
 	r.TxCreateTimestamp = time.Now().Unix()
+	return
+}
+
+//waitUnlock 等待sendUnlock发出的tx打包,结果写入r
+func (ce *ChainEvents) waitUnlock(d *models.Delegate, r *models.DelegateExecuteRecord, tx *types.Transaction) {
 	txReceipt, err := bind.WaitMined(rpc.GetCallContext(), ce.bcs.Client, tx)
 	if err != nil {
 		r.Error = fmt.Sprintf("tx WaitMined err : %s", err.Error())
@@ -619,33 +942,46 @@ func (ce *ChainEvents) doUnlock(d *models.Delegate, du *models.DelegateUnlock, t
 	r.TxPackBlockNumber = ce.blockNumber.Load().(int64)
 	r.TxPackTimestamp = time.Now().Unix()
 	if txReceipt.Status != types.ReceiptStatusSuccessful {
-		log.Info(fmt.Sprintf("unlock failed %s,receipt=%s", utils.HPex(channelAddr), utils.StringInterface(txReceipt, 3)))
+		log.Info(fmt.Sprintf("unlock failed %s,receipt=%s", utils.HPex(d.ChannelIdentifier()), utils.StringInterface(txReceipt, 3)))
 		r.Error = "tx execution err "
 		return
 	}
 	r.Status = models.ExecuteStatusSuccessFinished
-	return
 }
 
 /*
-在可以代理惩罚的时间(closedBlockNumber+settleTimeout)到来时,
-逐个执行惩罚委托,只要有一个成功,就可以立即结束,因为多余的惩罚也没有任何意义.
-务必此时先扣费,后执行
-如果委托方自己进行了 punish, 监控服务多做一遍也没什么成本,简化处理流程.
+doDelegatePunishes 只有在链上能查到对方unlock了声明放弃的锁时才发送punish tx,
+lockHash为空表示检查所有委托的punish,否则只处理指定的锁.
+一个委托只收一次punish的费用,惩罚成功一次以后就不会再惩罚
 */
-func (ce *ChainEvents) doDelegatePunishes(d *models.Delegate) {
+func (ce *ChainEvents) doDelegatePunishes(d *models.Delegate, lockHash common.Hash) {
 	// TODO 需要事务么
 	// 0. 获取DelegatePunishes
-	dps, err := ce.db.GetDelegatePunishListByDelegateKey(d.Key)
+	all, err := ce.db.GetDelegatePunishListByDelegateKey(d.Key)
 	if err != nil {
 		panic(err)
 	}
+	var dps []*models.DelegatePunish
+	for _, dp := range all {
+		if dp.Punished {
+			log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] already punished lock %s", d.ChannelIdentifierStr, d.DelegatorAddressStr, dp.LockHashStr))
+			return
+		}
+		if lockHash != utils.EmptyHash && dp.LockHash() != lockHash {
+			continue
+		}
+		if !ce.hasObsoleteUnlockEvidence(d, dp) {
+			continue
+		}
+		dps = append(dps, dp)
+	}
 	if len(dps) == 0 {
 		log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] Punish no need ", d.ChannelIdentifierStr, d.DelegatorAddressStr))
 		return
 	}
 	// 1. 锁定费用
-	err = ce.db.AccountLockSmt(d.DelegatorAddress(), params.SmtPunish)
+	fees := ce.db.FeesOf(d)
+	err = ce.db.AccountLockSmt(d.DelegatorAddress(), fees.Punish)
 	if err != nil {
 		d.Status = models.DelegateStatusFailed
 		d.Error = fmt.Sprintf("smt not enough,err=%s", err)
@@ -666,19 +1002,23 @@ func (ce *ChainEvents) doDelegatePunishes(d *models.Delegate) {
 		r := ce.doPunish(d, dp)
 		if r.Status == models.ExecuteStatusSuccessFinished {
 			hasSuccess = true
+			err = ce.db.MarkDelegatePunished(dp)
+			if err != nil {
+				log.Error(fmt.Sprintf("MarkDelegatePunished err %s", err))
+			}
 		}
 	}
 	// 4. 结果处理
 	if hasSuccess {
 		//成功则计费
-		err = ce.db.AccountUseSmt(d.DelegatorAddress(), params.SmtPunish)
+		err = ce.db.AccountUseSmt(d.DelegatorAddress(), fees.Punish)
 		if err != nil {
 			log.Error(fmt.Sprintf("db AccountUseSmt err : %s", err.Error()))
 		}
 		log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] Punish called SUCCESS", d.ChannelIdentifierStr, d.DelegatorAddressStr))
 	} else {
 		// 失败解锁费用并更新delegate
-		err = ce.db.AccountUnlockSmt(d.DelegatorAddress(), params.SmtPunish)
+		err = ce.db.AccountUnlockSmt(d.DelegatorAddress(), fees.Punish)
 		if err != nil {
 			log.Error(fmt.Sprintf("db AccountUnlockSmt err : %s", err.Error()))
 		}
@@ -689,6 +1029,23 @@ func (ce *ChainEvents) doDelegatePunishes(d *models.Delegate) {
 	}
 }
 
+/*
+hasObsoleteUnlockEvidence 对方unlock的锁会记录在委托人的unlocked_locks中,这是punish成功的前提
+*/
+func (ce *ChainEvents) hasObsoleteUnlockEvidence(d *models.Delegate, dp *models.DelegatePunish) bool {
+	tokenNetwork, err := ce.bcs.TokenNetwork(d.TokenAddress())
+	if err != nil {
+		log.Error(fmt.Sprintf("TokenNetwork err : %s", err.Error()))
+		return false
+	}
+	unlocked, err := tokenNetwork.GetContract().QueryUnlockedLocks(nil, d.TokenAddress(), d.DelegatorAddress(), d.PartnerAddress(), dp.LockHash())
+	if err != nil {
+		log.Error(fmt.Sprintf("QueryUnlockedLocks channel=%s lock=%s err %s", d.ChannelIdentifierStr, dp.LockHashStr, err))
+		return false
+	}
+	return unlocked
+}
+
 func (ce *ChainEvents) doPunish(d *models.Delegate, dp *models.DelegatePunish) (r *models.DelegateExecuteRecord) {
 	r = models.NewDelegateExecuteRecord(d, models.DelegateTypePunish, dp)
 	defer ce.db.SaveDelegateExecuteRecord(r)
@@ -701,7 +1058,7 @@ func (ce *ChainEvents) doPunish(d *models.Delegate, dp *models.DelegatePunish) (
 	}
 	tx, err := tokenNetwork.GetContract().PunishObsoleteUnlock(ce.bcs.Auth, d.TokenAddress(), d.DelegatorAddress(), d.PartnerAddress(), dp.LockHash(), dp.AdditionalHash(), dp.Signature)
 	if err != nil {
-		r.Error = fmt.Sprintf("create tx err : %s", err.Error())
+		ce.txCreateFailed(r, err)
 		return
 	}
 	r.Status = models.ExecuteStatusErrorFinished // 默认失败
@@ -724,6 +1081,11 @@ func (ce *ChainEvents) doPunish(d *models.Delegate, dp *models.DelegatePunish) (
 	return
 }
 
+//ChainID of the chain this ChainEvents works on
+func (ce *ChainEvents) ChainID() *big.Int {
+	return ce.chainID
+}
+
 //GetBlockNumber return latest blocknumber of ethereum
 func (ce *ChainEvents) GetBlockNumber() int64 {
 	i := ce.blockNumber.Load()
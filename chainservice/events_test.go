@@ -0,0 +1,93 @@
+package chainservice
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyBalanceProofUpdate(t *testing.T) {
+	status, _ := classifyBalanceProofUpdate(3, 0)
+	assert.EqualValues(t, models.DelegateStatusInit, status)
+	status, _ = classifyBalanceProofUpdate(3, 2)
+	assert.EqualValues(t, models.DelegateStatusInit, status)
+	status, reason := classifyBalanceProofUpdate(3, 3)
+	assert.EqualValues(t, models.DelegateStatusUpdateUnnecessary, status)
+	assert.NotEmpty(t, reason)
+	status, reason = classifyBalanceProofUpdate(3, 5)
+	assert.EqualValues(t, models.DelegateStatusStaleDelegation, status)
+	assert.NotEmpty(t, reason)
+}
+
+func TestHandleBlockNumberStopping(t *testing.T) {
+	ast := assert.New(t)
+	db := models.SetupTestDb(t)
+	defer db.CloseDB()
+	ce := &ChainEvents{db: db, blockNumber: new(atomic.Value)}
+	ce.blockNumber.Store(int64(10))
+	ce.handleBlockNumber(11)
+	ast.EqualValues(11, db.GetLatestBlockNumber())
+	// 正在退出,补齐的块和当前块都没有处理完
+	atomic.StoreInt32(&ce.stopping, 1)
+	ce.handleBlockNumber(14)
+	ast.EqualValues(11, db.GetLatestBlockNumber())
+}
+
+func TestHandleBlockNumberRescan(t *testing.T) {
+	ast := assert.New(t)
+	db := models.SetupTestDb(t)
+	defer db.CloseDB()
+	ce := &ChainEvents{db: db, blockNumber: new(atomic.Value)}
+	c := &models.ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+	}
+	c.SetSettleBlockNumber(20)
+	addr := utils.NewRandomAddress()
+	err := db.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	d, err := db.GetDelegateByKey(models.BuildDelegateKey(c.ChannelIdentifier, addr))
+	ast.Nil(err)
+	// 没有需要惩罚的锁,不会访问公链
+	ce.blockNumber.Store(int64(18))
+	ce.handleBlockNumber(19)
+	ce.handleBlockNumber(20)
+	ce.executeWaitGroup.Wait()
+	ast.EqualValues(20, db.GetLatestBlockNumber())
+	dms, err := db.GetDelegateMonitors(0, 0)
+	ast.Nil(err)
+	for _, dm := range dms {
+		if dm.Type == models.MonitorTypePunish {
+			ast.True(dm.Done)
+		}
+	}
+
+	// 重新扫描已经执行过的块,重复收到通道关闭事件也不会重复添加
+	ce.blockNumber.Store(int64(18))
+	db.SaveLatestBlockNumber(18)
+	db.AddDelegateMonitor(d)
+	db.AddDelegatePunishLockMonitor(d, 19, utils.EmptyHash)
+	db.AddDelegatePunishLockMonitor(d, 20, utils.EmptyHash)
+	dms2, err := db.GetDelegateMonitors(0, 0)
+	ast.Nil(err)
+	ast.EqualValues(len(dms)+1, len(dms2))
+	// 只执行补上的惩罚
+	pending, err := db.GetDelegateMonitorList(19)
+	ast.Nil(err)
+	if ast.EqualValues(1, len(pending)) {
+		ast.EqualValues(models.MonitorTypePunishLock, pending[0].Type)
+	}
+	pending, err = db.GetDelegateMonitorList(20)
+	ast.Nil(err)
+	ast.EqualValues(0, len(pending))
+	ce.handleBlockNumber(19)
+	ce.handleBlockNumber(20)
+	ce.executeWaitGroup.Wait()
+	ast.EqualValues(20, db.GetLatestBlockNumber())
+	pending, err = db.GetDelegateMonitorList(19)
+	ast.Nil(err)
+	ast.EqualValues(0, len(pending))
+}
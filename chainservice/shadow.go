@@ -0,0 +1,72 @@
+package chainservice
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/network/helper"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+/*
+simulatedTx 影子模式下Signer不签名,而是用eth_call模拟执行,
+bind在签名出错时不会发送tx,模拟的结果通过这个错误带回给调用方
+*/
+type simulatedTx struct {
+	err error // eth_call的错误,nil表示模拟执行成功
+}
+
+func (e *simulatedTx) Error() string {
+	if e.err == nil {
+		return "tx simulated"
+	}
+	return fmt.Sprintf("tx simulated : %s", e.err)
+}
+
+//newShadowTransactor 创建只模拟执行的TransactOpts,tx不会被签名和广播
+func newShadowTransactor(client *helper.SafeEthClient, from common.Address) *bind.TransactOpts {
+	return &bind.TransactOpts{
+		From: from,
+		Signer: func(signer types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), params.EndpointCallTimeout)
+			defer cancel()
+			_, err := client.CallContract(ctx, ethereum.CallMsg{
+				From:     address,
+				To:       tx.To(),
+				Gas:      tx.Gas(),
+				GasPrice: tx.GasPrice(),
+				Value:    tx.Value(),
+				Data:     tx.Data(),
+			}, nil)
+			return nil, &simulatedTx{err: err}
+		},
+	}
+}
+
+/*
+txCreateFailed 记录创建tx失败的原因.
+影子模式下创建tx总是"失败"的,实际上是模拟执行的结果,按照tx已经打包的情况记录
+*/
+func (ce *ChainEvents) txCreateFailed(r *models.DelegateExecuteRecord, err error) {
+	st, ok := err.(*simulatedTx)
+	if !ok {
+		r.Error = fmt.Sprintf("create tx err : %s", err.Error())
+		return
+	}
+	r.TxCreateBlockNumber = ce.blockNumber.Load().(int64)
+	r.TxCreateTimestamp = time.Now().Unix()
+	if st.err != nil {
+		log.Info(fmt.Sprintf("simulate %s for %s failed %s", r.Key, r.DelegatorStr, st.err))
+		r.Status = models.ExecuteStatusErrorFinished
+		r.Error = fmt.Sprintf("simulate tx err : %s", st.err)
+		return
+	}
+	r.Status = models.ExecuteStatusSuccessFinished
+}
@@ -0,0 +1,33 @@
+package chainservice
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxCreateFailed(t *testing.T) {
+	ast := assert.New(t)
+	ce := &ChainEvents{blockNumber: new(atomic.Value)}
+	ce.blockNumber.Store(int64(100))
+
+	r := &models.DelegateExecuteRecord{}
+	ce.txCreateFailed(r, errors.New("gas required exceeds allowance"))
+	ast.EqualValues(models.ExecuteStatusNotExecute, r.Status)
+	ast.EqualValues("create tx err : gas required exceeds allowance", r.Error)
+	ast.EqualValues(0, r.TxCreateBlockNumber)
+
+	r = &models.DelegateExecuteRecord{}
+	ce.txCreateFailed(r, &simulatedTx{})
+	ast.EqualValues(models.ExecuteStatusSuccessFinished, r.Status)
+	ast.EqualValues(100, r.TxCreateBlockNumber)
+	ast.Empty(r.TxHashStr)
+
+	r = &models.DelegateExecuteRecord{}
+	ce.txCreateFailed(r, &simulatedTx{err: errors.New("execution reverted")})
+	ast.EqualValues(models.ExecuteStatusErrorFinished, r.Status)
+	ast.EqualValues("simulate tx err : execution reverted", r.Error)
+}
@@ -10,7 +10,9 @@ import (
 	"github.com/SmartMeshFoundation/Photon/params"
 
 	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	params2 "github.com/SmartMeshFoundation/Photon-Monitoring/params"
 	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
 	"github.com/SmartMeshFoundation/Photon/utils"
 	"github.com/ethereum/go-ethereum/common"
 )
@@ -20,22 +22,22 @@ import (
 func (ce *ChainEvents) VerifyDelegate(c *models.ChannelFor3rd, delegater common.Address) error {
 	partner := c.PartnerAddress
 	haveValidData := false
-	tokenNetwork, err := ce.bcs.TokenNetwork(c.TokenAddress)
-	if err != nil {
-		return err
-	}
-	settleBlockNumber, openBlockNumber, _, _, err := tokenNetwork.GetContract().GetChannelInfoByChannelIdentifier(nil, c.ChannelIdentifier)
+	ci, err := ce.getChannelInfo(c.ChannelIdentifier)
 	if err != nil {
 		return fmt.Errorf("channel %s get channel info err %s", c.ChannelIdentifier.String(), err)
 	}
+	settleBlockNumber, openBlockNumber, settleTimeout := ci.settleBlockNumber, ci.openBlockNumber, ci.settleTimeout
 	//openBlockNumber 表示通道不存在,
 	if openBlockNumber == 0 || c.OpenBlockNumber != int64(openBlockNumber) {
 		return fmt.Errorf("channel %s open blocknumber not match on chain, chain's openblocknumber=%d,delegate's=%d",
 			c.ChannelIdentifier.String(), openBlockNumber, c.OpenBlockNumber,
 		)
 	}
+	if limit := unlockCapacity(settleTimeout); len(c.Unlocks) > limit {
+		return fmt.Errorf("too many unlocks %d, at most %d unlocks for settle timeout %d", len(c.Unlocks), limit, settleTimeout)
+	}
 	if c.UpdateTransfer.Nonce > 0 {
-		closingAddr, err := verifyClosingSignature(c)
+		closingAddr, err := ce.verifyClosingSignature(c)
 		if err != nil {
 			return err
 		}
@@ -44,7 +46,7 @@ func (ce *ChainEvents) VerifyDelegate(c *models.ChannelFor3rd, delegater common.
 				utils.APex(closingAddr), utils.APex(partner),
 				utils.APex(delegater))
 		}
-		if !verifyNonClosingSignature(c, delegater) {
+		if !ce.verifyNonClosingSignature(c, delegater) {
 			return errors.New("non closing error")
 		}
 		err = ce.verifyUnlocks(c, delegater)
@@ -82,6 +84,18 @@ func (ce *ChainEvents) VerifyDelegate(c *models.ChannelFor3rd, delegater common.
 	c.SetSettleBlockNumber(int64(settleBlockNumber))
 	return nil
 }
+/*
+unlockCapacity 一个委托最多允许的unlock数量,
+不超过params.MaxUnlocksPerDelegate,也不超过settle_timeout/2
+*/
+func unlockCapacity(settleTimeout uint64) int {
+	limit := params2.MaxUnlocksPerDelegate
+	if settleTimeout > 0 && int(settleTimeout/2) < limit {
+		limit = int(settleTimeout / 2)
+	}
+	return limit
+}
+
 func (ce *ChainEvents) verifyUnlocks(c *models.ChannelFor3rd, delegater common.Address) error {
 	for _, l := range c.Unlocks {
 		if l.Lock == nil || l.Lock.Amount == nil {
@@ -95,6 +109,84 @@ func (ce *ChainEvents) verifyUnlocks(c *models.ChannelFor3rd, delegater common.A
 			return fmt.Errorf("unlock's signature error, signer=%s,delegater=%s", signer.String(), delegater.String())
 		}
 	}
+	incomplete, err := verifyUnlockProofs(c.Unlocks, c.UpdateTransfer.Locksroot)
+	if err != nil {
+		return err
+	}
+	if incomplete {
+		log.Warn(fmt.Sprintf("delegate of channel %s from %s doesn't unlock all locks in locksroot %s",
+			c.ChannelIdentifier.String(), delegater.String(), c.UpdateTransfer.Locksroot.String()))
+	}
+	c.SetUnlocksIncomplete(incomplete)
+	return nil
+}
+
+/*
+verifyUnlockProofs 校验每个unlock的MerkleProof确实能证明该锁在locksroot中,
+同一个锁不能重复委托,否则链上执行必然失败,白白收费.
+所有证明都正确时,再检查证明路径上的每个兄弟节点是否都能由委托的锁计算出来,
+不能的话说明这个兄弟节点下面有没有委托的锁,返回incomplete=true.
+merkle树的root和锁的顺序有关,委托的顺序不一定是通道中的顺序,所以不能直接重建merkle树比较root
+*/
+func verifyUnlockProofs(unlocks []*models.Unlock, locksroot common.Hash) (incomplete bool, err error) {
+	lockHashes := make(map[common.Hash]bool)
+	secretHashes := make(map[common.Hash]bool)
+	for _, u := range unlocks {
+		if u.Lock == nil || u.Lock.Amount == nil {
+			err = fmt.Errorf("lock error %s", u.Lock)
+			return
+		}
+		lockHash := u.Lock.Hash()
+		if lockHashes[lockHash] || secretHashes[u.Lock.LockSecretHash] {
+			err = fmt.Errorf("duplicate unlock %s", u.Lock)
+			return
+		}
+		lockHashes[lockHash] = true
+		secretHashes[u.Lock.LockSecretHash] = true
+		err = verifyMerkleProof(u.MerkleProof, locksroot, lockHash)
+		if err != nil {
+			err = fmt.Errorf("unlock %s merkle proof err %s", u.Lock, err)
+			return
+		}
+	}
+	if len(unlocks) == 0 {
+		incomplete = locksroot != utils.EmptyHash
+		return
+	}
+	// 委托的锁以及它们的证明路径上的所有节点
+	nodes := make(map[common.Hash]bool)
+	for _, u := range unlocks {
+		h := u.Lock.Hash()
+		nodes[h] = true
+		for i := 0; i < len(u.MerkleProof); i += len(h) {
+			h = mtree.HashPair(h, common.BytesToHash(u.MerkleProof[i:i+len(h)]))
+			nodes[h] = true
+		}
+	}
+	for _, u := range unlocks {
+		for i := 0; i < len(u.MerkleProof); i += common.HashLength {
+			sibling := common.BytesToHash(u.MerkleProof[i : i+common.HashLength])
+			if sibling != utils.EmptyHash && !nodes[sibling] {
+				incomplete = true
+				return
+			}
+		}
+	}
+	return
+}
+
+//verifyMerkleProof proof is concatenation of 32 bytes hashes,same as the contract
+func verifyMerkleProof(proof []byte, root, leaf common.Hash) error {
+	if len(proof)%len(leaf) != 0 {
+		return fmt.Errorf("invalid proof length %d", len(proof))
+	}
+	h := leaf
+	for i := 0; i < len(proof); i += len(leaf) {
+		h = mtree.HashPair(h, common.BytesToHash(proof[i:i+len(leaf)]))
+	}
+	if h != root {
+		return fmt.Errorf("proof doesn't match locksroot %s", root.String())
+	}
 	return nil
 }
 func (ce *ChainEvents) verifyPunishes(c *models.ChannelFor3rd) error {
@@ -120,7 +212,7 @@ func (ce *ChainEvents) verifyUnlockSignature(u *models.Unlock, c *models.Channel
 	_, err = buf.Write(u.Lock.LockSecretHash[:])
 	_, err = buf.Write(c.ChannelIdentifier[:])
 	err = binary.Write(buf, binary.BigEndian, c.OpenBlockNumber)
-	_, err = buf.Write(utils.BigIntTo32Bytes(params.ChainID))
+	_, err = buf.Write(utils.BigIntTo32Bytes(ce.chainID))
 	if err != nil {
 		log.Error(fmt.Sprintf("buf write error %s", err))
 		return
@@ -136,7 +228,7 @@ func (ce *ChainEvents) verifyPunishSignature(p *models.Punish, c *models.Channel
 	_, err = buf.Write(p.LockHash[:])
 	_, err = buf.Write(c.ChannelIdentifier[:])
 	err = binary.Write(buf, binary.BigEndian, c.OpenBlockNumber)
-	_, err = buf.Write(utils.BigIntTo32Bytes(params.ChainID))
+	_, err = buf.Write(utils.BigIntTo32Bytes(ce.chainID))
 	_, err = buf.Write(p.AdditionalHash[:])
 	if err != nil {
 		return
@@ -144,7 +236,7 @@ func (ce *ChainEvents) verifyPunishSignature(p *models.Punish, c *models.Channel
 	hash := utils.Sha3(buf.Bytes())
 	return utils.Ecrecover(hash, p.Signature)
 }
-func verifyClosingSignature(c *models.ChannelFor3rd) (signer common.Address, err error) {
+func (ce *ChainEvents) verifyClosingSignature(c *models.ChannelFor3rd) (signer common.Address, err error) {
 	u := c.UpdateTransfer
 	buf := new(bytes.Buffer)
 	if c.UpdateTransfer.Nonce <= 0 {
@@ -152,7 +244,7 @@ func verifyClosingSignature(c *models.ChannelFor3rd) (signer common.Address, err
 		return
 	}
 	log.Trace(fmt.Sprintf("c=%s", utils.StringInterface(c, 5)))
-	log.Trace(fmt.Sprintf("chaind=%s", params.ChainID.String()))
+	log.Trace(fmt.Sprintf("chaind=%s", ce.chainID.String()))
 	_, err = buf.Write(params.ContractSignaturePrefix)
 	_, err = buf.Write([]byte(params.ContractBalanceProofMessageLength))
 	_, err = buf.Write(utils.BigIntTo32Bytes(u.TransferAmount))
@@ -161,12 +253,12 @@ func verifyClosingSignature(c *models.ChannelFor3rd) (signer common.Address, err
 	_, err = buf.Write(u.ExtraHash[:])
 	_, err = buf.Write(c.ChannelIdentifier[:])
 	err = binary.Write(buf, binary.BigEndian, c.OpenBlockNumber)
-	_, err = buf.Write(utils.BigIntTo32Bytes(params.ChainID))
+	_, err = buf.Write(utils.BigIntTo32Bytes(ce.chainID))
 	hash := utils.Sha3(buf.Bytes())
 	sig := u.ClosingSignature
 	return utils.Ecrecover(hash, sig)
 }
-func verifyNonClosingSignature(c *models.ChannelFor3rd, delegater common.Address) bool {
+func (ce *ChainEvents) verifyNonClosingSignature(c *models.ChannelFor3rd, delegater common.Address) bool {
 	var err error
 	u := c.UpdateTransfer
 	buf := new(bytes.Buffer)
@@ -177,7 +269,7 @@ func verifyNonClosingSignature(c *models.ChannelFor3rd, delegater common.Address
 	err = binary.Write(buf, binary.BigEndian, u.Nonce)
 	_, err = buf.Write(c.ChannelIdentifier[:])
 	err = binary.Write(buf, binary.BigEndian, c.OpenBlockNumber)
-	_, err = buf.Write(utils.BigIntTo32Bytes(params.ChainID))
+	_, err = buf.Write(utils.BigIntTo32Bytes(ce.chainID))
 	hash := utils.Sha3(buf.Bytes())
 	sig := u.NonClosingSignature
 	signer, err := utils.Ecrecover(hash, sig)
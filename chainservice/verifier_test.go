@@ -0,0 +1,97 @@
+package chainservice
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	params2 "github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUnlocks(n int) (unlocks []*models.Unlock, root common.Hash) {
+	var locks []*mtree.Lock
+	for i := 0; i < n; i++ {
+		locks = append(locks, &mtree.Lock{
+			Expiration:     int64(100 + i),
+			Amount:         big.NewInt(int64(10 + i)),
+			LockSecretHash: utils.NewRandomHash(),
+		})
+	}
+	tree := mtree.NewMerkleTree(locks)
+	for _, l := range locks {
+		unlocks = append(unlocks, &models.Unlock{
+			Lock:        l,
+			MerkleProof: mtree.Proof2Bytes(tree.MakeProof(l.Hash())),
+		})
+	}
+	return unlocks, tree.MerkleRoot()
+}
+
+func TestVerifyUnlockProofs(t *testing.T) {
+	unlocks, root := newTestUnlocks(5)
+	incomplete, err := verifyUnlockProofs(unlocks, root)
+	assert.Nil(t, err)
+	assert.False(t, incomplete)
+
+	//委托的顺序和通道中锁的顺序不同
+	reversed := []*models.Unlock{unlocks[4], unlocks[2], unlocks[3], unlocks[0], unlocks[1]}
+	incomplete, err = verifyUnlockProofs(reversed, root)
+	assert.Nil(t, err)
+	assert.False(t, incomplete)
+
+	//只委托了部分锁
+	incomplete, err = verifyUnlockProofs(unlocks[1:3], root)
+	assert.Nil(t, err)
+	assert.True(t, incomplete)
+	incomplete, err = verifyUnlockProofs(unlocks[:4], root)
+	assert.Nil(t, err)
+	assert.True(t, incomplete)
+	incomplete, err = verifyUnlockProofs([]*models.Unlock{unlocks[4], unlocks[1], unlocks[0], unlocks[3]}, root)
+	assert.Nil(t, err)
+	assert.True(t, incomplete)
+	incomplete, err = verifyUnlockProofs(nil, root)
+	assert.Nil(t, err)
+	assert.True(t, incomplete)
+
+	//重复的锁
+	_, err = verifyUnlockProofs([]*models.Unlock{unlocks[0], unlocks[1], unlocks[0]}, root)
+	assert.NotNil(t, err)
+
+	//错误的证明
+	bad := *unlocks[2]
+	bad.MerkleProof = unlocks[3].MerkleProof
+	_, err = verifyUnlockProofs([]*models.Unlock{unlocks[0], &bad}, root)
+	assert.NotNil(t, err)
+	bad.MerkleProof = unlocks[2].MerkleProof[:31]
+	_, err = verifyUnlockProofs([]*models.Unlock{&bad}, root)
+	assert.NotNil(t, err)
+
+	//不在locksroot中的锁
+	others, _ := newTestUnlocks(1)
+	_, err = verifyUnlockProofs(others, root)
+	assert.NotNil(t, err)
+
+	//只有一个锁时proof为空
+	single, singleRoot := newTestUnlocks(1)
+	incomplete, err = verifyUnlockProofs(single, singleRoot)
+	assert.Nil(t, err)
+	assert.False(t, incomplete)
+}
+
+func TestUnlockCapacity(t *testing.T) {
+	ast := assert.New(t)
+	old := params2.MaxUnlocksPerDelegate
+	defer func() {
+		params2.MaxUnlocksPerDelegate = old
+	}()
+	params2.MaxUnlocksPerDelegate = 20
+	ast.Equal(20, unlockCapacity(0))
+	ast.Equal(20, unlockCapacity(100))
+	ast.Equal(20, unlockCapacity(41))
+	ast.Equal(15, unlockCapacity(30))
+	ast.Equal(0, unlockCapacity(1))
+}
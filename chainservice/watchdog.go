@@ -0,0 +1,205 @@
+package chainservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/blockchain"
+	"github.com/SmartMeshFoundation/Photon/log"
+	smparams "github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+)
+
+type feedState int
+
+const (
+	feedOK           feedState = iota
+	feedStalled                // 公链在出块,但是事件源没有通知新块,需要重启
+	feedChainStalled           // 公链本身没有出新块,重启事件源也没有用,只报警
+)
+
+/*
+checkFeed 根据最后处理的块,最后处理新块的时间以及独立查询到的公链最新块判断事件源的状态:
+1. 落后最新块超过params.WatchdogMaxLag,并且至少一个检查周期内没有任何进展
+2. 超过params.WatchdogMaxSilence没有处理新块,而公链有新块
+3. 超过params.WatchdogMaxSilence没有处理新块,公链也没有新块,说明是公链节点的问题
+*/
+func checkFeed(processed int64, silence time.Duration, head int64) feedState {
+	maxSilence, _ := params.GetAlertConfig()
+	if head-processed > params.WatchdogMaxLag && silence >= params.WatchdogInterval {
+		return feedStalled
+	}
+	if silence >= maxSilence {
+		if head > processed {
+			return feedStalled
+		}
+		return feedChainStalled
+	}
+	return feedOK
+}
+
+//WatchdogStatus 事件源的健康状况
+type WatchdogStatus struct {
+	LastBlockNumber int64     `json:"last_block_number"`
+	LastBlockTime   time.Time `json:"last_block_time"`
+	HeadBlockNumber int64     `json:"head_block_number"`
+	Restarts        int64     `json:"restarts"`
+	LastRestart     time.Time `json:"last_restart,omitempty"`
+	Paused          bool      `json:"paused"`
+}
+
+//WatchdogStatus return current status of chain event feed
+func (ce *ChainEvents) WatchdogStatus() *WatchdogStatus {
+	s := &WatchdogStatus{
+		LastBlockNumber: ce.GetBlockNumber(),
+		LastBlockTime:   time.Unix(0, atomic.LoadInt64(&ce.lastBlockTime)),
+		HeadBlockNumber: atomic.LoadInt64(&ce.headBlockNumber),
+		Restarts:        atomic.LoadInt64(&ce.restarts),
+		Paused:          ce.Paused(),
+	}
+	if t := atomic.LoadInt64(&ce.lastRestartTime); t > 0 {
+		s.LastRestart = time.Unix(0, t)
+	}
+	return s
+}
+
+//events 当前的事件源,watchdog可能会替换
+func (ce *ChainEvents) events() *blockchain.Events {
+	ce.beLock.RLock()
+	defer ce.beLock.RUnlock()
+	return ce.be
+}
+
+/*
+watchdogLoop 定期独立查询eth_blockNumber,和最后处理的块比较.
+blockchain.Events在连接断开时会直接退出轮询,loop就会一直等待,
+这时重启事件源,从最后处理的块开始,错过的块由handleBlockNumber补齐.
+*/
+func (ce *ChainEvents) watchdogLoop() {
+	chainStalled := false
+	for {
+		select {
+		case <-time.After(params.WatchdogInterval):
+		case <-ce.quitChan:
+			return
+		}
+		processed := ce.GetBlockNumber()
+		silence := time.Since(time.Unix(0, atomic.LoadInt64(&ce.lastBlockTime)))
+		ctx, cancel := context.WithTimeout(context.Background(), smparams.EthRPCTimeout)
+		h, err := ce.client.HeaderByNumber(ctx, nil)
+		cancel()
+		if err != nil {
+			// 公链节点连不上,重启事件源也没有用,等节点恢复以后再判断
+			log.Warn(fmt.Sprintf("watchdog eth_blockNumber err %s", err))
+			maxSilence, _ := params.GetAlertConfig()
+			if silence >= maxSilence && !chainStalled {
+				chainStalled = true
+				ce.alert(fmt.Sprintf("no new block processed for %s and eth node unreachable: %s", silence, err), processed, 0)
+			}
+			continue
+		}
+		head := h.Number.Int64()
+		atomic.StoreInt64(&ce.headBlockNumber, head)
+		if ce.Paused() {
+			// 暂停期间不处理新块是正常的
+			continue
+		}
+		switch checkFeed(processed, silence, head) {
+		case feedStalled:
+			chainStalled = false
+			ce.alert(fmt.Sprintf("chain event feed stalled for %s, restart it", silence), processed, head)
+			ce.restartEvents()
+		case feedChainStalled:
+			if !chainStalled {
+				chainStalled = true
+				ce.alert(fmt.Sprintf("no new block on chain for %s", silence), processed, head)
+			}
+		default:
+			if chainStalled {
+				chainStalled = false
+				log.Info(fmt.Sprintf("chain event feed recovered at block %d", processed))
+			}
+		}
+	}
+}
+
+/*
+restartEvents 停止旧的事件源,并从最后处理的块重新开始.
+新事件源会先重新查询最近2*ForkConfirmNumber块的事件,重复的事件是允许的.
+*/
+func (ce *ChainEvents) restartEvents() {
+	if ce.isStopping() {
+		return
+	}
+	be := blockchain.NewBlockChainEvents(ce.client, ce.bcs, &mockChainEventRecordDao{})
+	ce.beLock.Lock()
+	old := ce.be
+	ce.be = be
+	ce.beLock.Unlock()
+	old.Stop()
+	// 旧的AlarmTask可能还阻塞在发送上,丢弃它的通知,避免goroutine泄露
+	go drainStateChanges(old.StateChangeChannel)
+	// 给新的事件源留出追赶的时间,避免每个检查周期都重启
+	atomic.StoreInt64(&ce.lastBlockTime, time.Now().UnixNano())
+	atomic.StoreInt64(&ce.lastRestartTime, time.Now().UnixNano())
+	atomic.AddInt64(&ce.restarts, 1)
+	be.Start(ce.GetBlockNumber())
+	select {
+	case ce.eventsChangedChan <- struct{}{}:
+	default:
+	}
+}
+
+func drainStateChanges(ch chan transfer.StateChange) {
+	for {
+		select {
+		case <-ch:
+		case <-time.After(2 * time.Minute):
+			return
+		}
+	}
+}
+
+type alertMessage struct {
+	Message         string    `json:"message"`
+	LastBlockNumber int64     `json:"last_block_number"`
+	HeadBlockNumber int64     `json:"head_block_number"`
+	Time            time.Time `json:"time"`
+}
+
+//alert 需要运维介入的情况,记录错误日志,配置了params.AlertURL时同时POST过去
+func (ce *ChainEvents) alert(msg string, processed, head int64) {
+	log.Error(fmt.Sprintf("ALERT %s, last processed block=%d, head=%d", msg, processed, head))
+	_, alertURL := params.GetAlertConfig()
+	if alertURL == "" {
+		return
+	}
+	body, err := json.Marshal(&alertMessage{
+		Message:         msg,
+		LastBlockNumber: processed,
+		HeadBlockNumber: head,
+		Time:            time.Now(),
+	})
+	if err != nil {
+		log.Error(fmt.Sprintf("marshal alert err %s", err))
+		return
+	}
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		res, err := client.Post(alertURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Error(fmt.Sprintf("send alert to %s err %s", alertURL, err))
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			log.Error(fmt.Sprintf("send alert to %s status %s", alertURL, res.Status))
+		}
+	}()
+}
@@ -0,0 +1,23 @@
+package chainservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFeed(t *testing.T) {
+	ast := assert.New(t)
+	// 正常出块
+	ast.Equal(feedOK, checkFeed(100, 10*time.Second, 101))
+	// 追赶中,刚刚还有进展
+	ast.Equal(feedOK, checkFeed(100, time.Second, 100+params.WatchdogMaxLag+1))
+	// 落后太多并且一个周期没有进展
+	ast.Equal(feedStalled, checkFeed(100, params.WatchdogInterval, 100+params.WatchdogMaxLag+1))
+	// 长时间没有新块,公链有新块
+	ast.Equal(feedStalled, checkFeed(100, params.WatchdogMaxSilence, 101))
+	// 长时间没有新块,公链也没有新块
+	ast.Equal(feedChainStalled, checkFeed(100, params.WatchdogMaxSilence, 100))
+}
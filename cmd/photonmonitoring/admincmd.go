@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/dto"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/urfave/cli.v1"
+)
+
+/*
+运维命令,查看和修复数据库中的委托,计划,执行记录和账户.
+指定--api时通过运行中的PMS的管理接口操作,否则直接打开--dbpath指定的数据库.
+PMS运行时不要离线修改数据库,应该使用--api.
+所有的修改都需要--operator和--reason,记录在数据库的audit_logs中
+*/
+
+//adminFlags 每个运维命令都可以使用的参数
+func adminFlags(extra ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "api",
+			Usage: "admin api of a running Photon monitoring, for example http://127.0.0.1:6003. leave it empty to open the database directly",
+		},
+		cli.StringFlag{
+			Name:  "token-file",
+			Usage: "Text file containing the bearer token of the admin api",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "client certificate file for the admin api",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "private key file of tls-cert",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "ca to verify the certificate of the admin api, system cas are used if empty",
+		},
+		cli.StringFlag{
+			Name:  "network",
+			Usage: "network name of the running Photon monitoring, empty for the first network",
+		},
+		cli.StringFlag{
+			Name:  "dbpath",
+			Usage: "path of the Photon monitoring database, used when --api is empty",
+		},
+		cli.StringFlag{
+			Name:  "db-key",
+			Usage: "key to decrypt the database, 'keystore' or path of a passphrase file",
+		},
+		cli.StringFlag{
+			Name:  "db-old-keys",
+			Usage: "comma separated keys used before rotation, 'keystore' or path of a passphrase file",
+		},
+		cli.StringFlag{
+			Name:  "address",
+			Usage: "account of Photon monitoring, needed if any key is 'keystore'",
+		},
+		cli.StringFlag{
+			Name:  "keystore-path",
+			Usage: "If you have a non-standard path for the ethereum keystore directory provide it using this argument. ",
+			Value: params.DefaultKeyStoreDir(),
+		},
+		cli.StringFlag{
+			Name:  "password-file",
+			Usage: "Text file containing password for provided account",
+		},
+	}, extra...)
+}
+
+//changeFlags 人工修改必须说明是谁以及为什么
+var changeFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "operator",
+		Usage: "who makes this change, recorded in the audit log",
+		Value: os.Getenv("USER"),
+	},
+	cli.StringFlag{
+		Name:  "reason",
+		Usage: "why this change is needed, recorded in the audit log",
+	},
+}
+
+var adminCommands = []cli.Command{
+	{
+		Name:  "delegates",
+		Usage: "inspect delegates",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "list delegates of all delegators, newest first",
+				Action: delegatesListCtx,
+				Flags: adminFlags(
+					cli.StringFlag{Name: "delegator", Usage: "only delegates of this delegator"},
+					cli.StringFlag{Name: "status", Usage: "only delegates with this status"},
+					cli.StringFlag{Name: "token", Usage: "only delegates of this token"},
+					cli.StringFlag{Name: "partner", Usage: "only delegates with this partner"},
+					cli.IntFlag{Name: "offset", Usage: "skip the first offset delegates"},
+					cli.IntFlag{Name: "limit", Usage: "at most limit delegates", Value: 20},
+				),
+			},
+			{
+				Name:      "show",
+				Usage:     "show everything about a delegate",
+				ArgsUsage: "<delegate key> | <channel> <delegator>",
+				Action:    delegatesShowCtx,
+				Flags:     adminFlags(),
+			},
+		},
+	},
+	{
+		Name:  "monitors",
+		Usage: "inspect scheduled delegate executions",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "list scheduled executions by block number",
+				Action: monitorsListCtx,
+				Flags: adminFlags(
+					cli.Int64Flag{Name: "from", Usage: "from this block number, default is the latest processed block", Value: -1},
+					cli.IntFlag{Name: "limit", Usage: "at most limit monitors, 0 for all", Value: 100},
+				),
+			},
+		},
+	},
+	{
+		Name:  "records",
+		Usage: "inspect execution records",
+		Subcommands: []cli.Command{
+			{
+				Name:      "list",
+				Usage:     "list execution records of a delegator, newest first",
+				ArgsUsage: "<delegator>",
+				Action:    recordsListCtx,
+				Flags: adminFlags(
+					cli.StringFlag{Name: "channel", Usage: "only records of this channel"},
+					cli.StringFlag{Name: "type", Usage: "only records of this type"},
+					cli.StringFlag{Name: "status", Usage: "only records with this status"},
+					cli.IntFlag{Name: "limit", Usage: "at most limit records, 0 for all"},
+				),
+			},
+		},
+	},
+	{
+		Name:  "accounts",
+		Usage: "inspect and adjust accounts",
+		Subcommands: []cli.Command{
+			{
+				Name:      "show",
+				Usage:     "show balances of an account",
+				ArgsUsage: "<address>",
+				Action:    accountsShowCtx,
+				Flags:     adminFlags(),
+			},
+			{
+				Name:      "adjust",
+				Usage:     "add delta to a balance of an account, delta can be negative",
+				ArgsUsage: "<address>",
+				Action:    accountsAdjustCtx,
+				Flags: adminFlags(append([]cli.Flag{
+					cli.StringFlag{Name: "field", Usage: fmt.Sprintf("balance to adjust, one of %s", strings.Join(models.AccountFields, ","))},
+					cli.StringFlag{Name: "delta", Usage: "amount to add"},
+				}, changeFlags...)...),
+			},
+		},
+	},
+	{
+		Name:      "retry",
+		Usage:     "schedule a failed delegate to run in the next block. offline it charges the fees set by the global fee flags or --config",
+		ArgsUsage: "<delegate key> | <channel> <delegator>",
+		Action:    retryCtx,
+		Flags:     adminFlags(changeFlags...),
+	},
+	{
+		Name:      "cancel",
+		Usage:     "cancel the pending executions of a delegate and release its fees",
+		ArgsUsage: "<delegate key> | <channel> <delegator>",
+		Action:    cancelCtx,
+		Flags:     adminFlags(changeFlags...),
+	},
+	{
+		Name:   "status",
+		Usage:  "show the execution status of a running Photon monitoring",
+		Action: statusCtx,
+		Flags:  adminFlags(),
+	},
+	{
+		Name:   "pause",
+		Usage:  "pause delegate execution of a running Photon monitoring until resume or restart",
+		Action: pauseCtx,
+		Flags:  adminFlags(changeFlags...),
+	},
+	{
+		Name:   "resume",
+		Usage:  "resume delegate execution, blocks missed during the pause are processed",
+		Action: resumeCtx,
+		Flags:  adminFlags(changeFlags...),
+	},
+	{
+		Name:   "rescan",
+		Usage:  "rescan chain events from a block that is already processed",
+		Action: rescanCtx,
+		Flags: adminFlags(append([]cli.Flag{
+			cli.Int64Flag{Name: "from", Usage: "rescan from this block number"},
+		}, changeFlags...)...),
+	},
+	{
+		Name:  "audit",
+		Usage: "inspect manual changes",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "list manual changes, newest first",
+				Action: auditListCtx,
+				Flags: adminFlags(
+					cli.IntFlag{Name: "limit", Usage: "at most limit logs, 0 for all", Value: 100},
+				),
+			},
+		},
+	},
+}
+
+//adminTarget 运维命令操作的对象,db和api只有一个有效
+type adminTarget struct {
+	db     *models.ModelDB
+	api    string
+	client *http.Client
+	token  string
+}
+
+func openAdminTarget(ctx *cli.Context) (t *adminTarget, err error) {
+	t = &adminTarget{}
+	if api := ctx.String("api"); api != "" {
+		t.api = strings.TrimSuffix(api, "/")
+		if ctx.String("network") != "" {
+			t.api += "/net/" + ctx.String("network")
+		}
+		t.client, t.token, err = adminHTTPClient(ctx)
+		return
+	}
+	t.db, err = openOfflineDB(ctx)
+	return
+}
+
+//adminHTTPClient 管理接口的认证方式要和PMS的admin-token-file,admin-client-ca一致
+func adminHTTPClient(ctx *cli.Context) (client *http.Client, token string, err error) {
+	if f := ctx.String("token-file"); f != "" {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, "", fmt.Errorf("read token-file err %s", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	tlsConfig := &tls.Config{}
+	if ctx.String("tls-cert") != "" {
+		cert, err := tls.LoadX509KeyPair(ctx.String("tls-cert"), ctx.String("tls-key"))
+		if err != nil {
+			return nil, "", fmt.Errorf("load client certificate err %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if ctx.String("tls-ca") != "" {
+		data, err := ioutil.ReadFile(ctx.String("tls-ca"))
+		if err != nil {
+			return nil, "", fmt.Errorf("read tls-ca err %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, "", fmt.Errorf("no certificate found in %s", ctx.String("tls-ca"))
+		}
+	}
+	client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return
+}
+
+func (t *adminTarget) close() {
+	if t.db != nil {
+		t.db.CloseDB()
+	}
+}
+
+//call 调用/admin接口并打印返回的Data
+func (t *adminTarget) call(method, path string, query url.Values, body interface{}) error {
+	u := t.api + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s %s", method, u, resp.Status, strings.TrimSpace(string(data)))
+	}
+	res := &dto.APIResponse{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return fmt.Errorf("%s %s: invalid response %s", method, u, err)
+	}
+	if res.ErrorCode != 0 {
+		return fmt.Errorf("%s", res.ErrorMsg)
+	}
+	return printJSON(res.Data)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+//delegateKeyArg 委托可以用delegates list返回的key指定,也可以用通道和委托人指定
+func delegateKeyArg(ctx *cli.Context) ([]byte, error) {
+	switch ctx.NArg() {
+	case 1:
+		return models.ParseDelegateKey(ctx.Args().Get(0))
+	case 2:
+		channel, delegator := ctx.Args().Get(0), ctx.Args().Get(1)
+		if len(common.FromHex(channel)) != common.HashLength || !common.IsHexAddress(delegator) {
+			return nil, fmt.Errorf("invalid channel %s or delegator %s", channel, delegator)
+		}
+		return models.BuildDelegateKey(common.HexToHash(channel), common.HexToAddress(delegator)), nil
+	}
+	return nil, fmt.Errorf("need <delegate key> or <channel> <delegator>")
+}
+
+func addressArg(ctx *cli.Context) (common.Address, error) {
+	s := ctx.Args().First()
+	if !common.IsHexAddress(s) {
+		return utils.EmptyAddress, fmt.Errorf("invalid address %s", s)
+	}
+	return common.HexToAddress(s), nil
+}
+
+//changeArgs 返回operator和reason
+func changeArgs(ctx *cli.Context) (string, string, error) {
+	if ctx.String("operator") == "" {
+		return "", "", fmt.Errorf("operator is required")
+	}
+	return ctx.String("operator"), ctx.String("reason"), nil
+}
+
+func delegatesListCtx(ctx *cli.Context) error {
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	if t.db == nil {
+		query := url.Values{}
+		for _, name := range []string{"delegator", "status", "token", "partner"} {
+			if ctx.String(name) != "" {
+				query.Set(name, ctx.String(name))
+			}
+		}
+		query.Set("offset", strconv.Itoa(ctx.Int("offset")))
+		query.Set("limit", strconv.Itoa(ctx.Int("limit")))
+		return t.call(http.MethodGet, "/admin/delegates", query, nil)
+	}
+	for _, name := range []string{"delegator", "token", "partner"} {
+		if s := ctx.String(name); s != "" && !common.IsHexAddress(s) {
+			return fmt.Errorf("invalid %s %s", name, s)
+		}
+	}
+	q := &models.DelegateQuery{
+		Delegator: common.HexToAddress(ctx.String("delegator")),
+		Token:     common.HexToAddress(ctx.String("token")),
+		Partner:   common.HexToAddress(ctx.String("partner")),
+		Offset:    ctx.Int("offset"),
+		Limit:     ctx.Int("limit"),
+	}
+	if s := ctx.String("status"); s != "" {
+		status, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid status %s", s)
+		}
+		ds := models.DelegateStatus(status)
+		q.Status = &ds
+	}
+	l, err := t.db.GetDelegateViews(q)
+	if err != nil {
+		return err
+	}
+	return printJSON(l)
+}
+
+func delegatesShowCtx(ctx *cli.Context) error {
+	key, err := delegateKeyArg(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	if t.db == nil {
+		return t.call(http.MethodGet, "/admin/delegate/"+common.ToHex(key), nil, nil)
+	}
+	v, err := t.db.GetDelegateView(key)
+	if err != nil {
+		return err
+	}
+	return printJSON(v)
+}
+
+func monitorsListCtx(ctx *cli.Context) error {
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	from := ctx.Int64("from")
+	if t.db == nil {
+		query := url.Values{}
+		if from >= 0 {
+			query.Set("from", strconv.FormatInt(from, 10))
+		}
+		query.Set("limit", strconv.Itoa(ctx.Int("limit")))
+		return t.call(http.MethodGet, "/admin/monitors", query, nil)
+	}
+	if from < 0 {
+		from = t.db.GetLatestBlockNumber()
+	}
+	dms, err := t.db.GetDelegateMonitors(from, ctx.Int("limit"))
+	if err != nil {
+		return err
+	}
+	return printJSON(dms)
+}
+
+func recordsListCtx(ctx *cli.Context) error {
+	delegator, err := addressArg(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	if t.db == nil {
+		query := url.Values{}
+		for _, name := range []string{"channel", "type", "status"} {
+			if ctx.String(name) != "" {
+				query.Set(name, ctx.String(name))
+			}
+		}
+		query.Set("limit", strconv.Itoa(ctx.Int("limit")))
+		return t.call(http.MethodGet, "/admin/records/"+delegator.String(), query, nil)
+	}
+	q := &models.DelegateExecuteRecordQuery{
+		Delegator:         delegator,
+		ChannelIdentifier: common.HexToHash(ctx.String("channel")),
+		Limit:             ctx.Int("limit"),
+	}
+	if s := ctx.String("type"); s != "" {
+		dt, err := models.ParseDelegateType(s)
+		if err != nil {
+			return err
+		}
+		q.Type = &dt
+	}
+	if s := ctx.String("status"); s != "" {
+		status, err := models.ParseExecuteStatus(s)
+		if err != nil {
+			return err
+		}
+		q.Status = &status
+	}
+	vs, err := t.db.GetExecuteRecordViews(q)
+	if err != nil {
+		return err
+	}
+	return printJSON(vs)
+}
+
+func accountsShowCtx(ctx *cli.Context) error {
+	addr, err := addressArg(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	if t.db == nil {
+		return t.call(http.MethodGet, "/admin/account/"+addr.String(), nil, nil)
+	}
+	return printJSON(models.NewAccountView(t.db.AccountGetAccount(addr)))
+}
+
+func accountsAdjustCtx(ctx *cli.Context) error {
+	addr, err := addressArg(ctx)
+	if err != nil {
+		return err
+	}
+	operator, reason, err := changeArgs(ctx)
+	if err != nil {
+		return err
+	}
+	delta, ok := new(big.Int).SetString(ctx.String("delta"), 10)
+	if !ok {
+		return fmt.Errorf("delta arg err %s", ctx.String("delta"))
+	}
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	if t.db == nil {
+		return t.call(http.MethodPost, "/admin/account/"+addr.String()+"/adjust", nil, map[string]interface{}{
+			"operator": operator,
+			"reason":   reason,
+			"field":    ctx.String("field"),
+			"delta":    delta,
+		})
+	}
+	a, err := t.db.AccountAdjust(addr, ctx.String("field"), delta, operator, reason)
+	if err != nil {
+		return err
+	}
+	return printJSON(models.NewAccountView(a))
+}
+
+//globalFlags 读取全局参数,离线重试时按照全局参数或者配置文件中的收费计算
+type globalFlags struct {
+	ctx *cli.Context
+}
+
+func (g globalFlags) String(name string) string {
+	return g.ctx.GlobalString(name)
+}
+
+func retryCtx(ctx *cli.Context) error {
+	key, err := delegateKeyArg(ctx)
+	if err != nil {
+		return err
+	}
+	operator, reason, err := changeArgs(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	if t.db == nil {
+		return t.call(http.MethodPost, "/admin/delegate/"+common.ToHex(key)+"/retry", nil, map[string]interface{}{
+			"operator": operator,
+			"reason":   reason,
+		})
+	}
+	fees, err := parseFees(globalFlags{ctx})
+	if err != nil {
+		return err
+	}
+	t.db.SetFees(fees)
+	d, err := t.db.RetryDelegate(key, operator, reason)
+	if err != nil {
+		return err
+	}
+	return printJSON(d)
+}
+
+func cancelCtx(ctx *cli.Context) error {
+	key, err := delegateKeyArg(ctx)
+	if err != nil {
+		return err
+	}
+	operator, reason, err := changeArgs(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	if t.db == nil {
+		return t.call(http.MethodPost, "/admin/delegate/"+common.ToHex(key)+"/cancel", nil, map[string]interface{}{
+			"operator": operator,
+			"reason":   reason,
+		})
+	}
+	d, err := t.db.CancelDelegate(key, operator, reason)
+	if err != nil {
+		return err
+	}
+	return printJSON(d)
+}
+
+func auditListCtx(ctx *cli.Context) error {
+	t, err := openAdminTarget(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	if t.db == nil {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(ctx.Int("limit")))
+		return t.call(http.MethodGet, "/admin/audit", query, nil)
+	}
+	logs, err := t.db.GetAuditLogs(ctx.Int("limit"))
+	if err != nil {
+		return err
+	}
+	return printJSON(logs)
+}
+
+//openOnlineTarget 暂停,恢复以及重新扫描只能通过运行中的PMS进行
+func openOnlineTarget(ctx *cli.Context) (*adminTarget, error) {
+	if ctx.String("api") == "" {
+		return nil, fmt.Errorf("%s needs --api of a running Photon monitoring", ctx.Command.Name)
+	}
+	return openAdminTarget(ctx)
+}
+
+func statusCtx(ctx *cli.Context) error {
+	t, err := openOnlineTarget(ctx)
+	if err != nil {
+		return err
+	}
+	return t.call(http.MethodGet, "/admin/status", nil, nil)
+}
+
+func pauseCtx(ctx *cli.Context) error {
+	return controlCtx(ctx, "/admin/pause", nil)
+}
+
+func resumeCtx(ctx *cli.Context) error {
+	return controlCtx(ctx, "/admin/resume", nil)
+}
+
+func rescanCtx(ctx *cli.Context) error {
+	if ctx.Int64("from") <= 0 {
+		return fmt.Errorf("from is required")
+	}
+	return controlCtx(ctx, "/admin/rescan", map[string]interface{}{"from": ctx.Int64("from")})
+}
+
+func controlCtx(ctx *cli.Context, path string, extra map[string]interface{}) error {
+	operator, reason, err := changeArgs(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := openOnlineTarget(ctx)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"operator": operator,
+		"reason":   reason,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	return t.call(http.MethodPost, path, nil, body)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/internal/debug"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/naoina/toml"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//reloadableFlags 运行中可以重新加载的参数:收费,日志级别,报警阈值以及限流
+var reloadableFlags = []string{
+	"unlock-fee", "punish-fee", "update-transfer-fee", "secret-register-fee",
+	"verbosity", "vmodule",
+	"stall-timeout", "alert-url",
+	"rate-limit", "rate-limit-burst",
+}
+
+/*
+configFile --config指定的toml配置文件,键是命令行参数的名字,比如
+```toml
+network = "spectrum-mainnet"
+eth-rpc-endpoint = "ws://127.0.0.1:5555"
+address = "0x292650fee408320D888e06ed89D938294Ea42f99"
+password-file = "/etc/photonmonitoring/password"
+payment-sources = ["photon", "erc20"]
+unlock-fee = "1"
+verbosity = 3
+rate-limit = 10
+```
+优先级从高到低是命令行参数,配置文件,--network预设,默认值.
+收到SIGHUP或者调用POST /admin/reload时重新读取配置文件,只有reloadableFlags中的参数会生效,
+其他参数的修改记录警告,需要重启.从配置文件中删除的参数保持当前值.
+*/
+type configFile struct {
+	lock     sync.Mutex
+	path     string
+	ctx      *cli.Context
+	cmdline  map[string]bool   // 命令行明确指定的参数,配置文件不能覆盖
+	values   map[string]string // 当前生效的配置文件内容
+	rns      []*runningNetwork
+	loadedAt time.Time
+	reloads  int
+}
+
+//activeConfig 在app.Before中创建,mainCtx中启动网络以后再开始接受重新加载
+var activeConfig *configFile
+
+//flagNames 所有的全局参数
+func flagNames(ctx *cli.Context) map[string]bool {
+	names := make(map[string]bool)
+	for _, f := range ctx.App.Flags {
+		names[strings.TrimSpace(strings.Split(f.GetName(), ",")[0])] = true
+	}
+	return names
+}
+
+//readConfigFile 读取toml配置文件,所有的值都转换成命令行参数的形式,数组用逗号连接
+func readConfigFile(path string, names map[string]bool) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file %s err %s", path, err)
+	}
+	var m map[string]interface{}
+	err = toml.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s err %s", path, err)
+	}
+	values := make(map[string]string)
+	for k, v := range m {
+		if !names[k] || k == "config" {
+			return nil, fmt.Errorf("config file %s: unknown setting %s", path, k)
+		}
+		switch vv := v.(type) {
+		case []interface{}:
+			var ss []string
+			for _, e := range vv {
+				ss = append(ss, fmt.Sprint(e))
+			}
+			values[k] = strings.Join(ss, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("config file %s: %s must not be a table", path, k)
+		default:
+			values[k] = fmt.Sprint(vv)
+		}
+	}
+	return values, nil
+}
+
+/*
+loadConfigFile 在debug.Setup之前调用,这样配置文件中的日志参数也能生效.
+没有--config时也会创建activeConfig,用来查看当前配置
+*/
+func loadConfigFile(ctx *cli.Context) error {
+	c := &configFile{
+		path:     ctx.String("config"),
+		ctx:      ctx,
+		cmdline:  make(map[string]bool),
+		values:   make(map[string]string),
+		loadedAt: time.Now(),
+	}
+	activeConfig = c
+	names := flagNames(ctx)
+	for name := range names {
+		if ctx.IsSet(name) {
+			c.cmdline[name] = true
+		}
+	}
+	if c.path == "" {
+		return nil
+	}
+	values, err := readConfigFile(c.path, names)
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		if c.cmdline[k] {
+			continue
+		}
+		err = ctx.Set(k, v)
+		if err != nil {
+			return fmt.Errorf("config file %s: %s=%s err %s", c.path, k, v, err)
+		}
+	}
+	c.values = values
+	return nil
+}
+
+//overlay 用values覆盖base中的参数
+type overlay struct {
+	values map[string]string
+	base   flags
+}
+
+func (o *overlay) String(name string) string {
+	if v, ok := o.values[name]; ok {
+		return v
+	}
+	return o.base.String(name)
+}
+
+//reloadable 可以在运行中修改的配置,收费是每个网络分别计算的
+type reloadable struct {
+	verbosity      int
+	vmodule        string
+	stallTimeout   time.Duration
+	alertURL       string
+	rateLimit      float64
+	rateLimitBurst int
+}
+
+func parseReloadable(f flags) (r *reloadable, err error) {
+	r = &reloadable{
+		vmodule:  f.String("vmodule"),
+		alertURL: f.String("alert-url"),
+	}
+	r.verbosity, err = strconv.Atoi(f.String("verbosity"))
+	if err != nil || r.verbosity < 0 {
+		return nil, fmt.Errorf("verbosity arg err %s", f.String("verbosity"))
+	}
+	stallTimeout, err := strconv.Atoi(f.String("stall-timeout"))
+	if err != nil || stallTimeout <= 0 {
+		return nil, fmt.Errorf("stall-timeout arg err %s", f.String("stall-timeout"))
+	}
+	r.stallTimeout = time.Duration(stallTimeout) * time.Second
+	r.rateLimit, err = strconv.ParseFloat(f.String("rate-limit"), 64)
+	if err != nil || r.rateLimit < 0 {
+		return nil, fmt.Errorf("rate-limit arg err %s", f.String("rate-limit"))
+	}
+	r.rateLimitBurst, err = strconv.Atoi(f.String("rate-limit-burst"))
+	if err != nil || r.rateLimitBurst < 1 {
+		return nil, fmt.Errorf("rate-limit-burst arg err %s", f.String("rate-limit-burst"))
+	}
+	return r, nil
+}
+
+//apply 日志参数在启动时已经由debug.Setup设置
+func (r *reloadable) apply(logging bool) error {
+	if logging {
+		err := debug.Handler.Vmodule(r.vmodule)
+		if err != nil {
+			return fmt.Errorf("vmodule arg err %s", err)
+		}
+		debug.Handler.Verbosity(r.verbosity)
+	}
+	params.SetAlertConfig(r.stallTimeout, r.alertURL)
+	params.SetRateLimit(r.rateLimit, r.rateLimitBurst)
+	return nil
+}
+
+//start 网络都已经启动,开始接受SIGHUP
+func (c *configFile) start(rns []*runningNetwork) {
+	c.lock.Lock()
+	c.rns = rns
+	c.lock.Unlock()
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			_, err := c.Reload()
+			if err != nil {
+				log.Error(fmt.Sprintf("reload config err %s", err))
+			}
+		}
+	}()
+}
+
+/*
+Reload 重新读取配置文件,先校验所有修改,都没有问题才一起生效.
+收费修改以后新的委托按照新的收费计算,已经接受的委托仍然按照接受时的收费扣费.
+*/
+func (c *configFile) Reload() (changes []string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.path == "" {
+		return nil, fmt.Errorf("no config file, start with --config to enable reload")
+	}
+	values, err := readConfigFile(c.path, flagNames(c.ctx))
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool)
+	for _, f := range reloadableFlags {
+		allowed[f] = true
+	}
+	updates := make(map[string]string)
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, old := values[k], c.ctx.String(k)
+		if v == old {
+			continue
+		}
+		if c.cmdline[k] {
+			log.Warn(fmt.Sprintf("reload config: %s is set on command line, ignore %s", k, v))
+			continue
+		}
+		if !allowed[k] {
+			log.Warn(fmt.Sprintf("reload config: %s changed to %s, restart to apply", k, v))
+			continue
+		}
+		updates[k] = v
+		changes = append(changes, fmt.Sprintf("%s %s -> %s", k, old, v))
+	}
+	view := &overlay{values: updates, base: c.ctx}
+	r, err := parseReloadable(view)
+	if err != nil {
+		return nil, err
+	}
+	fees := make([]*params.Fees, len(c.rns))
+	for i, rn := range c.rns {
+		fees[i], err = parseFees(&overlay{values: rn.nc.values, base: view})
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %s", rn.Name, err)
+		}
+		// 启动时不收费就没有启动收费渠道
+		if len(rn.sources) == 0 && !fees[i].IsFree() {
+			return nil, fmt.Errorf("network %s was started free of charge, restart to charge fees", rn.Name)
+		}
+	}
+	err = r.apply(true)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range updates {
+		err = c.ctx.Set(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("set %s=%s err %s", k, v, err)
+		}
+	}
+	for i, rn := range c.rns {
+		rn.db.SetFees(fees[i])
+	}
+	c.values = values
+	c.loadedAt = time.Now()
+	c.reloads++
+	if len(changes) == 0 {
+		log.Info(fmt.Sprintf("config reloaded from %s, nothing changed", c.path))
+	} else {
+		log.Info(fmt.Sprintf("config reloaded from %s: %s", c.path, strings.Join(changes, ", ")))
+	}
+	return changes, nil
+}
+
+//SetLogLevel 通过管理接口修改日志级别,和重新加载配置文件一样生效,当前值记录在参数中
+func (c *configFile) SetLogLevel(verbosity int, vmodule string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if verbosity < 0 {
+		return fmt.Errorf("verbosity arg err %d", verbosity)
+	}
+	err := debug.Handler.Vmodule(vmodule)
+	if err != nil {
+		return fmt.Errorf("vmodule arg err %s", err)
+	}
+	debug.Handler.Verbosity(verbosity)
+	old := fmt.Sprintf("verbosity=%s vmodule=%s", c.ctx.String("verbosity"), c.ctx.String("vmodule"))
+	for k, v := range map[string]string{"verbosity": strconv.Itoa(verbosity), "vmodule": vmodule} {
+		err = c.ctx.Set(k, v)
+		if err != nil {
+			return fmt.Errorf("set %s=%s err %s", k, v, err)
+		}
+	}
+	log.Info(fmt.Sprintf("log level changed from %s to verbosity=%d vmodule=%s", old, verbosity, vmodule))
+	return nil
+}
+
+type feesView struct {
+	Token          common.Address `json:"token"`
+	UpdateTransfer *big.Int       `json:"update_transfer"`
+	Unlock         *big.Int       `json:"unlock"`
+	Punish         *big.Int       `json:"punish"`
+	Secret         *big.Int       `json:"secret"`
+}
+
+type networkConfigView struct {
+	Name      string            `json:"name"`
+	Overrides map[string]string `json:"overrides"`
+	Fees      *feesView         `json:"fees"`
+}
+
+type configView struct {
+	File       string               `json:"file,omitempty"`
+	LoadedAt   time.Time            `json:"loaded_at"`
+	Reloads    int                  `json:"reloads"`
+	Reloadable []string             `json:"reloadable"`
+	Flags      map[string]string    `json:"flags"`
+	Networks   []*networkConfigView `json:"networks"`
+}
+
+//ActiveConfig 所有参数当前的值以及每个网络正在使用的收费
+func (c *configFile) ActiveConfig() interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v := &configView{
+		File:       c.path,
+		LoadedAt:   c.loadedAt,
+		Reloads:    c.reloads,
+		Reloadable: reloadableFlags,
+		Flags:      make(map[string]string),
+	}
+	for name := range flagNames(c.ctx) {
+		v.Flags[name] = c.ctx.String(name)
+	}
+	for _, rn := range c.rns {
+		fees := rn.db.Fees()
+		v.Networks = append(v.Networks, &networkConfigView{
+			Name:      rn.Name,
+			Overrides: rn.nc.values,
+			Fees: &feesView{
+				Token:          fees.Token,
+				UpdateTransfer: fees.UpdateTransfer,
+				Unlock:         fees.Unlock,
+				Punish:         fees.Punish,
+				Secret:         fees.Secret,
+			},
+		})
+	}
+	return v
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/internal/debug"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/smt"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestConfigFileReload(t *testing.T) {
+	ast := assert.New(t)
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.toml")
+	write := func(content string) {
+		err := ioutil.WriteFile(file, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldRate, oldBurst := params.GetRateLimit()
+	defer params.SetRateLimit(oldRate, oldBurst)
+	write(`unlock-fee = "0"`)
+
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "config"},
+		cli.StringFlag{Name: "smt", Value: utils.NewRandomAddress().String()},
+		cli.StringFlag{Name: "unlock-fee", Value: "0"},
+		cli.StringFlag{Name: "punish-fee", Value: "0"},
+		cli.StringFlag{Name: "update-transfer-fee", Value: "0"},
+		cli.StringFlag{Name: "secret-register-fee", Value: "0"},
+		cli.IntFlag{Name: "stall-timeout", Value: 300},
+		cli.StringFlag{Name: "alert-url"},
+		cli.Float64Flag{Name: "rate-limit"},
+		cli.IntFlag{Name: "rate-limit-burst", Value: 20},
+		cli.IntFlag{Name: "api-port", Value: 6000},
+	}
+	app.Flags = append(app.Flags, debug.Flags...)
+	app.Before = func(ctx *cli.Context) error {
+		err := loadConfigFile(ctx)
+		if err != nil {
+			return err
+		}
+		return debug.Setup(ctx)
+	}
+	app.Action = func(ctx *cli.Context) error {
+		db := models.SetupTestDb(t)
+		defer db.CloseDB()
+		nc := &networkConfig{name: params.DefaultNetworkName, values: make(map[string]string), ctx: ctx}
+		fees, err := parseFees(nc)
+		if err != nil {
+			return err
+		}
+		db.SetFees(fees)
+		rn := &runningNetwork{Network: &params.Network{Name: nc.name, Fees: fees}, nc: nc, db: db}
+		c := activeConfig
+		c.rns = []*runningNetwork{rn}
+
+		// 启动时不收费,不能通过重新加载开始收费
+		write("unlock-fee = \"2\"\npunish-fee = \"9\"\napi-port = 7000\nrate-limit = 5")
+		_, err = c.Reload()
+		ast.NotNil(err)
+		ast.EqualValues(big.NewInt(0), db.Fees().Unlock)
+
+		rn.sources = []smt.PaymentSource{smt.NewReceiptWebhook("127.0.0.1:0", utils.NewRandomAddress(), fees.Token, utils.NewRandomAddress(), db)}
+		changes, err := c.Reload()
+		ast.Nil(err)
+		ast.EqualValues([]string{"rate-limit 0 -> 5", "unlock-fee 0 -> 2"}, changes)
+		ast.EqualValues(big.NewInt(2), db.Fees().Unlock)
+		// 命令行明确指定的参数不会被配置文件覆盖
+		ast.EqualValues(big.NewInt(4), db.Fees().Punish)
+		// 不能重新加载的参数需要重启
+		ast.Equal("6000", ctx.String("api-port"))
+		rate, _ := params.GetRateLimit()
+		ast.EqualValues(5, rate)
+		ast.Equal(1, c.reloads)
+
+		// 有错误时所有修改都不生效
+		write("unlock-fee = \"3\"\nrate-limit-burst = 0")
+		_, err = c.Reload()
+		ast.NotNil(err)
+		ast.EqualValues(big.NewInt(2), db.Fees().Unlock)
+		ast.Equal(1, c.reloads)
+		return nil
+	}
+	err = app.Run([]string{"test", "--config", file, "--punish-fee", "4"})
+	ast.Nil(err)
+}
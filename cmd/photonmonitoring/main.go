@@ -1,30 +1,32 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
 	"fmt"
-	"math/big"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"strings"
 
 	"github.com/SmartMeshFoundation/Photon/accounts"
 
-	"encoding/hex"
 	"os"
 	"os/signal"
 	"path"
-	"path/filepath"
+	"time"
 
 	debug2 "runtime/debug"
 
-	"github.com/SmartMeshFoundation/Photon-Monitoring/chainservice"
 	"github.com/SmartMeshFoundation/Photon-Monitoring/internal/debug"
 	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
 	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
 	restful "github.com/SmartMeshFoundation/Photon-Monitoring/rest"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
 	"github.com/SmartMeshFoundation/Photon-Monitoring/smt"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/network/helper"
-	smparams "github.com/SmartMeshFoundation/Photon/params"
 	"github.com/SmartMeshFoundation/Photon/utils"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -50,6 +52,10 @@ func StartMain() {
 	fmt.Printf("os.args=%q\n", os.Args)
 	app := cli.NewApp()
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "toml config file, keys are the names of these flags. fees, verbosity, alert thresholds and rate limits are reloaded on SIGHUP",
+		},
 		cli.StringFlag{
 			Name:  "address",
 			Usage: "The ethereum address you would like Photon monitoring to use sign transaction on ethereum",
@@ -62,9 +68,42 @@ func StartMain() {
 		cli.StringFlag{
 			Name: "eth-rpc-endpoint",
 			Usage: `"host:port" address of ethereum JSON-RPC server.\n'
-	           'Also accepts a protocol prefix (ws:// or ipc channel) with optional port',`,
+	           'Also accepts a protocol prefix (ws:// or ipc channel) with optional port',
+	           'Comma separated for multiple endpoints with failover',`,
 			Value: node.DefaultIPCEndpoint("geth"),
 		},
+		cli.StringFlag{
+			Name:  "network",
+			Usage: "preset of a known deployment: " + presetNames() + ", explicit flags override the preset",
+		},
+		cli.StringFlag{
+			Name:  "networks",
+			Usage: "json file of networks served by one process, each with a name and flags to override, such as eth-rpc-endpoint and registry-contract-address",
+		},
+		cli.IntFlag{
+			Name:  "eth-rpc-quorum",
+			Usage: "how many endpoints must agree on channel info before accepting a delegation or scheduling actions, 1 to disable",
+			Value: params.EndpointQuorum,
+		},
+		cli.IntFlag{
+			Name:  "stall-timeout",
+			Usage: "seconds without a new processed block before the chain event feed is restarted",
+			Value: int(params.WatchdogMaxSilence / time.Second),
+		},
+		cli.StringFlag{
+			Name:  "alert-url",
+			Usage: "url to POST alerts to, such as a stalled chain event feed, empty to only log them",
+		},
+		cli.Float64Flag{
+			Name:  "rate-limit",
+			Usage: "max requests per second of one client ip to the api, 0 to disable",
+			Value: params.RateLimit,
+		},
+		cli.IntFlag{
+			Name:  "rate-limit-burst",
+			Usage: "max requests of one client ip in a burst",
+			Value: params.RateLimitBurst,
+		},
 		cli.StringFlag{
 			Name:  "registry-contract-address",
 			Usage: `hex encoded address of the registry contract.`,
@@ -75,6 +114,27 @@ func StartMain() {
 			Usage: ` port  for the RPC server to listen on.`,
 			Value: 6000,
 		},
+		cli.StringFlag{
+			Name:  "admin-listen",
+			Usage: "listen address of the admin api, empty to disable it. without admin-token-file or admin-client-ca it only accepts requests from localhost",
+			Value: params.AdminListen,
+		},
+		cli.StringFlag{
+			Name:  "admin-token-file",
+			Usage: "Text file containing the bearer token of the admin api",
+		},
+		cli.StringFlag{
+			Name:  "admin-tls-cert",
+			Usage: "certificate file to serve the admin api over https",
+		},
+		cli.StringFlag{
+			Name:  "admin-tls-key",
+			Usage: "private key file of admin-tls-cert",
+		},
+		cli.StringFlag{
+			Name:  "admin-client-ca",
+			Usage: "require client certificates signed by this ca to access the admin api, needs admin-tls-cert",
+		},
 		cli.StringFlag{
 			Name:  "datadir",
 			Usage: "Directory for storing photon data.",
@@ -114,12 +174,186 @@ func StartMain() {
 			Usage: "query charging fee photon node",
 			Value: params.PhotonURL,
 		},
+		cli.StringFlag{
+			Name:  "fee-node",
+			Usage: "address of the photon node which receives charging fee, published by /info",
+		},
+		cli.StringFlag{
+			Name:  "payment-sources",
+			Usage: "comma separated sources of charging fee: photon,erc20,webhook",
+			Value: "photon",
+		},
+		cli.StringFlag{
+			Name:  "webhook-listen",
+			Usage: "listen address of signed receipt webhook",
+			Value: "127.0.0.1:6001",
+		},
+		cli.StringFlag{
+			Name:  "webhook-signer",
+			Usage: "address of the trusted receipt issuer",
+		},
+		cli.StringFlag{
+			Name:  "payout-method",
+			Usage: "how to refund unused smt: photon or erc20, leave it empty to disable refund",
+		},
+		cli.StringFlag{
+			Name:  "payout-photon-api",
+			Usage: "api address of the photon node which refunds by photon transfer",
+			Value: "http://127.0.0.1:5001",
+		},
+		cli.IntFlag{
+			Name:  "max-unlocks",
+			Usage: "max number of unlocks in one delegate, also limited by settle_timeout/2",
+			Value: params.MaxUnlocksPerDelegate,
+		},
+		cli.BoolFlag{
+			Name:  "economic-guard",
+			Usage: "skip unlocks whose gas cost exceeds the value of the lock instead of only executing them last",
+		},
+		cli.StringFlag{
+			Name:  "gas-price",
+			Usage: "gas price in wei used to estimate the cost of a transaction",
+			Value: params.DefaultGasPrice.String(),
+		},
+		cli.Uint64Flag{
+			Name:  "unlock-gas",
+			Usage: "estimated gas used by one unlock transaction",
+			Value: params.UnlockGasEstimate,
+		},
+		cli.StringFlag{
+			Name:  "smt-per-wei",
+			Usage: "how much smt one wei of gas worth, for example 1 or 1/1000",
+			Value: "1",
+		},
+		cli.StringFlag{
+			Name:  "token-prices",
+			Usage: "comma separated token=smt price of one token unit, for example 0x3af7...=1/2",
+		},
+		cli.IntFlag{
+			Name:  "archive-retention",
+			Usage: "days to keep the history of finished delegates, 0 to keep forever",
+			Value: int(params.ArchiveRetention / (24 * time.Hour)),
+		},
+		cli.IntFlag{
+			Name:  "reconcile-interval",
+			Usage: "minutes between two reconciliations of charging fee, 0 to disable",
+			Value: int(params.ReconcileInterval / time.Minute),
+		},
+		cli.IntFlag{
+			Name:  "shutdown-timeout",
+			Usage: "seconds to wait for in-flight delegate transactions when quit",
+			Value: int(params.ShutdownTimeout / time.Second),
+		},
+		cli.BoolFlag{
+			Name:  "shadow",
+			Usage: "only simulate delegate transactions with eth_call and never broadcast them, to verify a new version against the primary instance",
+		},
+		cli.StringFlag{
+			Name:  "signer",
+			Usage: "url of external signer(http,ws or ipc) which manages the account, the private key is loaded from keystore if empty",
+		},
+		cli.StringFlag{
+			Name:  "db-key",
+			Usage: "encrypt secrets and signatures in database, 'keystore' to derive the key from the account, or path of a passphrase file. empty to store them in plaintext",
+		},
+		cli.StringFlag{
+			Name:  "db-old-keys",
+			Usage: "comma separated db-key used before rotation, only to read old data. run rekey command to re-encrypt them",
+		},
 	}
 	app.Flags = append(app.Flags, debug.Flags...)
 	app.Action = mainCtx
+	app.Commands = []cli.Command{
+		{
+			Name:   "reconcile",
+			Usage:  "reconcile charging fee of every account and report the discrepancies",
+			Action: reconcileCtx,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dbpath",
+					Usage: "path of the Photon monitoring database",
+				},
+				cli.StringFlag{
+					Name:  "photon-url",
+					Usage: "query charging fee photon node, leave it empty to reconcile only with local records",
+				},
+				cli.StringFlag{
+					Name:  "smt",
+					Usage: "smt address",
+					Value: params.SmtAddress.String(),
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "report consistent accounts too",
+				},
+			},
+		},
+		{
+			Name:   "signer",
+			Usage:  "run a signer for Photon monitoring, so the private key is isolated from it",
+			Action: signerCtx,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "address",
+					Usage: "account to sign with",
+				},
+				cli.StringFlag{
+					Name:  "keystore-path",
+					Usage: "If you have a non-standard path for the ethereum keystore directory provide it using this argument. ",
+					Value: params.DefaultKeyStoreDir(),
+				},
+				cli.StringFlag{
+					Name:  "password-file",
+					Usage: "Text file containing password for provided account",
+				},
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "http listen address of the signer, keep it in private network",
+					Value: "127.0.0.1:8550",
+				},
+			},
+		},
+		{
+			Name:   "rekey",
+			Usage:  "re-encrypt secrets and signatures in database with db-key, decrypt old data with db-old-keys",
+			Action: rekeyCtx,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dbpath",
+					Usage: "path of the Photon monitoring database",
+				},
+				cli.StringFlag{
+					Name:  "db-key",
+					Usage: "new key, 'keystore' or path of a passphrase file. empty to decrypt the database",
+				},
+				cli.StringFlag{
+					Name:  "db-old-keys",
+					Usage: "comma separated keys used before, 'keystore' or path of a passphrase file",
+				},
+				cli.StringFlag{
+					Name:  "address",
+					Usage: "account of Photon monitoring, needed if any key is 'keystore'",
+				},
+				cli.StringFlag{
+					Name:  "keystore-path",
+					Usage: "If you have a non-standard path for the ethereum keystore directory provide it using this argument. ",
+					Value: params.DefaultKeyStoreDir(),
+				},
+				cli.StringFlag{
+					Name:  "password-file",
+					Usage: "Text file containing password for provided account",
+				},
+			},
+		},
+	}
+	app.Commands = append(app.Commands, adminCommands...)
+	app.Commands = append(app.Commands, shadowReportCommand)
 	app.Name = "Photonmonitoring"
-	app.Version = "0.5"
+	app.Version = params.Version
 	app.Before = func(ctx *cli.Context) error {
+		if err := loadConfigFile(ctx); err != nil {
+			return err
+		}
 		if err := debug.Setup(ctx); err != nil {
 			return err
 		}
@@ -137,38 +371,12 @@ func StartMain() {
 }
 
 func mainCtx(ctx *cli.Context) error {
-	var err error
 	fmt.Printf("Welcom to Photon monitoring,version %s\n", ctx.App.Version)
-	config(ctx)
+	ncs := config(ctx)
 	//log.Debug(fmt.Sprintf("Config:%s", utils.StringInterface(cfg, 2)))
-	ethEndpoint := ctx.String("eth-rpc-endpoint")
-	client, err := helper.NewSafeClient(ethEndpoint)
-	if err != nil {
-		log.Error(fmt.Sprintf("cannot connect to geth :%s err=%s", ethEndpoint, err))
-		utils.SystemExit(1)
-	}
-	smparams.ChainID, err = client.NetworkID(context.Background())
-	if err != nil {
-		log.Error(fmt.Sprintf("get network id err %s", err))
-		utils.SystemExit(1)
-	}
-	db, err := models.OpenDb(params.DataBasePath)
-	if err != nil {
-		log.Error(fmt.Sprintf("err=%s", err))
-		utils.SystemExit(2)
-	}
-	sq := smt.NewSmtQuery(params.PhotonURL, db, 0)
-	//默认PMS不收费,如果收费再去连接关联的photon节点
-	if params.SmtUpdateTransfer.Cmp(utils.BigInt0) > 0 ||
-		params.SmtPunish.Cmp(utils.BigInt0) > 0 ||
-		params.SmtUnlock.Cmp(utils.BigInt0) > 0 {
-		sq.Start()
-	}
-	ce := chainservice.NewChainEvents(params.PrivKey, client, params.RegistryAddress, db)
-	err = ce.Start()
-	if err != nil {
-		log.Error(fmt.Sprintf("ce start err =%s ", err))
-		utils.SystemExit(3)
+	var rns []*runningNetwork
+	for i, nc := range ncs {
+		rns = append(rns, startNetwork(nc, i == 0))
 	}
 	/*
 		quit handler
@@ -178,33 +386,335 @@ func mainCtx(ctx *cli.Context) error {
 		signal.Notify(quitSignal, os.Interrupt, os.Kill)
 		<-quitSignal
 		signal.Stop(quitSignal)
-		sq.Stop()
-		ce.Stop()
-		db.CloseDB()
+		for _, rn := range rns {
+			rn.stopServices()
+		}
+		log.Info(fmt.Sprintf("waiting at most %s for in-flight delegate executions", params.ShutdownTimeout))
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), params.ShutdownTimeout)
+		for _, rn := range rns {
+			rn.shutdown(shutdownCtx)
+		}
+		cancel()
 		utils.SystemExit(0)
 	}()
-	restful.Start(db, ce)
+	activeConfig.start(rns)
+	var nets []*restful.Network
+	for _, rn := range rns {
+		nets = append(nets, &restful.Network{Network: rn.Network, DB: rn.db, Prices: rn.prices, Verify: rn.ce, Chain: rn.ce})
+	}
+	restful.SetAdmin(activeConfig)
+	restful.Start(nets)
+	return nil
+}
+/*
+reconcileCtx 离线对账,打印对账结果
+*/
+func reconcileCtx(ctx *cli.Context) error {
+	dbPath := ctx.String("dbpath")
+	if !utils.Exists(dbPath) {
+		return fmt.Errorf("database %s doesn't exist", dbPath)
+	}
+	db, err := models.OpenDb(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.CloseDB()
+	rc := smt.NewReconciler(db, common.HexToAddress(ctx.String("smt")), ctx.String("photon-url"), 0)
+	results, err := rc.Reconcile()
+	if err != nil {
+		return err
+	}
+	discrepancies := 0
+	for _, r := range results {
+		if !r.Consistent {
+			discrepancies++
+		}
+		if r.Consistent && !ctx.Bool("all") {
+			continue
+		}
+		fmt.Printf("%s credited=%s recorded=%s recorded_photon=%s node=%s consistent=%v %s\n",
+			r.AddressStr, r.CreditedStr, r.RecordedStr, r.RecordedPhotonStr, r.NodeStr, r.Consistent, r.Reason)
+	}
+	fmt.Printf("%d accounts reconciled, %d discrepancies\n", len(results), discrepancies)
+	return nil
+}
+
+/*
+rekeyCtx 用新密钥重新加密数据库中的密码和签名
+*/
+func rekeyCtx(ctx *cli.Context) error {
+	db, err := openOfflineDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.CloseDB()
+	n, err := db.RekeyDB()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d records re-encrypted\n", n)
 	return nil
 }
-func config(ctx *cli.Context) {
+
+//openOfflineDB 打开dbpath指定的数据库,用db-key和db-old-keys解密
+func openOfflineDB(ctx *cli.Context) (*models.ModelDB, error) {
+	dbPath := ctx.String("dbpath")
+	if !utils.Exists(dbPath) {
+		return nil, fmt.Errorf("database %s doesn't exist", dbPath)
+	}
+	err := setupOfflineDataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return models.OpenDb(dbPath)
+}
+
+//setupOfflineDataKeys 离线命令按db-key和db-old-keys设置数据库密钥,需要时从keystore加载私钥
+func setupOfflineDataKeys(ctx *cli.Context) error {
+	var privKey *ecdsa.PrivateKey
 	var err error
-	params.APIPort = ctx.Int("api-port")
-	address := common.HexToAddress(ctx.String("address"))
-	address, privkeyBin, err := accounts.PromptAccount(address, ctx.String("keystore-path"), ctx.String("password-file"))
+	if strings.Contains(ctx.String("db-key")+","+ctx.String("db-old-keys"), "keystore") {
+		privKey, err = loadKey(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return setupDataKeys(ctx, privKey)
+}
+
+/*
+setupAdmin 管理接口的监听地址和认证方式,
+监听非本机地址时必须配置token或者客户端证书
+*/
+func setupAdmin(ctx *cli.Context) error {
+	params.AdminListen = ctx.String("admin-listen")
+	params.AdminTLSCert = ctx.String("admin-tls-cert")
+	params.AdminTLSKey = ctx.String("admin-tls-key")
+	params.AdminClientCA = ctx.String("admin-client-ca")
+	if params.AdminListen == "" {
+		return nil
+	}
+	if (params.AdminTLSCert == "") != (params.AdminTLSKey == "") {
+		return fmt.Errorf("admin-tls-cert and admin-tls-key must be set together")
+	}
+	if params.AdminClientCA != "" && params.AdminTLSCert == "" {
+		return fmt.Errorf("admin-client-ca needs admin-tls-cert")
+	}
+	if _, err := restful.AdminTLSConfig(); err != nil {
+		return err
+	}
+	if f := ctx.String("admin-token-file"); f != "" {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("read admin-token-file err %s", err)
+		}
+		params.AdminToken = strings.TrimSpace(string(data))
+		if params.AdminToken == "" {
+			return fmt.Errorf("admin-token-file %s is empty", f)
+		}
+	}
+	if params.AdminToken != "" || params.AdminClientCA != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(params.AdminListen)
+	if err != nil {
+		return fmt.Errorf("admin-listen arg err %s", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin api listens on %s, set admin-token-file or admin-client-ca to protect it", params.AdminListen)
+	}
+	return nil
+}
+
+type listenAddr struct {
+	owner string
+	addr  string
+	host  string
+	port  string
+}
+
+/*
+checkListenAddrs 对外api,管理接口以及每个网络的webhook不能监听同一个地址,
+否则后启动的那个监听失败,整个进程退出
+*/
+func checkListenAddrs(ncs []*networkConfig) error {
+	var used []*listenAddr
+	add := func(owner, addr string) error {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("%s arg err %s", owner, err)
+		}
+		for _, u := range used {
+			if u.port == port && (u.host == host || isUnspecifiedHost(u.host) || isUnspecifiedHost(host)) {
+				return fmt.Errorf("%s %s conflicts with %s %s", owner, addr, u.owner, u.addr)
+			}
+		}
+		used = append(used, &listenAddr{owner, addr, host, port})
+		return nil
+	}
+	err := add("api-port", fmt.Sprintf("0.0.0.0:%d", params.APIPort))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	log.Trace(fmt.Sprintf("privkey=%s", common.Bytes2Hex(privkeyBin)))
-	params.Address = address
-	params.PrivKey, err = crypto.ToECDSA(privkeyBin)
+	if params.AdminListen != "" {
+		err = add("admin-listen", params.AdminListen)
+		if err != nil {
+			return err
+		}
+	}
+	for _, nc := range ncs {
+		for _, name := range strings.Split(nc.String("payment-sources"), ",") {
+			if strings.TrimSpace(name) != "webhook" {
+				continue
+			}
+			err = add(fmt.Sprintf("network %s webhook-listen", nc.name), nc.String("webhook-listen"))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isUnspecifiedHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
+
+//loadKey 从keystore中解密address的私钥
+func loadKey(ctx flags) (*ecdsa.PrivateKey, error) {
+	_, privkeyBin, err := accounts.PromptAccount(common.HexToAddress(ctx.String("address")), ctx.String("keystore-path"), ctx.String("password-file"))
 	if err != nil {
-		log.Error("privkey error:", err)
-		utils.SystemExit(1)
+		return nil, err
 	}
-	registAddrStr := ctx.String("registry-contract-address")
-	if len(registAddrStr) > 0 {
-		params.RegistryAddress = common.HexToAddress(registAddrStr)
+	return crypto.ToECDSA(privkeyBin)
+}
+
+/*
+signerCtx 运行签名服务,PMS使用--signer连接它,这样私钥只在签名服务的进程中
+*/
+func signerCtx(ctx *cli.Context) error {
+	key, err := loadKey(ctx)
+	if err != nil {
+		return err
+	}
+	srv, err := signer.NewServer(signer.NewKeystoreSigner(key))
+	if err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("signer for %s listen on %s", crypto.PubkeyToAddress(key.PublicKey).String(), ctx.String("listen")))
+	return http.ListenAndServe(ctx.String("listen"), srv)
+}
+
+/*
+dataKey 根据db-key参数得到数据库密钥:
+空表示不加密,keystore表示从PMS账户私钥派生,其他的是保存口令的文件
+*/
+func dataKey(spec string, privKey *ecdsa.PrivateKey) ([]byte, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "":
+		return nil, nil
+	case "keystore":
+		if privKey == nil {
+			return nil, fmt.Errorf("db key keystore is not available with external signer, use a passphrase file")
+		}
+		return models.DeriveDataKeyFromPrivateKey(privKey), nil
+	}
+	passphrase, err := ioutil.ReadFile(spec)
+	if err != nil {
+		return nil, fmt.Errorf("read db key passphrase file %s err %s", spec, err)
+	}
+	passphrase = bytes.TrimSpace(passphrase)
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("db key passphrase file %s is empty", spec)
+	}
+	return models.DeriveDataKeyFromPassphrase(passphrase)
+}
+
+//setupDataKeys 设置db-key和db-old-keys,必须在打开数据库之前调用
+func setupDataKeys(ctx *cli.Context, privKey *ecdsa.PrivateKey) error {
+	current, err := dataKey(ctx.String("db-key"), privKey)
+	if err != nil {
+		return err
+	}
+	var olds [][]byte
+	if ctx.String("db-old-keys") != "" {
+		for _, spec := range strings.Split(ctx.String("db-old-keys"), ",") {
+			old, err := dataKey(spec, privKey)
+			if err != nil {
+				return err
+			}
+			if old != nil {
+				olds = append(olds, old)
+			}
+		}
+	}
+	return models.SetDataKeys(current, olds...)
+}
+
+/*
+payoutSender 根据payout-method参数创建退款渠道
+*/
+func payoutSender(ctx flags, client *helper.SafeEthClient, n *params.Network) smt.PayoutSender {
+	switch params.PayoutMethod {
+	case "photon":
+		return smt.NewPhotonPayoutSender(ctx.String("payout-photon-api"), n.Fees.Token)
+	case "erc20":
+		sender, err := smt.NewERC20PayoutSender(client, signer.NewTransactor(n.Signer), n.Fees.Token)
+		if err != nil {
+			log.Error(fmt.Sprintf("create erc20 payout sender err %s", err))
+			utils.SystemExit(1)
+		}
+		return sender
 	}
+	log.Error(fmt.Sprintf("unknown payout method %s", params.PayoutMethod))
+	utils.SystemExit(1)
+	return nil
+}
+
+/*
+paymentSources 根据payment-sources参数创建收费渠道
+*/
+func paymentSources(ctx flags, client *helper.SafeEthClient, n *params.Network, db *models.ModelDB) (sources []smt.PaymentSource) {
+	for _, name := range strings.Split(ctx.String("payment-sources"), ",") {
+		switch strings.TrimSpace(name) {
+		case "photon":
+			sources = append(sources, smt.NewSmtQuery(ctx.String("photon-url"), n.Fees.Token, db))
+		case "erc20":
+			sources = append(sources, smt.NewTransferWatcher(client, n.Fees.Token, n.Address(), db))
+		case "webhook":
+			signer := ctx.String("webhook-signer")
+			if !common.IsHexAddress(signer) {
+				log.Error(fmt.Sprintf("webhook-signer must be a valid address, got %s", signer))
+				utils.SystemExit(1)
+			}
+			sources = append(sources, smt.NewReceiptWebhook(ctx.String("webhook-listen"), common.HexToAddress(signer), n.Fees.Token, n.Address(), db))
+		default:
+			log.Error(fmt.Sprintf("unknown payment source %s", name))
+			utils.SystemExit(1)
+		}
+	}
+	return
+}
+/*
+config 设置全局参数以及每个网络的账户,数据库和收费配置,
+第一个网络的配置同时作为params中的全局配置
+*/
+func config(ctx *cli.Context) []*networkConfig {
+	// 必须在应用--network预设之前记录,预设填充的参数不算明确指定
+	explicit := make(map[string]bool)
+	for name := range flagNames(ctx) {
+		if ctx.IsSet(name) {
+			explicit[name] = true
+		}
+	}
+	preset, err := applyPreset(ctx)
+	if err != nil {
+		log.Error(err.Error())
+		utils.SystemExit(1)
+	}
+	params.APIPort = ctx.Int("api-port")
 	dataDir := ctx.String("datadir")
 	if len(dataDir) == 0 {
 		dataDir = path.Join(utils.GetHomePath(), ".Photonmonitoring")
@@ -217,53 +727,76 @@ func config(ctx *cli.Context) {
 			utils.SystemExit(1)
 		}
 	}
-	userDbPath := hex.EncodeToString(params.Address[:])
-	userDbPath = userDbPath[:8]
-	userDbPath = filepath.Join(params.DataDir, userDbPath)
-	log.Trace(fmt.Sprintf("dbpath=%s", userDbPath))
-	if !utils.Exists(userDbPath) {
-		err = os.MkdirAll(userDbPath, os.ModePerm)
+	ncs, err := loadNetworkConfigs(ctx, preset, explicit)
+	if err != nil {
+		log.Error(err.Error())
+		utils.SystemExit(1)
+	}
+	for _, nc := range ncs {
+		err = setupNetwork(nc)
 		if err != nil {
-			log.Error(fmt.Sprintf("Datadir:%s doesn't exist and cannot create %v", userDbPath, err))
+			log.Error(fmt.Sprintf("network %s: %s", nc.name, err))
+			utils.SystemExit(1)
+		}
+		url := nc.String("photon-url")
+		if len(url) <= 0 || strings.Index(url, "http://") != 0 {
+			log.Error(fmt.Sprintf("network %s: photon-url must be a valid url path,for example %s", nc.name, params.PhotonURL))
 			utils.SystemExit(1)
 		}
 	}
-	databasePath := filepath.Join(userDbPath, "log.db")
-	params.DataBasePath = databasePath
-	params.SmtAddress = common.HexToAddress(ctx.String("smt"))
-	bi, b := new(big.Int).SetString(ctx.String("unlock-fee"), 10)
-	if !b {
-		log.Error(fmt.Sprintf("unlock-fee arg err %s", ctx.String("unlock-fee")))
+	// 所有网络使用同一个数据库密钥,keystore方式从第一个网络的账户派生
+	err = setupDataKeys(ctx, ncs[0].privKey)
+	if err != nil {
+		log.Error(fmt.Sprintf("db key err %s", err))
 		utils.SystemExit(1)
 	}
-	params.SmtUnlock = bi
-	bi, b = new(big.Int).SetString(ctx.String("punish-fee"), 10)
-	if !b {
-		log.Error(fmt.Sprintf("punish-fee arg err %s", ctx.String("punish-fee")))
+	first := ncs[0].network
+	params.Signer = first.Signer
+	params.Address = first.Address()
+	params.RegistryAddress = first.RegistryAddress
+	params.DataBasePath = first.DataBasePath
+	params.SmtAddress = first.Fees.Token
+	params.SmtUnlock = first.Fees.Unlock
+	params.SmtPunish = first.Fees.Punish
+	params.SmtUpdateTransfer = first.Fees.UpdateTransfer
+	params.SmtSecret = first.Fees.Secret
+	params.PhotonURL = ncs[0].String("photon-url")
+	params.ShutdownTimeout = time.Duration(ctx.Int("shutdown-timeout")) * time.Second
+	params.PayoutMethod = ctx.String("payout-method")
+	params.ShadowMode = ctx.Bool("shadow")
+	if params.ShadowMode {
+		// 影子实例不能动用运营方的资金
+		log.Warn("shadow mode: delegate transactions are simulated only, payouts are disabled")
+		params.PayoutMethod = ""
+	}
+	params.ReconcileInterval = time.Duration(ctx.Int("reconcile-interval")) * time.Minute
+	params.ArchiveRetention = time.Duration(ctx.Int("archive-retention")) * 24 * time.Hour
+	params.MaxUnlocksPerDelegate = ctx.Int("max-unlocks")
+	params.EndpointQuorum = ctx.Int("eth-rpc-quorum")
+	err = setupAdmin(ctx)
+	if err != nil {
+		log.Error(err.Error())
 		utils.SystemExit(1)
 	}
-	params.SmtPunish = bi
-	bi, b = new(big.Int).SetString(ctx.String("update-transfer-fee"), 10)
-	if !b {
-		log.Error(fmt.Sprintf("update-transfer-fee arg err %s", ctx.String("update-transfer-fee")))
+	err = checkListenAddrs(ncs)
+	if err != nil {
+		log.Error(err.Error())
 		utils.SystemExit(1)
 	}
-	params.SmtUpdateTransfer = bi
-	bi, b = new(big.Int).SetString(ctx.String("secret-register-fee"), 10)
-	if !b {
-		log.Error(fmt.Sprintf("secret-register-fee arg err %s", ctx.String("secret-register-fee")))
+	r, err := parseReloadable(ctx)
+	if err != nil {
+		log.Error(err.Error())
 		utils.SystemExit(1)
 	}
-	params.SmtSecret = bi
-	log.Info(fmt.Sprintf("unlock_fee=%s,punish_fee=%s,updatetransfer_fee=%s,secertregister_fee=%s smtaddress=%s",
-		params.SmtUnlock, params.SmtPunish, params.SmtUpdateTransfer, params.SmtSecret, params.SmtAddress.String(),
-	))
-	url := ctx.String("photon-url")
-	if len(url) <= 0 || strings.Index(url, "http://") != 0 {
-		log.Error(fmt.Sprintf("photon-url must be a valid url path,for example %s", params.PhotonURL))
+	// 日志参数已经由debug.Setup设置
+	err = r.apply(false)
+	if err != nil {
+		log.Error(err.Error())
 		utils.SystemExit(1)
 	}
-	params.PhotonURL = url
+	params.EconomicGuard = ctx.Bool("economic-guard")
+	params.UnlockGasEstimate = ctx.Uint64("unlock-gas")
 	//调试状态,不检测balanceProof中的nonce新旧,直接覆盖
 	params.DebugMode = ctx.Bool("debug")
+	return ncs
 }
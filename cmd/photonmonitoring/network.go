@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/chainservice"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/smt"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/network/helper"
+	smparams "github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//flags 命令行参数,或者某个网络覆盖以后的参数
+type flags interface {
+	String(name string) string
+}
+
+//networkFlags 可以在--networks文件中按网络覆盖的参数
+var networkFlags = []string{
+	"eth-rpc-endpoint", "registry-contract-address",
+	"address", "keystore-path", "password-file", "signer",
+	"smt", "unlock-fee", "punish-fee", "update-transfer-fee", "secret-register-fee",
+	"photon-url", "fee-node", "payment-sources", "webhook-listen", "webhook-signer", "payout-photon-api",
+	"gas-price", "smt-per-wei", "token-prices",
+}
+
+var networkNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+/*
+networkConfig 一个网络的配置.--networks文件是一个json数组,每一项是网络名字和要覆盖的命令行参数,比如
+```json
+[
+  {"name": "mainnet", "eth-rpc-endpoint": "http://127.0.0.1:17888", "registry-contract-address": "0x...", "smt": "0x..."},
+  {"name": "testnet", "eth-rpc-endpoint": "http://127.0.0.1:27888", "registry-contract-address": "0x...", "webhook-listen": "127.0.0.1:6002"}
+]
+```
+每一项也可以用network指定预设,优先级从高到低是这一项中明确配置的值,命令行和配置文件中明确指定的参数,
+这一项的预设,--network预设以及默认值.没有--networks时只有一个名为default的网络,完全使用命令行参数.
+*/
+type networkConfig struct {
+	name    string
+	values  map[string]string
+	ctx     *cli.Context
+	network *params.Network
+	privKey *ecdsa.PrivateKey // 只有keystore方式才有私钥
+	preset  *networkPreset    // 启动时检查连接的公链是否和预设一致
+}
+
+//String returns the overridden value of flag name or the command line value
+func (nc *networkConfig) String(name string) string {
+	if v, ok := nc.values[name]; ok {
+		return v
+	}
+	return nc.ctx.String(name)
+}
+
+/*
+loadNetworkConfigs 读取--networks文件,preset是命令行--network指定的预设,
+explicit是命令行和配置文件中明确指定的参数,每一项的预设不能覆盖它们
+*/
+func loadNetworkConfigs(ctx *cli.Context, preset *networkPreset, explicit map[string]bool) ([]*networkConfig, error) {
+	file := ctx.String("networks")
+	if file == "" {
+		return []*networkConfig{{name: params.DefaultNetworkName, ctx: ctx, preset: preset}}, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read networks file %s err %s", file, err)
+	}
+	var items []map[string]string
+	err = json.Unmarshal(data, &items)
+	if err != nil {
+		return nil, fmt.Errorf("networks file %s err %s", file, err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no network in %s", file)
+	}
+	allowed := make(map[string]bool)
+	for _, f := range networkFlags {
+		allowed[f] = true
+	}
+	var ncs []*networkConfig
+	names := make(map[string]bool)
+	for _, item := range items {
+		nc := &networkConfig{name: item["name"], values: make(map[string]string), ctx: ctx, preset: preset}
+		if !networkNameRegexp.MatchString(nc.name) {
+			return nil, fmt.Errorf("invalid network name '%s'", nc.name)
+		}
+		if names[nc.name] {
+			return nil, fmt.Errorf("duplicate network %s", nc.name)
+		}
+		names[nc.name] = true
+		for k, v := range item {
+			if k == "name" || k == "network" {
+				continue
+			}
+			if !allowed[k] {
+				return nil, fmt.Errorf("network %s: %s cannot be configured per network", nc.name, k)
+			}
+			nc.values[k] = v
+		}
+		if name, ok := item["network"]; ok {
+			nc.preset, err = getPreset(name)
+			if err != nil {
+				return nil, fmt.Errorf("network %s: %s", nc.name, err)
+			}
+			for k, v := range nc.preset.flags {
+				if _, ok := nc.values[k]; !ok && allowed[k] && !explicit[k] {
+					nc.values[k] = v
+				}
+			}
+		}
+		ncs = append(ncs, nc)
+	}
+	return ncs, nil
+}
+
+//setupNetwork 创建网络的签名账户,确定数据库路径和收费配置
+func setupNetwork(nc *networkConfig) (err error) {
+	n := &params.Network{Name: nc.name}
+	address := common.HexToAddress(nc.String("address"))
+	if endpoint := nc.String("signer"); endpoint != "" {
+		if address == utils.EmptyAddress {
+			return fmt.Errorf("address is required when using external signer")
+		}
+		n.Signer, err = signer.NewExternalSigner(endpoint, address)
+		if err != nil {
+			return fmt.Errorf("external signer err %s", err)
+		}
+	} else {
+		nc.privKey, err = loadKey(nc)
+		if err != nil {
+			return fmt.Errorf("load key err %s", err)
+		}
+		n.Signer = signer.NewKeystoreSigner(nc.privKey)
+	}
+	n.RegistryAddress = params.RegistryAddress
+	if registAddrStr := nc.String("registry-contract-address"); len(registAddrStr) > 0 {
+		n.RegistryAddress = common.HexToAddress(registAddrStr)
+	}
+	n.Fees, err = parseFees(nc)
+	if err != nil {
+		return
+	}
+	if feeNode := nc.String("fee-node"); feeNode != "" {
+		if !common.IsHexAddress(feeNode) {
+			return fmt.Errorf("fee-node arg err %s", feeNode)
+		}
+		n.FeeNode = common.HexToAddress(feeNode)
+	}
+	n.GasPrice, n.SmtPerWei, n.TokenPrices, err = parsePrices(nc)
+	if err != nil {
+		return
+	}
+	n.RevealTimeout = params.RevealTimeout
+	n.MaxUnlocks = nc.ctx.Int("max-unlocks")
+	// 没有--networks时保持原来的数据库路径,否则放在以网络名字命名的目录下
+	dir := params.DataDir
+	if nc.ctx.String("networks") != "" {
+		dir = filepath.Join(dir, nc.name)
+	}
+	userDbPath := hex.EncodeToString(n.Address().Bytes())[:8]
+	userDbPath = filepath.Join(dir, userDbPath)
+	log.Trace(fmt.Sprintf("network %s dbpath=%s", n.Name, userDbPath))
+	if !utils.Exists(userDbPath) {
+		err = os.MkdirAll(userDbPath, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("Datadir:%s doesn't exist and cannot create %v", userDbPath, err)
+		}
+	}
+	n.DataBasePath = filepath.Join(userDbPath, "log.db")
+	log.Info(fmt.Sprintf("network %s: address=%s registry=%s unlock_fee=%s,punish_fee=%s,updatetransfer_fee=%s,secertregister_fee=%s smtaddress=%s",
+		n.Name, n.Address().String(), n.RegistryAddress.String(),
+		n.Fees.Unlock, n.Fees.Punish, n.Fees.UpdateTransfer, n.Fees.Secret, n.Fees.Token.String(),
+	))
+	nc.network = n
+	return
+}
+
+func parseFees(f flags) (fees *params.Fees, err error) {
+	fees = &params.Fees{
+		Token: common.HexToAddress(f.String("smt")),
+	}
+	for _, fee := range []struct {
+		name string
+		v    **big.Int
+	}{
+		{"unlock-fee", &fees.Unlock},
+		{"punish-fee", &fees.Punish},
+		{"update-transfer-fee", &fees.UpdateTransfer},
+		{"secret-register-fee", &fees.Secret},
+	} {
+		bi, b := new(big.Int).SetString(f.String(fee.name), 10)
+		if !b {
+			return nil, fmt.Errorf("%s arg err %s", fee.name, f.String(fee.name))
+		}
+		*fee.v = bi
+	}
+	return
+}
+
+//parsePrices 判断unlock是否划算使用的gas和token价格
+func parsePrices(f flags) (gasPrice *big.Int, smtPerWei *big.Rat, prices map[common.Address]*big.Rat, err error) {
+	gasPrice, b := new(big.Int).SetString(f.String("gas-price"), 10)
+	if !b {
+		return nil, nil, nil, fmt.Errorf("gas-price arg err %s", f.String("gas-price"))
+	}
+	smtPerWei, b = new(big.Rat).SetString(f.String("smt-per-wei"))
+	if !b {
+		return nil, nil, nil, fmt.Errorf("smt-per-wei arg err %s", f.String("smt-per-wei"))
+	}
+	prices = make(map[common.Address]*big.Rat)
+	if f.String("token-prices") == "" {
+		return
+	}
+	for _, tp := range strings.Split(f.String("token-prices"), ",") {
+		ss := strings.Split(strings.TrimSpace(tp), "=")
+		if len(ss) != 2 || !common.IsHexAddress(ss[0]) {
+			return nil, nil, nil, fmt.Errorf("token-prices arg err %s", tp)
+		}
+		price, b := new(big.Rat).SetString(ss[1])
+		if !b {
+			return nil, nil, nil, fmt.Errorf("token-prices arg err %s", tp)
+		}
+		prices[common.HexToAddress(ss[0])] = price
+	}
+	return
+}
+
+//runningNetwork 一个网络运行时的所有组件
+type runningNetwork struct {
+	*params.Network
+	nc      *networkConfig
+	pool    *chainservice.EndpointPool
+	db      *models.ModelDB
+	prices  models.PriceFeed
+	sources []smt.PaymentSource
+	rc      *smt.Reconciler
+	pw      *smt.PayoutWorker
+	ce      *chainservice.ChainEvents
+}
+
+/*
+startNetwork 连接网络的公链节点,打开数据库并启动收费,退款以及链上事件处理.
+Photon库中的params.ChainID是全局的,使用第一个网络的ChainID.
+*/
+func startNetwork(nc *networkConfig, first bool) *runningNetwork {
+	var err error
+	n := nc.network
+	rn := &runningNetwork{Network: n, nc: nc}
+	ethEndpoint := nc.String("eth-rpc-endpoint")
+	if urls := strings.Split(ethEndpoint, ","); len(urls) > 1 || params.EndpointQuorum > 1 {
+		if params.EndpointQuorum > len(urls) {
+			log.Error(fmt.Sprintf("network %s: eth-rpc-quorum %d is more than %d endpoints", n.Name, params.EndpointQuorum, len(urls)))
+			utils.SystemExit(1)
+		}
+		rn.pool, err = chainservice.NewEndpointPool(urls)
+		if err != nil {
+			log.Error(fmt.Sprintf("network %s: cannot connect to geth :%s err=%s", n.Name, ethEndpoint, err))
+			utils.SystemExit(1)
+		}
+		// 所有组件都连接本地代理,由代理负责切换节点
+		ethEndpoint, err = rn.pool.Start()
+		if err != nil {
+			log.Error(fmt.Sprintf("network %s: start eth rpc proxy err %s", n.Name, err))
+			utils.SystemExit(1)
+		}
+	}
+	client, err := helper.NewSafeClient(ethEndpoint)
+	if err != nil {
+		log.Error(fmt.Sprintf("network %s: cannot connect to geth :%s err=%s", n.Name, ethEndpoint, err))
+		utils.SystemExit(1)
+	}
+	n.ChainID, err = client.NetworkID(context.Background())
+	if err != nil {
+		log.Error(fmt.Sprintf("network %s: get network id err %s", n.Name, err))
+		utils.SystemExit(1)
+	}
+	if nc.preset != nil {
+		err = checkChainID(nc.preset, client, n.ChainID)
+		if err != nil {
+			log.Error(fmt.Sprintf("network %s: %s", n.Name, err))
+			utils.SystemExit(1)
+		}
+	}
+	if first {
+		smparams.ChainID = n.ChainID
+	}
+	rn.db, err = models.OpenDb(n.DataBasePath)
+	if err != nil {
+		log.Error(fmt.Sprintf("err=%s", err))
+		utils.SystemExit(2)
+	}
+	rn.db.SetFees(n.Fees)
+	//默认PMS不收费,如果收费再去启动收费渠道
+	if !n.Fees.IsFree() {
+		rn.sources = paymentSources(nc, client, n, rn.db)
+		for _, s := range rn.sources {
+			err = s.Start()
+			if err != nil {
+				log.Error(fmt.Sprintf("network %s: start payment source %s err %s", n.Name, s.Name(), err))
+				utils.SystemExit(3)
+			}
+		}
+	}
+	if len(rn.sources) > 0 && params.ReconcileInterval > 0 {
+		photonURL := ""
+		if strings.Contains(nc.String("payment-sources"), "photon") {
+			photonURL = nc.String("photon-url")
+		}
+		rn.rc = smt.NewReconciler(rn.db, n.Fees.Token, photonURL, params.ReconcileInterval)
+		rn.rc.Start()
+	}
+	if len(params.PayoutMethod) > 0 {
+		rn.pw = smt.NewPayoutWorker(rn.db, payoutSender(nc, client, n))
+		err = rn.pw.Start()
+		if err != nil {
+			log.Error(fmt.Sprintf("network %s: start payout worker err %s", n.Name, err))
+			utils.SystemExit(3)
+		}
+	}
+	rn.prices = models.NewStaticPriceFeed(n)
+	rn.ce = chainservice.NewChainEvents(n, client, rn.db, rn.prices)
+	if rn.pool != nil {
+		rn.ce.SetEndpointPool(rn.pool)
+	}
+	err = rn.ce.Start()
+	if err != nil {
+		log.Error(fmt.Sprintf("network %s: ce start err =%s ", n.Name, err))
+		utils.SystemExit(3)
+	}
+	return rn
+}
+
+//stopServices 停止收费,对账以及退款
+func (rn *runningNetwork) stopServices() {
+	for _, s := range rn.sources {
+		s.Stop()
+	}
+	if rn.rc != nil {
+		rn.rc.Stop()
+	}
+	if rn.pw != nil {
+		rn.pw.Stop()
+	}
+}
+
+//shutdown 等待正在执行的委托结束,然后关闭数据库
+func (rn *runningNetwork) shutdown(ctx context.Context) {
+	err := rn.ce.Shutdown(ctx)
+	if err != nil {
+		log.Error(fmt.Sprintf("network %s: %s, unfinished delegates will be reconciled on next start", rn.Name, err))
+	}
+	if rn.pool != nil {
+		rn.pool.Stop()
+	}
+	rn.db.CloseDB()
+}
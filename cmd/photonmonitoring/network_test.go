@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func newTestContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, name := range append(networkFlags, "networks") {
+		set.String(name, "", "")
+	}
+	err := set.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestLoadNetworkConfigsPresetOrder(t *testing.T) {
+	ast := assert.New(t)
+	dir, err := ioutil.TempDir("", "networks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "networks.json")
+	err = ioutil.WriteFile(file, []byte(`[
+  {"name": "testnet", "network": "spectrum-testnet", "unlock-fee": "5"}
+]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newTestContext(t, "--networks", file, "--smt", "0x292650fee408320D888e06ed89D938294Ea42f99", "--unlock-fee", "7")
+	ncs, err := loadNetworkConfigs(ctx, nil, map[string]bool{"smt": true, "unlock-fee": true, "networks": true})
+	ast.Nil(err)
+	ast.EqualValues(1, len(ncs))
+	nc := ncs[0]
+	// 这一项明确配置的值最优先
+	ast.Equal("5", nc.String("unlock-fee"))
+	// 命令行明确指定的参数优先于这一项的预设
+	ast.Equal("0x292650fee408320D888e06ed89D938294Ea42f99", nc.String("smt"))
+	// 没有明确指定的参数使用预设
+	ast.Equal(networkPresets["spectrum-testnet"].flags["fee-node"], nc.String("fee-node"))
+	ast.Equal(networkPresets["spectrum-testnet"].flags["punish-fee"], nc.String("punish-fee"))
+}
+
+func TestCheckListenAddrs(t *testing.T) {
+	ast := assert.New(t)
+	oldPort, oldAdmin := params.APIPort, params.AdminListen
+	defer func() {
+		params.APIPort, params.AdminListen = oldPort, oldAdmin
+	}()
+	params.APIPort = 6000
+	webhook := func(name, listen string) *networkConfig {
+		return &networkConfig{
+			name:   name,
+			values: map[string]string{"payment-sources": "photon,webhook", "webhook-listen": listen},
+			ctx:    newTestContext(t),
+		}
+	}
+	// 默认的管理接口和webhook地址不冲突
+	params.AdminListen = "127.0.0.1:6003"
+	ast.Nil(checkListenAddrs([]*networkConfig{webhook("a", "127.0.0.1:6001"), webhook("b", "127.0.0.1:6002")}))
+	ast.NotNil(checkListenAddrs([]*networkConfig{webhook("a", "127.0.0.1:6003")}))
+	ast.NotNil(checkListenAddrs([]*networkConfig{webhook("a", "127.0.0.1:6001"), webhook("b", "127.0.0.1:6001")}))
+	// api监听所有地址
+	ast.NotNil(checkListenAddrs([]*networkConfig{webhook("a", "127.0.0.1:6000")}))
+	// 没有使用webhook收费时不监听
+	nc := webhook("a", "127.0.0.1:6003")
+	nc.values["payment-sources"] = "photon"
+	ast.Nil(checkListenAddrs([]*networkConfig{nc}))
+	params.AdminListen = ""
+	ast.Nil(checkListenAddrs([]*networkConfig{webhook("a", "127.0.0.1:6003")}))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/SmartMeshFoundation/Photon/network/helper"
+	smparams "github.com/SmartMeshFoundation/Photon/params"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//networkPreset 已知部署的默认参数,和README以及公告中的一致
+type networkPreset struct {
+	chainID int64
+	flags   map[string]string
+}
+
+var networkPresets = map[string]*networkPreset{
+	"spectrum-mainnet": {
+		chainID: 20180430,
+		flags: map[string]string{
+			"registry-contract-address": "0x28233F8e0f8Bd049382077c6eC78bE9c2915c7D4",
+			"smt":                       "0x6fdb6b4deb71c4D9AFbA4350e2e9D6CfD534F1cb",
+			"fee-node":                  "0xa94399b93da31e25ab5612de8c64556694d5f2fd",
+			"api-port":                  "7003",
+			"update-transfer-fee":       "3",
+			"unlock-fee":                "1",
+			"punish-fee":                "2",
+			"secret-register-fee":       "1",
+		},
+	},
+	"spectrum-testnet": {
+		chainID: 3,
+		flags: map[string]string{
+			"registry-contract-address": "0xa2150A4647908ab8D0135F1c4BFBB723495e8d12",
+			"smt":                       "0x048257d9F5e671412E46f2Ff4B5F7AFDb7059A86",
+			"fee-node":                  "0xaed9188842c05e07bf5abdde2fb400432ae49d28",
+			"api-port":                  "7004",
+			"update-transfer-fee":       "3",
+			"unlock-fee":                "1",
+			"punish-fee":                "2",
+			"secret-register-fee":       "1",
+		},
+	},
+	"local": {
+		chainID: smparams.TestPrivateChainID,
+		flags: map[string]string{
+			"registry-contract-address": "0x4dc3388E72e45E99061Ec4Fe17Db2ebfe3B4341f",
+			"smt":                       "0xc0dfdD7821c762eF38F86225BD45ff4e912fFA20",
+			"fee-node":                  "0x69c5621db8093ee9a26cc2e253f929316e6e5b92",
+			"api-port":                  "6000",
+		},
+	},
+}
+
+func presetNames() string {
+	var names []string
+	for name := range networkPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func getPreset(name string) (*networkPreset, error) {
+	p, ok := networkPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown network preset %s, available: %s", name, presetNames())
+	}
+	return p, nil
+}
+
+//applyPreset 用--network预设填充没有明确指定的命令行参数,明确指定的参数优先
+func applyPreset(ctx *cli.Context) (*networkPreset, error) {
+	name := ctx.String("network")
+	if name == "" {
+		return nil, nil
+	}
+	p, err := getPreset(name)
+	if err != nil {
+		return nil, err
+	}
+	var unset []string
+	for k := range p.flags {
+		if !ctx.IsSet(k) {
+			unset = append(unset, k)
+		}
+	}
+	for _, k := range unset {
+		err = ctx.Set(k, p.flags[k])
+		if err != nil {
+			return nil, fmt.Errorf("preset %s set %s err %s", name, k, err)
+		}
+	}
+	return p, nil
+}
+
+/*
+checkChainID 连接的公链必须和预设一致,避免用主网的配置连上了测试网.
+和bind中的处理一致,spectrum主网通过第1块的hash识别.
+*/
+func checkChainID(p *networkPreset, client *helper.SafeEthClient, networkID *big.Int) error {
+	chainID := networkID
+	h, err := client.HeaderByNumber(context.Background(), big.NewInt(1))
+	if err == nil && h != nil && h.Hash() == smparams.MainNetGenesisBlockHash {
+		chainID = big.NewInt(20180430)
+	}
+	if chainID.Int64() != p.chainID {
+		return fmt.Errorf("connected to chain %s, but the preset expects chain %d", chainID, p.chainID)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//bulletinFlags 公告表格中的参数对应的命令行参数
+var bulletinFlags = map[string]string{
+	"合约地址":                 "registry-contract-address",
+	"PMS'端口":               "api-port",
+	"收费节点地址":               "fee-node",
+	"收费token":              "smt",
+	"ContractAddress":      "registry-contract-address",
+	"Port":                 "api-port",
+	"DelegatedChargeNode":  "fee-node",
+	"DelegatedChargeToken": "smt",
+}
+
+//parseBulletin 按网络读取公告中的参数表格
+func parseBulletin(t *testing.T, file string) map[string]map[string]string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks := make(map[string]map[string]string)
+	var current map[string]string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			current = nil
+			name := ""
+			switch {
+			case strings.Contains(line, "测试网") || strings.Contains(line, "Test network"):
+				name = "spectrum-testnet"
+			case strings.Contains(line, "主网") || strings.Contains(line, "Main network"):
+				name = "spectrum-mainnet"
+			}
+			if name != "" {
+				current = make(map[string]string)
+				networks[name] = current
+			}
+			continue
+		}
+		ss := strings.Split(line, "|")
+		if current == nil || len(ss) != 2 {
+			continue
+		}
+		if flag, ok := bulletinFlags[strings.TrimSpace(ss[0])]; ok {
+			current[flag] = strings.TrimSpace(ss[1])
+		}
+	}
+	return networks
+}
+
+func TestNetworkPresetsMatchBulletin(t *testing.T) {
+	ast := assert.New(t)
+	for _, file := range []string{"../../docs/zh_pms_online_bulletin.md", "../../docs/en_pms_online_bulletin.md"} {
+		networks := parseBulletin(t, file)
+		ast.EqualValues(2, len(networks), file)
+		for name, flags := range networks {
+			p := networkPresets[name]
+			if !ast.NotNil(p, name) {
+				continue
+			}
+			ast.EqualValues(len(bulletinFlags)/2, len(flags), "%s %s", file, name)
+			for k, v := range flags {
+				ast.True(strings.EqualFold(v, p.flags[k]), "%s %s %s: bulletin=%s preset=%s", file, name, k, v, p.flags[k])
+			}
+		}
+	}
+}
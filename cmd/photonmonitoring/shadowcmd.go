@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"gopkg.in/urfave/cli.v1"
+)
+
+/*
+升级前用--shadow运行新版本,它从主实例数据库的拷贝启动,接收同样的委托,
+只用eth_call模拟执行.运行一段时间以后用shadow-report比较两个实例的执行记录,
+没有差异再切换到新版本
+*/
+var shadowReportCommand = cli.Command{
+	Name:   "shadow-report",
+	Usage:  "compare execute records of a shadow instance with the primary instance and report where they behave differently",
+	Action: shadowReportCtx,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "primary-db",
+			Usage: "path of the primary Photon monitoring database",
+		},
+		cli.StringFlag{
+			Name:  "shadow-db",
+			Usage: "path of the shadow Photon monitoring database",
+		},
+		cli.Int64Flag{
+			Name:  "since",
+			Usage: "unix timestamp, only compare records executed after it. default is one minute before the first simulated record",
+		},
+		cli.Int64Flag{
+			Name:  "until",
+			Usage: "unix timestamp, only compare records executed before it. default is one minute after the last simulated record",
+		},
+		cli.StringFlag{
+			Name:  "db-key",
+			Usage: "key to decrypt both databases, 'keystore' or path of a passphrase file",
+		},
+		cli.StringFlag{
+			Name:  "db-old-keys",
+			Usage: "comma separated keys used before rotation, 'keystore' or path of a passphrase file",
+		},
+		cli.StringFlag{
+			Name:  "address",
+			Usage: "account of Photon monitoring, needed if any key is 'keystore'",
+		},
+		cli.StringFlag{
+			Name:  "keystore-path",
+			Usage: "If you have a non-standard path for the ethereum keystore directory provide it using this argument. ",
+			Value: params.DefaultKeyStoreDir(),
+		},
+		cli.StringFlag{
+			Name:  "password-file",
+			Usage: "Text file containing password for provided account",
+		},
+	},
+}
+
+//shadowReportSlack 默认比较范围在模拟记录前后放宽的秒数
+const shadowReportSlack = 60
+
+func shadowReportCtx(ctx *cli.Context) error {
+	primaryPath, shadowPath := ctx.String("primary-db"), ctx.String("shadow-db")
+	for _, p := range []string{primaryPath, shadowPath} {
+		if !utils.Exists(p) {
+			return fmt.Errorf("database %s doesn't exist", p)
+		}
+	}
+	err := setupOfflineDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+	primary, err := models.OpenDb(primaryPath)
+	if err != nil {
+		return err
+	}
+	defer primary.CloseDB()
+	shadow, err := models.OpenDb(shadowPath)
+	if err != nil {
+		return err
+	}
+	defer shadow.CloseDB()
+	since, until, err := shadow.GetSimulatedRange()
+	if err != nil {
+		return err
+	}
+	if since == 0 && !ctx.IsSet("since") {
+		return fmt.Errorf("no simulated records in %s, is it running with --shadow?", shadowPath)
+	}
+	// 两个实例处理同一个块的时间有先后,默认范围放宽一些
+	since, until = since-shadowReportSlack, until+shadowReportSlack
+	if ctx.IsSet("since") {
+		since = ctx.Int64("since")
+	}
+	if ctx.IsSet("until") {
+		until = ctx.Int64("until")
+	}
+	prs, err := primary.GetExecuteRecordsBetween(since, until, false)
+	if err != nil {
+		return err
+	}
+	srs, err := shadow.GetExecuteRecordsBetween(since, until, true)
+	if err != nil {
+		return err
+	}
+	report, err := models.CompareExecuteRecords(prs, srs)
+	if err != nil {
+		return err
+	}
+	report.Since, report.Until = since, until
+	err = printJSON(report)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d operations matched, %d differences\n", report.Matched, len(report.Diffs))
+	return nil
+}
@@ -1,5 +1,7 @@
 module github.com/SmartMeshFoundation/Photon-Monitoring
 
+go 1.12
+
 replace (
 	github.com/SmartMeshFoundation/Photon v0.9.3 => github.com/nkbai/Photon v1.2.0-rc6
 	github.com/ethereum/go-ethereum v1.8.17 => github.com/nkbai/go-ethereum v0.1.2
@@ -14,14 +16,18 @@ require (
 	github.com/SmartMeshFoundation/Photon v0.9.3
 	github.com/SmartMeshFoundation/Spectrum v0.0.0-20190124055011-77d9bf969c1b
 	github.com/ant0ine/go-json-rest v3.3.2+incompatible
-	github.com/asdine/storm v2.1.1+incompatible
-	github.com/coreos/bbolt v1.3.1-coreos.6
 	github.com/ethereum/go-ethereum v1.8.17
 	github.com/jinzhu/gorm v1.9.8
 	github.com/labstack/gommon v0.2.7
 	github.com/mattn/go-colorable v0.1.0
+	github.com/naoina/toml v0.0.0-20170918210437-9fafd6967416
 	github.com/stretchr/testify v1.2.2
+	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
+	gopkg.in/urfave/cli.v1 v1.20.0
+)
+
+require (
+	github.com/naoina/go-stringutil v0.1.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v0.0.0-20170224212429-dcecefd839c4 // indirect
-	gopkg.in/urfave/cli.v1 v1.20.0
 )
@@ -19,12 +19,13 @@ type Account struct {
 	UsedSmt          *big.Int //单增
 	LockedSmt        *big.Int //执行之前先锁定,成功的话,则减去响应的 smt,否则应该退还.
 	// TODO NeedSmt该值会在一个锁对应的DelegateUnlock及DelegateAnnounceDispose同时存在时产生误差,暂时没处理
-	NeedSmt *big.Int //还需要多少 smt, 才能执行所有提交的 tx,供查询,不是计费的依据,
+	NeedSmt      *big.Int //还需要多少 smt, 才能执行所有提交的 tx,供查询,不是计费的依据,
+	WithdrawnSmt *big.Int //退款给用户的 smt,申请退款时即扣除,退款失败再退回
 }
 
 func (a *Account) String() string {
-	return fmt.Sprintf("addr=%s,total=%s,used=%s,locked=%s,need=%s", common.BytesToAddress(a.Address).String(),
-		a.TotalReceivedSmt, a.UsedSmt, a.LockedSmt, a.NeedSmt)
+	return fmt.Sprintf("addr=%s,total=%s,used=%s,locked=%s,need=%s,withdrawn=%s", common.BytesToAddress(a.Address).String(),
+		a.TotalReceivedSmt, a.UsedSmt, a.LockedSmt, a.NeedSmt, a.WithdrawnSmt)
 }
 func (a *Account) toSerialization() *accountSerialization {
 	return &accountSerialization{
@@ -33,6 +34,7 @@ func (a *Account) toSerialization() *accountSerialization {
 		UsedSmtBytes:          a.UsedSmt.Bytes(),
 		LockedSmtBytes:        a.LockedSmt.Bytes(),
 		NeedSmtBytes:          a.NeedSmt.Bytes(),
+		WithdrawnSmtBytes:     a.WithdrawnSmt.Bytes(),
 	}
 }
 
@@ -42,6 +44,7 @@ type accountSerialization struct {
 	UsedSmtBytes          []byte
 	LockedSmtBytes        []byte
 	NeedSmtBytes          []byte
+	WithdrawnSmtBytes     []byte
 }
 
 func (al *accountSerialization) toAccount() *Account {
@@ -51,6 +54,7 @@ func (al *accountSerialization) toAccount() *Account {
 		UsedSmt:          new(big.Int).SetBytes(al.UsedSmtBytes),
 		LockedSmt:        new(big.Int).SetBytes(al.LockedSmtBytes),
 		NeedSmt:          new(big.Int).SetBytes(al.NeedSmtBytes),
+		WithdrawnSmt:     new(big.Int).SetBytes(al.WithdrawnSmtBytes),
 	}
 }
 
@@ -95,6 +99,7 @@ func AccountAvailable(a *Account) *big.Int {
 	n := new(big.Int)
 	n = n.Sub(a.TotalReceivedSmt, a.UsedSmt)
 	n = n.Sub(n, a.LockedSmt)
+	n = n.Sub(n, a.WithdrawnSmt)
 	return n
 }
 
@@ -148,6 +153,36 @@ func (model *ModelDB) AccountUseSmt(addr common.Address, amount *big.Int) error
 	return err
 }
 
+/*
+AccountReleaseAllLockedSmt 启动时没有任何tx在执行,所有锁定的smt都是上次异常退出遗留的,
+和AccountUnlockSmt一样直接释放,不计费.
+*/
+func (model *ModelDB) AccountReleaseAllLockedSmt() (n int, err error) {
+	var als []*accountSerialization
+	err = model.db.Find(&als).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	for _, al := range als {
+		a := al.toAccount()
+		if a.LockedSmt.Cmp(utils.BigInt0) == 0 {
+			continue
+		}
+		log.Warn(fmt.Sprintf("release dangling locked smt %s of %s", a.LockedSmt, common.BytesToAddress(a.Address).String()))
+		a.LockedSmt = new(big.Int)
+		model.accountSanity(a)
+		err = model.db.Save(a.toSerialization()).Error
+		if err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
 //AccountGetAccount returns account info
 func (model *ModelDB) AccountGetAccount(addr common.Address) *Account {
 	var a = &accountSerialization{}
@@ -176,20 +211,46 @@ func GetAccountInTx(tx *gorm.DB, addr common.Address) *Account {
 	return a.toAccount()
 }
 
+/*
+updateAccountColumnInTx 只更新账户中变化的那一列,整行保存会覆盖其他地方同时对该账户其他列的修改.
+账户不存在时新建
+*/
+func updateAccountColumnInTx(tx *gorm.DB, a *Account, column string, value []byte) error {
+	r := tx.Model(&accountSerialization{Address: a.Address}).UpdateColumn(column, value)
+	if r.Error != nil || r.RowsAffected > 0 {
+		return r.Error
+	}
+	return tx.Create(a.toSerialization()).Error
+}
+
 func (model *ModelDB) accountSanity(a *Account) {
+	if err := checkAccount(a); err != nil {
+		panic(err.Error())
+	}
+}
+
+//checkAccount 账户的各项金额必须自洽,人工调整账户时用来拒绝错误的调整
+func checkAccount(a *Account) error {
 	if a.TotalReceivedSmt.Cmp(utils.BigInt0) < 0 {
-		panic(fmt.Sprintf("totalReceive negative=%s, account=%s\n", a.TotalReceivedSmt, utils.StringInterface(a, 2)))
+		return fmt.Errorf("totalReceive negative=%s, account=%s", a.TotalReceivedSmt, utils.StringInterface(a, 2))
 	}
 	if a.UsedSmt.Cmp(utils.BigInt0) < 0 {
-		panic(fmt.Sprintf("UsedSmt negative=%s, account=%s\n", a.UsedSmt, utils.StringInterface(a, 2)))
+		return fmt.Errorf("UsedSmt negative=%s, account=%s", a.UsedSmt, utils.StringInterface(a, 2))
 	}
 	if a.LockedSmt.Cmp(utils.BigInt0) < 0 {
-		panic(fmt.Sprintf("LockedSmt negative=%s, account=%s\n", a.LockedSmt, utils.StringInterface(a, 2)))
+		return fmt.Errorf("LockedSmt negative=%s, account=%s", a.LockedSmt, utils.StringInterface(a, 2))
 	}
 	if a.NeedSmt.Cmp(utils.BigInt0) < 0 {
-		panic(fmt.Sprintf("NeedSmt negative=%s, account=%s\n", a.NeedSmt, utils.StringInterface(a, 2)))
+		return fmt.Errorf("NeedSmt negative=%s, account=%s", a.NeedSmt, utils.StringInterface(a, 2))
 	}
 	if a.UsedSmt.Cmp(a.TotalReceivedSmt) > 0 {
-		panic(fmt.Sprintf("UsedSmt>TotalReceivedSmt used=%s,total=%s account=%s\n", a.UsedSmt, a.TotalReceivedSmt, utils.StringInterface(a, 2)))
+		return fmt.Errorf("UsedSmt>TotalReceivedSmt used=%s,total=%s account=%s", a.UsedSmt, a.TotalReceivedSmt, utils.StringInterface(a, 2))
+	}
+	if a.WithdrawnSmt.Cmp(utils.BigInt0) < 0 {
+		return fmt.Errorf("WithdrawnSmt negative=%s, account=%s", a.WithdrawnSmt, utils.StringInterface(a, 2))
+	}
+	if new(big.Int).Add(a.UsedSmt, a.WithdrawnSmt).Cmp(a.TotalReceivedSmt) > 0 {
+		return fmt.Errorf("UsedSmt+WithdrawnSmt>TotalReceivedSmt used=%s,withdrawn=%s,total=%s account=%s", a.UsedSmt, a.WithdrawnSmt, a.TotalReceivedSmt, utils.StringInterface(a, 2))
 	}
+	return nil
 }
@@ -0,0 +1,371 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/utils"
+	"github.com/SmartMeshFoundation/Photon/log"
+	photonutils "github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/jinzhu/gorm"
+)
+
+/*
+运维工具使用的查看和修复接口,离线打开数据库和通过运行中的PMS调用都使用这里的实现,
+所有的修改都在同一个事务中记录AuditLog
+*/
+
+//DelegateView 解码以后的委托,密码只显示hash
+type DelegateView struct {
+	Key                       hexutil.Bytes               `json:"key"`
+	Delegate                  *Delegate                   `json:"delegate"`
+	NeedSMT                   *big.Int                    `json:"need_smt"`
+	UpdateBalanceProof        *DelegateUpdateBalanceProof `json:"update_balance_proof"`
+	Unlocks                   []*DelegateUnlock           `json:"unlocks"`
+	SecretHashes              []common.Hash               `json:"secret_hashes"`
+	Punishes                  []*DelegatePunish           `json:"punishes"`
+	AnnounceDisposes          []*DelegateAnnounceDispose  `json:"announce_disposes"`
+	Monitors                  []*DelegateMonitor          `json:"monitors"`
+	UpdateBalanceProofSkipped bool                        `json:"update_balance_proof_skipped"`
+}
+
+//GetDelegateView returns the decoded delegate with its punishes, announce disposes and monitors
+func (model *ModelDB) GetDelegateView(key []byte) (v *DelegateView, err error) {
+	d, err := model.GetDelegateByKey(key)
+	if err != nil {
+		return
+	}
+	v = &DelegateView{
+		Key:                       d.Key,
+		Delegate:                  d,
+		NeedSMT:                   d.NeedSMT(),
+		UpdateBalanceProof:        d.UpdateBalanceProof(),
+		Unlocks:                   d.Unlocks(),
+		UpdateBalanceProofSkipped: d.UpdateBalanceProofSkipped(),
+	}
+	for _, s := range d.Secrets() {
+		v.SecretHashes = append(v.SecretHashes, photonutils.ShaSecret(s.GetSecret().Bytes()))
+	}
+	v.Punishes, err = model.GetDelegatePunishListByDelegateKey(key)
+	if err != nil {
+		return
+	}
+	v.AnnounceDisposes, err = model.GetDelegateAnnounceDisposeListByDelegateKey(key)
+	if err != nil {
+		return
+	}
+	err = model.db.Where("delegate_key = ?", key).Order("block_number asc").Find(&v.Monitors).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
+
+//ParseDelegateKey 解析十六进制的委托key,也就是通道id和委托人地址连接在一起
+func ParseDelegateKey(s string) ([]byte, error) {
+	key, err := hexutil.Decode(s)
+	if err != nil || len(key) != common.HashLength+common.AddressLength {
+		return nil, fmt.Errorf("invalid delegate key %s", s)
+	}
+	return key, nil
+}
+
+//DelegateList 按条件查询到的委托,total是不分页时的总数
+type DelegateList struct {
+	Total     int             `json:"total"`
+	Delegates []*DelegateView `json:"delegates"`
+}
+
+//GetDelegateViews query delegates like GetDelegates and decode them
+func (model *ModelDB) GetDelegateViews(q *DelegateQuery) (l *DelegateList, err error) {
+	ds, total, err := model.GetDelegates(q)
+	if err != nil {
+		return
+	}
+	l = &DelegateList{Total: total, Delegates: []*DelegateView{}}
+	for _, d := range ds {
+		var v *DelegateView
+		v, err = model.GetDelegateView(d.Key)
+		if err != nil {
+			return
+		}
+		l.Delegates = append(l.Delegates, v)
+	}
+	return
+}
+
+//ExecuteRecordView 用解码后的参数替换gob编码的GobParams
+type ExecuteRecordView struct {
+	*DelegateExecuteRecord
+	Params interface{} `json:"params"`
+}
+
+//GetExecuteRecordViews query records like GetDelegateExecuteRecords and decode the params, unregistered secrets are hidden
+func (model *ModelDB) GetExecuteRecordViews(q *DelegateExecuteRecordQuery) (vs []*ExecuteRecordView, err error) {
+	rs, err := model.GetDelegateExecuteRecords(q)
+	if err != nil {
+		return
+	}
+	for _, record := range rs {
+		p, err := record.Params()
+		if err != nil {
+			log.Error(fmt.Sprintf("decode params of record %s err %s", record.Key, err))
+		}
+		if ds, ok := p.(*DelegateSecret); ok && record.Status != ExecuteStatusSuccessFinished {
+			// 没有注册成功的密码还没有公开,不能返回
+			ds.Secret = ""
+			record.Secret = ""
+		}
+		vs = append(vs, &ExecuteRecordView{
+			DelegateExecuteRecord: record,
+			Params:                p,
+		})
+	}
+	return
+}
+
+//GetDelegateMonitors returns monitors at or after fromBlockNumber, limit<=0 means all
+func (model *ModelDB) GetDelegateMonitors(fromBlockNumber int64, limit int) (dms []*DelegateMonitor, err error) {
+	db := model.db.Where("block_number >= ?", fromBlockNumber).Order("block_number asc")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+	err = db.Find(&dms).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
+
+//AccountView 账户的各项金额
+type AccountView struct {
+	Address       common.Address `json:"address"`
+	TotalReceived *big.Int       `json:"total_received"`
+	Used          *big.Int       `json:"used"`
+	Locked        *big.Int       `json:"locked"`
+	Need          *big.Int       `json:"need"`
+	Withdrawn     *big.Int       `json:"withdrawn"`
+	Available     *big.Int       `json:"available"`
+}
+
+//NewAccountView decode account a
+func NewAccountView(a *Account) *AccountView {
+	return &AccountView{
+		Address:       common.BytesToAddress(a.Address),
+		TotalReceived: a.TotalReceivedSmt,
+		Used:          a.UsedSmt,
+		Locked:        a.LockedSmt,
+		Need:          a.NeedSmt,
+		Withdrawn:     a.WithdrawnSmt,
+		Available:     AccountAvailable(a),
+	}
+}
+
+//AccountFields 可以人工调整的账户金额
+var AccountFields = []string{"received", "used", "locked", "need", "withdrawn"}
+
+func accountField(a *Account, field string) (*big.Int, error) {
+	switch field {
+	case "received":
+		return a.TotalReceivedSmt, nil
+	case "used":
+		return a.UsedSmt, nil
+	case "locked":
+		return a.LockedSmt, nil
+	case "need":
+		return a.NeedSmt, nil
+	case "withdrawn":
+		return a.WithdrawnSmt, nil
+	}
+	return nil, fmt.Errorf("unknown account field %s, must be one of %v", field, AccountFields)
+}
+
+//AdjustKeyPrefix 人工调整到账时补记的ReceivedTransfer的Key前缀,对账时计入本地记录
+const AdjustKeyPrefix = "adjust-"
+
+/*
+AccountAdjust 人工调整账户的一项金额,比如补记漏掉的到账或者释放卡住的锁定.
+delta可以是负数,调整以后账户必须仍然自洽.
+调整received时同时补记一条ReceivedTransfer,否则对账时账户和到账记录对不上
+*/
+func (model *ModelDB) AccountAdjust(addr common.Address, field string, delta *big.Int, operator, reason string) (a *Account, err error) {
+	if delta == nil || delta.Sign() == 0 {
+		err = fmt.Errorf("invalid delta %s", delta)
+		return
+	}
+	model.lock.Lock()
+	defer model.lock.Unlock()
+	lastBlockNumber := model.GetLatestBlockNumber()
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	a = GetAccountInTx(tx, addr)
+	v, err := accountField(a, field)
+	if err != nil {
+		return
+	}
+	old := new(big.Int).Set(v)
+	v.Add(v, delta)
+	err = checkAccount(a)
+	if err != nil {
+		return
+	}
+	err = tx.Save(a.toSerialization()).Error
+	if err != nil {
+		return
+	}
+	if field == "received" {
+		err = tx.Create(&ReceivedTransfer{
+			Key:             fmt.Sprintf("%s%s-%d", AdjustKeyPrefix, addr.String(), time.Now().UnixNano()),
+			BlockNumber:     lastBlockNumber,
+			TokenAddressStr: model.Fees().Token.String(),
+			FromAddressStr:  addr.String(),
+			AmountStr:       delta.String(),
+		}).Error
+		if err != nil {
+			return
+		}
+	}
+	err = addAuditLogInTx(tx, operator, "account-adjust", addr.String(),
+		fmt.Sprintf("%s %s -> %s", field, old, v), reason)
+	if err != nil {
+		return
+	}
+	err = tx.Commit().Error
+	if err == nil {
+		log.Warn(fmt.Sprintf("account %s adjusted by %s: %s %s -> %s, reason: %s", addr.String(), operator, field, old, v, reason))
+	}
+	return
+}
+
+func checkManualChange(d *Delegate) error {
+	switch d.Status {
+	case DelegateStatusRunning:
+		return fmt.Errorf("delegate is running, wait for it to finish")
+	case DelegateStatusCooperativeSettled, DelegateStatusWithdrawed:
+		return fmt.Errorf("channel is gone, delegate status=%d", d.Status)
+	}
+	return nil
+}
+
+/*
+RetryDelegate 重新安排委托在下一块执行updateBalanceProof和unlock,用于处理因为余额不足或者节点故障而失败的委托,只能重试状态为失败的委托.
+通道必须已经关闭并且还没有到settle.执行时锁定的费用已经从NeedSMT中扣除了,这里按接受委托时的收费重新计算需要的费用.
+*/
+func (model *ModelDB) RetryDelegate(key []byte, operator, reason string) (d *Delegate, err error) {
+	model.lock.Lock()
+	defer model.lock.Unlock()
+	d, err = model.GetDelegateByKey(key)
+	if err != nil {
+		return
+	}
+	err = checkManualChange(d)
+	if err != nil {
+		return
+	}
+	// 部分成功或者已经被其他人执行的委托,有些tx已经上链,重新执行会重复提交和收费
+	if d.Status != DelegateStatusFailed {
+		err = fmt.Errorf("only failed delegate can be retried, status=%d", d.Status)
+		return
+	}
+	lastBlockNumber := model.GetLatestBlockNumber()
+	if d.SettleBlockNumber == 0 {
+		err = fmt.Errorf("channel is not closed yet, nothing to retry")
+		return
+	}
+	if lastBlockNumber+1 >= d.SettleBlockNumber {
+		err = fmt.Errorf("settle block %d passed, last block=%d", d.SettleBlockNumber, lastBlockNumber)
+		return
+	}
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	oldStatus := d.Status
+	if !d.UpdateBalanceProofSkipped() {
+		d.Status = DelegateStatusInit
+	}
+	d.Error = fmt.Sprintf("retried by %s: %s", operator, reason)
+	fees := model.FeesOf(d)
+	need := new(big.Int).Mul(fees.Unlock, big.NewInt(int64(len(d.Unlocks()))))
+	if !d.UpdateBalanceProofSkipped() && d.UpdateBalanceProof().Nonce > 0 {
+		need.Add(need, fees.UpdateTransfer)
+	}
+	oldNeed := d.NeedSMT()
+	if need.Cmp(oldNeed) > 0 {
+		d.NeedSMTStr = utils.BigIntToString(need)
+		updateAccountSMT(tx, d.DelegatorAddress(), oldNeed, need)
+	} else {
+		need = oldNeed
+	}
+	err = tx.Save(d).Error
+	if err != nil {
+		return
+	}
+	addDelegateMonitorInTx(tx, d, lastBlockNumber+1, MonitorTypeUnlockAndUpdateBalanceProof)
+	err = addAuditLogInTx(tx, operator, "delegate-retry", hexutil.Encode(key),
+		fmt.Sprintf("status %d -> %d, need_smt %s -> %s, execute at %d", oldStatus, d.Status, oldNeed, need, lastBlockNumber+1), reason)
+	if err != nil {
+		return
+	}
+	err = tx.Commit().Error
+	if err == nil {
+		log.Warn(fmt.Sprintf("delegate [channel=%s delegator=%s] retried by %s at %d, reason: %s",
+			d.ChannelIdentifierStr, d.DelegatorAddressStr, operator, lastBlockNumber+1, reason))
+	}
+	return
+}
+
+/*
+CancelDelegate 取消委托还没有执行的操作:删除所有计划,清除待注册的密码,释放占用的NeedSMT,标记为失败.
+已经上链的tx不受影响
+*/
+func (model *ModelDB) CancelDelegate(key []byte, operator, reason string) (d *Delegate, err error) {
+	model.lock.Lock()
+	defer model.lock.Unlock()
+	d, err = model.GetDelegateByKey(key)
+	if err != nil {
+		return
+	}
+	err = checkManualChange(d)
+	if err != nil {
+		return
+	}
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	oldStatus, oldNeed := d.Status, d.NeedSMT()
+	err = tx.Where("delegate_key = ?", key).Delete(&DelegateMonitor{}).Error
+	if err != nil {
+		return
+	}
+	d.Status = DelegateStatusFailed
+	d.Error = fmt.Sprintf("canceled by %s: %s", operator, reason)
+	d.SetSecrets([]*DelegateSecret{})
+	err = releaseNeedSMT(tx, d, oldNeed)
+	if err != nil {
+		return
+	}
+	err = addAuditLogInTx(tx, operator, "delegate-cancel", hexutil.Encode(key),
+		fmt.Sprintf("status %d -> %d, need_smt %s -> 0", oldStatus, d.Status, oldNeed), reason)
+	if err != nil {
+		return
+	}
+	err = tx.Commit().Error
+	if err == nil {
+		log.Warn(fmt.Sprintf("delegate [channel=%s delegator=%s] canceled by %s, reason: %s",
+			d.ChannelIdentifierStr, d.DelegatorAddressStr, operator, reason))
+	}
+	return
+}
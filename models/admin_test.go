@@ -0,0 +1,123 @@
+package models
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_AccountAdjust(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	addr := utils.NewRandomAddress()
+	m.AccountAddSmt(addr, big.NewInt(10))
+	a, err := m.AccountAdjust(addr, "received", big.NewInt(5), "ops", "missed deposit")
+	ast.Nil(err)
+	ast.EqualValues(big.NewInt(15), a.TotalReceivedSmt)
+	ast.EqualValues(big.NewInt(15), m.AccountGetAccount(addr).TotalReceivedSmt)
+	// 同时补记了到账
+	trs, err := m.GetReceivedTransferInBlockRange(-1, -1)
+	ast.Nil(err)
+	if ast.EqualValues(1, len(trs)) {
+		ast.True(strings.HasPrefix(trs[0].Key, AdjustKeyPrefix))
+		ast.EqualValues(addr, trs[0].FromAddress())
+		ast.EqualValues(big.NewInt(5), trs[0].Amount())
+	}
+	//调整以后账户不自洽
+	_, err = m.AccountAdjust(addr, "locked", big.NewInt(-1), "ops", "")
+	ast.NotNil(err)
+	_, err = m.AccountAdjust(addr, "balance", big.NewInt(1), "ops", "")
+	ast.NotNil(err)
+	ast.EqualValues(big.NewInt(15), m.AccountGetAccount(addr).TotalReceivedSmt)
+
+	logs, err := m.GetAuditLogs(0)
+	ast.Nil(err)
+	if ast.EqualValues(1, len(logs)) {
+		ast.EqualValues("account-adjust", logs[0].Action)
+		ast.EqualValues(addr.String(), logs[0].Target)
+		ast.EqualValues("received 10 -> 15", logs[0].Detail)
+		ast.EqualValues("missed deposit", logs[0].Reason)
+	}
+}
+
+func TestModelDB_RetryAndCancelDelegate(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	m.SetFees(&params.Fees{
+		UpdateTransfer: big.NewInt(3),
+		Unlock:         big.NewInt(1),
+		Punish:         big.NewInt(2),
+		Secret:         big.NewInt(1),
+	})
+	m.SaveLatestBlockNumber(100)
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+	}
+	c.UpdateTransfer.Nonce = 2
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	key := BuildDelegateKey(c.ChannelIdentifier, addr)
+	//通道还没有关闭
+	_, err = m.RetryDelegate(key, "ops", "")
+	ast.NotNil(err)
+
+	//执行时费用已经从NeedSmt中扣除,然后失败了
+	m.AccountAddSmt(addr, big.NewInt(10))
+	err = m.AccountLockSmt(addr, big.NewInt(3))
+	ast.Nil(err)
+	err = m.AccountUnlockSmt(addr, big.NewInt(3))
+	ast.Nil(err)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	d.SettleBlockNumber = 200
+	d.NeedSMTStr = "0"
+	//部分成功的委托已经有tx上链,不能重试
+	d.Status = DelegateStatusPartialSuccess
+	m.UpdateObject(d)
+	_, err = m.RetryDelegate(key, "ops", "")
+	ast.NotNil(err)
+	d.Status = DelegateStatusFailed
+	m.UpdateObject(d)
+	d, err = m.RetryDelegate(key, "ops", "node was down")
+	ast.Nil(err)
+	ast.EqualValues(DelegateStatusInit, d.Status)
+	ast.EqualValues(big.NewInt(3), d.NeedSMT())
+	ast.EqualValues(big.NewInt(3), m.AccountGetAccount(addr).NeedSmt)
+	dms, err := m.GetDelegateMonitorList(101)
+	ast.Nil(err)
+	ast.EqualValues(1, len(dms))
+
+	v, err := m.GetDelegateView(key)
+	ast.Nil(err)
+	ast.EqualValues(2, v.UpdateBalanceProof.Nonce)
+	ast.EqualValues(1, len(v.Monitors))
+
+	d, err = m.CancelDelegate(key, "ops", "channel abandoned")
+	ast.Nil(err)
+	ast.EqualValues(DelegateStatusFailed, d.Status)
+	ast.EqualValues(big.NewInt(0), m.AccountGetAccount(addr).NeedSmt)
+	dms, err = m.GetDelegateMonitors(0, 0)
+	ast.Nil(err)
+	ast.EqualValues(0, len(dms))
+
+	//执行中的委托不能修改
+	err = m.markDelegateRunning(c.ChannelIdentifier, addr)
+	ast.Nil(err)
+	_, err = m.RetryDelegate(key, "ops", "")
+	ast.NotNil(err)
+	_, err = m.CancelDelegate(key, "ops", "")
+	ast.NotNil(err)
+
+	logs, err := m.GetAuditLogs(1)
+	ast.Nil(err)
+	if ast.EqualValues(1, len(logs)) {
+		ast.EqualValues("delegate-cancel", logs[0].Action)
+	}
+}
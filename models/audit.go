@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+/*
+AuditLog 运维人工修改数据(调整账户,重试或者取消委托)的记录,
+和修改在同一个事务中保存,只增不改
+*/
+type AuditLog struct {
+	ID        int64  `json:"id" gorm:"primary_key"`
+	Timestamp int64  `json:"timestamp" gorm:"index"`
+	Operator  string `json:"operator"`
+	Action    string `json:"action"`
+	Target    string `json:"target" gorm:"index"` // 账户地址或者委托的key
+	Detail    string `json:"detail"`              // 修改前后的值
+	Reason    string `json:"reason"`
+}
+
+func addAuditLogInTx(tx *gorm.DB, operator, action, target, detail, reason string) error {
+	return tx.Create(&AuditLog{
+		Timestamp: time.Now().Unix(),
+		Operator:  operator,
+		Action:    action,
+		Target:    target,
+		Detail:    detail,
+		Reason:    reason,
+	}).Error
+}
+
+//AddAuditLog 记录不修改数据库的运维操作,比如暂停执行
+func (model *ModelDB) AddAuditLog(operator, action, target, detail, reason string) error {
+	return addAuditLogInTx(model.db, operator, action, target, detail, reason)
+}
+
+//GetAuditLogs returns the latest audit logs, limit<=0 means all
+func (model *ModelDB) GetAuditLogs(limit int) (logs []*AuditLog, err error) {
+	db := model.db.Order("id desc")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+	err = db.Find(&logs).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
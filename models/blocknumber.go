@@ -2,7 +2,9 @@ package models
 
 import (
 	"fmt"
+
 	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/jinzhu/gorm"
 )
 
 const lastBlockNumberKey = "lastBlockNumberKey"
@@ -14,7 +16,6 @@ type lastBlockNumber struct {
 
 //GetLatestBlockNumber lastest block number
 func (model *ModelDB) GetLatestBlockNumber() int64 {
-	var number int64
 	lastBlockNumber := &lastBlockNumber{
 		Key: lastBlockNumberKey,
 	}
@@ -22,7 +23,7 @@ func (model *ModelDB) GetLatestBlockNumber() int64 {
 	if err != nil {
 		log.Error(fmt.Sprintf("models GetLatestBlockNumber err=%s", err))
 	}
-	return number
+	return lastBlockNumber.BlockNumber
 }
 
 //SaveLatestBlockNumber block numer has been processed
@@ -35,3 +36,25 @@ func (model *ModelDB) SaveLatestBlockNumber(blockNumber int64) {
 		log.Error(fmt.Sprintf("models SaveLatestBlockNumber err=%s", err))
 	}
 }
+
+const paymentCursorKeyPrefix = "paymentCursor-"
+
+//GetPaymentCursor returns the block number from which payment source `name` should continue
+func (model *ModelDB) GetPaymentCursor(name string) int64 {
+	cursor := &lastBlockNumber{
+		Key: paymentCursorKeyPrefix + name,
+	}
+	err := model.db.Where(cursor).First(cursor).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		log.Error(fmt.Sprintf("models GetPaymentCursor err=%s", err))
+	}
+	return cursor.BlockNumber
+}
+
+//SavePaymentCursor payment source `name` has processed all transfers before blockNumber
+func (model *ModelDB) SavePaymentCursor(name string, blockNumber int64) error {
+	return model.db.Save(&lastBlockNumber{
+		Key:         paymentCursorKeyPrefix + name,
+		BlockNumber: blockNumber,
+	}).Error
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+PriceFeed 提供gas和token相对smt的价格,用于判断一个tx是否划算,
+目前只有读取配置的StaticPriceFeed,以后可以替换成真正的行情源
+*/
+type PriceFeed interface {
+	//GasPrice 估算tx花费时使用的gas price,单位wei
+	GasPrice() (*big.Int, error)
+	//SmtPerWei 1 wei 折合多少smt
+	SmtPerWei() (*big.Rat, error)
+	//SmtPerToken 1个token(最小单位)折合多少smt,不知道价格时返回error
+	SmtPerToken(token common.Address) (*big.Rat, error)
+}
+
+//StaticPriceFeed 价格来自一个网络的配置
+type StaticPriceFeed struct {
+	smt       common.Address
+	gasPrice  *big.Int
+	smtPerWei *big.Rat
+	prices    map[common.Address]*big.Rat
+}
+
+//NewStaticPriceFeed prices configured for network n, its fee token is always 1 smt
+func NewStaticPriceFeed(n *params.Network) *StaticPriceFeed {
+	return &StaticPriceFeed{
+		smt:       n.Fees.Token,
+		gasPrice:  n.GasPrice,
+		smtPerWei: n.SmtPerWei,
+		prices:    n.TokenPrices,
+	}
+}
+
+//GasPrice from the network's gas-price
+func (f *StaticPriceFeed) GasPrice() (*big.Int, error) {
+	if f.gasPrice == nil {
+		return nil, fmt.Errorf("gas price not configured")
+	}
+	return f.gasPrice, nil
+}
+
+//SmtPerWei from the network's smt-per-wei
+func (f *StaticPriceFeed) SmtPerWei() (*big.Rat, error) {
+	if f.smtPerWei == nil {
+		return nil, fmt.Errorf("gas price in smt not configured")
+	}
+	return f.smtPerWei, nil
+}
+
+//SmtPerToken from the network's token-prices, smt itself is always 1
+func (f *StaticPriceFeed) SmtPerToken(token common.Address) (*big.Rat, error) {
+	if token == f.smt {
+		return big.NewRat(1, 1), nil
+	}
+	p, ok := f.prices[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown price of token %s", token.String())
+	}
+	return p, nil
+}
+
+// UnlockAction 对一个unlock委托的处理决定
+type UnlockAction string
+
+const (
+	//UnlockActionExecute 划算,正常执行
+	UnlockActionExecute UnlockAction = "execute"
+	//UnlockActionDeprioritize 不划算,但是没有打开EconomicGuard,放到最后执行
+	UnlockActionDeprioritize UnlockAction = "deprioritize"
+	//UnlockActionSkip 不划算,跳过且不收费
+	UnlockActionSkip UnlockAction = "skip"
+)
+
+/*
+UnlockDecision 根据gas花费和锁的价值对一个unlock做出的决定,
+Cost和Value都折合成smt,Value为空表示不知道token价格
+*/
+type UnlockDecision struct {
+	LockSecretHash common.Hash  `json:"lock_secret_hash"`
+	Amount         *big.Int     `json:"amount"`
+	Cost           *big.Int     `json:"cost,omitempty"`
+	Value          *big.Int     `json:"value,omitempty"`
+	Action         UnlockAction `json:"action"`
+	Reason         string       `json:"reason,omitempty"`
+	unlock         *DelegateUnlock
+}
+
+// Unlock getter
+func (ud *UnlockDecision) Unlock() *DelegateUnlock {
+	return ud.unlock
+}
+
+//EstimateGasCost gas*网络的gas price 折合成smt
+func EstimateGasCost(feed PriceFeed, gas uint64) (*big.Int, error) {
+	gasPrice, err := feed.GasPrice()
+	if err != nil {
+		return nil, err
+	}
+	rate, err := feed.SmtPerWei()
+	if err != nil {
+		return nil, err
+	}
+	wei := new(big.Int).Mul(new(big.Int).SetUint64(gas), gasPrice)
+	return ratMul(wei, rate), nil
+}
+
+func ratMul(n *big.Int, rate *big.Rat) *big.Int {
+	r := new(big.Rat).Mul(new(big.Rat).SetInt(n), rate)
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+//DecideUnlock 判断一个unlock是否值得执行
+func DecideUnlock(feed PriceFeed, token common.Address, du *DelegateUnlock) *UnlockDecision {
+	ud := &UnlockDecision{
+		LockSecretHash: du.LockSecretHash(),
+		Amount:         du.Amount(),
+		Action:         UnlockActionExecute,
+		unlock:         du,
+	}
+	cost, err := EstimateGasCost(feed, params.UnlockGasEstimate)
+	if err != nil {
+		ud.Reason = fmt.Sprintf("cannot estimate gas cost : %s", err)
+		return ud
+	}
+	ud.Cost = cost
+	price, err := feed.SmtPerToken(token)
+	if err != nil {
+		ud.Reason = err.Error()
+		return ud
+	}
+	ud.Value = ratMul(ud.Amount, price)
+	if ud.Value.Cmp(ud.Cost) >= 0 {
+		return ud
+	}
+	ud.Reason = fmt.Sprintf("gas cost %s smt exceeds lock value %s smt", ud.Cost, ud.Value)
+	if params.EconomicGuard {
+		ud.Action = UnlockActionSkip
+	} else {
+		ud.Action = UnlockActionDeprioritize
+	}
+	return ud
+}
+
+/*
+DecideUnlocks 对一个委托的所有unlock做出决定,返回的顺序就是执行的顺序:
+划算的在前,不知道价格的其次,不划算的最后,跳过的不执行;
+同一类中金额大的优先,金额相同的过期早的优先,这样来不及全部unlock时损失最小
+*/
+func DecideUnlocks(feed PriceFeed, token common.Address, dus []*DelegateUnlock) (uds []*UnlockDecision) {
+	for _, du := range dus {
+		uds = append(uds, DecideUnlock(feed, token, du))
+	}
+	rank := func(ud *UnlockDecision) int {
+		switch {
+		case ud.Action == UnlockActionSkip:
+			return 3
+		case ud.Action == UnlockActionDeprioritize:
+			return 2
+		case ud.Value == nil:
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(uds, func(i, j int) bool {
+		ri, rj := rank(uds[i]), rank(uds[j])
+		if ri != rj {
+			return ri < rj
+		}
+		if c := uds[i].Amount.Cmp(uds[j].Amount); c != 0 {
+			return c > 0
+		}
+		return uds[i].unlock.Expiration < uds[j].unlock.Expiration
+	})
+	return
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUnlock(amount int64) *DelegateUnlock {
+	return &DelegateUnlock{
+		LockSecretHashStr: utils.NewRandomHash().String(),
+		AmountStr:         big.NewInt(amount).String(),
+	}
+}
+
+func TestDecideUnlocks(t *testing.T) {
+	ast := assert.New(t)
+	oldGas, oldGuard := params.UnlockGasEstimate, params.EconomicGuard
+	defer func() {
+		params.UnlockGasEstimate, params.EconomicGuard = oldGas, oldGuard
+	}()
+	params.UnlockGasEstimate = 10
+	smt := utils.NewRandomAddress()
+	feed := NewStaticPriceFeed(&params.Network{
+		Fees:      &params.Fees{Token: smt},
+		GasPrice:  big.NewInt(10),
+		SmtPerWei: big.NewRat(1, 2),
+	})
+	// cost = 10*10/2 = 50
+	cheap, rich, richer := newTestUnlock(49), newTestUnlock(50), newTestUnlock(1000)
+	dus := []*DelegateUnlock{cheap, rich, richer}
+
+	params.EconomicGuard = false
+	uds := DecideUnlocks(feed, smt, dus)
+	ast.EqualValues(3, len(uds))
+	ast.Equal(richer, uds[0].Unlock())
+	ast.Equal(rich, uds[1].Unlock())
+	ast.Equal(cheap, uds[2].Unlock())
+	ast.Equal(UnlockActionExecute, uds[0].Action)
+	ast.Equal(UnlockActionDeprioritize, uds[2].Action)
+	ast.EqualValues(big.NewInt(50), uds[2].Cost)
+	ast.NotEmpty(uds[2].Reason)
+
+	params.EconomicGuard = true
+	uds = DecideUnlocks(feed, smt, dus)
+	ast.Equal(UnlockActionSkip, uds[2].Action)
+	ast.Equal(UnlockActionExecute, uds[1].Action)
+
+	// 金额相同的过期早的优先
+	late, early := newTestUnlock(1000), newTestUnlock(1000)
+	late.Expiration, early.Expiration = 200, 100
+	uds = DecideUnlocks(feed, smt, []*DelegateUnlock{late, early})
+	ast.Equal(early, uds[0].Unlock())
+	ast.Equal(late, uds[1].Unlock())
+
+	// 未知价格的token总是执行
+	uds = DecideUnlocks(feed, utils.NewRandomAddress(), dus)
+	for _, ud := range uds {
+		ast.Equal(UnlockActionExecute, ud.Action)
+		ast.Nil(ud.Value)
+	}
+
+	// 价格是每个网络自己配置的
+	token := utils.NewRandomAddress()
+	other := NewStaticPriceFeed(&params.Network{
+		Fees:        &params.Fees{Token: utils.NewRandomAddress()},
+		GasPrice:    big.NewInt(20),
+		SmtPerWei:   big.NewRat(1, 2),
+		TokenPrices: map[common.Address]*big.Rat{token: big.NewRat(1, 10)},
+	})
+	uds = DecideUnlocks(other, token, []*DelegateUnlock{richer})
+	ast.EqualValues(big.NewInt(100), uds[0].Cost)
+	ast.EqualValues(big.NewInt(100), uds[0].Value)
+	_, err := feed.SmtPerToken(token)
+	ast.NotNil(err)
+}
+
+func TestModelDB_SkipUnlocks(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+	}
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	d.NeedSMTStr = big.NewInt(5).String()
+	m.accountUpdateNeedSmt(addr, big.NewInt(5))
+	err = m.SkipUnlocks(d, 2)
+	ast.Nil(err)
+	expect := new(big.Int).Sub(big.NewInt(5), new(big.Int).Mul(params.SmtUnlock, big.NewInt(2)))
+	ast.EqualValues(expect, m.getDelegateByOriginKey(c.ChannelIdentifier, addr).NeedSMT())
+	ast.EqualValues(expect, m.AccountGetAccount(addr).NeedSmt)
+}
@@ -13,6 +13,7 @@ import (
 
 	"encoding/gob"
 
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
 	"github.com/SmartMeshFoundation/Photon/log"
 )
 
@@ -22,6 +23,8 @@ type ModelDB struct {
 	lock  sync.Mutex
 	mlock sync.Mutex
 	Name  string
+	fees  *params.Fees // 这个数据库所属网络的收费配置,为空使用全局配置
+	flock sync.RWMutex // 收费配置可以在运行中重新加载
 }
 
 func newModelDB() (db *ModelDB) {
@@ -59,10 +62,42 @@ func OpenDb(dbPath string) (model *ModelDB, err error) {
 	model.db.AutoMigrate(&ReceivedTransfer{})
 	model.db.AutoMigrate(&lastBlockNumber{})
 	model.db.AutoMigrate(&DelegateExecuteRecord{})
+	model.db.AutoMigrate(&ReconcileResult{})
+	model.db.AutoMigrate(&Payout{})
+	model.db.AutoMigrate(&DelegateArchive{})
+	model.db.AutoMigrate(&AuditLog{})
 
 	return
 }
 
+//SetFees set fee config of the network this db belongs to
+func (model *ModelDB) SetFees(fees *params.Fees) {
+	model.flock.Lock()
+	model.fees = fees
+	model.flock.Unlock()
+}
+
+//Fees of the network this db belongs to
+func (model *ModelDB) Fees() *params.Fees {
+	model.flock.RLock()
+	defer model.flock.RUnlock()
+	if model.fees == nil {
+		return params.DefaultFees()
+	}
+	return model.fees
+}
+
+/*
+FeesOf 委托接受时的收费,锁定,扣除和释放费用都要用它,否则收费修改以后和NeedSMT对不上.
+之前接受的委托没有记录收费,使用当前的收费
+*/
+func (model *ModelDB) FeesOf(d *Delegate) *params.Fees {
+	if fees := d.Fees(); fees != nil {
+		return fees
+	}
+	return model.Fees()
+}
+
 //CloseDB close db
 func (model *ModelDB) CloseDB() {
 	model.lock.Lock()
@@ -3,6 +3,7 @@ package models
 import (
 	"bytes"
 	"encoding/gob"
+	"math"
 	"math/big"
 
 	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
@@ -36,6 +37,10 @@ const (
 	DelegateStatusCooperativeSettled = 6
 	//DelegateStatusWithdrawed this channel is withdrawed
 	DelegateStatusWithdrawed = 7
+	//DelegateStatusUpdateUnnecessary 链上已经是委托的balance proof,不需要updateBalanceProof,只做unlock
+	DelegateStatusUpdateUnnecessary = 8
+	//DelegateStatusStaleDelegation 链上的balance proof比委托的新,委托已经过时,只做unlock
+	DelegateStatusStaleDelegation = 9
 )
 
 // Delegate 一次photon委托的信息
@@ -44,7 +49,7 @@ type Delegate struct {
 	ChannelIdentifierStr       string         `json:"channel_identifier" gorm:"index"` //委托 channel
 	OpenBlockNumber            int64          `json:"open_block_number"`               // open block number of this channel
 	TokenAddressStr            string         `json:"token_address"`
-	DelegatorAddressStr        string         `json:"delegator_address"` //delegator
+	DelegatorAddressStr        string         `json:"delegator_address" gorm:"index"` //delegator
 	PartnerAddressStr          string         `json:"partner_address"`
 	SettleBlockNumber          int64          `json:"settle_block_number"`   // closed block number+settle_timeout
 	DelegateTimestamp          int64          `json:"delegate_timestamp"`    //委托时间
@@ -52,9 +57,11 @@ type Delegate struct {
 	Status                     DelegateStatus `json:"status" gorm:"index"`
 	Error                      string         `json:"error"`
 	NeedSMTStr                 string         `json:"need_smt_str"`
+	UnlocksIncomplete          bool           `json:"unlocks_incomplete"` // 委托的unlock没有包含locksroot中的全部锁
 	UpdateBalanceProofGobBytes []byte         `json:"-"`
 	UnlocksGobBytes            []byte         `json:"-"`
 	SecretsGobBytes            []byte         `json:"-"`
+	FeesGobBytes               []byte         `json:"-"` // 接受委托时的收费,执行时按它扣费
 }
 
 // ChannelIdentifier getter
@@ -143,24 +150,58 @@ func (d *Delegate) Secrets() []*DelegateSecret {
 	return dss
 }
 
+// SetFees setter
+func (d *Delegate) SetFees(fees *params.Fees) {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(fees)
+	if err != nil {
+		panic(err)
+	}
+	d.FeesGobBytes = buf.Bytes()
+}
+
+// Fees getter, nil if the delegate was accepted before fees were recorded
+func (d *Delegate) Fees() *params.Fees {
+	if len(d.FeesGobBytes) == 0 {
+		return nil
+	}
+	decoder := gob.NewDecoder(bytes.NewBuffer(d.FeesGobBytes))
+	fees := &params.Fees{}
+	err := decoder.Decode(fees)
+	if err != nil {
+		panic(err)
+	}
+	return fees
+}
+
 // NeedSMT getter
 func (d *Delegate) NeedSMT() *big.Int {
 	return utils.StringToBigInt(d.NeedSMTStr)
 }
 
+/*
+UpdateBalanceProofSkipped 不需要PMS updateBalanceProof,但是仍然需要unlock
+*/
+func (d *Delegate) UpdateBalanceProofSkipped() bool {
+	return d.Status == DelegateStatusSuccessFinishedByOther ||
+		d.Status == DelegateStatusUpdateUnnecessary ||
+		d.Status == DelegateStatusStaleDelegation
+}
+
 // CalcNeedSMT 计算一次委托需要的总花费
-func (d *Delegate) CalcNeedSMT(smt4Punish *big.Int) {
+func (d *Delegate) CalcNeedSMT(fees *params.Fees, smt4Punish *big.Int) {
 	needSMT := big.NewInt(0)
 	// 计算一次
 	if d.UpdateBalanceProof().Nonce > 0 {
-		needSMT = needSMT.Add(needSMT, params.SmtUpdateTransfer)
+		needSMT = needSMT.Add(needSMT, fees.UpdateTransfer)
 	}
 	// 按数量
-	smt4Unlock := new(big.Int).Mul(big.NewInt(int64(len(d.Unlocks()))), params.SmtUnlock)
+	smt4Unlock := new(big.Int).Mul(big.NewInt(int64(len(d.Unlocks()))), fees.Unlock)
 	needSMT = needSMT.Add(needSMT, smt4Unlock)
 
 	// 按数量
-	smt4Secret := new(big.Int).Mul(big.NewInt(int64(len(d.Secrets()))), params.SmtSecret)
+	smt4Secret := new(big.Int).Mul(big.NewInt(int64(len(d.Secrets()))), fees.Secret)
 	needSMT = needSMT.Add(needSMT, smt4Secret)
 
 	// 直接add参数
@@ -193,6 +234,49 @@ func (model *ModelDB) GetAllDelegate() (ds []*Delegate) {
 	return
 }
 
+/*
+DelegateQuery 查询委托的条件,为空表示不限制,对外的接口必须指定Delegator
+*/
+type DelegateQuery struct {
+	Delegator common.Address
+	Status    *DelegateStatus
+	Token     common.Address
+	Partner   common.Address
+	Offset    int
+	Limit     int
+}
+
+// GetDelegates 按条件分页查询委托,total是不分页时的总数
+func (model *ModelDB) GetDelegates(q *DelegateQuery) (ds []*Delegate, total int, err error) {
+	db := model.db.Model(&Delegate{})
+	if q.Delegator != (common.Address{}) {
+		db = db.Where("delegator_address_str = ?", q.Delegator.String())
+	}
+	if q.Status != nil {
+		db = db.Where("status = ?", *q.Status)
+	}
+	if q.Token != (common.Address{}) {
+		db = db.Where("token_address_str = ?", q.Token.String())
+	}
+	if q.Partner != (common.Address{}) {
+		db = db.Where("partner_address_str = ?", q.Partner.String())
+	}
+	err = db.Count(&total).Error
+	if err != nil {
+		return
+	}
+	// sqlite不支持没有LIMIT的OFFSET
+	limit := q.Limit
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	err = db.Limit(limit).Offset(q.Offset).Order("delegate_timestamp desc").Find(&ds).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
+
 /*
 GetDelegateListByChannelIdentifier returns the delegate about this channel and not run
 */
@@ -212,6 +296,58 @@ func (model *ModelDB) UpdateDelegateStatus(d *Delegate, status DelegateStatus) e
 	return model.db.Model(d).UpdateColumn("Status", status).Error
 }
 
+/*
+SkipUpdateBalanceProof 不再需要updateBalanceProof,同时释放为其预留的费用
+*/
+func (model *ModelDB) SkipUpdateBalanceProof(d *Delegate, status DelegateStatus, reason string) (err error) {
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+	d.Status = status
+	d.Error = reason
+	err = releaseNeedSMT(tx, d, model.FeesOf(d).UpdateTransfer)
+	return
+}
+
+/*
+SkipUnlocks 跳过了n个不划算的unlock,释放为其预留的费用
+*/
+func (model *ModelDB) SkipUnlocks(d *Delegate, n int) (err error) {
+	if n <= 0 {
+		return
+	}
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+	err = releaseNeedSMT(tx, d, new(big.Int).Mul(model.FeesOf(d).Unlock, big.NewInt(int64(n))))
+	return
+}
+
+func releaseNeedSMT(tx *gorm.DB, d *Delegate, amount *big.Int) (err error) {
+	oldNeedSMT := d.NeedSMT()
+	newNeedSMT := new(big.Int).Sub(oldNeedSMT, amount)
+	if newNeedSMT.Sign() < 0 {
+		newNeedSMT = big.NewInt(0)
+	}
+	d.NeedSMTStr = utils.BigIntToString(newNeedSMT)
+	err = tx.Save(d).Error
+	if err != nil {
+		return
+	}
+	updateAccountSMT(tx, d.DelegatorAddress(), oldNeedSMT, newNeedSMT)
+	return
+}
+
 // DeleteDelegate delete all records about a delegate
 func (model *ModelDB) DeleteDelegate(key []byte) (err error) {
 	tx := model.db.Begin()
@@ -222,15 +358,30 @@ func (model *ModelDB) DeleteDelegate(key []byte) (err error) {
 			tx.Commit()
 		}
 	}()
+	err = deleteDelegateInTx(tx, key)
+	return
+}
+
+/*
+deleteDelegateInTx DelegatePunish和DelegateAnnounceDispose的主键是自增ID,
+必须用Where指定DelegateKey,否则gorm会删除整张表
+*/
+func deleteDelegateInTx(tx *gorm.DB, key []byte) (err error) {
 	err = tx.Delete(&Delegate{
 		Key: key,
 	}).Error
-	err = tx.Delete(&DelegatePunish{
+	if err != nil {
+		return
+	}
+	err = tx.Where(&DelegatePunish{
 		DelegateKey: key,
-	}).Error
-	err = tx.Delete(&DelegateAnnounceDispose{
+	}).Delete(&DelegatePunish{}).Error
+	if err != nil {
+		return
+	}
+	err = tx.Where(&DelegateAnnounceDispose{
 		DelegateKey: key,
-	}).Error
+	}).Delete(&DelegateAnnounceDispose{}).Error
 	return
 }
 
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
+)
+
+// ArchiveEvent 导致委托结束的链上事件
+type ArchiveEvent string
+
+const (
+	//ArchiveEventSettled channel settled
+	ArchiveEventSettled ArchiveEvent = "settled"
+	//ArchiveEventCooperativeSettled channel cooperative settled
+	ArchiveEventCooperativeSettled ArchiveEvent = "cooperative_settled"
+	//ArchiveEventWithdraw channel withdrawed
+	ArchiveEventWithdraw ArchiveEvent = "withdraw"
+)
+
+/*
+DelegateArchive 通道settle/合作settle/withdraw以后,委托不再需要执行,
+把委托及其punish,AnnounceDispose的快照和执行结果汇总保存下来供用户查询,
+然后删除原来的记录.同一个通道重开以后的委托会有新的归档
+*/
+type DelegateArchive struct {
+	Key                      string         `json:"key" gorm:"primary_key"` // delegateKey-openBlockNumber
+	ChannelIdentifierStr     string         `json:"channel_identifier" gorm:"index"`
+	OpenBlockNumber          int64          `json:"open_block_number"`
+	TokenAddressStr          string         `json:"token_address"`
+	DelegatorAddressStr      string         `json:"delegator_address" gorm:"index"`
+	PartnerAddressStr        string         `json:"partner_address"`
+	SettleBlockNumber        int64          `json:"settle_block_number"`
+	Event                    ArchiveEvent   `json:"event"`
+	EventBlockNumber         int64          `json:"event_block_number"`
+	ArchiveTimestamp         int64          `json:"archive_timestamp" gorm:"index"`
+	FinalStatus              DelegateStatus `json:"final_status"`
+	Error                    string         `json:"error"`
+	Outcome                  string         `json:"outcome"` // 每种操作的执行结果汇总
+	SuccessCount             int            `json:"success_count"`
+	FailedCount              int            `json:"failed_count"`
+	SkippedCount             int            `json:"skipped_count"`
+	DelegateGobBytes         []byte         `json:"-"`
+	PunishesGobBytes         []byte         `json:"-"`
+	AnnounceDisposesGobBytes []byte         `json:"-"`
+	UnlocksIncomplete        bool           `json:"unlocks_incomplete"`
+	UpdateBalanceProofDone   bool           `json:"update_balance_proof_done"` // 是否由PMS成功提交了balance proof
+}
+
+//Delegate snapshot when archived
+func (da *DelegateArchive) Delegate() *Delegate {
+	d := &Delegate{}
+	err := gob.NewDecoder(bytes.NewBuffer(da.DelegateGobBytes)).Decode(d)
+	if err != nil {
+		log.Error(fmt.Sprintf("unmarshal archived delegate %s err %s", da.Key, err))
+	}
+	return d
+}
+
+//DelegatePunishes snapshot when archived
+func (da *DelegateArchive) DelegatePunishes() (dps []*DelegatePunish) {
+	err := gob.NewDecoder(bytes.NewBuffer(da.PunishesGobBytes)).Decode(&dps)
+	if err != nil {
+		log.Error(fmt.Sprintf("unmarshal archived punishes %s err %s", da.Key, err))
+	}
+	return
+}
+
+//DelegateAnnounceDisposes snapshot when archived
+func (da *DelegateArchive) DelegateAnnounceDisposes() (das []*DelegateAnnounceDispose) {
+	err := gob.NewDecoder(bytes.NewBuffer(da.AnnounceDisposesGobBytes)).Decode(&das)
+	if err != nil {
+		log.Error(fmt.Sprintf("unmarshal archived announce disposes %s err %s", da.Key, err))
+	}
+	return
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func buildArchiveKey(d *Delegate) string {
+	return fmt.Sprintf("%s-%d", common.Bytes2Hex(d.Key), d.OpenBlockNumber)
+}
+
+/*
+summarizeRecords 按类型汇总执行记录,比如
+unlock: 2 success,1 failed,1 skipped; punish: 1 success
+*/
+func summarizeRecords(da *DelegateArchive, rs []*DelegateExecuteRecord) {
+	type counter struct{ success, failed, skipped int }
+	counters := make(map[DelegateType]*counter)
+	for _, r := range rs {
+		c, ok := counters[r.Type]
+		if !ok {
+			c = &counter{}
+			counters[r.Type] = c
+		}
+		switch r.Status {
+		case ExecuteStatusSuccessFinished:
+			c.success++
+			da.SuccessCount++
+			if r.Type == DelegateTypeUpdateBalanceProof {
+				da.UpdateBalanceProofDone = true
+			}
+		case ExecuteStatusSkipped:
+			c.skipped++
+			da.SkippedCount++
+		default:
+			c.failed++
+			da.FailedCount++
+		}
+	}
+	var ss []string
+	for _, t := range []DelegateType{DelegateTypeUpdateBalanceProof, DelegateTypeUnlock, DelegateTypePunish, DelegateTypeRegisterSecret} {
+		c, ok := counters[t]
+		if !ok {
+			continue
+		}
+		ss = append(ss, fmt.Sprintf("%s: %d success,%d failed,%d skipped", delegateTypeNames[t], c.success, c.failed, c.skipped))
+	}
+	if len(ss) == 0 {
+		da.Outcome = "nothing executed"
+		return
+	}
+	da.Outcome = strings.Join(ss, "; ")
+}
+
+/*
+ArchiveDelegate 归档一个已经结束的委托,并删除委托以及对应的punish和AnnounceDispose,
+执行记录DelegateExecuteRecord本身就是历史,保留不动
+*/
+func (model *ModelDB) ArchiveDelegate(d *Delegate, event ArchiveEvent, blockNumber int64) (da *DelegateArchive, err error) {
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+	var dps []*DelegatePunish
+	err = tx.Where(&DelegatePunish{DelegateKey: d.Key}).Find(&dps).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return
+	}
+	var das []*DelegateAnnounceDispose
+	err = tx.Where(&DelegateAnnounceDispose{DelegateKey: d.Key}).Find(&das).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return
+	}
+	var rs []*DelegateExecuteRecord
+	err = tx.Where(&DelegateExecuteRecord{
+		ChannelIdentifierStr: d.ChannelIdentifierStr,
+		OpenBlockNumber:      d.OpenBlockNumber,
+		DelegatorStr:         d.DelegatorAddressStr,
+	}).Find(&rs).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return
+	}
+	da = &DelegateArchive{
+		Key:                  buildArchiveKey(d),
+		ChannelIdentifierStr: d.ChannelIdentifierStr,
+		OpenBlockNumber:      d.OpenBlockNumber,
+		TokenAddressStr:      d.TokenAddressStr,
+		DelegatorAddressStr:  d.DelegatorAddressStr,
+		PartnerAddressStr:    d.PartnerAddressStr,
+		SettleBlockNumber:    d.SettleBlockNumber,
+		Event:                event,
+		EventBlockNumber:     blockNumber,
+		ArchiveTimestamp:     time.Now().Unix(),
+		FinalStatus:          d.Status,
+		Error:                d.Error,
+		UnlocksIncomplete:    d.UnlocksIncomplete,
+	}
+	summarizeRecords(da, rs)
+	da.DelegateGobBytes, err = gobEncode(d)
+	if err != nil {
+		return
+	}
+	da.PunishesGobBytes, err = gobEncode(dps)
+	if err != nil {
+		return
+	}
+	da.AnnounceDisposesGobBytes, err = gobEncode(das)
+	if err != nil {
+		return
+	}
+	err = tx.Save(da).Error
+	if err != nil {
+		return
+	}
+	err = deleteDelegateInTx(tx, d.Key)
+	return
+}
+
+//GetDelegateArchives 查询一个委托人的历史委托,channelIdentifier为空时返回所有通道的,按归档时间倒序
+func (model *ModelDB) GetDelegateArchives(delegator common.Address, channelIdentifier common.Hash) (das []*DelegateArchive, err error) {
+	q := &DelegateArchive{
+		DelegatorAddressStr: delegator.String(),
+	}
+	if channelIdentifier != (common.Hash{}) {
+		q.ChannelIdentifierStr = channelIdentifier.String()
+	}
+	err = model.db.Where(q).Order("archive_timestamp desc").Find(&das).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
+
+//PruneDelegateArchives 删除归档时间早于before的历史委托,返回删除的数量
+func (model *ModelDB) PruneDelegateArchives(before time.Time) (n int64, err error) {
+	db := model.db.Where("archive_timestamp < ?", before.Unix()).Delete(&DelegateArchive{})
+	return db.RowsAffected, db.Error
+}
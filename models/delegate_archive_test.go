@@ -0,0 +1,77 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_ArchiveDelegate(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+		Punishes: []*Punish{
+			{LockHash: utils.NewRandomHash()},
+		},
+		AnnouceDisposed: []*AnnouceDisposed{
+			{LockSecretHash: utils.NewRandomHash()},
+		},
+	}
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	// 另一个委托的punish不能被删除
+	c2 := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+		Punishes: []*Punish{
+			{LockHash: utils.NewRandomHash()},
+		},
+	}
+	err = m.ReceiveDelegate(c2, addr)
+	ast.Nil(err)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	r := NewDelegateExecuteRecord(d, DelegateTypePunish, &DelegatePunish{})
+	r.Status = ExecuteStatusSuccessFinished
+	m.SaveDelegateExecuteRecord(r)
+	r = NewDelegateExecuteRecord(d, DelegateTypeUnlock, &DelegateUnlock{})
+	r.Status = ExecuteStatusSkipped
+	m.SaveDelegateExecuteRecord(r)
+
+	da, err := m.ArchiveDelegate(d, ArchiveEventSettled, 100)
+	ast.Nil(err)
+	ast.Equal("unlock: 0 success,0 failed,1 skipped; punish: 1 success,0 failed,0 skipped", da.Outcome)
+	_, err = m.GetDelegateByKey(d.Key)
+	ast.NotNil(err)
+	dps, err := m.GetDelegatePunishListByDelegateKey(d.Key)
+	ast.Nil(err)
+	ast.EqualValues(0, len(dps))
+	d2 := m.getDelegateByOriginKey(c2.ChannelIdentifier, addr)
+	dps, err = m.GetDelegatePunishListByDelegateKey(d2.Key)
+	ast.Nil(err)
+	ast.EqualValues(1, len(dps))
+
+	das, err := m.GetDelegateArchives(addr, utils.EmptyHash)
+	ast.Nil(err)
+	ast.EqualValues(1, len(das))
+	ast.Equal(ArchiveEventSettled, das[0].Event)
+	ast.EqualValues(100, das[0].EventBlockNumber)
+	ast.Equal(d.ChannelIdentifierStr, das[0].Delegate().ChannelIdentifierStr)
+	ast.EqualValues(1, len(das[0].DelegatePunishes()))
+	ast.EqualValues(1, len(das[0].DelegateAnnounceDisposes()))
+	das, err = m.GetDelegateArchives(addr, c2.ChannelIdentifier)
+	ast.Nil(err)
+	ast.EqualValues(0, len(das))
+
+	n, err := m.PruneDelegateArchives(time.Now().Add(-time.Hour))
+	ast.Nil(err)
+	ast.EqualValues(0, n)
+	n, err = m.PruneDelegateArchives(time.Now().Add(time.Hour))
+	ast.Nil(err)
+	ast.EqualValues(1, n)
+}
@@ -6,10 +6,11 @@ import (
 	"fmt"
 	"time"
 
-	utils2 "github.com/SmartMeshFoundation/Photon-Monitoring/utils"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/utils"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
 )
 
 // ExecuteStatus 委托的具体操作的执行状态
@@ -22,6 +23,8 @@ const (
 	ExecuteStatusSuccessFinished
 	//ExecuteStatusErrorFinished finished with error
 	ExecuteStatusErrorFinished
+	//ExecuteStatusSkipped gas花费超过价值,没有执行,也不收费,原因记录在Error中
+	ExecuteStatusSkipped
 )
 
 // DelegateType 委托类型,目前有4种
@@ -55,7 +58,8 @@ type DelegateExecuteRecord struct {
 	TxPackBlockNumber    int64         `json:"tx_pack_block_number"`   // 打包高度
 	TxPackTimestamp      int64         `json:"tx_pack_timestamp"`      // 打包时间
 	GobParams            []byte        `json:"params"`                 // 相关参数,gob编码,根据类型不同对应DelegateUpdateBalanceProof,DelegateUnlock,DelegatePunish三个结构体
-	Secret               string        `json:"secret" gorm:"index"`    // 仅注册密码时使用,方便查询
+	Secret               string        `json:"secret" gorm:"index"`    // 仅注册密码时使用,方便查询,配置了数据库密钥时保存的是密码的HMAC
+	Simulated            bool          `json:"simulated" gorm:"index"` // 影子模式下只用eth_call模拟执行,tx没有广播
 }
 
 // ChannelIdentifier getter
@@ -73,11 +77,36 @@ func (r *DelegateExecuteRecord) TxHash() common.Hash {
 	return common.HexToHash(r.TxHashStr)
 }
 
+/*
+Params 按Type解码GobParams,
+返回*DelegateUpdateBalanceProof,*DelegateUnlock,*DelegatePunish或者*DelegateSecret
+*/
+func (r *DelegateExecuteRecord) Params() (p interface{}, err error) {
+	switch r.Type {
+	case DelegateTypeUpdateBalanceProof:
+		p = &DelegateUpdateBalanceProof{}
+	case DelegateTypeUnlock:
+		p = &DelegateUnlock{}
+	case DelegateTypePunish:
+		p = &DelegatePunish{}
+	case DelegateTypeRegisterSecret:
+		p = &DelegateSecret{}
+	default:
+		return nil, fmt.Errorf("unknown delegate type %d", r.Type)
+	}
+	b, err := decryptField(r.GobParams)
+	if err != nil {
+		return nil, err
+	}
+	err = gob.NewDecoder(bytes.NewBuffer(b)).Decode(p)
+	return
+}
+
 // NewDelegateExecuteRecord 构造一条记录,params采用gob编码
-func NewDelegateExecuteRecord(d *Delegate, executeType DelegateType, params interface{}) *DelegateExecuteRecord {
+func NewDelegateExecuteRecord(d *Delegate, executeType DelegateType, executeParams interface{}) *DelegateExecuteRecord {
 	var buf bytes.Buffer
 	e := gob.NewEncoder(&buf)
-	err := e.Encode(params)
+	err := e.Encode(executeParams)
 	if err != nil {
 		panic(err)
 	}
@@ -96,6 +125,7 @@ func NewDelegateExecuteRecord(d *Delegate, executeType DelegateType, params inte
 		TxPackBlockNumber:    0,
 		TxPackTimestamp:      0,
 		GobParams:            buf.Bytes(),
+		Simulated:            params.ShadowMode,
 	}
 }
 
@@ -105,7 +135,9 @@ dao
 
 // SaveDelegateExecuteRecord save to db
 func (model *ModelDB) SaveDelegateExecuteRecord(r *DelegateExecuteRecord) {
-	log.Trace(fmt.Sprintf("NewDelegateExecuteRecord :\n%s", utils2.ToJSONStringFormat(r)))
+	// 不打印GobParams,其中可能有还没有注册的密码
+	log.Trace(fmt.Sprintf("NewDelegateExecuteRecord : key=%s channel=%s delegator=%s type=%s status=%s tx=%s error=%s",
+		r.Key, r.ChannelIdentifierStr, r.DelegatorStr, delegateTypeNames[r.Type], executeStatusNames[r.Status], r.TxHashStr, r.Error))
 	err := model.db.Save(r).Error
 	if err != nil {
 		panic(err)
@@ -117,12 +149,80 @@ func (model *ModelDB) HasSecretAlreadyRegister(secret common.Hash) bool {
 	q := &DelegateExecuteRecord{
 		Type:   DelegateTypeRegisterSecret,
 		Status: ExecuteStatusSuccessFinished,
-		Secret: secret.String(),
 	}
 	r := &DelegateExecuteRecord{}
-	err := model.db.Where(q).Find(r).Error
+	// Secret中保存的是密码的索引,密钥轮换过的数据库中可能同时存在新旧密钥计算的索引
+	err := model.db.Where(q).Where("secret IN (?)", secretIndexes(secret.String())).Find(r).Error
 	if err != nil {
 		return false
 	}
 	return true
 }
+
+var delegateTypeNames = map[DelegateType]string{
+	DelegateTypeUpdateBalanceProof: "update_balance_proof",
+	DelegateTypeUnlock:             "unlock",
+	DelegateTypePunish:             "punish",
+	DelegateTypeRegisterSecret:     "register_secret",
+}
+
+// ParseDelegateType 支持数字或者名字,比如1或者unlock
+func ParseDelegateType(s string) (t DelegateType, err error) {
+	for k, v := range delegateTypeNames {
+		if v == s || fmt.Sprintf("%d", k) == s {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown delegate type %s", s)
+}
+
+var executeStatusNames = map[ExecuteStatus]string{
+	ExecuteStatusNotExecute:      "not_execute",
+	ExecuteStatusSuccessFinished: "success",
+	ExecuteStatusErrorFinished:   "failed",
+	ExecuteStatusSkipped:         "skipped",
+}
+
+// ParseExecuteStatus 支持数字或者名字,比如1或者success
+func ParseExecuteStatus(s string) (status ExecuteStatus, err error) {
+	for k, v := range executeStatusNames {
+		if v == s || fmt.Sprintf("%d", k) == s {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown execute status %s", s)
+}
+
+/*
+DelegateExecuteRecordQuery 查询执行记录的条件,Delegator必须指定,
+其他为空表示不限制
+*/
+type DelegateExecuteRecordQuery struct {
+	Delegator         common.Address
+	ChannelIdentifier common.Hash
+	Type              *DelegateType
+	Status            *ExecuteStatus
+	Limit             int
+}
+
+// GetDelegateExecuteRecords 按条件查询执行记录,按执行时间倒序
+func (model *ModelDB) GetDelegateExecuteRecords(q *DelegateExecuteRecordQuery) (rs []*DelegateExecuteRecord, err error) {
+	db := model.db.Where("delegator_str = ?", q.Delegator.String())
+	if q.ChannelIdentifier != utils.EmptyHash {
+		db = db.Where("channel_identifier_str = ?", q.ChannelIdentifier.String())
+	}
+	if q.Type != nil {
+		db = db.Where("type = ?", *q.Type)
+	}
+	if q.Status != nil {
+		db = db.Where("status = ?", *q.Status)
+	}
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit)
+	}
+	err = db.Order("execute_timestamp desc").Find(&rs).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_GetDelegateExecuteRecords(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	delegator := utils.NewRandomAddress()
+	d := &Delegate{
+		ChannelIdentifierStr: utils.NewRandomHash().String(),
+		DelegatorAddressStr:  delegator.String(),
+	}
+	d2 := &Delegate{
+		ChannelIdentifierStr: utils.NewRandomHash().String(),
+		DelegatorAddressStr:  delegator.String(),
+	}
+	du := &DelegateUnlock{
+		LockSecretHashStr: utils.NewRandomHash().String(),
+		AmountStr:         "10",
+		Expiration:        100,
+	}
+	r := NewDelegateExecuteRecord(d, DelegateTypeUnlock, du)
+	r.Status = ExecuteStatusSuccessFinished
+	m.SaveDelegateExecuteRecord(r)
+	r = NewDelegateExecuteRecord(d, DelegateTypePunish, &DelegatePunish{LockHashStr: utils.NewRandomHash().String()})
+	r.Status = ExecuteStatusErrorFinished
+	m.SaveDelegateExecuteRecord(r)
+	m.SaveDelegateExecuteRecord(NewDelegateExecuteRecord(d2, DelegateTypeUnlock, du))
+	m.SaveDelegateExecuteRecord(NewDelegateExecuteRecord(&Delegate{DelegatorAddressStr: utils.NewRandomAddress().String()}, DelegateTypeUnlock, du))
+
+	rs, err := m.GetDelegateExecuteRecords(&DelegateExecuteRecordQuery{Delegator: delegator})
+	ast.Nil(err)
+	ast.EqualValues(3, len(rs))
+	rs, err = m.GetDelegateExecuteRecords(&DelegateExecuteRecordQuery{Delegator: delegator, ChannelIdentifier: d.ChannelIdentifier()})
+	ast.Nil(err)
+	ast.EqualValues(2, len(rs))
+	tp, err := ParseDelegateType("unlock")
+	ast.Nil(err)
+	rs, err = m.GetDelegateExecuteRecords(&DelegateExecuteRecordQuery{Delegator: delegator, Type: &tp})
+	ast.Nil(err)
+	ast.EqualValues(2, len(rs))
+	status, err := ParseExecuteStatus("1")
+	ast.Nil(err)
+	rs, err = m.GetDelegateExecuteRecords(&DelegateExecuteRecordQuery{Delegator: delegator, Type: &tp, Status: &status})
+	ast.Nil(err)
+	ast.EqualValues(1, len(rs))
+	p, err := rs[0].Params()
+	ast.Nil(err)
+	ast.Equal(du, p)
+	rs, err = m.GetDelegateExecuteRecords(&DelegateExecuteRecordQuery{Delegator: delegator, Limit: 1})
+	ast.Nil(err)
+	ast.EqualValues(1, len(rs))
+
+	_, err = ParseDelegateType("withdraw")
+	ast.NotNil(err)
+}
@@ -16,6 +16,7 @@ type DelegatePunish struct {
 	DelegateKey       []byte `json:"delegate_key" gorm:"index"` // 对应的photonDelegateKey
 	AdditionalHashStr string `json:"additional_hash"`
 	Signature         []byte `json:"signature"`
+	Punished          bool   `json:"punished"` // 已经惩罚成功
 }
 
 // LockHash getter
@@ -43,6 +44,12 @@ func (model *ModelDB) GetDelegatePunishListByDelegateKey(delegateKey []byte) (du
 	return
 }
 
+// MarkDelegatePunished punish tx success
+func (model *ModelDB) MarkDelegatePunished(dp *DelegatePunish) error {
+	dp.Punished = true
+	return model.db.Model(dp).Where("id = ?", dp.ID).UpdateColumn("Punished", true).Error
+}
+
 func init() {
 	gob.Register(&DelegatePunish{})
 }
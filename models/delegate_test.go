@@ -201,3 +201,183 @@ func TestModelDB_DelegateNewDelegateWithPunishes(t *testing.T) {
 	err = m.ReceiveDelegate(c, addr)
 	ast.Nil(err)
 }
+
+func TestModelDB_SkipUpdateBalanceProof(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	oldFee := params.SmtUpdateTransfer
+	params.SmtUpdateTransfer = big.NewInt(10)
+	defer func() {
+		params.SmtUpdateTransfer = oldFee
+	}()
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+	}
+	c.UpdateTransfer.Nonce = 2
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	ast.EqualValues(big.NewInt(10), m.AccountGetAccount(addr).NeedSmt)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	err = m.SkipUpdateBalanceProof(d, DelegateStatusUpdateUnnecessary, "already on chain")
+	ast.Nil(err)
+	d = m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	ast.EqualValues(DelegateStatusUpdateUnnecessary, d.Status)
+	ast.True(d.UpdateBalanceProofSkipped())
+	ast.EqualValues(big.NewInt(0), d.NeedSMT())
+	ast.EqualValues(big.NewInt(0), m.AccountGetAccount(addr).NeedSmt)
+}
+
+func TestModelDB_SetFees(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	ast.Equal(params.SmtUnlock, m.Fees().Unlock)
+	// 同一进程中的另一个网络有自己的收费
+	fees := params.DefaultFees()
+	fees.UpdateTransfer = big.NewInt(7)
+	fees.Punish = big.NewInt(5)
+	m.SetFees(fees)
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+		Punishes:          []*Punish{{LockHash: utils.NewRandomHash()}},
+	}
+	c.UpdateTransfer.Nonce = 2
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	ast.EqualValues(big.NewInt(12), m.AccountGetAccount(addr).NeedSmt)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	err = m.SkipUpdateBalanceProof(d, DelegateStatusUpdateUnnecessary, "already on chain")
+	ast.Nil(err)
+	ast.EqualValues(big.NewInt(5), m.AccountGetAccount(addr).NeedSmt)
+}
+
+func TestModelDB_DelegateFeesSnapshot(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	fees := params.DefaultFees()
+	fees.UpdateTransfer = big.NewInt(3)
+	m.SetFees(fees)
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+	}
+	c.UpdateTransfer.Nonce = 2
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	// 接受以后涨价,已经接受的委托仍然按原来的收费
+	raised := params.DefaultFees()
+	raised.UpdateTransfer = big.NewInt(10)
+	m.SetFees(raised)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	ast.EqualValues(big.NewInt(3), m.FeesOf(d).UpdateTransfer)
+	// 更新委托也不改变收费
+	c.UpdateTransfer.Nonce = 3
+	err = m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	d = m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	ast.EqualValues(big.NewInt(3), d.NeedSMT())
+	ast.EqualValues(big.NewInt(3), m.FeesOf(d).UpdateTransfer)
+	m.AccountAddSmt(addr, big.NewInt(3))
+	err = m.AccountLockSmt(addr, m.FeesOf(d).UpdateTransfer)
+	ast.Nil(err)
+	// 没有记录收费的旧委托使用当前收费
+	d.FeesGobBytes = nil
+	ast.EqualValues(big.NewInt(10), m.FeesOf(d).UpdateTransfer)
+}
+
+func TestModelDB_MarkDelegatePunished(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+		Punishes: []*Punish{
+			{LockHash: utils.NewRandomHash()},
+			{LockHash: utils.NewRandomHash()},
+		},
+	}
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	dps, err := m.GetDelegatePunishListByDelegateKey(d.Key)
+	ast.Nil(err)
+	ast.EqualValues(2, len(dps))
+	err = m.MarkDelegatePunished(dps[1])
+	ast.Nil(err)
+	dps, err = m.GetDelegatePunishListByDelegateKey(d.Key)
+	ast.Nil(err)
+	ast.False(dps[0].Punished)
+	ast.True(dps[1].Punished)
+}
+
+func TestModelDB_GetDelegates(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	addr := utils.NewRandomAddress()
+	token, partner := utils.NewRandomAddress(), utils.NewRandomAddress()
+	for i := 0; i < 3; i++ {
+		c := &ChannelFor3rd{
+			ChannelIdentifier: utils.NewRandomHash(),
+			OpenBlockNumber:   3,
+			TokenAddress:      token,
+			PartnerAddress:    partner,
+		}
+		if i == 2 {
+			c.PartnerAddress = utils.NewRandomAddress()
+		}
+		err := m.ReceiveDelegate(c, addr)
+		ast.Nil(err)
+	}
+	err := m.ReceiveDelegate(&ChannelFor3rd{ChannelIdentifier: utils.NewRandomHash()}, utils.NewRandomAddress())
+	ast.Nil(err)
+
+	ds, total, err := m.GetDelegates(&DelegateQuery{Delegator: addr})
+	ast.Nil(err)
+	ast.Equal(3, total)
+	ast.EqualValues(3, len(ds))
+	ds, total, err = m.GetDelegates(&DelegateQuery{Delegator: addr, Partner: partner, Token: token})
+	ast.Nil(err)
+	ast.Equal(2, total)
+	ast.EqualValues(2, len(ds))
+	ds, total, err = m.GetDelegates(&DelegateQuery{Delegator: addr, Offset: 2, Limit: 2})
+	ast.Nil(err)
+	ast.Equal(3, total)
+	ast.EqualValues(1, len(ds))
+	status := DelegateStatus(DelegateStatusFailed)
+	ds, total, err = m.GetDelegates(&DelegateQuery{Delegator: addr, Status: &status})
+	ast.Nil(err)
+	ast.Equal(0, total)
+	ast.EqualValues(0, len(ds))
+}
+
+func TestModelDB_GetNextDelegateMonitor(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	d := &Delegate{
+		Key:               utils.NewRandomHash().Bytes(),
+		SettleBlockNumber: 1000,
+	}
+	dm, err := m.GetNextDelegateMonitor(d.Key, 0)
+	ast.Nil(err)
+	ast.Nil(dm)
+	m.AddDelegateMonitor(d)
+	dm, err = m.GetNextDelegateMonitor(d.Key, 0)
+	ast.Nil(err)
+	ast.EqualValues(1000-params.RevealTimeout, dm.BlockNumber)
+	ast.EqualValues(MonitorTypeUnlockAndUpdateBalanceProof, dm.Type)
+	dm, err = m.GetNextDelegateMonitor(d.Key, 1000-int64(params.RevealTimeout)+1)
+	ast.Nil(err)
+	ast.EqualValues(1000, dm.BlockNumber)
+	ast.EqualValues(MonitorTypePunish, dm.Type)
+}
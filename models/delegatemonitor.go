@@ -3,10 +3,10 @@ package models
 import (
 	"fmt"
 
-	"github.com/SmartMeshFoundation/Spectrum/log"
-
 	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/jinzhu/gorm"
 )
 
@@ -17,6 +17,7 @@ type MonitorType int
 const (
 	MonitorTypeUnlockAndUpdateBalanceProof = iota // updateBalanceProof及unlock
 	MonitorTypePunish                             // 惩罚
+	MonitorTypePunishLock                         // 对方unlock了已经声明放弃的锁,惩罚指定的锁
 )
 
 // DelegateMonitor 存储一次委托的触发时间点
@@ -24,18 +25,40 @@ type DelegateMonitor struct {
 	Key         []byte `gorm:"primary_key"` // 随机生成,唯一
 	BlockNumber int64  `gorm:"index"`
 	Type        MonitorType
-	DelegateKey []byte
+	DelegateKey []byte `gorm:"index"`
+	LockHashStr string // 仅MonitorTypePunishLock使用
+	Done        bool   `gorm:"default:0"` // 已经开始执行,重新扫描这个块时不再执行
 }
 
-//GetDelegateMonitorList return all delegates which should be executed at `blockNumber`
+//GetDelegateMonitorList return all delegates which should be executed at `blockNumber` and have not been executed
 func (model *ModelDB) GetDelegateMonitorList(blockNumber int64) (dms []*DelegateMonitor, err error) {
-	dm := &DelegateMonitor{
-		BlockNumber: blockNumber,
+	err = model.db.Where("block_number = ? AND done = ?", blockNumber, false).Find(&dms).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
 	}
-	err = model.db.Where(dm).Find(&dms).Error
+	return
+}
+
+//MarkDelegateMonitorDone 委托已经开始执行
+func (model *ModelDB) MarkDelegateMonitorDone(dm *DelegateMonitor) error {
+	dm.Done = true
+	return model.db.Model(dm).UpdateColumn("done", true).Error
+}
+
+/*
+GetNextDelegateMonitor 返回一个委托在fromBlockNumber(包含)之后最早的Monitor,
+也就是下一次计划执行的时间点,没有则返回nil
+*/
+func (model *ModelDB) GetNextDelegateMonitor(delegateKey []byte, fromBlockNumber int64) (dm *DelegateMonitor, err error) {
+	var dms []*DelegateMonitor
+	err = model.db.Where("delegate_key = ? AND block_number >= ? AND done = ?", delegateKey, fromBlockNumber, false).
+		Order("block_number asc").Limit(1).Find(&dms).Error
 	if err == gorm.ErrRecordNotFound {
 		err = nil
 	}
+	if len(dms) > 0 {
+		dm = dms[0]
+	}
 	return
 }
 
@@ -55,27 +78,75 @@ func AddDelegateMonitorInTx(tx *gorm.DB, d *Delegate) {
 			3. 如果photon保持无网到RevealTimeout这么久,出现安全问题,photon自己担责.
 	*/
 	updateBalanceProofTime := d.SettleBlockNumber - int64(params.RevealTimeout)
-	err := tx.Save(&DelegateMonitor{
+	/*
+		代理惩罚部分统一在通道 settle time out 以后进行,避免和真正的参与方发生冲突.
+	*/
+	added := addDelegateMonitorOnceInTx(tx, d, updateBalanceProofTime, MonitorTypeUnlockAndUpdateBalanceProof)
+	added = addDelegateMonitorOnceInTx(tx, d, d.SettleBlockNumber, MonitorTypePunish) || added
+	if !added {
+		return
+	}
+	log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] will try to UpdateTransfer and Unlock at %d and Punish at %d ",
+		d.ChannelIdentifierStr, d.DelegatorAddressStr, updateBalanceProofTime, d.SettleBlockNumber))
+}
+
+// AddDelegatePunishLockMonitor 在blockNumber惩罚对方unlock的指定锁
+func (model *ModelDB) AddDelegatePunishLockMonitor(d *Delegate, blockNumber int64, lockHash common.Hash) {
+	// 重新扫描时会再次收到unlock事件,一个锁只需要惩罚一次
+	var n int
+	err := model.db.Model(&DelegateMonitor{}).Where("delegate_key = ? AND type = ? AND lock_hash_str = ?",
+		d.Key, MonitorTypePunishLock, lockHash.String()).Count(&n).Error
+	if err != nil {
+		panic(fmt.Sprintf("db err %s", err))
+	}
+	if n > 0 {
+		return
+	}
+	err = model.db.Save(&DelegateMonitor{
 		Key:         utils.NewRandomAddress().Bytes(),
-		BlockNumber: updateBalanceProofTime,
-		Type:        MonitorTypeUnlockAndUpdateBalanceProof,
+		BlockNumber: blockNumber,
+		Type:        MonitorTypePunishLock,
 		DelegateKey: d.Key,
+		LockHashStr: lockHash.String(),
 	}).Error
 	if err != nil {
 		panic(fmt.Sprintf("db err %s", err))
 	}
-	/*
-		代理惩罚部分统一在通道 settle time out 以后进行,避免和真正的参与方发生冲突.
-	*/
-	err = tx.Save(&DelegateMonitor{
+	log.Info(fmt.Sprintf("delegate [channel=%s delegator=%s] will try to Punish lock %s at %d",
+		d.ChannelIdentifierStr, d.DelegatorAddressStr, lockHash.String(), blockNumber))
+}
+
+// LockHash getter
+func (dm *DelegateMonitor) LockHash() common.Hash {
+	return common.HexToHash(dm.LockHashStr)
+}
+
+func addDelegateMonitorInTx(tx *gorm.DB, d *Delegate, blockNumber int64, monitorType MonitorType) {
+	err := tx.Save(&DelegateMonitor{
 		Key:         utils.NewRandomAddress().Bytes(),
-		BlockNumber: d.SettleBlockNumber,
-		Type:        MonitorTypePunish,
+		BlockNumber: blockNumber,
+		Type:        monitorType,
 		DelegateKey: d.Key,
 	}).Error
 	if err != nil {
 		panic(fmt.Sprintf("db err %s", err))
 	}
-	log.Info("delegate [channel=%s delegator=%s] will try to UpdateTransfer and Unlock at %d and Punish at %d ",
-		d.ChannelIdentifierStr, d.DelegatorAddressStr, updateBalanceProofTime, d.SettleBlockNumber)
+}
+
+/*
+addDelegateMonitorOnceInTx 重新扫描时会再次处理同一个通道关闭事件,
+已经有相同的Monitor时不管是否执行过都不再添加,returns true if added
+*/
+func addDelegateMonitorOnceInTx(tx *gorm.DB, d *Delegate, blockNumber int64, monitorType MonitorType) bool {
+	var n int
+	err := tx.Model(&DelegateMonitor{}).Where("delegate_key = ? AND block_number = ? AND type = ?",
+		d.Key, blockNumber, monitorType).Count(&n).Error
+	if err != nil {
+		panic(fmt.Sprintf("db err %s", err))
+	}
+	if n > 0 {
+		return false
+	}
+	addDelegateMonitorInTx(tx, d, blockNumber, monitorType)
+	return true
 }
@@ -31,3 +31,20 @@ func TestModelDB_DelegateMonitorAdd(t *testing.T) {
 		return
 	}
 }
+
+func TestModelDB_AddDelegatePunishLockMonitor(t *testing.T) {
+	m := SetupTestDb(t)
+	d := &Delegate{
+		Key: utils.NewRandomHash().Bytes(),
+	}
+	lockHash := utils.NewRandomHash()
+	m.AddDelegatePunishLockMonitor(d, 20, lockHash)
+	ds, err := m.GetDelegateMonitorList(20)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(ds) != 1 || ds[0].Type != MonitorTypePunishLock || ds[0].LockHash() != lockHash {
+		t.Errorf("ds=%#v", ds)
+	}
+}
@@ -52,6 +52,7 @@ type ChannelFor3rd struct {
 	AnnouceDisposed   []*AnnouceDisposed `json:"annouce_disposed"`
 	Secrets           []*Secret          `json:"secrets"`
 	settleBlockNumber int64              //for internal use,
+	unlocksIncomplete bool               //for internal use,
 }
 
 //SetSettleBlockNumber 设置blockNumber,主要用于解决用户委托的时候通道已经关闭的情形.
@@ -59,6 +60,11 @@ func (c *ChannelFor3rd) SetSettleBlockNumber(blockNumber int64) {
 	c.settleBlockNumber = blockNumber
 }
 
+//SetUnlocksIncomplete 委托的unlock没有包含locksroot中的全部锁
+func (c *ChannelFor3rd) SetUnlocksIncomplete(incomplete bool) {
+	c.unlocksIncomplete = incomplete
+}
+
 // GetDelegateUpdateBalanceProof change UpdateTransfer to DelegateUpdateBalanceProof
 func (c *ChannelFor3rd) GetDelegateUpdateBalanceProof() *DelegateUpdateBalanceProof {
 	return &DelegateUpdateBalanceProof{
@@ -0,0 +1,313 @@
+package models
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+数据库中的密码,balance proof签名,punish签名等敏感数据使用AES-GCM加密保存,
+拿到log.db的人无法抢先注册密码.
+密文格式为 encryptedMagic(4字节)+keyID(4字节)+nonce(12字节)+密文,
+keyID用来在密钥轮换以后找到对应的旧密钥.
+没有设置密钥时按原来的方式明文保存.
+*/
+var encryptedMagic = []byte("PMSE")
+
+const (
+	keyIDLength       = 4
+	secretIndexPrefix = "hmac:"
+)
+
+type dataKey struct {
+	id    []byte
+	aead  cipher.AEAD
+	index []byte // 计算密码索引的HMAC密钥
+}
+
+func newDataKey(key []byte) (*dataKey, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("data key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{
+		id:    utils.Sha3(key).Bytes()[:keyIDLength],
+		aead:  aead,
+		index: utils.Sha3([]byte("index"), key).Bytes(),
+	}, nil
+}
+
+var dataKeys struct {
+	sync.RWMutex
+	current *dataKey
+	all     []*dataKey
+}
+
+/*
+SetDataKeys 设置加密数据库使用的密钥,新数据总是用current加密,
+old是轮换之前的密钥,只用来解密.current为空表示不加密,但是仍然可以用old解密
+*/
+func SetDataKeys(current []byte, old ...[]byte) error {
+	dataKeys.Lock()
+	defer dataKeys.Unlock()
+	dataKeys.current = nil
+	dataKeys.all = nil
+	if len(current) > 0 {
+		k, err := newDataKey(current)
+		if err != nil {
+			return err
+		}
+		dataKeys.current = k
+		dataKeys.all = append(dataKeys.all, k)
+	}
+	for _, o := range old {
+		k, err := newDataKey(o)
+		if err != nil {
+			return err
+		}
+		dataKeys.all = append(dataKeys.all, k)
+	}
+	return nil
+}
+
+//DeriveDataKeyFromPrivateKey 从PMS的私钥派生数据库密钥,这样不需要额外保管密钥
+func DeriveDataKeyFromPrivateKey(key *ecdsa.PrivateKey) []byte {
+	return utils.Sha3([]byte("photon monitoring data key"), crypto.FromECDSA(key)).Bytes()
+}
+
+//DeriveDataKeyFromPassphrase 从单独的口令派生数据库密钥
+func DeriveDataKeyFromPassphrase(passphrase []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, []byte("photon monitoring data key"), 1<<15, 8, 1, 32)
+}
+
+func isEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, encryptedMagic)
+}
+
+//encryptField 用当前密钥加密,没有密钥,数据为空或者已经加密时原样返回
+func encryptField(plain []byte) ([]byte, error) {
+	dataKeys.RLock()
+	k := dataKeys.current
+	dataKeys.RUnlock()
+	if k == nil || len(plain) == 0 || isEncrypted(plain) {
+		return plain, nil
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, encryptedMagic...)
+	out = append(out, k.id...)
+	out = append(out, nonce...)
+	return k.aead.Seal(out, nonce, plain, nil), nil
+}
+
+//decryptField 按密文中的keyID找到密钥解密,明文数据原样返回
+func decryptField(b []byte) ([]byte, error) {
+	if !isEncrypted(b) {
+		return b, nil
+	}
+	header := len(encryptedMagic) + keyIDLength
+	if len(b) < header {
+		return nil, fmt.Errorf("encrypted data too short")
+	}
+	id := b[len(encryptedMagic):header]
+	dataKeys.RLock()
+	defer dataKeys.RUnlock()
+	for _, k := range dataKeys.all {
+		if !bytes.Equal(k.id, id) {
+			continue
+		}
+		if len(b) < header+k.aead.NonceSize() {
+			return nil, fmt.Errorf("encrypted data too short")
+		}
+		nonce := b[header : header+k.aead.NonceSize()]
+		return k.aead.Open(nil, nonce, b[header+k.aead.NonceSize():], nil)
+	}
+	return nil, fmt.Errorf("no data key for encrypted data, key id=%s", hex.EncodeToString(id))
+}
+
+func encryptFields(fields ...*[]byte) (err error) {
+	for _, f := range fields {
+		*f, err = encryptField(*f)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func decryptFields(fields ...*[]byte) (err error) {
+	for _, f := range fields {
+		*f, err = decryptField(*f)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func hmacIndex(k *dataKey, secret string) string {
+	mac := hmac.New(sha256.New, k.index)
+	_, err := mac.Write([]byte(secret))
+	if err != nil {
+		panic(err)
+	}
+	return secretIndexPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+secretIndex DelegateExecuteRecord.Secret中保存的是密码的HMAC而不是密码本身,
+只用于查询密码是否注册过.没有密钥时仍然是明文
+*/
+func secretIndex(secret string) string {
+	dataKeys.RLock()
+	defer dataKeys.RUnlock()
+	if dataKeys.current == nil {
+		return secret
+	}
+	return hmacIndex(dataKeys.current, secret)
+}
+
+//secretIndexes 密码在明文以及所有密钥下的索引,密钥轮换以后还没有rekey的记录也能查到
+func secretIndexes(secret string) []string {
+	dataKeys.RLock()
+	defer dataKeys.RUnlock()
+	indexes := []string{secret}
+	for _, k := range dataKeys.all {
+		indexes = append(indexes, hmacIndex(k, secret))
+	}
+	return indexes
+}
+
+/*
+gorm hooks,保存前加密,保存后和读出后解密,所以内存中的数据始终是明文,
+对已经加密的数据重复加密或者对明文解密都不会有副作用
+*/
+
+//BeforeSave encrypt balance proof,unlocks and secrets
+func (d *Delegate) BeforeSave() error {
+	return encryptFields(&d.UpdateBalanceProofGobBytes, &d.UnlocksGobBytes, &d.SecretsGobBytes)
+}
+
+//AfterSave decrypt
+func (d *Delegate) AfterSave() error {
+	return decryptFields(&d.UpdateBalanceProofGobBytes, &d.UnlocksGobBytes, &d.SecretsGobBytes)
+}
+
+//AfterFind decrypt
+func (d *Delegate) AfterFind() error {
+	return decryptFields(&d.UpdateBalanceProofGobBytes, &d.UnlocksGobBytes, &d.SecretsGobBytes)
+}
+
+//BeforeSave encrypt signature
+func (dp *DelegatePunish) BeforeSave() error {
+	return encryptFields(&dp.Signature)
+}
+
+//AfterSave decrypt
+func (dp *DelegatePunish) AfterSave() error {
+	return decryptFields(&dp.Signature)
+}
+
+//AfterFind decrypt
+func (dp *DelegatePunish) AfterFind() error {
+	return decryptFields(&dp.Signature)
+}
+
+//BeforeSave encrypt params, and replace secret with its index
+func (r *DelegateExecuteRecord) BeforeSave() error {
+	if r.Type == DelegateTypeRegisterSecret && r.Secret != "" {
+		// 从参数中取密码重新计算,这样密钥轮换以后rekey也会更新索引
+		p, err := r.Params()
+		if err != nil {
+			return err
+		}
+		r.Secret = secretIndex(p.(*DelegateSecret).Secret)
+	}
+	return encryptFields(&r.GobParams)
+}
+
+//AfterSave decrypt
+func (r *DelegateExecuteRecord) AfterSave() error {
+	return decryptFields(&r.GobParams)
+}
+
+//AfterFind decrypt
+func (r *DelegateExecuteRecord) AfterFind() error {
+	return decryptFields(&r.GobParams)
+}
+
+//BeforeSave encrypt snapshot of delegate and punishes
+func (da *DelegateArchive) BeforeSave() error {
+	return encryptFields(&da.DelegateGobBytes, &da.PunishesGobBytes)
+}
+
+//AfterSave decrypt
+func (da *DelegateArchive) AfterSave() error {
+	return decryptFields(&da.DelegateGobBytes, &da.PunishesGobBytes)
+}
+
+//AfterFind decrypt
+func (da *DelegateArchive) AfterFind() error {
+	return decryptFields(&da.DelegateGobBytes, &da.PunishesGobBytes)
+}
+
+/*
+RekeyDB 用SetDataKeys设置的旧密钥解密所有敏感数据,再用当前密钥重新加密,
+用于轮换密钥,给旧数据库加密,或者当前密钥为空时解密整个数据库.
+返回重新保存的记录数
+*/
+func (model *ModelDB) RekeyDB() (n int, err error) {
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+	var ds []*Delegate
+	var dps []*DelegatePunish
+	var rs []*DelegateExecuteRecord
+	var das []*DelegateArchive
+	for _, rows := range []interface{}{&ds, &dps, &rs, &das} {
+		err = tx.Find(rows).Error
+		if err != nil {
+			err = fmt.Errorf("read %T err %s", rows, err)
+			return
+		}
+		v := reflect.ValueOf(rows).Elem()
+		for i := 0; i < v.Len(); i++ {
+			err = tx.Save(v.Index(i).Interface()).Error
+			if err != nil {
+				err = fmt.Errorf("save %T err %s", rows, err)
+				return
+			}
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptField(t *testing.T) {
+	ast := assert.New(t)
+	defer SetDataKeys(nil)
+	plain := []byte("secret")
+	ast.Nil(SetDataKeys(nil))
+	b, err := encryptField(plain)
+	ast.Nil(err)
+	ast.Equal(plain, b)
+
+	k1, k2 := utils.NewRandomHash().Bytes(), utils.NewRandomHash().Bytes()
+	ast.Nil(SetDataKeys(k1))
+	c1, err := encryptField(plain)
+	ast.Nil(err)
+	ast.True(isEncrypted(c1))
+	ast.False(bytes.Contains(c1, plain))
+	// 重复加密没有影响
+	c, err := encryptField(c1)
+	ast.Nil(err)
+	ast.Equal(c1, c)
+	b, err = decryptField(c1)
+	ast.Nil(err)
+	ast.Equal(plain, b)
+	// 明文原样返回
+	b, err = decryptField(plain)
+	ast.Nil(err)
+	ast.Equal(plain, b)
+
+	// 轮换以后旧密钥加密的数据仍然可以解密
+	ast.Nil(SetDataKeys(k2, k1))
+	b, err = decryptField(c1)
+	ast.Nil(err)
+	ast.Equal(plain, b)
+	ast.Nil(SetDataKeys(k2))
+	_, err = decryptField(c1)
+	ast.NotNil(err)
+	c1[len(c1)-1]++
+	ast.Nil(SetDataKeys(k1))
+	_, err = decryptField(c1)
+	ast.NotNil(err)
+
+	ast.NotNil(SetDataKeys([]byte("short")))
+}
+
+func TestModelDB_RekeyDB(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	defer SetDataKeys(nil)
+	// 没有加密的旧数据库
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+		Punishes: []*Punish{
+			{LockHash: utils.NewRandomHash(), Signature: []byte("punish signature")},
+		},
+		Secrets: []*Secret{
+			{Secret: utils.NewRandomHash(), RegisterBlock: 10},
+		},
+	}
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	r := NewDelegateExecuteRecord(d, DelegateTypeRegisterSecret, d.Secrets()[0])
+	r.Secret = d.Secrets()[0].Secret
+	r.Status = ExecuteStatusSuccessFinished
+	m.SaveDelegateExecuteRecord(r)
+	ast.True(m.HasSecretAlreadyRegister(c.Secrets[0].Secret))
+
+	rawSecrets := func() []byte {
+		var b []byte
+		err := m.db.Model(&Delegate{}).Where(&Delegate{Key: d.Key}).Select("secrets_gob_bytes").Row().Scan(&b)
+		ast.Nil(err)
+		return b
+	}
+	rawSecretIndex := func() string {
+		var s string
+		err := m.db.Model(&DelegateExecuteRecord{}).Where(&DelegateExecuteRecord{Key: r.Key}).Select("secret").Row().Scan(&s)
+		ast.Nil(err)
+		return s
+	}
+	ast.False(isEncrypted(rawSecrets()))
+	ast.Equal(c.Secrets[0].Secret.String(), rawSecretIndex())
+
+	// 加密旧数据库
+	k1, k2 := utils.NewRandomHash().Bytes(), utils.NewRandomHash().Bytes()
+	ast.Nil(SetDataKeys(k1))
+	n, err := m.RekeyDB()
+	ast.Nil(err)
+	ast.EqualValues(3, n)
+	ast.True(isEncrypted(rawSecrets()))
+	ast.NotEqual(c.Secrets[0].Secret.String(), rawSecretIndex())
+	ast.True(m.HasSecretAlreadyRegister(c.Secrets[0].Secret))
+	d2, err := m.GetDelegateByKey(d.Key)
+	ast.Nil(err)
+	ast.Equal(c.Secrets[0].Secret.String(), d2.Secrets()[0].Secret)
+	dps, err := m.GetDelegatePunishListByDelegateKey(d.Key)
+	ast.Nil(err)
+	ast.Equal([]byte("punish signature"), dps[0].Signature)
+
+	// 轮换密钥,rekey之前旧数据用旧密钥读取
+	ast.Nil(SetDataKeys(k2, k1))
+	old := rawSecrets()
+	ast.True(m.HasSecretAlreadyRegister(c.Secrets[0].Secret))
+	_, err = m.RekeyDB()
+	ast.Nil(err)
+	ast.NotEqual(old, rawSecrets())
+	ast.Nil(SetDataKeys(k2))
+	ast.True(m.HasSecretAlreadyRegister(c.Secrets[0].Secret))
+	ast.False(m.HasSecretAlreadyRegister(utils.NewRandomHash()))
+	rs, err := m.GetDelegateExecuteRecords(&DelegateExecuteRecordQuery{Delegator: addr})
+	ast.Nil(err)
+	p, err := rs[0].Params()
+	ast.Nil(err)
+	ast.Equal(c.Secrets[0].Secret.String(), p.(*DelegateSecret).Secret)
+
+	// 没有密钥无法读取
+	ast.Nil(SetDataKeys(nil))
+	_, err = m.GetDelegateByKey(d.Key)
+	ast.NotNil(err)
+}
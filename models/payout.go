@@ -0,0 +1,221 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	utils2 "github.com/SmartMeshFoundation/Photon-Monitoring/utils"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
+)
+
+// PayoutStatus 退款状态
+type PayoutStatus int
+
+const (
+	//PayoutStatusPending 等待发送
+	PayoutStatusPending PayoutStatus = iota
+	//PayoutStatusSending 正在发送,如果此时程序退出,无法确定是否已经发出
+	PayoutStatusSending
+	//PayoutStatusSuccess 退款成功
+	PayoutStatusSuccess
+	//PayoutStatusFailed 退款失败,金额已经退回账户
+	PayoutStatusFailed
+	//PayoutStatusUnknown 无法确定是否发出,金额不退回,需要人工核对
+	PayoutStatusUnknown
+)
+
+/*
+Payout 一次退款,用户申请退款时即从账户中扣除,
+由PayoutSender通过photon转账或者链上erc20转账发给用户
+*/
+type Payout struct {
+	Key          string       `json:"key" gorm:"primary_key"` // BuildPayoutKey
+	DelegatorStr string       `json:"delegator" gorm:"index"`
+	AmountStr    string       `json:"amount"`
+	Nonce        int64        `json:"nonce"` // 用户签名的nonce,单增,防止重放
+	Method       string       `json:"method"`
+	Status       PayoutStatus `json:"status" gorm:"index"`
+	Reference    string       `json:"reference"` // tx hash 或者 photon 转账的 lock secret hash
+	Error        string       `json:"error"`
+	CreateTime   int64        `json:"create_time"`
+	UpdateTime   int64        `json:"update_time"`
+}
+
+// Delegator getter
+func (p *Payout) Delegator() common.Address {
+	return common.HexToAddress(p.DelegatorStr)
+}
+
+// Amount getter
+func (p *Payout) Amount() *big.Int {
+	return utils2.StringToBigInt(p.AmountStr)
+}
+
+//BuildPayoutKey key of payout
+func BuildPayoutKey(delegator common.Address, nonce int64) string {
+	return fmt.Sprintf("%s-%d", delegator.String(), nonce)
+}
+
+/*
+CreatePayout 创建退款,扣除账户余额和保存退款记录在同一个事务中完成.
+只能退还没有被委托占用的部分,即 Available-NeedSmt
+*/
+func (model *ModelDB) CreatePayout(delegator common.Address, amount *big.Int, nonce int64, method string) (p *Payout, err error) {
+	if amount == nil || amount.Sign() <= 0 {
+		err = fmt.Errorf("invalid refund amount %s", amount)
+		return
+	}
+	model.lock.Lock()
+	defer model.lock.Unlock()
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	var last Payout
+	err = tx.Where("delegator_str = ?", delegator.String()).Order("nonce desc").First(&last).Error
+	if err == nil && last.Nonce >= nonce {
+		err = fmt.Errorf("nonce must be larger than %d", last.Nonce)
+		return
+	}
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return
+	}
+	a := GetAccountInTx(tx, delegator)
+	refundable := AccountAvailable(a)
+	refundable.Sub(refundable, a.NeedSmt)
+	if refundable.Cmp(amount) < 0 {
+		err = fmt.Errorf("balance not enough,refundable=%s,amount=%s", refundable, amount)
+		return
+	}
+	a.WithdrawnSmt.Add(a.WithdrawnSmt, amount)
+	model.accountSanity(a)
+	err = updateAccountColumnInTx(tx, a, "withdrawn_smt_bytes", a.WithdrawnSmt.Bytes())
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	p = &Payout{
+		Key:          BuildPayoutKey(delegator, nonce),
+		DelegatorStr: delegator.String(),
+		AmountStr:    amount.String(),
+		Nonce:        nonce,
+		Method:       method,
+		Status:       PayoutStatusPending,
+		CreateTime:   now,
+		UpdateTime:   now,
+	}
+	err = tx.Create(p).Error
+	if err != nil {
+		return
+	}
+	err = tx.Commit().Error
+	return
+}
+
+//GetPayout returns payout by key
+func (model *ModelDB) GetPayout(key string) (p *Payout, err error) {
+	p = &Payout{}
+	err = model.db.Where(&Payout{Key: key}).First(p).Error
+	return
+}
+
+//GetPayoutsByDelegator returns all payouts of delegator
+func (model *ModelDB) GetPayoutsByDelegator(delegator common.Address) (ps []*Payout, err error) {
+	err = model.db.Where("delegator_str = ?", delegator.String()).Order("nonce").Find(&ps).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
+
+//GetPayoutsByStatus returns all payouts of status
+func (model *ModelDB) GetPayoutsByStatus(status PayoutStatus) (ps []*Payout, err error) {
+	err = model.db.Where("status = ?", status).Order("create_time").Find(&ps).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
+
+/*
+UpdatePayoutStatus 更新退款状态,失败的退款在同一个事务中退回账户
+*/
+func (model *ModelDB) UpdatePayoutStatus(key string, status PayoutStatus, reference, errMsg string) (err error) {
+	model.lock.Lock()
+	defer model.lock.Unlock()
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	p := &Payout{}
+	err = tx.Where(&Payout{Key: key}).First(p).Error
+	if err != nil {
+		return
+	}
+	if p.Status == PayoutStatusSuccess || p.Status == PayoutStatusFailed {
+		err = fmt.Errorf("payout %s already finished with status %d", key, p.Status)
+		return
+	}
+	if status == PayoutStatusFailed {
+		a := GetAccountInTx(tx, p.Delegator())
+		a.WithdrawnSmt.Sub(a.WithdrawnSmt, p.Amount())
+		model.accountSanity(a)
+		err = updateAccountColumnInTx(tx, a, "withdrawn_smt_bytes", a.WithdrawnSmt.Bytes())
+		if err != nil {
+			return
+		}
+		log.Info(fmt.Sprintf("payout %s failed, return %s to %s", key, p.AmountStr, p.DelegatorStr))
+	}
+	p.Status = status
+	p.Reference = reference
+	p.Error = errMsg
+	p.UpdateTime = time.Now().Unix()
+	err = tx.Save(p).Error
+	if err != nil {
+		return
+	}
+	err = tx.Commit().Error
+	return
+}
+
+//RefundRequest 用户申请退款,需要用户签名
+type RefundRequest struct {
+	Amount    *big.Int `json:"amount"`
+	Nonce     int64    `json:"nonce"`
+	Signature []byte   `json:"signature"`
+}
+
+/*
+DataToSign 用户签名的数据,包含PMS地址防止在其他PMS上重放,
+包含chain id和registry地址防止在同一个PMS服务的其他网络上重放
+*/
+func (r *RefundRequest) DataToSign(pms common.Address, chainID *big.Int, registry common.Address) []byte {
+	buf := new(bytes.Buffer)
+	_, err := buf.Write(pms[:])
+	_, err = buf.Write(utils.BigIntTo32Bytes(chainID))
+	_, err = buf.Write(registry[:])
+	_, err = buf.Write(utils.BigIntTo32Bytes(r.Amount))
+	err = binary.Write(buf, binary.BigEndian, r.Nonce)
+	if err != nil {
+		log.Error(fmt.Sprintf("buf write error %s", err))
+	}
+	return buf.Bytes()
+}
+
+//Signer returns the address who signed the request
+func (r *RefundRequest) Signer(pms common.Address, chainID *big.Int, registry common.Address) (common.Address, error) {
+	if r.Amount == nil {
+		return common.Address{}, fmt.Errorf("refund without amount")
+	}
+	return utils.Ecrecover(utils.Sha3(r.DataToSign(pms, chainID, registry)), r.Signature)
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_CreatePayout(t *testing.T) {
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	addr := utils.NewRandomAddress()
+	m.AccountAddSmt(addr, big.NewInt(100))
+	m.accountUpdateNeedSmt(addr, big.NewInt(30))
+
+	//被委托占用的部分不能退
+	_, err := m.CreatePayout(addr, big.NewInt(80), 1, "photon")
+	assert.NotNil(t, err)
+	p, err := m.CreatePayout(addr, big.NewInt(50), 1, "photon")
+	assert.Nil(t, err)
+	assert.EqualValues(t, PayoutStatusPending, p.Status)
+	a := m.AccountGetAccount(addr)
+	assert.EqualValues(t, big.NewInt(50), a.WithdrawnSmt)
+	assert.EqualValues(t, big.NewInt(50), AccountAvailable(a))
+	//重放
+	_, err = m.CreatePayout(addr, big.NewInt(10), 1, "photon")
+	assert.NotNil(t, err)
+
+	p2, err := m.CreatePayout(addr, big.NewInt(20), 2, "photon")
+	assert.Nil(t, err)
+	err = m.UpdatePayoutStatus(p.Key, PayoutStatusSuccess, "0x01", "")
+	assert.Nil(t, err)
+	//失败的退款退回账户
+	err = m.UpdatePayoutStatus(p2.Key, PayoutStatusFailed, "", "failed")
+	assert.Nil(t, err)
+	err = m.UpdatePayoutStatus(p2.Key, PayoutStatusFailed, "", "failed")
+	assert.NotNil(t, err)
+	a = m.AccountGetAccount(addr)
+	assert.EqualValues(t, big.NewInt(50), a.WithdrawnSmt)
+	//退款只更新withdrawn,不影响其他列
+	assert.EqualValues(t, big.NewInt(30), a.NeedSmt)
+
+	ps, err := m.GetPayoutsByDelegator(addr)
+	assert.Nil(t, err)
+	if assert.EqualValues(t, 2, len(ps)) {
+		assert.EqualValues(t, PayoutStatusSuccess, ps[0].Status)
+		assert.EqualValues(t, "0x01", ps[0].Reference)
+		assert.EqualValues(t, PayoutStatusFailed, ps[1].Status)
+	}
+}
+
+func TestRefundRequest_Signer(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	pms := utils.NewRandomAddress()
+	registry := utils.NewRandomAddress()
+	chainID := big.NewInt(8888)
+	r := &RefundRequest{
+		Amount: big.NewInt(10),
+		Nonce:  3,
+	}
+	var err error
+	r.Signature, err = utils.SignData(key, r.DataToSign(pms, chainID, registry))
+	assert.Nil(t, err)
+	signer, err := r.Signer(pms, chainID, registry)
+	assert.Nil(t, err)
+	assert.EqualValues(t, crypto.PubkeyToAddress(key.PublicKey), signer)
+	//其他PMS不能重放
+	signer, err = r.Signer(utils.NewRandomAddress(), chainID, registry)
+	assert.NotEqual(t, crypto.PubkeyToAddress(key.PublicKey), signer)
+	//同一个PMS的其他网络也不能重放
+	signer, err = r.Signer(pms, big.NewInt(1), registry)
+	assert.NotEqual(t, crypto.PubkeyToAddress(key.PublicKey), signer)
+	signer, err = r.Signer(pms, chainID, utils.NewRandomAddress())
+	assert.NotEqual(t, crypto.PubkeyToAddress(key.PublicKey), signer)
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
+)
+
+/*
+ReconcileResult 一个账户的对账结果,只保留最近一次对账的结果
+Credited 是账户中记录的TotalReceivedSmt,
+Recorded 是ReceivedTransfer表中该账户所有到账之和,包括人工调整补记的到账,
+RecordedPhoton 是其中来自photon节点的部分,
+Node 是photon节点返回的该账户到账之和,节点不可用时为空
+*/
+type ReconcileResult struct {
+	AddressStr        string `json:"address" gorm:"primary_key"`
+	CreditedStr       string `json:"credited"`
+	RecordedStr       string `json:"recorded"`
+	RecordedPhotonStr string `json:"recorded_photon"`
+	NodeStr           string `json:"node"`
+	Consistent        bool   `json:"consistent"`
+	Reason            string `json:"reason"`
+	ReconcileTime     int64  `json:"reconcile_time"`
+}
+
+// Address getter
+func (r *ReconcileResult) Address() common.Address {
+	return common.HexToAddress(r.AddressStr)
+}
+
+//AccountGetAllAccounts returns all accounts
+func (model *ModelDB) AccountGetAllAccounts() (accounts []*Account, err error) {
+	var als []*accountSerialization
+	err = model.db.Find(&als).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	for _, al := range als {
+		accounts = append(accounts, al.toAccount())
+	}
+	return
+}
+
+//SaveReconcileResults replace the last reconcile results
+func (model *ModelDB) SaveReconcileResults(results []*ReconcileResult) (err error) {
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	err = tx.Delete(&ReconcileResult{}).Error
+	if err != nil {
+		return
+	}
+	for _, r := range results {
+		err = tx.Save(r).Error
+		if err != nil {
+			return
+		}
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Error(fmt.Sprintf("SaveReconcileResults commit err %s", err))
+	}
+	return
+}
+
+//GetReconcileResults returns the last reconcile results, only discrepancies if onlyDiscrepancy
+func (model *ModelDB) GetReconcileResults(onlyDiscrepancy bool) (results []*ReconcileResult, err error) {
+	d := model.db.Order("address_str")
+	if onlyDiscrepancy {
+		d = d.Where("consistent = ?", false)
+	}
+	err = d.Find(&results).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/jinzhu/gorm"
+)
+
+/*
+RescheduleInterruptedDelegates 修正上次退出时仍处于Running状态的委托.
+Running说明updateBalanceProof/unlock已经开始执行,但是没有等到结果进程就退出了,
+这时候tx可能已经上链,也可能没有发出去:
+1. 还没有到settle的,恢复为Init并安排在下一块重新执行,已经成功的tx重复执行只会失败,不会扣费
+2. 已经过了settle的,没有机会再执行了,标记为失败
+*/
+func (model *ModelDB) RescheduleInterruptedDelegates(lastBlockNumber int64) (n int, err error) {
+	var ds []*Delegate
+	err = model.db.Where(&Delegate{
+		Status: DelegateStatusRunning,
+	}).Find(&ds).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	if err != nil || len(ds) == 0 {
+		return
+	}
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+	for _, d := range ds {
+		if lastBlockNumber+1 < d.SettleBlockNumber {
+			d.Status = DelegateStatusInit
+			d.Error = "interrupted by shutdown, rescheduled"
+			addDelegateMonitorInTx(tx, d, lastBlockNumber+1, MonitorTypeUnlockAndUpdateBalanceProof)
+		} else {
+			d.Status = DelegateStatusFailed
+			d.Error = "interrupted by shutdown and settle block passed"
+		}
+		err = tx.Save(d).Error
+		if err != nil {
+			err = fmt.Errorf("db err when update Delegate : %s", err.Error())
+			return
+		}
+		log.Warn(fmt.Sprintf("delegate [channel=%s delegator=%s] was interrupted, %s",
+			d.ChannelIdentifierStr, d.DelegatorAddressStr, d.Error))
+		n++
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_RescheduleInterruptedDelegates(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	m.SaveLatestBlockNumber(100)
+	c := &ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+	}
+	addr := utils.NewRandomAddress()
+	err := m.ReceiveDelegate(c, addr)
+	ast.Nil(err)
+	addr2 := utils.NewRandomAddress()
+	err = m.ReceiveDelegate(c, addr2)
+	ast.Nil(err)
+	d := m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	d.SettleBlockNumber = 200
+	d.Status = DelegateStatusRunning
+	m.UpdateObject(d)
+	d2 := m.getDelegateByOriginKey(c.ChannelIdentifier, addr2)
+	d2.SettleBlockNumber = 100
+	d2.Status = DelegateStatusRunning
+	m.UpdateObject(d2)
+
+	n, err := m.RescheduleInterruptedDelegates(150)
+	ast.Nil(err)
+	ast.EqualValues(2, n)
+	d = m.getDelegateByOriginKey(c.ChannelIdentifier, addr)
+	ast.EqualValues(DelegateStatusInit, d.Status)
+	dms, err := m.GetDelegateMonitorList(151)
+	ast.Nil(err)
+	ast.EqualValues(1, len(dms))
+	ast.EqualValues(d.Key, dms[0].DelegateKey)
+	d2 = m.getDelegateByOriginKey(c.ChannelIdentifier, addr2)
+	ast.EqualValues(DelegateStatusFailed, d2.Status)
+
+	n, err = m.RescheduleInterruptedDelegates(150)
+	ast.Nil(err)
+	ast.EqualValues(0, n)
+}
+
+func TestModelDB_AccountReleaseAllLockedSmt(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	addr := utils.NewRandomAddress()
+	m.AccountAddSmt(addr, big.NewInt(20))
+	m.accountUpdateNeedSmt(addr, big.NewInt(20))
+	err := m.AccountLockSmt(addr, big.NewInt(10))
+	ast.Nil(err)
+	m.AccountAddSmt(utils.NewRandomAddress(), big.NewInt(5))
+	n, err := m.AccountReleaseAllLockedSmt()
+	ast.Nil(err)
+	ast.EqualValues(1, n)
+	a := m.AccountGetAccount(addr)
+	ast.EqualValues(big.NewInt(0), a.LockedSmt)
+	ast.EqualValues(big.NewInt(0), a.UsedSmt)
+	ast.EqualValues(big.NewInt(20), AccountAvailable(a))
+}
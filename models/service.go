@@ -27,8 +27,14 @@ func (model *ModelDB) ReceiveDelegate(c *ChannelFor3rd, delegator common.Address
 		}
 	}()
 	delegateKey := BuildDelegateKey(c.ChannelIdentifier, delegator)
+	// 已经接受的委托更新时沿用接受时的收费,同一个委托的NeedSMT和执行时扣的费用总是一致的
+	fees := model.Fees()
+	old := &Delegate{}
+	if tx.Where(&Delegate{Key: delegateKey}).Find(old).Error == nil && old.Fees() != nil {
+		fees = old.Fees()
+	}
 	// 1. 追加Punish部分
-	newSMT4Punish, err := appendDelegatePunish(tx, delegateKey, c.Punishes)
+	newSMT4Punish, err := appendDelegatePunish(tx, delegateKey, c.Punishes, fees.Punish)
 	if err != nil {
 		return
 	}
@@ -40,7 +46,7 @@ func (model *ModelDB) ReceiveDelegate(c *ChannelFor3rd, delegator common.Address
 	}
 
 	// 3. 更新Delegate
-	d, oldNeedSMT, err := updateDelegate(tx, c, delegator, lastBlockNumber, newSMT4Punish)
+	d, oldNeedSMT, err := updateDelegate(tx, c, delegator, lastBlockNumber, newSMT4Punish, fees)
 	if err != nil {
 		return
 	}
@@ -50,7 +56,7 @@ func (model *ModelDB) ReceiveDelegate(c *ChannelFor3rd, delegator common.Address
 	return
 }
 
-func updateDelegate(tx *gorm.DB, c *ChannelFor3rd, delegator common.Address, lastBlockNumber int64, newSMT4Punish *big.Int) (d *Delegate, oldNeedSMT *big.Int, err error) {
+func updateDelegate(tx *gorm.DB, c *ChannelFor3rd, delegator common.Address, lastBlockNumber int64, newSMT4Punish *big.Int, fees *params.Fees) (d *Delegate, oldNeedSMT *big.Int, err error) {
 	isFirst := false
 	// 1. 获取delegate对象
 	d = &Delegate{
@@ -81,6 +87,7 @@ func updateDelegate(tx *gorm.DB, c *ChannelFor3rd, delegator common.Address, las
 		d.Error = ""
 		d.SetUpdateBalanceProof(c.GetDelegateUpdateBalanceProof())
 		d.SetUnlocks(c.GetDelegateUnlocks())
+		d.UnlocksIncomplete = c.unlocksIncomplete
 		// 如果是close之后的第一次委托,注册监听
 		if c.settleBlockNumber > 0 {
 			AddDelegateMonitorInTx(tx, d)
@@ -106,6 +113,7 @@ func updateDelegate(tx *gorm.DB, c *ChannelFor3rd, delegator common.Address, las
 			}
 			d.SetUpdateBalanceProof(c.GetDelegateUpdateBalanceProof())
 			d.SetUnlocks(c.GetDelegateUnlocks())
+			d.UnlocksIncomplete = c.unlocksIncomplete
 		}
 		// 这里不用更新SettleBlockNumber及注册监听,如果是第一次委托就已经close,上面if里面会做这部分工作
 		// 如果之前已经委托过,那么会在收到通道关闭事件的时候做这部分工作
@@ -116,7 +124,8 @@ func updateDelegate(tx *gorm.DB, c *ChannelFor3rd, delegator common.Address, las
 	d.SetSecrets(c.GetDeleteSecrets())
 
 	// 3. 更新计费信息
-	d.CalcNeedSMT(newSMT4Punish)
+	d.SetFees(fees)
+	d.CalcNeedSMT(fees, newSMT4Punish)
 	// 4. 更新
 	err = tx.Save(d).Error
 	if err != nil {
@@ -128,7 +137,7 @@ func updateDelegate(tx *gorm.DB, c *ChannelFor3rd, delegator common.Address, las
 /*
 无关状态,直接追加,最多就是追加的数据无效了
 */
-func appendDelegatePunish(tx *gorm.DB, delegateKey []byte, newPunishes []*Punish) (newSMT4Punish *big.Int, err error) {
+func appendDelegatePunish(tx *gorm.DB, delegateKey []byte, newPunishes []*Punish, punishFee *big.Int) (newSMT4Punish *big.Int, err error) {
 	newSMT4Punish = big.NewInt(0)
 	// 1. 查询已经存在的委托
 	var all []*DelegatePunish
@@ -161,7 +170,7 @@ func appendDelegatePunish(tx *gorm.DB, delegateKey []byte, newPunishes []*Punish
 	}
 	// 3. 计算花费,不管旧的新的,只要存在punish委托,就计算费用,且只计算一次
 	if len(all) > 0 || len(newPunishes) > 0 {
-		newSMT4Punish = newSMT4Punish.Add(newSMT4Punish, params.SmtPunish)
+		newSMT4Punish = newSMT4Punish.Add(newSMT4Punish, punishFee)
 	}
 	return
 }
@@ -0,0 +1,195 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/jinzhu/gorm"
+)
+
+// 影子实例和主实例执行结果的差异类型
+const (
+	ShadowDiffOnlyPrimary = "only_primary" // 主实例执行了,影子实例没有执行
+	ShadowDiffOnlyShadow  = "only_shadow"  // 影子实例执行了,主实例没有执行
+	ShadowDiffStatus      = "status"       // 都执行了,但是结果不同
+)
+
+//ShadowOutcome 一个操作在某个实例中最后一次执行的结果
+type ShadowOutcome struct {
+	Status           string `json:"status"`
+	Error            string `json:"error,omitempty"`
+	TxHash           string `json:"tx_hash,omitempty"`
+	ExecuteTimestamp int64  `json:"execute_timestamp"`
+	Attempts         int    `json:"attempts"`
+}
+
+//ShadowDiff 同一个操作在两个实例中的不同表现
+type ShadowDiff struct {
+	Kind      string         `json:"kind"`
+	Channel   string         `json:"channel_identifier"`
+	Delegator string         `json:"delegator"`
+	Type      string         `json:"type"`
+	Subject   string         `json:"subject"` // nonce,锁的secret hash或者密码的hash
+	Primary   *ShadowOutcome `json:"primary,omitempty"`
+	Shadow    *ShadowOutcome `json:"shadow,omitempty"`
+}
+
+//ShadowReport 影子实例和主实例在同一时间段内执行记录的比较结果
+type ShadowReport struct {
+	Since   int64         `json:"since"`
+	Until   int64         `json:"until"`
+	Primary int           `json:"primary"` // 主实例执行的操作数
+	Shadow  int           `json:"shadow"`  // 影子实例模拟执行的操作数
+	Matched int           `json:"matched"`
+	Diffs   []*ShadowDiff `json:"diffs"`
+}
+
+/*
+GetExecuteRecordsBetween 查询执行时间在[since,until]之间的记录,until<=0表示不限制,
+simulatedOnly为true时只返回影子模式下模拟执行的记录
+*/
+func (model *ModelDB) GetExecuteRecordsBetween(since, until int64, simulatedOnly bool) (rs []*DelegateExecuteRecord, err error) {
+	db := model.db.Where("execute_timestamp >= ?", since)
+	if until > 0 {
+		db = db.Where("execute_timestamp <= ?", until)
+	}
+	if simulatedOnly {
+		db = db.Where("simulated = ?", true)
+	}
+	err = db.Order("execute_timestamp").Find(&rs).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return
+}
+
+/*
+GetSimulatedRange 影子实例模拟执行记录的时间范围,
+影子实例通常从主实例的数据库拷贝启动,之前的记录都不是模拟的
+*/
+func (model *ModelDB) GetSimulatedRange() (since, until int64, err error) {
+	var r struct {
+		Since int64
+		Until int64
+	}
+	err = model.db.Model(&DelegateExecuteRecord{}).Where("simulated = ?", true).
+		Select("min(execute_timestamp) as since, max(execute_timestamp) as until").Scan(&r).Error
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+	return r.Since, r.Until, err
+}
+
+/*
+executeSubject 区分同一个委托中的不同操作,
+主实例和影子实例分别生成记录,只能通过参数对应起来
+*/
+func executeSubject(r *DelegateExecuteRecord) (string, error) {
+	p, err := r.Params()
+	if err != nil {
+		return "", err
+	}
+	switch v := p.(type) {
+	case *DelegateUpdateBalanceProof:
+		return fmt.Sprintf("nonce %d", v.Nonce), nil
+	case *DelegateUnlock:
+		return v.LockSecretHash().String(), nil
+	case *DelegatePunish:
+		return v.LockHash().String(), nil
+	case *DelegateSecret:
+		// 报告中不能出现密码
+		return utils.ShaSecret(v.GetSecret().Bytes()).String(), nil
+	}
+	return "", fmt.Errorf("unknown params %T", p)
+}
+
+type shadowOperation struct {
+	channel   string
+	delegator string
+	t         DelegateType
+	subject   string
+}
+
+//latestOutcomes 同一个操作可能执行多次,只比较最后一次的结果
+func latestOutcomes(rs []*DelegateExecuteRecord) (m map[shadowOperation]*ShadowOutcome, err error) {
+	m = make(map[shadowOperation]*ShadowOutcome)
+	for _, r := range rs {
+		subject, err := executeSubject(r)
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %s", r.Key, err)
+		}
+		op := shadowOperation{r.ChannelIdentifierStr, r.DelegatorStr, r.Type, subject}
+		o := m[op]
+		if o == nil {
+			o = &ShadowOutcome{}
+			m[op] = o
+		}
+		o.Attempts++
+		if r.ExecuteTimestamp >= o.ExecuteTimestamp {
+			o.Status = executeStatusNames[r.Status]
+			o.Error = r.Error
+			o.TxHash = r.TxHashStr
+			o.ExecuteTimestamp = r.ExecuteTimestamp
+		}
+	}
+	return
+}
+
+/*
+CompareExecuteRecords 比较主实例和影子实例的执行记录,
+只比较每个操作最后一次执行的状态,模拟执行和真实执行的错误信息本来就不一样
+*/
+func CompareExecuteRecords(primary, shadow []*DelegateExecuteRecord) (report *ShadowReport, err error) {
+	ps, err := latestOutcomes(primary)
+	if err != nil {
+		return
+	}
+	ss, err := latestOutcomes(shadow)
+	if err != nil {
+		return
+	}
+	report = &ShadowReport{
+		Primary: len(ps),
+		Shadow:  len(ss),
+		Diffs:   []*ShadowDiff{},
+	}
+	newDiff := func(kind string, op shadowOperation) *ShadowDiff {
+		return &ShadowDiff{
+			Kind:      kind,
+			Channel:   op.channel,
+			Delegator: op.delegator,
+			Type:      delegateTypeNames[op.t],
+			Subject:   op.subject,
+			Primary:   ps[op],
+			Shadow:    ss[op],
+		}
+	}
+	for op, p := range ps {
+		s, ok := ss[op]
+		switch {
+		case !ok:
+			report.Diffs = append(report.Diffs, newDiff(ShadowDiffOnlyPrimary, op))
+		case p.Status != s.Status:
+			report.Diffs = append(report.Diffs, newDiff(ShadowDiffStatus, op))
+		default:
+			report.Matched++
+		}
+	}
+	for op := range ss {
+		if _, ok := ps[op]; !ok {
+			report.Diffs = append(report.Diffs, newDiff(ShadowDiffOnlyShadow, op))
+		}
+	}
+	sort.Slice(report.Diffs, func(i, j int) bool {
+		return diffTimestamp(report.Diffs[i]) < diffTimestamp(report.Diffs[j])
+	})
+	return
+}
+
+func diffTimestamp(d *ShadowDiff) int64 {
+	if d.Primary != nil {
+		return d.Primary.ExecuteTimestamp
+	}
+	return d.Shadow.ExecuteTimestamp
+}
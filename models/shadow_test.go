@@ -0,0 +1,80 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareExecuteRecords(t *testing.T) {
+	ast := assert.New(t)
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	d := &Delegate{
+		ChannelIdentifierStr: utils.NewRandomHash().String(),
+		DelegatorAddressStr:  utils.NewRandomAddress().String(),
+	}
+	newRecord := func(t DelegateType, p interface{}, status ExecuteStatus, ts int64) *DelegateExecuteRecord {
+		r := NewDelegateExecuteRecord(d, t, p)
+		r.Status = status
+		r.ExecuteTimestamp = ts
+		return r
+	}
+	du := &DelegateUnlock{LockSecretHashStr: utils.NewRandomHash().String(), AmountStr: "10"}
+	du2 := &DelegateUnlock{LockSecretHashStr: utils.NewRandomHash().String(), AmountStr: "10"}
+	dp := &DelegatePunish{LockHashStr: utils.NewRandomHash().String()}
+	ds := &DelegateSecret{Secret: utils.NewRandomHash().String()}
+	ub := &DelegateUpdateBalanceProof{Nonce: 3}
+	primary := []*DelegateExecuteRecord{
+		newRecord(DelegateTypeUpdateBalanceProof, ub, ExecuteStatusSuccessFinished, 10),
+		//失败以后重试成功,只比较最后一次
+		newRecord(DelegateTypeUnlock, du, ExecuteStatusErrorFinished, 20),
+		newRecord(DelegateTypeUnlock, du, ExecuteStatusSuccessFinished, 30),
+		newRecord(DelegateTypeUnlock, du2, ExecuteStatusSuccessFinished, 30),
+		newRecord(DelegateTypePunish, dp, ExecuteStatusSuccessFinished, 40),
+	}
+	params.ShadowMode = true
+	defer func() { params.ShadowMode = false }()
+	shadow := []*DelegateExecuteRecord{
+		newRecord(DelegateTypeUpdateBalanceProof, ub, ExecuteStatusSuccessFinished, 11),
+		newRecord(DelegateTypeUnlock, du, ExecuteStatusSuccessFinished, 21),
+		newRecord(DelegateTypeUnlock, du2, ExecuteStatusSkipped, 31),
+		newRecord(DelegateTypeRegisterSecret, ds, ExecuteStatusSuccessFinished, 50),
+	}
+	ast.True(shadow[0].Simulated)
+	ast.False(primary[0].Simulated)
+
+	report, err := CompareExecuteRecords(primary, shadow)
+	ast.Nil(err)
+	ast.EqualValues(4, report.Primary)
+	ast.EqualValues(4, report.Shadow)
+	ast.EqualValues(2, report.Matched)
+	if ast.EqualValues(3, len(report.Diffs)) {
+		ast.EqualValues(ShadowDiffStatus, report.Diffs[0].Kind)
+		ast.EqualValues(du2.LockSecretHashStr, report.Diffs[0].Subject)
+		ast.EqualValues("success", report.Diffs[0].Primary.Status)
+		ast.EqualValues("skipped", report.Diffs[0].Shadow.Status)
+		ast.EqualValues(ShadowDiffOnlyPrimary, report.Diffs[1].Kind)
+		ast.EqualValues("punish", report.Diffs[1].Type)
+		ast.Nil(report.Diffs[1].Shadow)
+		ast.EqualValues(ShadowDiffOnlyShadow, report.Diffs[2].Kind)
+		//报告中只有密码的hash
+		ast.EqualValues(utils.ShaSecret(ds.GetSecret().Bytes()).String(), report.Diffs[2].Subject)
+	}
+
+	for _, r := range append(primary, shadow...) {
+		m.SaveDelegateExecuteRecord(r)
+	}
+	since, until, err := m.GetSimulatedRange()
+	ast.Nil(err)
+	ast.EqualValues(11, since)
+	ast.EqualValues(50, until)
+	rs, err := m.GetExecuteRecordsBetween(since, until, true)
+	ast.Nil(err)
+	ast.EqualValues(4, len(rs))
+	rs, err = m.GetExecuteRecordsBetween(20, 40, false)
+	ast.Nil(err)
+	ast.EqualValues(6, len(rs))
+}
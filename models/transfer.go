@@ -88,6 +88,51 @@ func (model *ModelDB) NewReceiveTransferFromReceiveTransfer(tr *ReceivedTransfer
 	return true
 }
 
+/*
+ReceiveDeposit 保存到账记录并给付款人记账,两步在同一个事务中完成,
+避免保存了到账记录却没有记账.同一笔到账(Key相同)只会记一次
+returns true if it's a new deposit
+*/
+func (model *ModelDB) ReceiveDeposit(tr *ReceivedTransfer) (isNew bool, err error) {
+	model.lock.Lock()
+	defer model.lock.Unlock()
+	tx := model.db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	old := &ReceivedTransfer{
+		Key: tr.Key,
+	}
+	err = tx.Where(old).Find(old).Error
+	if err == nil {
+		tx.Rollback()
+		return
+	}
+	if err != gorm.ErrRecordNotFound {
+		return
+	}
+	err = tx.Create(tr).Error
+	if err != nil {
+		return
+	}
+	a := GetAccountInTx(tx, tr.FromAddress())
+	a.TotalReceivedSmt.Add(a.TotalReceivedSmt, tr.Amount())
+	model.accountSanity(a)
+	err = updateAccountColumnInTx(tx, a, "total_received_smt_bytes", a.TotalReceivedSmt.Bytes())
+	if err != nil {
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return
+	}
+	isNew = true
+	log.Info(fmt.Sprintf("receive smt %s from %s,now total=%s", tr.AmountStr, tr.FromAddressStr, a.TotalReceivedSmt))
+	return
+}
+
 //GetReceivedTransfer return the received transfer by key
 func (model *ModelDB) GetReceivedTransfer(key string) (*ReceivedTransfer, error) {
 	var r ReceivedTransfer
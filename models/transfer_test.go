@@ -74,3 +74,41 @@ func TestID(t *testing.T) {
 	m.db.Find(&r)
 	fmt.Println(utils.StringInterface(r, 3))
 }
+
+func TestModelDB_ReceiveDeposit(t *testing.T) {
+	m := SetupTestDb(t)
+	defer m.CloseDB()
+	from := utils.NewRandomAddress()
+	tr := &ReceivedTransfer{
+		Key:             "d1",
+		BlockNumber:     3,
+		TokenAddressStr: utils.NewRandomAddress().String(),
+		FromAddressStr:  from.String(),
+		AmountStr:       "10",
+	}
+	isNew, err := m.ReceiveDeposit(tr)
+	assert.Nil(t, err)
+	assert.True(t, isNew)
+	isNew, err = m.ReceiveDeposit(tr)
+	assert.Nil(t, err)
+	assert.False(t, isNew)
+	assert.True(t, m.IsReceivedTransferExist("d1"))
+	assert.EqualValues(t, big.NewInt(10), m.AccountGetAccount(from).TotalReceivedSmt)
+	//已有账户到账只更新total,不影响其他列
+	m.accountUpdateNeedSmt(from, big.NewInt(3))
+	tr2 := *tr
+	tr2.Key = "d2"
+	tr2.AmountStr = "5"
+	isNew, err = m.ReceiveDeposit(&tr2)
+	assert.Nil(t, err)
+	assert.True(t, isNew)
+	a := m.AccountGetAccount(from)
+	assert.EqualValues(t, big.NewInt(15), a.TotalReceivedSmt)
+	assert.EqualValues(t, big.NewInt(3), a.NeedSmt)
+
+	assert.EqualValues(t, 0, m.GetPaymentCursor("photon"))
+	err = m.SavePaymentCursor("photon", 7)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 7, m.GetPaymentCursor("photon"))
+	assert.EqualValues(t, 0, m.GetPaymentCursor("erc20"))
+}
@@ -6,9 +6,9 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"time"
 
-	"crypto/ecdsa"
-
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/node"
 )
@@ -28,6 +28,9 @@ var SmtSecret *big.Int
 //SmtAddress the token payed for service
 var SmtAddress common.Address
 
+//Version of Photon monitoring
+var Version = "0.5"
+
 //APIPort listening request from app
 var APIPort = 6000
 
@@ -37,8 +40,8 @@ var PhotonURL = "http://127.0.0.1:5001/api/1/queryreceivedtransfer"
 //RegistryAddress chain events where comes from
 var RegistryAddress = common.HexToAddress("0xd66d3719E89358e0790636b8586b539467EDa596")
 
-//PrivKey used for sign tx
-var PrivKey *ecdsa.PrivateKey
+//Signer used for sign tx, delegation receipt and service info
+var Signer signer.Signer
 
 //Address used for sign tx
 var Address common.Address
@@ -57,6 +60,82 @@ var DebugMode = false
 */
 var RevealTimeout = 30
 
+/*MaxUnlocksPerDelegate 一个委托最多能包含多少个unlock,同时也不能超过settle_timeout/2,
+否则在RevealTimeout内可能来不及全部unlock
+*/
+var MaxUnlocksPerDelegate = 20
+
+/*ShutdownTimeout 收到退出信号以后,最多等待正在执行的委托tx多长时间,
+超时未完成的委托会在下次启动时修正.
+*/
+var ShutdownTimeout = time.Minute
+
+//PayoutMethod 退款方式,photon或者erc20,为空表示不支持退款
+var PayoutMethod = ""
+
+//ArchiveRetention 已经结束的委托归档以后保留多长时间,0表示永久保留
+var ArchiveRetention = 180 * 24 * time.Hour
+
+//ReconcileInterval 多长时间对账一次
+var ReconcileInterval = time.Hour
+
+/*EconomicGuard 为true时,gas花费(由运营方支付)超过锁本身价值的unlock直接跳过,不收费;
+为false时只是把这些unlock放到最后执行
+*/
+var EconomicGuard = false
+
+//DefaultGasPrice 估算tx花费时使用的gas price默认值,单位wei,每个网络可以单独配置
+var DefaultGasPrice = big.NewInt(18000000000)
+
+//UnlockGasEstimate 一次UnlockDelegate调用大约消耗的gas
+var UnlockGasEstimate uint64 = 150000
+
+/*EndpointQuorum 配置了多个公链节点时,接受委托和通道关闭后安排执行之前,
+至少要有这么多个节点返回一致的通道信息,小于等于1表示不检查
+*/
+var EndpointQuorum = 1
+
+//EndpointCheckInterval 多长时间检查一次公链节点的健康状况
+var EndpointCheckInterval = 10 * time.Second
+
+//EndpointCallTimeout 单个公链节点请求的超时时间,超时以后换下一个节点
+var EndpointCallTimeout = 5 * time.Second
+
+//EndpointMaxLag 公链节点落后最新块超过这么多块就认为不健康
+var EndpointMaxLag int64 = 3
+
+//EndpointStallTimeout 公链节点的块高这么长时间没有变化就认为已经停止同步
+var EndpointStallTimeout = 3 * time.Minute
+
+//WatchdogInterval 多长时间检查一次链上事件源是否停止
+var WatchdogInterval = 30 * time.Second
+
+//WatchdogMaxLag 已处理的块落后公链最新块超过这么多块,并且一个检查周期内没有进展,就认为事件源已经停止
+var WatchdogMaxLag int64 = 5
+
+//WatchdogMaxSilence 这么长时间没有处理过新块就认为事件源已经停止
+var WatchdogMaxSilence = 2 * time.Minute
+
+//AlertURL 事件源停止等需要运维介入的情况会POST到这个地址,为空表示只记录日志
+var AlertURL = ""
+
+//AdminListen 管理接口的监听地址,为空表示不提供管理接口,默认值不能和webhook-listen的默认值相同
+var AdminListen = "127.0.0.1:6003"
+
+//AdminToken 访问管理接口需要在Authorization中提供的Bearer token
+var AdminToken = ""
+
+//AdminTLSCert AdminTLSKey 管理接口使用https
+var AdminTLSCert, AdminTLSKey string
+
+//AdminClientCA 管理接口要求客户端证书,并且由这个CA签发
+var AdminClientCA = ""
+
+/*ShadowMode 影子模式,用于升级前验证新版本:照常接收委托和安排执行,
+但是所有tx只用eth_call模拟执行,不签名也不广播,执行记录标记为模拟的
+*/
+var ShadowMode = false
+
 func init() {
 	SmtUnlock = big.NewInt(1)
 	SmtPunish = big.NewInt(2)
@@ -0,0 +1,60 @@
+package params
+
+import (
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//DefaultNetworkName 只配置了一个网络时的名字,这个网络的数据库路径和REST路由保持不变
+const DefaultNetworkName = "default"
+
+//Fees 一个网络的收费配置
+type Fees struct {
+	Token          common.Address // 收费使用的token
+	UpdateTransfer *big.Int
+	Unlock         *big.Int
+	Punish         *big.Int
+	Secret         *big.Int
+}
+
+//DefaultFees 命令行配置的全局收费
+func DefaultFees() *Fees {
+	return &Fees{
+		Token:          SmtAddress,
+		UpdateTransfer: SmtUpdateTransfer,
+		Unlock:         SmtUnlock,
+		Punish:         SmtPunish,
+		Secret:         SmtSecret,
+	}
+}
+
+//IsFree 所有的服务都不收费
+func (f *Fees) IsFree() bool {
+	return f.UpdateTransfer.Sign() <= 0 && f.Punish.Sign() <= 0 && f.Unlock.Sign() <= 0
+}
+
+/*
+Network 一个进程可以同时为多个(链,registry)提供服务,
+每个Network有自己的事件源,数据库(也就是处理进度),签名账户,收费配置和价格
+*/
+type Network struct {
+	Name            string
+	RegistryAddress common.Address
+	ChainID         *big.Int // 启动时从公链节点获取
+	Signer          signer.Signer
+	Fees            *Fees
+	FeeNode         common.Address // 通过photon收费时,收费photon节点的地址,只用于告诉App向谁付费
+	RevealTimeout   int
+	MaxUnlocks      int
+	GasPrice        *big.Int                    // 估算tx花费时使用的gas price,单位wei
+	SmtPerWei       *big.Rat                    // 1 wei的gas花费折合多少smt(最小单位)
+	TokenPrices     map[common.Address]*big.Rat // 1个token(最小单位)折合多少smt,没有配置的token总是执行
+	DataBasePath    string
+}
+
+//Address of the account used by this network
+func (n *Network) Address() common.Address {
+	return n.Signer.Address()
+}
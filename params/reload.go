@@ -0,0 +1,48 @@
+package params
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+下面这些配置可以在运行中通过重新加载配置文件修改,
+启动以后只能通过这里的函数读写,其他配置在启动以后不会再修改.
+*/
+var reloadLock sync.RWMutex
+
+//RateLimit 每个客户端每秒最多请求多少次,0表示不限制
+var RateLimit float64
+
+//RateLimitBurst 每个客户端最多可以连续请求多少次
+var RateLimitBurst = 20
+
+//GetAlertConfig returns WatchdogMaxSilence and AlertURL
+func GetAlertConfig() (maxSilence time.Duration, alertURL string) {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return WatchdogMaxSilence, AlertURL
+}
+
+//SetAlertConfig set WatchdogMaxSilence and AlertURL
+func SetAlertConfig(maxSilence time.Duration, alertURL string) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	WatchdogMaxSilence = maxSilence
+	AlertURL = alertURL
+}
+
+//GetRateLimit returns RateLimit and RateLimitBurst
+func GetRateLimit() (rate float64, burst int) {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return RateLimit, RateLimitBurst
+}
+
+//SetRateLimit set RateLimit and RateLimitBurst
+func SetRateLimit(rate float64, burst int) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	RateLimit = rate
+	RateLimitBurst = burst
+}
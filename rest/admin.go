@@ -0,0 +1,476 @@
+package restful
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/chainservice"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/dto"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//Admin 运行中的配置管理,由main提供
+type Admin interface {
+	//Reload 重新加载配置文件,返回修改了哪些配置
+	Reload() (changes []string, err error)
+	//ActiveConfig 当前生效的配置
+	ActiveConfig() interface{}
+	//SetLogLevel 修改日志级别,直到下一次重新加载配置文件时修改了这些参数
+	SetLogLevel(verbosity int, vmodule string) error
+}
+
+//Executor 运维对委托执行的控制,由chainservice.ChainEvents实现
+type Executor interface {
+	Pause()
+	Resume()
+	Paused() bool
+	Rescan(fromBlockNumber int64) error
+	WatchdogStatus() *chainservice.WatchdogStatus
+}
+
+var admin Admin
+
+//SetAdmin must be called before Start
+func SetAdmin(a Admin) {
+	admin = a
+}
+
+/*
+ActiveConfig 当前生效的配置,包括命令行参数,配置文件以及每个网络的收费
+Get /admin/config
+```json
+{
+  "file": "/etc/photonmonitoring.toml",
+  "loaded_at": "2019-01-01T00:00:00+08:00",
+  "reloads": 1,
+  "reloadable": ["unlock-fee", "punish-fee", "update-transfer-fee", "secret-register-fee", "verbosity", "vmodule", "stall-timeout", "alert-url", "rate-limit", "rate-limit-burst"],
+  "flags": {
+    "api-port": "6000",
+    "unlock-fee": "1",
+    "verbosity": "3"
+  },
+  "networks": [
+    {
+      "name": "default",
+      "overrides": {},
+      "fees": {"token": "0x6fdb6b4deb71c4D9AFbA4350e2e9D6CfD534F1cb", "update_transfer": 3, "unlock": 1, "punish": 2, "secret": 1}
+    }
+  ]
+}
+```
+*/
+func ActiveConfig(w rest.ResponseWriter, r *rest.Request) {
+	if admin == nil {
+		rest.Error(w, "admin api is not available", http.StatusNotFound)
+		return
+	}
+	err := w.WriteJson(dto.NewAPIResponse(nil, admin.ActiveConfig()))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+/*
+ReloadConfig 重新加载配置文件,和收到SIGHUP一样.只有收费,日志级别,报警阈值和限流可以在运行中修改,
+其他配置的修改会被忽略并记录警告,需要重启才能生效
+Post /admin/reload
+```json
+["unlock-fee 1 -> 2", "verbosity 3 -> 4"]
+```
+*/
+func ReloadConfig(w rest.ResponseWriter, r *rest.Request) {
+	if admin == nil {
+		rest.Error(w, "admin api is not available", http.StatusNotFound)
+		return
+	}
+	changes, err := admin.Reload()
+	if err != nil {
+		writeError(w, fmt.Sprintf("reload config err %s", err))
+		return
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, changes))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+func writeResult(w rest.ResponseWriter, data interface{}) {
+	err := w.WriteJson(dto.NewAPIResponse(nil, data))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+/*
+AdminDelegates 按条件查询所有委托人的委托,包括已经结束的
+Get /admin/delegates?delegator=<delegator>&status=0&token=<token>&partner=<partner>&offset=0&limit=20
+```json
+{
+  "total": 1,
+  "delegates": [
+    {
+      "key": "0x4fa00ea25da02ecce11ced3d6167601c67762933adb98dfd82ad4f9b40f4db1a3af7fbddef2cebeeb850328a0834aa9a29684332",
+      "delegate": {...},
+      "need_smt": 5,
+      "update_balance_proof": {...},
+      "unlocks": [...],
+      "secret_hashes": [...],
+      "punishes": [...],
+      "announce_disposes": [...],
+      "monitors": [...],
+      "update_balance_proof_skipped": false
+    }
+  ]
+}
+```
+*/
+func AdminDelegates(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	q := &models.DelegateQuery{
+		Limit: defaultDelegatesLimit,
+	}
+	if s := r.URL.Query().Get("delegator"); s != "" {
+		if !common.IsHexAddress(s) {
+			writeError(w, fmt.Sprintf("invalid delegator %s", s))
+			return
+		}
+		q.Delegator = common.HexToAddress(s)
+	}
+	err := parseDelegateQuery(r, q)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	l, err := db.GetDelegateViews(q)
+	if err != nil {
+		writeError(w, fmt.Sprintf("db GetDelegates err : %s", err.Error()))
+		return
+	}
+	writeResult(w, l)
+}
+
+/*
+AdminDelegate 一个委托的全部内容,key是delegates中返回的key
+Get /admin/delegate/<key>
+*/
+func AdminDelegate(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	key, err := models.ParseDelegateKey(r.PathParam("key"))
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	v, err := db.GetDelegateView(key)
+	if err != nil {
+		writeError(w, fmt.Sprintf("db GetDelegateView err : %s", err.Error()))
+		return
+	}
+	writeResult(w, v)
+}
+
+//adminChange 人工修改必须说明是谁以及为什么
+type adminChange struct {
+	Operator string   `json:"operator"`
+	Reason   string   `json:"reason"`
+	Field    string   `json:"field,omitempty"`
+	Delta    *big.Int `json:"delta,omitempty"`
+	From     int64    `json:"from,omitempty"`
+}
+
+func decodeAdminChange(r *rest.Request) (*adminChange, error) {
+	req := &adminChange{}
+	err := r.DecodeJsonPayload(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Operator == "" {
+		return nil, fmt.Errorf("operator is required")
+	}
+	return req, nil
+}
+
+/*
+RetryDelegate 在下一块重新执行失败的委托,见models.RetryDelegate
+Post /admin/delegate/<key>/retry
+```json
+{"operator": "alice", "reason": "node was down"}
+```
+返回修改以后的委托
+*/
+func RetryDelegate(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	key, err := models.ParseDelegateKey(r.PathParam("key"))
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	req, err := decodeAdminChange(r)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	d, err := db.RetryDelegate(key, req.Operator, req.Reason)
+	if err != nil {
+		writeError(w, fmt.Sprintf("retry delegate err %s", err))
+		return
+	}
+	writeResult(w, d)
+}
+
+/*
+CancelDelegate 取消委托还没有执行的操作,见models.CancelDelegate
+Post /admin/delegate/<key>/cancel
+```json
+{"operator": "alice", "reason": "channel abandoned"}
+```
+返回修改以后的委托
+*/
+func CancelDelegate(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	key, err := models.ParseDelegateKey(r.PathParam("key"))
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	req, err := decodeAdminChange(r)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	d, err := db.CancelDelegate(key, req.Operator, req.Reason)
+	if err != nil {
+		writeError(w, fmt.Sprintf("cancel delegate err %s", err))
+		return
+	}
+	writeResult(w, d)
+}
+
+/*
+AdminMonitors 计划执行的操作,按块号排序
+Get /admin/monitors?from=<block number>&limit=100
+from默认是最新处理的块
+*/
+func AdminMonitors(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	values := r.URL.Query()
+	from := db.GetLatestBlockNumber()
+	if s := values.Get("from"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, fmt.Sprintf("invalid from %s", s))
+			return
+		}
+		from = n
+	}
+	limit := 0
+	if s := values.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, fmt.Sprintf("invalid limit %s", s))
+			return
+		}
+		limit = n
+	}
+	dms, err := db.GetDelegateMonitors(from, limit)
+	if err != nil {
+		writeError(w, fmt.Sprintf("db GetDelegateMonitors err : %s", err.Error()))
+		return
+	}
+	writeResult(w, dms)
+}
+
+/*
+AdminAccount 账户的各项金额
+Get /admin/account/<address>
+```json
+{"address": "0x3af7fbddef2cebeeb850328a0834aa9a29684332", "total_received": 100, "used": 10, "locked": 0, "need": 5, "withdrawn": 0, "available": 90}
+```
+*/
+func AdminAccount(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	addr := common.HexToAddress(r.PathParam("address"))
+	if addr == utils.EmptyAddress {
+		writeError(w, "arg error")
+		return
+	}
+	writeResult(w, models.NewAccountView(db.AccountGetAccount(addr)))
+}
+
+/*
+AdjustAccount 人工调整账户的一项金额,field是received,used,locked,need,withdrawn之一,delta可以是负数
+Post /admin/account/<address>/adjust
+```json
+{"operator": "alice", "reason": "missed deposit tx 0x...", "field": "received", "delta": 100}
+```
+返回调整以后的账户
+*/
+func AdjustAccount(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	addr := common.HexToAddress(r.PathParam("address"))
+	if addr == utils.EmptyAddress {
+		writeError(w, "arg error")
+		return
+	}
+	req, err := decodeAdminChange(r)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	a, err := db.AccountAdjust(addr, req.Field, req.Delta, req.Operator, req.Reason)
+	if err != nil {
+		writeError(w, fmt.Sprintf("adjust account err %s", err))
+		return
+	}
+	writeResult(w, models.NewAccountView(a))
+}
+
+/*
+AuditLogs 最近的人工修改记录,按时间倒序
+Get /admin/audit?limit=100
+*/
+func AuditLogs(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, fmt.Sprintf("invalid limit %s", s))
+			return
+		}
+		limit = n
+	}
+	logs, err := db.GetAuditLogs(limit)
+	if err != nil {
+		writeError(w, fmt.Sprintf("db GetAuditLogs err : %s", err.Error()))
+		return
+	}
+	writeResult(w, logs)
+}
+
+/*
+SetLogLevel 修改日志级别,和配置文件中的verbosity,vmodule相同
+Post /admin/verbosity
+```json
+{"verbosity": 5, "vmodule": "chainservice=5"}
+```
+*/
+func SetLogLevel(w rest.ResponseWriter, r *rest.Request) {
+	if admin == nil {
+		rest.Error(w, "admin api is not available", http.StatusNotFound)
+		return
+	}
+	req := &struct {
+		Verbosity *int   `json:"verbosity"`
+		Vmodule   string `json:"vmodule"`
+	}{}
+	err := r.DecodeJsonPayload(req)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	if req.Verbosity == nil {
+		writeError(w, "verbosity is required")
+		return
+	}
+	err = admin.SetLogLevel(*req.Verbosity, req.Vmodule)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	writeResult(w, admin.ActiveConfig())
+}
+
+/*
+ExecutionStatus 委托执行和链上事件源的状况
+Get /admin/status
+```json
+{
+  "last_block_number": 15338450,
+  "last_block_time": "2019-01-01T00:00:00+08:00",
+  "head_block_number": 15338451,
+  "restarts": 0,
+  "last_restart": "0001-01-01T00:00:00Z",
+  "paused": false
+}
+```
+*/
+func ExecutionStatus(w rest.ResponseWriter, r *rest.Request) {
+	writeResult(w, networkOf(r).Chain.WatchdogStatus())
+}
+
+/*
+PauseExecution 暂停执行委托,仍然接收新的委托和链上事件,重启以后自动恢复
+Post /admin/pause
+```json
+{"operator": "alice", "reason": "eth node is forked"}
+```
+*/
+func PauseExecution(w rest.ResponseWriter, r *rest.Request) {
+	n := networkOf(r)
+	req, err := decodeAdminChange(r)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	n.Chain.Pause()
+	err = n.DB.AddAuditLog(req.Operator, "pause", n.Name, fmt.Sprintf("paused at block %d", n.DB.GetLatestBlockNumber()), req.Reason)
+	if err != nil {
+		log.Error(fmt.Sprintf("AddAuditLog err %s", err))
+	}
+	writeResult(w, n.Chain.WatchdogStatus())
+}
+
+/*
+ResumeExecution 恢复执行委托,暂停期间错过的块会补齐
+Post /admin/resume
+```json
+{"operator": "alice", "reason": "eth node recovered"}
+```
+*/
+func ResumeExecution(w rest.ResponseWriter, r *rest.Request) {
+	n := networkOf(r)
+	req, err := decodeAdminChange(r)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	n.Chain.Resume()
+	err = n.DB.AddAuditLog(req.Operator, "resume", n.Name, fmt.Sprintf("resumed from block %d", n.DB.GetLatestBlockNumber()), req.Reason)
+	if err != nil {
+		log.Error(fmt.Sprintf("AddAuditLog err %s", err))
+	}
+	writeResult(w, n.Chain.WatchdogStatus())
+}
+
+/*
+Rescan 从from重新扫描链上事件并补齐执行计划,from不能超过最新处理的块加一
+Post /admin/rescan
+```json
+{"operator": "alice", "reason": "missed close event", "from": 15338000}
+```
+*/
+func Rescan(w rest.ResponseWriter, r *rest.Request) {
+	n := networkOf(r)
+	req, err := decodeAdminChange(r)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	processed := n.DB.GetLatestBlockNumber()
+	err = n.Chain.Rescan(req.From)
+	if err != nil {
+		writeError(w, fmt.Sprintf("rescan err %s", err))
+		return
+	}
+	err = n.DB.AddAuditLog(req.Operator, "rescan", n.Name, fmt.Sprintf("rescan from block %d, last processed block %d", req.From, processed), req.Reason)
+	if err != nil {
+		log.Error(fmt.Sprintf("AddAuditLog err %s", err))
+	}
+	writeResult(w, n.Chain.WatchdogStatus())
+}
@@ -0,0 +1,120 @@
+package restful
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+/*
+adminAuthMiddleware 管理接口的认证:
+配置了token时检查Authorization: Bearer <token>,配置了客户端CA时TLS层已经校验过客户端证书,
+都没有配置时只接受本机的请求
+*/
+type adminAuthMiddleware struct{}
+
+//MiddlewareFunc makes adminAuthMiddleware implement the rest.Middleware interface.
+func (m *adminAuthMiddleware) MiddlewareFunc(h rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		if params.AdminToken != "" {
+			if !checkBearerToken(r.Header.Get("Authorization"), params.AdminToken) {
+				rest.Error(w, "invalid admin token", http.StatusUnauthorized)
+				return
+			}
+		} else if params.AdminClientCA == "" {
+			ip := net.ParseIP(clientIP(r))
+			if ip == nil || !ip.IsLoopback() {
+				rest.Error(w, "admin api is only available from localhost", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+func checkBearerToken(header, token string) bool {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(token)) == 1
+}
+
+//AdminTLSConfig 配置了params.AdminClientCA时要求客户端证书
+func AdminTLSConfig() (*tls.Config, error) {
+	if params.AdminClientCA == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(params.AdminClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read admin client ca err %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", params.AdminClientCA)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+/*
+startAdmin 管理接口,包括配置,运维修复以及执行控制.
+和公开接口一样,每个网络的接口都在/net/:network下面
+*/
+func startAdmin() {
+	api := rest.NewApi()
+	api.Use(rest.DefaultDevStack...)
+	api.Use(&adminAuthMiddleware{})
+	routes := []*rest.Route{
+		rest.Get("/admin/delegates", AdminDelegates),
+		rest.Get("/admin/delegate/:key", AdminDelegate),
+		rest.Post("/admin/delegate/:key/retry", RetryDelegate),
+		rest.Post("/admin/delegate/:key/cancel", CancelDelegate),
+		rest.Get("/admin/monitors", AdminMonitors),
+		rest.Get("/admin/records/:delegater", Records),
+		rest.Get("/admin/account/:address", AdminAccount),
+		rest.Post("/admin/account/:address/adjust", AdjustAccount),
+		rest.Get("/admin/audit", AuditLogs),
+		rest.Get("/admin/reconcile", Reconcile),
+		rest.Get("/admin/status", ExecutionStatus),
+		rest.Post("/admin/pause", PauseExecution),
+		rest.Post("/admin/resume", ResumeExecution),
+		rest.Post("/admin/rescan", Rescan),
+	}
+	all := []*rest.Route{
+		rest.Get("/admin/config", ActiveConfig),
+		rest.Post("/admin/reload", ReloadConfig),
+		rest.Post("/admin/verbosity", SetLogLevel),
+	}
+	all = append(all, perNetwork(routes)...)
+	router, err := rest.MakeRouter(all...)
+	if err != nil {
+		log.Crit(fmt.Sprintf("maker admin router :%s", err))
+	}
+	api.SetApp(router)
+	tlsConfig, err := AdminTLSConfig()
+	if err != nil {
+		log.Crit(err.Error())
+	}
+	srv := &http.Server{
+		Addr:      params.AdminListen,
+		Handler:   api.MakeHandler(),
+		TLSConfig: tlsConfig,
+	}
+	if params.AdminTLSCert == "" {
+		log.Crit(fmt.Sprintf("admin listen and serve :%s", srv.ListenAndServe()))
+		return
+	}
+	log.Crit(fmt.Sprintf("admin listen and serve tls :%s", srv.ListenAndServeTLS(params.AdminTLSCert, params.AdminTLSKey)))
+}
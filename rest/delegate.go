@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/verifier"
+	"github.com/SmartMeshFoundation/Photon/dto"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/utils"
 	"github.com/ant0ine/go-json-rest/rest"
@@ -47,6 +49,31 @@ Post /\<delegater\>/delegate
   "id":3948588888488485，
   "status":1，//1 表示委托失败，2委托成功，但是余额不足，3委托成功，并且余额充足。
   "error": "错误描述", //正常情况下应该为空
+  "unlocks": [ //每个unlock按当前gas价格做出的决定,action为execute,deprioritize或者skip,执行时会重新判断
+    {
+      "lock_secret_hash": "0x933c446b9ee22072f26677561d25b1219cf0bc1ebd3cc5c1d8fa23270df6f609",
+      "amount": 10,
+      "cost": 2700000000000000,
+      "value": 10,
+      "action": "skip",
+      "reason": "gas cost 2700000000000000 smt exceeds lock value 10 smt"
+    }
+  ],
+  "receipt": { //PMS签名的回执,证明PMS接受了这个委托,可以通过POST /receipt/verify校验
+    "pms": "0x3af7fbddef2cebeeb850328a0834aa9a29684332",
+    "chain_id": 8888,
+    "channel_identifier": "0x4fa00ea25da02ecce11ced3d6167601c67762933adb98dfd82ad4f9b40f4db1a",
+    "open_block_number": 15338350,
+    "delegator": "0x5B3F0E96E45e1e4351F6460feBfB6007af25FBB0",
+    "nonce": 3,
+    "locksroot": "0x0000000000000000000000000000000000000000000000000000000000000000",
+    "unlock_count": 0,
+    "punish_count": 1,
+    "fee": 5,
+    "block_number": 15338360,
+    "signature": "0x5b1d83a624d4fc213597f16d802c5f8487217..."
+  },
+  "receipt_error": "签发回执失败的原因" //委托已经成功保存,只是没有回执,正常情况下没有这个字段
 }
 
 */
@@ -58,12 +85,17 @@ const (
 )
 
 type delegateResponse struct {
-	Status int
-	Error  string
+	Status  int
+	Error   string
+	Unlocks []*models.UnlockDecision    `json:"unlocks,omitempty"`
+	Receipt *verifier.DelegationReceipt `json:"receipt,omitempty"`
+	// 委托已经保存,但是签发回执失败,比如外部签名服务不可用,可以稍后重新委托获取回执
+	ReceiptError string `json:"receipt_error,omitempty"`
 }
 
 //Delegate user's balance proof updated,
 func Delegate(w rest.ResponseWriter, r *rest.Request) {
+	n := networkOf(r)
 	var err2 error
 	req := &models.ChannelFor3rd{}
 	delegateStr := r.PathParam("delegater")
@@ -87,8 +119,8 @@ func Delegate(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 	//log.Trace(fmt.Sprintf("req=%s", utils.StringInterface(req, 3)))
-	if verify != nil {
-		err = verify.VerifyDelegate(req, delegater)
+	if n.Verify != nil {
+		err = n.Verify.VerifyDelegate(req, delegater)
 		if err != nil {
 			log.Error(err.Error())
 			err2 = w.WriteJson(&delegateResponse{
@@ -98,7 +130,7 @@ func Delegate(w rest.ResponseWriter, r *rest.Request) {
 			return
 		}
 	}
-	err = db.ReceiveDelegate(req, delegater)
+	err = n.DB.ReceiveDelegate(req, delegater)
 	if err != nil {
 		log.Error(err.Error())
 		err2 = w.WriteJson(&delegateResponse{
@@ -107,17 +139,108 @@ func Delegate(w rest.ResponseWriter, r *rest.Request) {
 		})
 		return
 	}
-	if db.AccountIsBalanceEnough(delegater) {
-		err2 = w.WriteJson(&delegateResponse{
-			Status: delegateSuccess,
-		})
-	} else {
+	// 委托已经开始执行时不会再更新unlock,按保存下来的委托做决定
+	d, err := n.DB.GetDelegateByKey(models.BuildDelegateKey(req.ChannelIdentifier, delegater))
+	if err != nil {
+		log.Error(err.Error())
 		err2 = w.WriteJson(&delegateResponse{
-			Status: delegateSuccessButNotEnoughBalance,
+			Status: delegateError,
+			Error:  err.Error(),
 		})
+		return
+	}
+	uds := models.DecideUnlocks(n.Prices, d.TokenAddress(), d.Unlocks())
+	res := &delegateResponse{
+		Status:  delegateSuccess,
+		Unlocks: uds,
 	}
+	if !n.DB.AccountIsBalanceEnough(delegater) {
+		res.Status = delegateSuccessButNotEnoughBalance
+	}
+	res.Receipt, err = newDelegationReceipt(n, d)
+	if err != nil {
+		log.Error(fmt.Sprintf("create delegation receipt err %s", err))
+		res.ReceiptError = err.Error()
+	}
+	err2 = w.WriteJson(res)
 	if err2 != nil {
 		log.Error(fmt.Sprintf("write json err %s", err2))
 	}
 
 }
+
+/*
+newDelegationReceipt 委托已经保存以后,按保存下来的委托签发回执,fee是保存以后这个委托总共需要的smt.
+委托已经开始执行时不会再更新nonce和unlock,重复的punish也不会再追加,所以不能用请求中的值
+*/
+func newDelegationReceipt(n *Network, d *models.Delegate) (*verifier.DelegationReceipt, error) {
+	punishes, err := n.DB.GetDelegatePunishListByDelegateKey(d.Key)
+	if err != nil {
+		return nil, err
+	}
+	ubp := d.UpdateBalanceProof()
+	r := &verifier.DelegationReceipt{
+		PMS:               n.Address(),
+		ChainID:           n.ChainID,
+		ChannelIdentifier: d.ChannelIdentifier(),
+		OpenBlockNumber:   d.OpenBlockNumber,
+		Delegator:         d.DelegatorAddress(),
+		Nonce:             ubp.Nonce,
+		Locksroot:         ubp.Locksroot(),
+		UnlockCount:       len(d.Unlocks()),
+		PunishCount:       len(punishes),
+		Fee:               d.NeedSMT(),
+		BlockNumber:       n.DB.GetLatestBlockNumber(),
+	}
+	err = r.Sign(n.Signer)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+VerifyReceipt 校验一个委托回执是否由本PMS签发,并返回对应委托当前的状态
+Post /receipt/verify
+请求为委托时返回的receipt
+```json
+{
+  "valid": true,
+  "error": "", //校验失败的原因
+  "delegate": {}, //委托当前的状态,已经结束或者不存在时为空
+  "superseded": false //委托人之后又提交了更新的nonce
+}
+```
+*/
+func VerifyReceipt(w rest.ResponseWriter, r *rest.Request) {
+	n := networkOf(r)
+	receipt := &verifier.DelegationReceipt{}
+	err := r.DecodeJsonPayload(receipt)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	res := &verifyReceiptResponse{}
+	err = verifier.VerifyReceipt(receipt, n.Address())
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Valid = true
+		d, err := n.DB.GetDelegateByKey(models.BuildDelegateKey(receipt.ChannelIdentifier, receipt.Delegator))
+		if err == nil && d.OpenBlockNumber == receipt.OpenBlockNumber {
+			res.Delegate = d
+			res.Superseded = d.UpdateBalanceProof().Nonce > receipt.Nonce
+		}
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, res))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+type verifyReceiptResponse struct {
+	Valid      bool             `json:"valid"`
+	Error      string           `json:"error,omitempty"`
+	Delegate   *models.Delegate `json:"delegate,omitempty"`
+	Superseded bool             `json:"superseded"`
+}
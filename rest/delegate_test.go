@@ -0,0 +1,121 @@
+package restful
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDelegateUnlock(amount int64) *models.Unlock {
+	return &models.Unlock{
+		Lock: &mtree.Lock{
+			Expiration:     100,
+			Amount:         big.NewInt(amount),
+			LockSecretHash: utils.NewRandomHash(),
+		},
+	}
+}
+
+func postDelegate(t *testing.T, url string, c *models.ChannelFor3rd) *delegateResponse {
+	body, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res delegateResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &res
+}
+
+func TestDelegateRespondsStoredDelegate(t *testing.T) {
+	ast := assert.New(t)
+	db := models.SetupTestDb(t)
+	defer db.CloseDB()
+	smt := utils.NewRandomAddress()
+	db.SetFees(&params.Fees{
+		Token:          smt,
+		UpdateTransfer: big.NewInt(3),
+		Unlock:         big.NewInt(1),
+		Punish:         big.NewInt(2),
+		Secret:         big.NewInt(1),
+	})
+	key, _ := crypto.GenerateKey()
+	pn := &params.Network{
+		Name:            "default",
+		RegistryAddress: utils.NewRandomAddress(),
+		ChainID:         big.NewInt(8888),
+		Signer:          signer.NewKeystoreSigner(key),
+		Fees:            &params.Fees{Token: smt},
+		GasPrice:        big.NewInt(1),
+		SmtPerWei:       big.NewRat(1, 1),
+	}
+	n := &Network{
+		Network: pn,
+		DB:      db,
+		Prices:  models.NewStaticPriceFeed(pn),
+	}
+	ts := httptest.NewServer(newPublicHandler([]*Network{n}))
+	defer ts.Close()
+	delegator := utils.NewRandomAddress()
+	url := ts.URL + "/delegate/" + delegator.String()
+	c := &models.ChannelFor3rd{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+		TokenAddress:      utils.NewRandomAddress(),
+		PartnerAddress:    utils.NewRandomAddress(),
+		UpdateTransfer: models.UpdateTransfer{
+			Nonce:          1,
+			TransferAmount: big.NewInt(10),
+		},
+		Unlocks:  []*models.Unlock{newTestDelegateUnlock(10)},
+		Punishes: []*models.Punish{{LockHash: utils.NewRandomHash()}},
+	}
+	res := postDelegate(t, url, c)
+	ast.NotEqual(delegateError, res.Status, res.Error)
+	ast.EqualValues(1, len(res.Unlocks))
+	if ast.NotNil(res.Receipt) {
+		ast.EqualValues(1, res.Receipt.Nonce)
+		ast.EqualValues(1, res.Receipt.PunishCount)
+	}
+
+	// 开始执行以后委托的unlock不再更新,返回的是保存下来的unlock
+	d, err := db.GetDelegateByKey(models.BuildDelegateKey(c.ChannelIdentifier, delegator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Status = models.DelegateStatusRunning
+	db.UpdateObject(d)
+	c.UpdateTransfer.Nonce = 2
+	c.Unlocks = append(c.Unlocks, newTestDelegateUnlock(20))
+	// 重复的punish不会再追加
+	c.Punishes = append(c.Punishes, c.Punishes[0])
+	res = postDelegate(t, url, c)
+	ast.NotEqual(delegateError, res.Status, res.Error)
+	if ast.EqualValues(1, len(res.Unlocks)) {
+		ast.EqualValues(big.NewInt(10), res.Unlocks[0].Amount)
+	}
+	// 回执签的也是保存下来的委托
+	if ast.NotNil(res.Receipt) {
+		ast.EqualValues(1, res.Receipt.Nonce)
+		ast.EqualValues(1, res.Receipt.UnlockCount)
+		ast.EqualValues(1, res.Receipt.PunishCount)
+	}
+}
@@ -0,0 +1,175 @@
+package restful
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/dto"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+/*
+Info PMS的服务条款,App不需要再手工配置PMS地址,合约,收费token等信息.
+payload是PMS签名的原始json的base64编码,App应该对解码以后的payload计算sha3并恢复签名者,
+和自己固定(pin)的PMS地址比较,然后只使用从payload中解析出来的条款
+Get /info 或者 /net/<network>/info
+```json
+{
+  "payload": "eyJuZXR3b3JrIjoiZGVmYXVsdCIsImFkZHJlc3MiOiIweDNhZjdmYmRkZWYyY2ViZWViODUwMzI4YTA4MzRhYTlhMjk2ODQzMzIi...",
+  "signer": "0x3af7fbddef2cebeeb850328a0834aa9a29684332",
+  "signature": "0x5b1d83a624d4fc213597f16d802c5f8487217..."
+}
+```
+payload解码以后的内容
+```json
+{
+  "network": "default",
+  "address": "0x3af7fbddef2cebeeb850328a0834aa9a29684332",
+  "chain_id": 8888,
+  "registry_address": "0xa2150A4647908ab8D0135F1c4BFBB723495e8d12",
+  "fee_token": "0x6fdb6b4deb71c4D9AFbA4350e2e9D6CfD534F1cb",
+  "fee_node": "0xa94399b93da31e25ab5612de8c64556694d5f2fd", //通过photon收费时收费节点的地址,可能为空
+  "fees": {
+    "update_balance_proof": 3,
+    "unlock": 1,
+    "punish": 2,
+    "register_secret": 1
+  },
+  "reveal_timeout": 30,
+  "max_unlocks": 20,
+  "version": "0.5",
+  "block_number": 15338350, //已经同步到的块
+  "timestamp": 1546272000
+}
+```
+*/
+func Info(w rest.ResponseWriter, r *rest.Request) {
+	n := networkOf(r)
+	res, err := signServiceInfo(n, newServiceInfo(n))
+	if err != nil {
+		writeError(w, fmt.Sprintf("sign info err %s", err))
+		return
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, res))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+type serviceFees struct {
+	UpdateBalanceProof *big.Int `json:"update_balance_proof"`
+	Unlock             *big.Int `json:"unlock"`
+	Punish             *big.Int `json:"punish"`
+	RegisterSecret     *big.Int `json:"register_secret"`
+}
+
+type serviceInfo struct {
+	Network         string         `json:"network"`
+	Address         common.Address `json:"address"`
+	ChainID         *big.Int       `json:"chain_id"`
+	RegistryAddress common.Address `json:"registry_address"`
+	FeeToken        common.Address `json:"fee_token"`
+	FeeNode         string         `json:"fee_node,omitempty"`
+	Fees            *serviceFees   `json:"fees"`
+	RevealTimeout   int            `json:"reveal_timeout"`
+	MaxUnlocks      int            `json:"max_unlocks"`
+	Version         string         `json:"version"`
+	BlockNumber     int64          `json:"block_number"`
+	Timestamp       int64          `json:"timestamp"`
+}
+
+func newServiceInfo(n *Network) *serviceInfo {
+	fees := n.DB.Fees()
+	info := &serviceInfo{
+		Network:         n.Name,
+		Address:         n.Address(),
+		ChainID:         n.ChainID,
+		RegistryAddress: n.RegistryAddress,
+		FeeToken:        fees.Token,
+		Fees: &serviceFees{
+			UpdateBalanceProof: fees.UpdateTransfer,
+			Unlock:             fees.Unlock,
+			Punish:             fees.Punish,
+			RegisterSecret:     fees.Secret,
+		},
+		RevealTimeout: n.RevealTimeout,
+		MaxUnlocks:    n.MaxUnlocks,
+		Version:       params.Version,
+		BlockNumber:   n.DB.GetLatestBlockNumber(),
+		Timestamp:     time.Now().Unix(),
+	}
+	if n.FeeNode != utils.EmptyAddress {
+		info.FeeNode = n.FeeNode.String()
+	}
+	return info
+}
+
+type infoResponse struct {
+	Payload   []byte         `json:"payload"` // 签名的原文,json编码以后是base64,不会被JsonIndentMiddleware重新排版
+	Signer    common.Address `json:"signer"`
+	Signature hexutil.Bytes  `json:"signature"`
+}
+
+//signServiceInfo 签名的是info序列化以后的原文,原样放在响应中
+func signServiceInfo(n *Network, info *serviceInfo) (*infoResponse, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := n.Signer.SignData(data)
+	if err != nil {
+		return nil, err
+	}
+	return &infoResponse{
+		Payload:   data,
+		Signer:    n.Address(),
+		Signature: sig,
+	}, nil
+}
+
+type networkInfo struct {
+	Name            string         `json:"name"`
+	Address         common.Address `json:"address"`
+	ChainID         *big.Int       `json:"chain_id"`
+	RegistryAddress common.Address `json:"registry_address"`
+	BlockNumber     int64          `json:"block_number"`
+}
+
+/*
+Networks 本PMS服务的所有网络,每个网络的接口在/net/<name>/下面,第一个网络同时可以不带前缀访问
+Get /networks
+```json
+[
+  {
+    "name": "default",
+    "address": "0x3af7fbddef2cebeeb850328a0834aa9a29684332",
+    "chain_id": 8888,
+    "registry_address": "0xa2150A4647908ab8D0135F1c4BFBB723495e8d12",
+    "block_number": 15338350
+  }
+]
+```
+*/
+func Networks(w rest.ResponseWriter, r *rest.Request) {
+	var nis []*networkInfo
+	for _, n := range networkList {
+		nis = append(nis, &networkInfo{
+			Name:            n.Name,
+			Address:         n.Address(),
+			ChainID:         n.ChainID,
+			RegistryAddress: n.RegistryAddress,
+			BlockNumber:     n.DB.GetLatestBlockNumber(),
+		})
+	}
+	err := w.WriteJson(dto.NewAPIResponse(nil, nis))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
@@ -0,0 +1,75 @@
+package restful
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfoSignature(t *testing.T) {
+	ast := assert.New(t)
+	db := models.SetupTestDb(t)
+	defer db.CloseDB()
+	db.SetFees(&params.Fees{
+		Token:          utils.NewRandomAddress(),
+		UpdateTransfer: big.NewInt(3),
+		Unlock:         big.NewInt(1),
+		Punish:         big.NewInt(2),
+		Secret:         big.NewInt(1),
+	})
+	key, _ := crypto.GenerateKey()
+	n := &Network{
+		Network: &params.Network{
+			Name:            "default",
+			RegistryAddress: utils.NewRandomAddress(),
+			ChainID:         big.NewInt(8888),
+			Signer:          signer.NewKeystoreSigner(key),
+			FeeNode:         utils.NewRandomAddress(),
+			RevealTimeout:   40,
+			MaxUnlocks:      7,
+		},
+		DB: db,
+	}
+	ts := httptest.NewServer(newPublicHandler([]*Network{n}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Data struct {
+			Payload   []byte        `json:"payload"`
+			Signer    string        `json:"signer"`
+			Signature hexutil.Bytes `json:"signature"`
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 按文档校验收到的payload
+	pms, err := utils.Ecrecover(utils.Sha3(res.Data.Payload), res.Data.Signature)
+	ast.Nil(err)
+	ast.EqualValues(crypto.PubkeyToAddress(key.PublicKey), pms)
+	var info serviceInfo
+	err = json.Unmarshal(res.Data.Payload, &info)
+	ast.Nil(err)
+	ast.EqualValues(n.RegistryAddress, info.RegistryAddress)
+	ast.EqualValues(big.NewInt(3), info.Fees.UpdateBalanceProof)
+	// 发布的是这个网络自己的配置
+	ast.EqualValues(n.FeeNode.String(), info.FeeNode)
+	ast.EqualValues(40, info.RevealTimeout)
+	ast.EqualValues(7, info.MaxUnlocks)
+}
@@ -13,26 +13,96 @@ import (
 	"github.com/ant0ine/go-json-rest/rest"
 )
 
-var db *models.ModelDB
-var verify verifier.DelegateVerifier
+//Network 一个网络对外提供服务需要的配置,数据库,价格以及委托校验
+type Network struct {
+	*params.Network
+	DB     *models.ModelDB
+	Prices models.PriceFeed
+	Verify verifier.DelegateVerifier
+	Chain  Executor
+}
+
+var networks = make(map[string]*Network)
+var networkList []*Network
+var defaultNetwork *Network
 
 /*
 Start the restful server
+每个网络的接口都在/net/:network下面,第一个网络同时使用不带前缀的路径,和只有一个网络时保持兼容.
+管理接口使用单独的监听地址params.AdminListen
 */
-func Start(d *models.ModelDB, v verifier.DelegateVerifier) {
-	db = d
-	verify = v
+func Start(nets []*Network) {
+	handler := newPublicHandler(nets)
+	if params.AdminListen != "" {
+		go startAdmin()
+	}
+	listen := fmt.Sprintf("0.0.0.0:%d", params.APIPort)
+	log.Crit(fmt.Sprintf("http listen and serve :%s", http.ListenAndServe(listen, handler)))
+}
+
+//newPublicHandler 对外提供服务的接口
+func newPublicHandler(nets []*Network) http.Handler {
+	for _, n := range nets {
+		networks[n.Name] = n
+	}
+	networkList = nets
+	defaultNetwork = nets[0]
 	api := rest.NewApi()
 	api.Use(rest.DefaultDevStack...)
-	router, err := rest.MakeRouter(
+	api.Use(newRateLimitMiddleware())
+	routes := []*rest.Route{
+		rest.Get("/info", Info),
 		rest.Post("/delegate/:delegater", Delegate),
+		rest.Post("/receipt/verify", VerifyReceipt),
 		rest.Get("/tx/:delegater/:channel", Tx),
 		rest.Get("/fee/:delegater", Fee),
-	)
+		rest.Get("/delegates/:delegater", Delegates),
+		rest.Get("/history/:delegater", History),
+		rest.Get("/history/:delegater/:channel", History),
+		rest.Get("/records/:delegater", Records),
+		rest.Post("/refund/:delegater", Refund),
+		rest.Get("/refund/:delegater", Payouts),
+	}
+	all := []*rest.Route{
+		rest.Get("/networks", Networks),
+	}
+	all = append(all, perNetwork(routes)...)
+	router, err := rest.MakeRouter(all...)
 	if err != nil {
 		log.Crit(fmt.Sprintf("maker router :%s", err))
 	}
 	api.SetApp(router)
-	listen := fmt.Sprintf("0.0.0.0:%d", params.APIPort)
-	log.Crit(fmt.Sprintf("http listen and serve :%s", http.ListenAndServe(listen, api.MakeHandler())))
+	return api.MakeHandler()
+}
+
+//perNetwork 每个接口同时提供不带前缀和带/net/:network前缀的路径
+func perNetwork(routes []*rest.Route) (all []*rest.Route) {
+	for _, route := range routes {
+		h := withNetwork(route.Func)
+		all = append(all,
+			&rest.Route{HttpMethod: route.HttpMethod, PathExp: route.PathExp, Func: h},
+			&rest.Route{HttpMethod: route.HttpMethod, PathExp: "/net/:network" + route.PathExp, Func: h},
+		)
+	}
+	return
+}
+
+//withNetwork 根据路径中的network找到对应的网络,没有network时使用第一个网络
+func withNetwork(h rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		n := defaultNetwork
+		if name := r.PathParam("network"); name != "" {
+			n = networks[name]
+		}
+		if n == nil {
+			rest.Error(w, fmt.Sprintf("unknown network %s", r.PathParam("network")), http.StatusNotFound)
+			return
+		}
+		r.Env["network"] = n
+		h(w, r)
+	}
+}
+
+func networkOf(r *rest.Request) *Network {
+	return r.Env["network"].(*Network)
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/SmartMeshFoundation/Photon/dto"
 
 	"math/big"
+	"strconv"
 
 	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
 	"github.com/SmartMeshFoundation/Photon/log"
@@ -46,6 +47,7 @@ Get /\<delegater\>/channel/<channel_address>
 }
 */
 func Tx(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
 	var err error
 	delegaterStr := r.PathParam("delegater")
 	channel := r.PathParam("channel")
@@ -125,6 +127,7 @@ Get /\<delegater\>/fee
 ```
 */
 func Fee(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
 	delegaterStr := r.PathParam("delegater")
 	delegater := common.HexToAddress(delegaterStr)
 	a := db.AccountGetAccount(delegater)
@@ -142,3 +145,369 @@ type feeReponse struct {
 	Available *big.Int
 	NeedSmt   *big.Int
 }
+
+/*
+Reconcile 最近一次对账结果
+Get /admin/reconcile?all=true,只在管理接口提供,结果包含所有账户的余额
+默认只返回不一致的账户,all=true返回所有账户
+```json
+[
+  {
+    "address":"0x5B3F0E96E45e1e4351F6460feBfB6007af25FBB0",
+    "credited":"100", //账户中记录的到账总额
+    "recorded":"90", //ReceivedTransfer表中的到账总额
+    "recorded_photon":"90", //其中来自photon节点的部分
+    "node":"100", //photon节点返回的到账总额,节点不可用时为空
+    "consistent":false,
+    "reason":"credited 100 but recorded 90; photon node has 100 but recorded 90",
+    "reconcile_time":1546272000
+  }
+]
+```
+*/
+func Reconcile(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	all := r.URL.Query().Get("all") == "true"
+	results, err := db.GetReconcileResults(!all)
+	if err != nil {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  fmt.Sprintf("db GetReconcileResults err : %s", err.Error()),
+		})
+		return
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, results))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+/*
+History 已经结束(settle,合作settle或者withdraw)的委托的历史,按归档时间倒序
+Get /history/\<delegater\>
+Get /history/\<delegater\>/<channel>
+```json
+[
+  {
+    "archive": {
+      "key": "4fa00e...-15338350",
+      "channel_identifier": "0x4fa00ea25da02ecce11ced3d6167601c67762933adb98dfd82ad4f9b40f4db1a",
+      "open_block_number": 15338350,
+      "token_address": "0x261E9136F561AE44788BD2a08039075119C02EB3",
+      "delegator_address": "0x3af7fbddef2cebeeb850328a0834aa9a29684332",
+      "partner_address": "0x5B3F0E96E45e1e4351F6460feBfB6007af25FBB0",
+      "settle_block_number": 15338450,
+      "event": "settled", //settled,cooperative_settled或者withdraw
+      "event_block_number": 15338460,
+      "archive_timestamp": 1546272000,
+      "final_status": 2,
+      "error": "",
+      "outcome": "update_balance_proof: 1 success,0 failed,0 skipped; unlock: 2 success,0 failed,1 skipped",
+      "success_count": 3,
+      "failed_count": 0,
+      "skipped_count": 1,
+      "unlocks_incomplete": false,
+      "update_balance_proof_done": true
+    },
+    "delegate_update_balance_proof": {},
+    "delegate_unlocks": [],
+    "delegate_punishes": [],
+    "delegate_announce_dispose": []
+  }
+]
+```
+*/
+func History(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	var err error
+	delegater := common.HexToAddress(r.PathParam("delegater"))
+	if delegater == utils.EmptyAddress {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  "arg error",
+		})
+		return
+	}
+	das, err := db.GetDelegateArchives(delegater, common.HexToHash(r.PathParam("channel")))
+	if err != nil {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  fmt.Sprintf("db GetDelegateArchives err : %s", err.Error()),
+		})
+		return
+	}
+	var res []*historyResponse
+	for _, da := range das {
+		d := da.Delegate()
+		res = append(res, &historyResponse{
+			Archive:                    da,
+			DelegateUpdateBalanceProof: d.UpdateBalanceProof(),
+			DelegateUnlocks:            d.Unlocks(),
+			DelegatePunishes:           da.DelegatePunishes(),
+			DelegateAnnounceDispose:    da.DelegateAnnounceDisposes(),
+		})
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, res))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+type historyResponse struct {
+	Archive                    *models.DelegateArchive            `json:"archive"`
+	DelegateUpdateBalanceProof *models.DelegateUpdateBalanceProof `json:"delegate_update_balance_proof"`
+	DelegateUnlocks            []*models.DelegateUnlock           `json:"delegate_unlocks"`
+	DelegatePunishes           []*models.DelegatePunish           `json:"delegate_punishes"`
+	DelegateAnnounceDispose    []*models.DelegateAnnounceDispose  `json:"delegate_announce_dispose"`
+}
+
+/*
+Records PMS为委托人执行的合约调用记录,按执行时间倒序,可以用来确认PMS是否以及何时提交了tx
+Get /records/\<delegater\>?channel=<channel>&type=unlock&status=success&limit=20
+type可以是update_balance_proof,unlock,punish,register_secret或者对应的数字,
+status可以是not_execute,success,failed,skipped或者对应的数字,不指定表示不限制,
+没有注册成功的register_secret记录不返回密码
+```json
+[
+  {
+    "key": "0x0A5A2f5C0DE2B1c5b1d1d0E28B6a3d9b5e8B0c1D",
+    "channel_identifier": "0x4fa00ea25da02ecce11ced3d6167601c67762933adb98dfd82ad4f9b40f4db1a",
+    "open_block_number": 15338350,
+    "delegator": "0x3af7fbddef2cebeeb850328a0834aa9a29684332",
+    "type": 1,
+    "status": 1,
+    "error": "",
+    "execute_timestamp": 1546272000,
+    "tx_hash_str": "0x5d2f6c1e7a0c0bd0a1c1d0fb7c26a8d4e8a3c2b1a0f9e8d7c6b5a4f3e2d1c0b9",
+    "tx_create_block_number": 15338420,
+    "tx_create_timestamp": 1546272000,
+    "tx_pack_block_number": 15338421,
+    "tx_pack_timestamp": 1546272015,
+    "secret": "",
+    "params": {
+      "lock_secret_hash": "0x933c446b9ee22072f26677561d25b1219cf0bc1ebd3cc5c1d8fa23270df6f609",
+      "amount": "10",
+      "Expiration": 15338500,
+      "merkle_proof": null,
+      "signature": "Wx2DpiTU/CE1l/FtgCxfhIcheRyxj3V9fgmOJ2HeenoeiQUFzE6XMDcPJ9R43OICXxuQBdxOQm25khbp1GbpYRw="
+    }
+  }
+]
+```
+*/
+func Records(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	var err error
+	q := &models.DelegateExecuteRecordQuery{
+		Delegator:         common.HexToAddress(r.PathParam("delegater")),
+		ChannelIdentifier: common.HexToHash(r.URL.Query().Get("channel")),
+	}
+	if q.Delegator == utils.EmptyAddress {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  "arg error",
+		})
+		return
+	}
+	err = parseRecordQuery(r, q)
+	if err != nil {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  err.Error(),
+		})
+		return
+	}
+	res, err := db.GetExecuteRecordViews(q)
+	if err != nil {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  fmt.Sprintf("db GetDelegateExecuteRecords err : %s", err.Error()),
+		})
+		return
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, res))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+func parseRecordQuery(r *rest.Request, q *models.DelegateExecuteRecordQuery) error {
+	values := r.URL.Query()
+	if s := values.Get("type"); s != "" {
+		t, err := models.ParseDelegateType(s)
+		if err != nil {
+			return err
+		}
+		q.Type = &t
+	}
+	if s := values.Get("status"); s != "" {
+		status, err := models.ParseExecuteStatus(s)
+		if err != nil {
+			return err
+		}
+		q.Status = &status
+	}
+	if s := values.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("invalid limit %s", s)
+		}
+		q.Limit = limit
+	}
+	return nil
+}
+
+/*
+Delegates 委托人所有还没有结束的委托,用于客户端丢失本地数据以后找回委托过哪些通道
+Get /delegates/\<delegater\>?status=0&token=<token>&partner=<partner>&offset=0&limit=20
+limit默认20,最大100,按委托时间倒序
+```json
+{
+  "total": 1,
+  "offset": 0,
+  "limit": 20,
+  "available_smt": 100, //账户可用的smt
+  "need_smt": 5, //执行所有委托还需要的smt
+  "delegates": [
+    {
+      "delegate": {
+        "channel_identifier": "0x4fa00ea25da02ecce11ced3d6167601c67762933adb98dfd82ad4f9b40f4db1a",
+        "open_block_number": 15338350,
+        "token_address": "0x261E9136F561AE44788BD2a08039075119C02EB3",
+        "delegator_address": "0x3af7fbddef2cebeeb850328a0834aa9a29684332",
+        "partner_address": "0x5B3F0E96E45e1e4351F6460feBfB6007af25FBB0",
+        "settle_block_number": 15338450,
+        "status": 0,
+        ...
+      },
+      "settle_block_number": 15338450, //0表示通道还没有关闭
+      "next_action_block_number": 15338420, //0表示还没有计划执行
+      "next_action_type": 0, //0 updateBalanceProof及unlock,1 punish,2 punish指定的锁
+      "required_smt": 5 //这个委托需要的smt
+    }
+  ]
+}
+```
+*/
+func Delegates(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	var err error
+	q := &models.DelegateQuery{
+		Delegator: common.HexToAddress(r.PathParam("delegater")),
+		Limit:     defaultDelegatesLimit,
+	}
+	if q.Delegator == utils.EmptyAddress {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  "arg error",
+		})
+		return
+	}
+	err = parseDelegateQuery(r, q)
+	if err != nil {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  err.Error(),
+		})
+		return
+	}
+	ds, total, err := db.GetDelegates(q)
+	if err != nil {
+		err = w.WriteJson(&dto.APIResponse{
+			ErrorCode: delegateError,
+			ErrorMsg:  fmt.Sprintf("db GetDelegates err : %s", err.Error()),
+		})
+		return
+	}
+	a := db.AccountGetAccount(q.Delegator)
+	res := &delegatesResponse{
+		Total:     total,
+		Offset:    q.Offset,
+		Limit:     q.Limit,
+		Available: models.AccountAvailable(a),
+		NeedSmt:   a.NeedSmt,
+		Delegates: []*delegateItem{},
+	}
+	lastBlockNumber := db.GetLatestBlockNumber()
+	for _, d := range ds {
+		item := &delegateItem{
+			Delegate:          d,
+			SettleBlockNumber: d.SettleBlockNumber,
+			RequiredSmt:       d.NeedSMT(),
+		}
+		dm, err := db.GetNextDelegateMonitor(d.Key, lastBlockNumber)
+		if err != nil {
+			log.Error(fmt.Sprintf("db GetNextDelegateMonitor err %s", err))
+		}
+		if dm != nil {
+			item.NextActionBlockNumber = dm.BlockNumber
+			item.NextActionType = dm.Type
+		}
+		res.Delegates = append(res.Delegates, item)
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, res))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+const (
+	defaultDelegatesLimit = 20
+	maxDelegatesLimit     = 100
+)
+
+func parseDelegateQuery(r *rest.Request, q *models.DelegateQuery) error {
+	values := r.URL.Query()
+	if s := values.Get("status"); s != "" {
+		status, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid status %s", s)
+		}
+		ds := models.DelegateStatus(status)
+		q.Status = &ds
+	}
+	if s := values.Get("token"); s != "" {
+		if !common.IsHexAddress(s) {
+			return fmt.Errorf("invalid token %s", s)
+		}
+		q.Token = common.HexToAddress(s)
+	}
+	if s := values.Get("partner"); s != "" {
+		if !common.IsHexAddress(s) {
+			return fmt.Errorf("invalid partner %s", s)
+		}
+		q.Partner = common.HexToAddress(s)
+	}
+	if s := values.Get("offset"); s != "" {
+		offset, err := strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return fmt.Errorf("invalid offset %s", s)
+		}
+		q.Offset = offset
+	}
+	if s := values.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxDelegatesLimit {
+			return fmt.Errorf("invalid limit %s, must between 1 and %d", s, maxDelegatesLimit)
+		}
+		q.Limit = limit
+	}
+	return nil
+}
+
+type delegatesResponse struct {
+	Total     int             `json:"total"`
+	Offset    int             `json:"offset"`
+	Limit     int             `json:"limit"`
+	Available *big.Int        `json:"available_smt"`
+	NeedSmt   *big.Int        `json:"need_smt"`
+	Delegates []*delegateItem `json:"delegates"`
+}
+
+type delegateItem struct {
+	Delegate              *models.Delegate   `json:"delegate"`
+	SettleBlockNumber     int64              `json:"settle_block_number"`
+	NextActionBlockNumber int64              `json:"next_action_block_number"`
+	NextActionType        models.MonitorType `json:"next_action_type"`
+	RequiredSmt           *big.Int           `json:"required_smt"`
+}
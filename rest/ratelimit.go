@@ -0,0 +1,83 @@
+package restful
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//bucket 一个客户端的令牌桶
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+rateLimitMiddleware 按客户端ip限制请求频率,每次请求都读取params中的限制,
+这样重新加载配置以后马上生效
+*/
+type rateLimitMiddleware struct {
+	lock      sync.Mutex
+	clients   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimitMiddleware() *rateLimitMiddleware {
+	return &rateLimitMiddleware{
+		clients:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+//MiddlewareFunc makes rateLimitMiddleware implement the rest.Middleware interface.
+func (m *rateLimitMiddleware) MiddlewareFunc(h rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		rate, burst := params.GetRateLimit()
+		if rate > 0 && !m.allow(clientIP(r), rate, burst, time.Now()) {
+			rest.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (m *rateLimitMiddleware) allow(client string, rate float64, burst int, now time.Time) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// 定期清理已经攒满令牌的客户端,避免map无限增长
+	if now.Sub(m.lastSweep) > time.Minute {
+		for c, b := range m.clients {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+				delete(m.clients, c)
+			}
+		}
+		m.lastSweep = now
+	}
+	b, ok := m.clients[client]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		m.clients[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func clientIP(r *rest.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,31 @@
+package restful
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitAllow(t *testing.T) {
+	ast := assert.New(t)
+	m := newRateLimitMiddleware()
+	now := time.Now()
+	// 先用完burst
+	ast.True(m.allow("1.1.1.1", 1, 2, now))
+	ast.True(m.allow("1.1.1.1", 1, 2, now))
+	ast.False(m.allow("1.1.1.1", 1, 2, now))
+	// 其他客户端不受影响
+	ast.True(m.allow("2.2.2.2", 1, 2, now))
+	// 按rate补充令牌,但是不超过burst
+	ast.True(m.allow("1.1.1.1", 1, 2, now.Add(time.Second)))
+	ast.False(m.allow("1.1.1.1", 1, 2, now.Add(time.Second)))
+	later := now.Add(time.Hour)
+	ast.True(m.allow("1.1.1.1", 1, 2, later))
+	ast.True(m.allow("1.1.1.1", 1, 2, later))
+	ast.False(m.allow("1.1.1.1", 1, 2, later))
+	// 已经攒满令牌的客户端被清理
+	ast.Equal(1, len(m.clients))
+	_, ok := m.clients["2.2.2.2"]
+	ast.False(ok)
+}
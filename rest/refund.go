@@ -0,0 +1,94 @@
+package restful
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
+	"github.com/SmartMeshFoundation/Photon/dto"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+Refund 申请退还未使用的余额
+Post /refund/<delegater>
+签名数据为 PMS地址(20字节)+chain id(32字节)+registry合约地址(20字节)+amount(32字节)+nonce(8字节,大端),
+chain id和registry地址和/info返回的一致,nonce必须比上一次退款的大
+```json
+{
+  "amount":100000000000000,
+  "nonce":1,
+  "signature":"Wx2DpiTU/CE1l/FtgCxfhIcheRyxj3V9fgmOJ2HeenoeiQUFzE6XMDcPJ9R43OICXxuQBdxOQm25khbp1GbpYRw="
+}
+```
+返回创建的退款记录,status 0表示等待发送
+*/
+func Refund(w rest.ResponseWriter, r *rest.Request) {
+	n := networkOf(r)
+	var err error
+	delegater := common.HexToAddress(r.PathParam("delegater"))
+	if delegater == utils.EmptyAddress {
+		writeError(w, "empty delegater")
+		return
+	}
+	if len(params.PayoutMethod) == 0 {
+		writeError(w, "refund is not supported")
+		return
+	}
+	req := &models.RefundRequest{}
+	err = r.DecodeJsonPayload(req)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	signer, err := req.Signer(n.Address(), n.ChainID, n.RegistryAddress)
+	if err != nil {
+		writeError(w, fmt.Sprintf("signature err %s", err))
+		return
+	}
+	if signer != delegater {
+		writeError(w, fmt.Sprintf("refund should be signed by %s, but signer is %s", delegater.String(), signer.String()))
+		return
+	}
+	p, err := n.DB.CreatePayout(delegater, req.Amount, req.Nonce, params.PayoutMethod)
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, p))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+/*
+Payouts 查询退款状态
+Get /refund/<delegater>
+status 0 等待发送,1 正在发送,2 成功,3 失败(金额已退回),4 无法确定结果(需要人工核对)
+*/
+func Payouts(w rest.ResponseWriter, r *rest.Request) {
+	db := networkOf(r).DB
+	delegater := common.HexToAddress(r.PathParam("delegater"))
+	ps, err := db.GetPayoutsByDelegator(delegater)
+	if err != nil {
+		writeError(w, fmt.Sprintf("db GetPayoutsByDelegator err : %s", err.Error()))
+		return
+	}
+	err = w.WriteJson(dto.NewAPIResponse(nil, ps))
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+func writeError(w rest.ResponseWriter, msg string) {
+	err := w.WriteJson(&dto.APIResponse{
+		ErrorCode: delegateError,
+		ErrorMsg:  msg,
+	})
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
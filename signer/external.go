@@ -0,0 +1,171 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+/*
+ContentTypePhoton account_signData的内容类型,对Keccak256(data)直接签名,不加任何前缀,
+v是27或28,和Photon的utils.SignData一致.
+Clef默认不支持这种类型,使用Clef时需要相应的规则或者使用Service
+*/
+const ContentTypePhoton = "application/x-photon-monitoring"
+
+// 外部签名服务可能需要人工确认,留足够的时间
+const callTimeout = time.Minute
+
+//SendTxArgs 请求签名的交易,和Clef的account_signTransaction参数一致
+type SendTxArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      hexutil.Uint64  `json:"gas"`
+	GasPrice hexutil.Big     `json:"gasPrice"`
+	Value    hexutil.Big     `json:"value"`
+	Nonce    hexutil.Uint64  `json:"nonce"`
+	Data     *hexutil.Bytes  `json:"data"`
+	ChainID  *hexutil.Big    `json:"chainId,omitempty"`
+}
+
+func newSendTxArgs(from common.Address, tx *types.Transaction, chainID *big.Int) *SendTxArgs {
+	data := hexutil.Bytes(tx.Data())
+	return &SendTxArgs{
+		From:     from,
+		To:       tx.To(),
+		Gas:      hexutil.Uint64(tx.Gas()),
+		GasPrice: hexutil.Big(*tx.GasPrice()),
+		Value:    hexutil.Big(*tx.Value()),
+		Nonce:    hexutil.Uint64(tx.Nonce()),
+		Data:     &data,
+		ChainID:  (*hexutil.Big)(chainID),
+	}
+}
+
+func (args *SendTxArgs) toTransaction() *types.Transaction {
+	var data []byte
+	if args.Data != nil {
+		data = *args.Data
+	}
+	if args.To == nil {
+		return types.NewContractCreation(uint64(args.Nonce), (*big.Int)(&args.Value), uint64(args.Gas), (*big.Int)(&args.GasPrice), data)
+	}
+	return types.NewTransaction(uint64(args.Nonce), *args.To, (*big.Int)(&args.Value), uint64(args.Gas), (*big.Int)(&args.GasPrice), data)
+}
+
+//SignTxResult account_signTransaction的结果
+type SignTxResult struct {
+	Raw hexutil.Bytes      `json:"raw"`
+	Tx  *types.Transaction `json:"tx"`
+}
+
+/*
+ExternalSigner 通过JSON-RPC请求外部签名服务签名,接口和Clef一致:
+account_list,account_signTransaction,account_signData.
+签名结果都会在本地校验签名者和内容,签名服务不能替换交易
+*/
+type ExternalSigner struct {
+	client  *rpc.Client
+	address common.Address
+}
+
+//NewExternalSigner connect to endpoint(http,ws or ipc) and make sure it manages address
+func NewExternalSigner(endpoint string, address common.Address) (*ExternalSigner, error) {
+	client, err := rpc.Dial(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("connect to signer %s err %s", endpoint, err)
+	}
+	return newExternalSigner(client, address)
+}
+
+func newExternalSigner(client *rpc.Client, address common.Address) (*ExternalSigner, error) {
+	s := &ExternalSigner{
+		client:  client,
+		address: address,
+	}
+	var accounts []common.Address
+	err := s.call(&accounts, "account_list")
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range accounts {
+		if a == address {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("signer doesn't manage account %s", address.String())
+}
+
+func (s *ExternalSigner) call(result interface{}, method string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	err := s.client.CallContext(ctx, result, method, args...)
+	if err != nil {
+		return fmt.Errorf("%s err %s", method, err)
+	}
+	return nil
+}
+
+//Address of the account managed by external signer
+func (s *ExternalSigner) Address() common.Address {
+	return s.address
+}
+
+//SignData request account_signData with ContentTypePhoton
+func (s *ExternalSigner) SignData(data []byte) ([]byte, error) {
+	var sig hexutil.Bytes
+	err := s.call(&sig, "account_signData", ContentTypePhoton, s.address, hexutil.Bytes(data))
+	if err != nil {
+		return nil, err
+	}
+	signer, err := utils.Ecrecover(utils.Sha3(data), sig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature from signer %s", err)
+	}
+	if signer != s.address {
+		return nil, fmt.Errorf("signature is signed by %s, not %s", signer.String(), s.address.String())
+	}
+	return sig, nil
+}
+
+//SignTx request account_signTransaction
+func (s *ExternalSigner) SignTx(signer types.Signer, tx *types.Transaction) (*types.Transaction, error) {
+	id, err := chainID(signer)
+	if err != nil {
+		return nil, err
+	}
+	var res SignTxResult
+	err = s.call(&res, "account_signTransaction", newSendTxArgs(s.address, tx, id))
+	if err != nil {
+		return nil, err
+	}
+	signed := new(types.Transaction)
+	err = rlp.DecodeBytes(res.Raw, signed)
+	if err != nil {
+		return nil, fmt.Errorf("decode signed tx err %s", err)
+	}
+	if signer.Hash(signed) != signer.Hash(tx) {
+		return nil, fmt.Errorf("signer changed the transaction")
+	}
+	from, err := types.Sender(signer, signed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed tx %s", err)
+	}
+	if from != s.address {
+		return nil, fmt.Errorf("tx is signed by %s, not %s", from.String(), s.address.String())
+	}
+	return signed, nil
+}
+
+//Close the connection
+func (s *ExternalSigner) Close() {
+	s.client.Close()
+}
@@ -0,0 +1,39 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+//KeystoreSigner 用从keystore解密出来的私钥签名,也就是原来的方式
+type KeystoreSigner struct {
+	key     *ecdsa.PrivateKey
+	address common.Address
+}
+
+//NewKeystoreSigner create signer holds the key
+func NewKeystoreSigner(key *ecdsa.PrivateKey) *KeystoreSigner {
+	return &KeystoreSigner{
+		key:     key,
+		address: crypto.PubkeyToAddress(key.PublicKey),
+	}
+}
+
+//Address of the key
+func (s *KeystoreSigner) Address() common.Address {
+	return s.address
+}
+
+//SignData by utils.SignData
+func (s *KeystoreSigner) SignData(data []byte) ([]byte, error) {
+	return utils.SignData(s.key, data)
+}
+
+//SignTx by types.SignTx
+func (s *KeystoreSigner) SignTx(signer types.Signer, tx *types.Transaction) (*types.Transaction, error) {
+	return types.SignTx(tx, signer, s.key)
+}
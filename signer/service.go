@@ -0,0 +1,65 @@
+package signer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+/*
+Service 实现ExternalSigner需要的account_*接口,用另一个Signer(一般是KeystoreSigner)签名.
+可以在单独的进程或者机器上替代Clef运行,这样PMS进程中没有私钥
+*/
+type Service struct {
+	s Signer
+}
+
+//NewServer create a json-rpc server with account namespace
+func NewServer(s Signer) (*rpc.Server, error) {
+	srv := rpc.NewServer()
+	err := srv.RegisterName("account", &Service{s: s})
+	if err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+//List account_list
+func (svc *Service) List() []common.Address {
+	return []common.Address{svc.s.Address()}
+}
+
+//SignData account_signData, only ContentTypePhoton supported
+func (svc *Service) SignData(contentType string, addr common.Address, data hexutil.Bytes) (hexutil.Bytes, error) {
+	if contentType != ContentTypePhoton {
+		return nil, fmt.Errorf("unsupported content type %s", contentType)
+	}
+	if addr != svc.s.Address() {
+		return nil, ErrNotAuthorized
+	}
+	return svc.s.SignData(data)
+}
+
+//SignTransaction account_signTransaction, chainId is required
+func (svc *Service) SignTransaction(args SendTxArgs) (*SignTxResult, error) {
+	if args.From != svc.s.Address() {
+		return nil, ErrNotAuthorized
+	}
+	if args.ChainID == nil {
+		return nil, fmt.Errorf("chainId is required")
+	}
+	tx, err := svc.s.SignTx(types.NewEIP155Signer((*big.Int)(args.ChainID)), args.toTransaction())
+	if err != nil {
+		return nil, err
+	}
+	raw, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return nil, err
+	}
+	return &SignTxResult{Raw: raw, Tx: tx}, nil
+}
@@ -0,0 +1,60 @@
+package signer
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+/*
+Signer PMS所有需要签名的地方(链上tx,委托回执,/info)都通过Signer完成,
+KeystoreSigner在进程内持有私钥,ExternalSigner把签名交给外部的签名服务,
+需要隔离私钥的运营者使用后者,私钥不会出现在PMS的内存中
+*/
+type Signer interface {
+	//Address of the signing account
+	Address() common.Address
+	//SignData 和utils.SignData一致,对Sha3(data)签名,v是27或28
+	SignData(data []byte) ([]byte, error)
+	//SignTx 签名交易,signer由bind根据链决定
+	SignTx(signer types.Signer, tx *types.Transaction) (*types.Transaction, error)
+}
+
+//ErrNotAuthorized 请求签名的账户不是Signer的账户
+var ErrNotAuthorized = errors.New("not authorized to sign this account")
+
+//NewTransactor 创建使用Signer签名的TransactOpts,替代bind.NewKeyedTransactor
+func NewTransactor(s Signer) *bind.TransactOpts {
+	return &bind.TransactOpts{
+		From: s.Address(),
+		Signer: func(signer types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != s.Address() {
+				return nil, ErrNotAuthorized
+			}
+			return s.SignTx(signer, tx)
+		},
+	}
+}
+
+// 只用来求chain id,不签任何真实数据
+var probeKey, _ = crypto.GenerateKey()
+
+/*
+chainID types.Signer没有暴露chain id,而外部签名服务需要它,
+bind对spectrum主网会修改chain id,所以不能直接用配置的chain id,
+这里用一个临时key签一个空交易,从签名中取出chain id
+*/
+func chainID(signer types.Signer) (*big.Int, error) {
+	tx, err := types.SignTx(types.NewTransaction(0, common.Address{}, nil, 0, nil, nil), signer, probeKey)
+	if err != nil {
+		return nil, err
+	}
+	if !tx.Protected() {
+		return nil, errors.New("only EIP155 transactions are supported")
+	}
+	return tx.ChainId(), nil
+}
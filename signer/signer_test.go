@@ -0,0 +1,48 @@
+package signer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExternalSigner(t *testing.T) {
+	ast := assert.New(t)
+	key, err := crypto.GenerateKey()
+	ast.Nil(err)
+	ks := NewKeystoreSigner(key)
+	srv, err := NewServer(ks)
+	ast.Nil(err)
+	_, err = newExternalSigner(rpc.DialInProc(srv), utils.NewRandomAddress())
+	ast.NotNil(err)
+	es, err := newExternalSigner(rpc.DialInProc(srv), ks.Address())
+	ast.Nil(err)
+	defer es.Close()
+
+	data := []byte("photon monitoring")
+	sig, err := es.SignData(data)
+	ast.Nil(err)
+	addr, err := utils.Ecrecover(utils.Sha3(data), sig)
+	ast.Nil(err)
+	ast.Equal(ks.Address(), addr)
+
+	for _, s := range []Signer{ks, es} {
+		auth := NewTransactor(s)
+		txSigner := types.NewEIP155Signer(big.NewInt(8888))
+		tx := types.NewTransaction(3, utils.NewRandomAddress(), big.NewInt(10), 100000, big.NewInt(18), []byte{1, 2, 3})
+		signed, err := auth.Signer(txSigner, ks.Address(), tx)
+		ast.Nil(err)
+		from, err := types.Sender(txSigner, signed)
+		ast.Nil(err)
+		ast.Equal(ks.Address(), from)
+		ast.Equal(txSigner.Hash(tx), txSigner.Hash(signed))
+		ast.EqualValues(8888, signed.ChainId().Int64())
+		_, err = auth.Signer(txSigner, utils.NewRandomAddress(), tx)
+		ast.Equal(ErrNotAuthorized, err)
+	}
+}
@@ -10,75 +10,130 @@ import (
 	"time"
 
 	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
-	"github.com/SmartMeshFoundation/Photon-Monitoring/params"
 	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/ethereum/go-ethereum/common"
 )
 
 //Query monitor receiving smt
 type Query struct {
 	url      string
+	token    common.Address
 	db       *models.ModelDB
+	client   *http.Client
 	quitChan chan struct{}
 	from     int64
 	stopped  bool
 	interval time.Duration
+	retries  int
 }
 
-//NewSmtQuery create qmt query
-func NewSmtQuery(url string, db *models.ModelDB, fromBlockNumber int64) *Query {
-	return &Query{
-		url:      url,
-		db:       db,
-		from:     fromBlockNumber,
+//NewSmtQuery create qmt query, continue from the saved cursor
+func NewSmtQuery(url string, token common.Address, db *models.ModelDB) *Query {
+	s := &Query{
+		url:   url,
+		token: token,
+		db:    db,
+		client: &http.Client{
+			Timeout: time.Second * 10,
+		},
 		quitChan: make(chan struct{}),
 		interval: time.Second * 10,
+		retries:  3,
 	}
+	s.from = db.GetPaymentCursor(s.Name())
+	return s
+}
+
+//Name of this payment source
+func (s *Query) Name() string {
+	return "photon"
 }
 
 //Start query
-func (s *Query) Start() {
+func (s *Query) Start() error {
 	go s.loop()
+	return nil
 }
 func (s *Query) loop() {
 	for {
 		select {
-		case <-time.After(time.Second * 10):
+		case <-time.After(s.interval):
 			s.getNewTransfer()
 		case <-s.quitChan:
 			return
 		}
 	}
 }
-func (s *Query) getNewTransfer() {
-	res, err := http.Get(fmt.Sprintf("%s?from_block=%d", s.url, s.from))
+
+/*
+queryWithRetry photon节点可能临时不可用,失败以后按1s,2s,4s...退避重试
+*/
+func (s *Query) queryWithRetry() (trs []*models.ReceivedTransfer, err error) {
+	backoff := time.Second
+	for i := 0; i < s.retries; i++ {
+		trs, err = s.query()
+		if err == nil {
+			return
+		}
+		log.Warn(fmt.Sprintf("query photon %s err %s, retry=%d", s.url, err, i))
+		select {
+		case <-time.After(backoff):
+		case <-s.quitChan:
+			return
+		}
+		backoff *= 2
+	}
+	return
+}
+
+func (s *Query) query() (trs []*models.ReceivedTransfer, err error) {
+	res, err := s.client.Get(fmt.Sprintf("%s?from_block=%d", s.url, s.from))
 	if err != nil {
-		log.Error(fmt.Sprintf("getNewTransfer err %s", err))
 		return
 	}
-	if s.stopped {
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("http status %s", res.Status)
 		return
 	}
 	data, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Error(fmt.Sprintf("read data err %s", err))
 		return
 	}
-	var trs []*models.ReceivedTransfer
 	err = json.Unmarshal(data, &trs)
+	return
+}
+
+func (s *Query) getNewTransfer() {
+	trs, err := s.queryWithRetry()
 	if err != nil {
-		log.Error(fmt.Sprintf("unmarshal err %s", err))
+		log.Error(fmt.Sprintf("getNewTransfer err %s", err))
+		return
+	}
+	if s.stopped {
 		return
 	}
 	var maxBlock int64
 	for _, tr := range trs {
-		if tr.TokenAddress() == params.SmtAddress && s.db.NewReceiveTransferFromReceiveTransfer(tr) {
-			s.db.AccountAddSmt(tr.FromAddress(), tr.Amount())
+		_, err = creditTransfer(s.db, s.token, tr)
+		if err != nil {
+			//不推进游标,下次重新查询,已经记账的不会重复记账
+			log.Error(fmt.Sprintf("getNewTransfer err %s", err))
+			return
 		}
-		if tr.BlockNumber > maxBlock {
+		if tr != nil && tr.BlockNumber > maxBlock {
 			maxBlock = tr.BlockNumber
 		}
 	}
+	/*
+		同一个块中可能还有没返回的到账,所以游标停留在maxBlock,而不是maxBlock+1
+	*/
 	if maxBlock > s.from {
+		err = s.db.SavePaymentCursor(s.Name(), maxBlock)
+		if err != nil {
+			log.Error(fmt.Sprintf("save payment cursor err %s", err))
+			return
+		}
 		s.from = maxBlock
 	}
 }
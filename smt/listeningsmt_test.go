@@ -1,15 +1,70 @@
 package smt
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewSmtQuery(t *testing.T) {
-	s := NewSmtQuery("http://127.0.0.1:5001/api/1/queryreceivedtransfer", models.SetupTestDb(t), 0)
-	s.Start()
-	time.Sleep(time.Second * 5)
+	db := models.SetupTestDb(t)
+	token := utils.NewRandomAddress()
+	from := utils.NewRandomAddress()
+	trs := []*models.ReceivedTransfer{
+		{
+			Key:             "t1",
+			BlockNumber:     3,
+			TokenAddressStr: token.String(),
+			FromAddressStr:  from.String(),
+			AmountStr:       "10",
+		},
+		//token不对,不能记账
+		{
+			Key:             "t2",
+			BlockNumber:     4,
+			TokenAddressStr: utils.NewRandomAddress().String(),
+			FromAddressStr:  from.String(),
+			AmountStr:       "10",
+		},
+		//金额不对,不能记账
+		{
+			Key:             "t3",
+			BlockNumber:     5,
+			TokenAddressStr: token.String(),
+			FromAddressStr:  from.String(),
+			AmountStr:       "-10",
+		},
+	}
+	failed := 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failed > 0 {
+			failed--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		err := json.NewEncoder(w).Encode(trs)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+	s := NewSmtQuery(ts.URL, token, db)
+	s.interval = time.Millisecond * 10
+	s.getNewTransfer()
+	assert.EqualValues(t, 5, s.from)
+	//重复查询不会重复记账
+	s.getNewTransfer()
+	a := db.AccountGetAccount(from)
+	assert.EqualValues(t, "10", a.TotalReceivedSmt.String())
+	//重启以后从保存的游标继续
+	assert.EqualValues(t, 5, NewSmtQuery(ts.URL, token, db).from)
+	err := s.Start()
+	assert.Nil(t, err)
 	s.Stop()
 }
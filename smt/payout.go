@@ -0,0 +1,260 @@
+package smt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/network/rpc"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+/*
+PayoutSender 退款渠道,把退款发给用户
+sent=false表示确定没有发出,可以把金额退回用户账户;
+sent=true并且err!=nil表示无法确定结果,需要人工核对
+*/
+type PayoutSender interface {
+	Name() string
+	Send(p *models.Payout) (reference string, sent bool, err error)
+}
+
+/*
+PhotonPayoutSender 通过关联的photon节点给用户转账退款
+*/
+type PhotonPayoutSender struct {
+	api    string // photon节点api地址,比如 http://127.0.0.1:5001
+	token  common.Address
+	client *http.Client
+}
+
+//NewPhotonPayoutSender create a sender use photon api
+func NewPhotonPayoutSender(api string, token common.Address) *PhotonPayoutSender {
+	return &PhotonPayoutSender{
+		api:   strings.TrimRight(api, "/"),
+		token: token,
+		client: &http.Client{
+			Timeout: time.Minute * 2,
+		},
+	}
+}
+
+//Name of this sender
+func (s *PhotonPayoutSender) Name() string {
+	return "photon"
+}
+
+type photonTransferRequest struct {
+	Amount   *big.Int `json:"amount"`
+	Fee      *big.Int `json:"fee"`
+	IsDirect bool     `json:"is_direct"`
+	Sync     bool     `json:"sync"`
+}
+
+type photonTransferResponse struct {
+	LockSecretHash string `json:"lock_secret_hash"`
+}
+
+//Send transfer by photon, wait until transfer finished
+func (s *PhotonPayoutSender) Send(p *models.Payout) (reference string, sent bool, err error) {
+	body, err := json.Marshal(&photonTransferRequest{
+		Amount: p.Amount(),
+		Fee:    big.NewInt(0),
+		Sync:   true,
+	})
+	if err != nil {
+		return
+	}
+	url := fmt.Sprintf("%s/api/1/transfers/%s/%s", s.api, s.token.String(), p.DelegatorStr)
+	res, err := s.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		//请求可能已经到达节点
+		sent = true
+		return
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		sent = true
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("photon transfer status %s : %s", res.Status, string(data))
+		//只有4xx确定节点拒绝了转账,超时和5xx时转账可能已经发出
+		sent = !isRejectedStatus(res.StatusCode)
+		return
+	}
+	sent = true
+	var tr photonTransferResponse
+	err = json.Unmarshal(data, &tr)
+	if err != nil {
+		return
+	}
+	reference = tr.LockSecretHash
+	return
+}
+
+func isRejectedStatus(code int) bool {
+	return code >= http.StatusBadRequest && code < http.StatusInternalServerError && code != http.StatusRequestTimeout
+}
+
+const erc20TransferABI = `[{"constant":false,"inputs":[{"name":"_to","type":"address"},{"name":"_value","type":"uint256"}],"name":"transfer","outputs":[{"name":"","type":"bool"}],"payable":false,"stateMutability":"nonpayable","type":"function"}]`
+
+/*
+ERC20Backend is chain interface needed by ERC20PayoutSender,
+TransactionReceipt is needed by bind.WaitMined, CodeAt comes from bind.ContractBackend
+*/
+type ERC20Backend interface {
+	bind.ContractBackend
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+/*
+ERC20PayoutSender 直接在链上调用token的transfer退款
+*/
+type ERC20PayoutSender struct {
+	backend  ERC20Backend
+	auth     *bind.TransactOpts
+	contract *bind.BoundContract
+}
+
+//NewERC20PayoutSender create a sender call erc20 transfer
+func NewERC20PayoutSender(backend ERC20Backend, auth *bind.TransactOpts, token common.Address) (*ERC20PayoutSender, error) {
+	parsed, err := abi.JSON(strings.NewReader(erc20TransferABI))
+	if err != nil {
+		return nil, err
+	}
+	return &ERC20PayoutSender{
+		backend:  backend,
+		auth:     auth,
+		contract: bind.NewBoundContract(token, parsed, backend, backend, backend),
+	}, nil
+}
+
+//Name of this sender
+func (s *ERC20PayoutSender) Name() string {
+	return "erc20"
+}
+
+//Send erc20 transfer and wait until mined
+func (s *ERC20PayoutSender) Send(p *models.Payout) (reference string, sent bool, err error) {
+	tx, err := s.contract.Transact(s.auth, "transfer", p.Delegator(), p.Amount())
+	if err != nil {
+		return
+	}
+	sent = true
+	reference = tx.Hash().String()
+	receipt, err := bind.WaitMined(rpc.GetCallContext(), s.backend, tx)
+	if err != nil {
+		return
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		//tx执行失败,token没有转出
+		sent = false
+		err = fmt.Errorf("tx %s execution err", reference)
+	}
+	return
+}
+
+/*
+PayoutWorker 定期处理等待发送的退款,同一时间只发送一笔
+*/
+type PayoutWorker struct {
+	db       *models.ModelDB
+	sender   PayoutSender
+	interval time.Duration
+	quitChan chan struct{}
+}
+
+//NewPayoutWorker create a worker
+func NewPayoutWorker(db *models.ModelDB, sender PayoutSender) *PayoutWorker {
+	return &PayoutWorker{
+		db:       db,
+		sender:   sender,
+		interval: time.Second * 10,
+		quitChan: make(chan struct{}),
+	}
+}
+
+/*
+Start 上次退出时正在发送的退款无法确定是否发出,标记为PayoutStatusUnknown,需要人工核对
+*/
+func (w *PayoutWorker) Start() error {
+	ps, err := w.db.GetPayoutsByStatus(models.PayoutStatusSending)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		log.Error(fmt.Sprintf("payout %s was interrupted, need manual check", p.Key))
+		err = w.db.UpdatePayoutStatus(p.Key, models.PayoutStatusUnknown, p.Reference, "interrupted while sending")
+		if err != nil {
+			return err
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-time.After(w.interval):
+				w.processPending()
+			case <-w.quitChan:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+//Stop worker
+func (w *PayoutWorker) Stop() {
+	close(w.quitChan)
+}
+
+func (w *PayoutWorker) processPending() {
+	ps, err := w.db.GetPayoutsByStatus(models.PayoutStatusPending)
+	if err != nil {
+		log.Error(fmt.Sprintf("GetPayoutsByStatus err %s", err))
+		return
+	}
+	for _, p := range ps {
+		select {
+		case <-w.quitChan:
+			return
+		default:
+		}
+		w.send(p)
+	}
+}
+
+func (w *PayoutWorker) send(p *models.Payout) {
+	err := w.db.UpdatePayoutStatus(p.Key, models.PayoutStatusSending, "", "")
+	if err != nil {
+		log.Error(fmt.Sprintf("UpdatePayoutStatus %s err %s", p.Key, err))
+		return
+	}
+	reference, sent, err := w.sender.Send(p)
+	status := models.PayoutStatusSuccess
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+		status = models.PayoutStatusFailed
+		if sent {
+			status = models.PayoutStatusUnknown
+		}
+		log.Error(fmt.Sprintf("send payout %s by %s err %s, sent=%v", p.Key, w.sender.Name(), err, sent))
+	}
+	err = w.db.UpdatePayoutStatus(p.Key, status, reference, errMsg)
+	if err != nil {
+		log.Error(fmt.Sprintf("UpdatePayoutStatus %s err %s", p.Key, err))
+	}
+}
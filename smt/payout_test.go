@@ -0,0 +1,112 @@
+package smt
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePayoutSender struct {
+	sent bool
+	err  error
+}
+
+func (f *fakePayoutSender) Name() string {
+	return "fake"
+}
+
+func (f *fakePayoutSender) Send(p *models.Payout) (reference string, sent bool, err error) {
+	return "ref-" + p.Key, f.sent, f.err
+}
+
+func TestPayoutWorker(t *testing.T) {
+	db := models.SetupTestDb(t)
+	addr := utils.NewRandomAddress()
+	db.AccountAddSmt(addr, big.NewInt(100))
+	sender := &fakePayoutSender{}
+	w := NewPayoutWorker(db, sender)
+
+	p1, err := db.CreatePayout(addr, big.NewInt(10), 1, "fake")
+	assert.Nil(t, err)
+	w.processPending()
+	p1, err = db.GetPayout(p1.Key)
+	assert.Nil(t, err)
+	assert.EqualValues(t, models.PayoutStatusSuccess, p1.Status)
+	assert.EqualValues(t, "ref-"+p1.Key, p1.Reference)
+
+	sender.err = errors.New("no route")
+	p2, err := db.CreatePayout(addr, big.NewInt(20), 2, "fake")
+	assert.Nil(t, err)
+	w.processPending()
+	p2, err = db.GetPayout(p2.Key)
+	assert.Nil(t, err)
+	assert.EqualValues(t, models.PayoutStatusFailed, p2.Status)
+
+	sender.sent = true
+	p3, err := db.CreatePayout(addr, big.NewInt(30), 3, "fake")
+	assert.Nil(t, err)
+	w.processPending()
+	p3, err = db.GetPayout(p3.Key)
+	assert.Nil(t, err)
+	assert.EqualValues(t, models.PayoutStatusUnknown, p3.Status)
+	//失败的退回,无法确定的不退回
+	assert.EqualValues(t, big.NewInt(40), db.AccountGetAccount(addr).WithdrawnSmt)
+
+	//上次退出时正在发送
+	p4, err := db.CreatePayout(addr, big.NewInt(1), 4, "fake")
+	assert.Nil(t, err)
+	err = db.UpdatePayoutStatus(p4.Key, models.PayoutStatusSending, "", "")
+	assert.Nil(t, err)
+	err = w.Start()
+	assert.Nil(t, err)
+	w.Stop()
+	p4, err = db.GetPayout(p4.Key)
+	assert.Nil(t, err)
+	assert.EqualValues(t, models.PayoutStatusUnknown, p4.Status)
+}
+
+func TestPhotonPayoutSender(t *testing.T) {
+	token := utils.NewRandomAddress()
+	to := utils.NewRandomAddress()
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues(t, "/api/1/transfers/"+token.String()+"/"+to.String(), r.URL.Path)
+		var req photonTransferRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		assert.Nil(t, err)
+		assert.EqualValues(t, big.NewInt(10), req.Amount)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		_, err = w.Write([]byte(`{"lock_secret_hash":"0x1234"}`))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+	s := NewPhotonPayoutSender(ts.URL+"/", token)
+	p := &models.Payout{
+		DelegatorStr: to.String(),
+		AmountStr:    "10",
+	}
+	ref, sent, err := s.Send(p)
+	assert.Nil(t, err)
+	assert.True(t, sent)
+	assert.EqualValues(t, "0x1234", ref)
+	status = http.StatusConflict
+	_, sent, err = s.Send(p)
+	assert.NotNil(t, err)
+	assert.False(t, sent)
+	//超时或者节点内部错误时转账可能已经发出,不能退回
+	for _, status = range []int{http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusGatewayTimeout} {
+		_, sent, err = s.Send(p)
+		assert.NotNil(t, err)
+		assert.True(t, sent)
+	}
+}
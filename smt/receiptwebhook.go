@@ -0,0 +1,179 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// receiptKeyPrefix 回执到账的Key前缀,和photon节点返回的Key区分开
+const receiptKeyPrefix = "receipt-"
+
+/*
+Receipt 可信第三方(比如支付网关)推送的到账回执
+*/
+type Receipt struct {
+	Key         string         `json:"key"` // 第三方的唯一流水号
+	Token       common.Address `json:"token"`
+	From        common.Address `json:"from"`
+	To          common.Address `json:"to"`
+	Amount      *big.Int       `json:"amount"`
+	BlockNumber int64          `json:"block_number"`
+	Signature   hexutil.Bytes  `json:"signature"`
+}
+
+//Pack the receipt, issuer signs it by utils.SignData
+func (r *Receipt) Pack() []byte {
+	buf := new(bytes.Buffer)
+	_, err := buf.Write([]byte(r.Key))
+	_, err = buf.Write(r.Token[:])
+	_, err = buf.Write(r.From[:])
+	_, err = buf.Write(r.To[:])
+	_, err = buf.Write(utils.BigIntTo32Bytes(r.Amount))
+	err = binary.Write(buf, binary.BigEndian, r.BlockNumber)
+	if err != nil {
+		log.Error(fmt.Sprintf("buf write error %s", err))
+	}
+	return buf.Bytes()
+}
+
+//Hash of the packed receipt
+func (r *Receipt) Hash() common.Hash {
+	return utils.Sha3(r.Pack())
+}
+
+/*
+ReceiptWebhook 接收签名的到账回执,只有签名者是预先配置的issuer,
+并且收款方是PMS的回执才会记账
+*/
+type ReceiptWebhook struct {
+	listen   string
+	issuer   common.Address
+	token    common.Address
+	receiver common.Address
+	db       *models.ModelDB
+	server   *http.Server
+}
+
+//NewReceiptWebhook create a webhook listening on `listen`
+func NewReceiptWebhook(listen string, issuer, token, receiver common.Address, db *models.ModelDB) *ReceiptWebhook {
+	return &ReceiptWebhook{
+		listen:   listen,
+		issuer:   issuer,
+		token:    token,
+		receiver: receiver,
+		db:       db,
+	}
+}
+
+//Name of this payment source
+func (h *ReceiptWebhook) Name() string {
+	return "webhook"
+}
+
+//Start http server
+func (h *ReceiptWebhook) Start() error {
+	mux := http.NewServeMux()
+	mux.Handle("/receipt", h)
+	// 先同步监听,端口被占用等错误直接返回给调用方,而不是启动一个收不到回执的webhook
+	ln, err := net.Listen("tcp", h.listen)
+	if err != nil {
+		return fmt.Errorf("receipt webhook listen on %s err %s", h.listen, err)
+	}
+	h.server = &http.Server{
+		Addr:    h.listen,
+		Handler: mux,
+	}
+	go func() {
+		err := h.server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error(fmt.Sprintf("receipt webhook serve err %s", err))
+		}
+	}()
+	return nil
+}
+
+//Stop http server
+func (h *ReceiptWebhook) Stop() {
+	if h.server != nil {
+		err := h.server.Close()
+		if err != nil {
+			log.Error(fmt.Sprintf("close receipt webhook err %s", err))
+		}
+	}
+}
+
+type receiptResponse struct {
+	Credited bool   `json:"credited"`
+	Error    string `json:"error,omitempty"`
+}
+
+//ServeHTTP accept POST receipt
+func (h *ReceiptWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var res receiptResponse
+	status := http.StatusOK
+	credited, err := h.handleReceipt(w, r)
+	if err != nil {
+		log.Warn(fmt.Sprintf("reject receipt : %s", err))
+		status = http.StatusBadRequest
+		res.Error = err.Error()
+	}
+	res.Credited = credited
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(&res)
+	if err != nil {
+		log.Error(fmt.Sprintf("write json err %s", err))
+	}
+}
+
+func (h *ReceiptWebhook) handleReceipt(w http.ResponseWriter, r *http.Request) (credited bool, err error) {
+	rc := &Receipt{}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(rc)
+	if err != nil {
+		return
+	}
+	if rc.Amount == nil {
+		err = fmt.Errorf("receipt without amount")
+		return
+	}
+	if rc.To != h.receiver {
+		err = fmt.Errorf("receipt to %s, but receiver is %s", rc.To.String(), h.receiver.String())
+		return
+	}
+	signer, err := utils.Ecrecover(rc.Hash(), rc.Signature)
+	if err != nil {
+		return
+	}
+	if signer != h.issuer {
+		err = fmt.Errorf("receipt signer %s is not trusted", signer.String())
+		return
+	}
+	tr := &models.ReceivedTransfer{
+		Key:             receiptKeyPrefix + rc.Key,
+		BlockNumber:     rc.BlockNumber,
+		TokenAddressStr: rc.Token.String(),
+		FromAddressStr:  rc.From.String(),
+		AmountStr:       rc.Amount.String(),
+	}
+	err = validateTransfer(h.token, tr)
+	if err != nil {
+		return
+	}
+	credited, err = creditTransfer(h.db, h.token, tr)
+	return
+}
@@ -0,0 +1,90 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiptWebhook(t *testing.T) {
+	db := models.SetupTestDb(t)
+	key, _ := crypto.GenerateKey()
+	issuer := crypto.PubkeyToAddress(key.PublicKey)
+	token := utils.NewRandomAddress()
+	pms := utils.NewRandomAddress()
+	from := utils.NewRandomAddress()
+	h := NewReceiptWebhook("", issuer, token, pms, db)
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	post := func(rc *Receipt) (res receiptResponse, status int) {
+		data, _ := json.Marshal(rc)
+		resp, err := http.Post(ts.URL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, resp.StatusCode
+	}
+	rc := &Receipt{
+		Key:         "r1",
+		Token:       token,
+		From:        from,
+		To:          pms,
+		Amount:      big.NewInt(10),
+		BlockNumber: 3,
+	}
+	var err error
+	rc.Signature, err = utils.SignData(key, rc.Pack())
+	assert.Nil(t, err)
+	res, status := post(rc)
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.True(t, res.Credited)
+	//重复的回执不会重复记账
+	res, status = post(rc)
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.False(t, res.Credited)
+	assert.EqualValues(t, "10", db.AccountGetAccount(from).TotalReceivedSmt.String())
+
+	//篡改金额,签名无效
+	rc.Amount = big.NewInt(1000)
+	_, status = post(rc)
+	assert.EqualValues(t, http.StatusBadRequest, status)
+
+	//不可信的签名者
+	other, _ := crypto.GenerateKey()
+	rc.Key = "r2"
+	rc.Signature, err = utils.SignData(other, rc.Pack())
+	assert.Nil(t, err)
+	_, status = post(rc)
+	assert.EqualValues(t, http.StatusBadRequest, status)
+	assert.EqualValues(t, "10", db.AccountGetAccount(from).TotalReceivedSmt.String())
+}
+
+func TestReceiptWebhookStart(t *testing.T) {
+	ast := assert.New(t)
+	h := NewReceiptWebhook("127.0.0.1:0", utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), nil)
+	ast.Nil(h.Start())
+	h.Stop()
+	// 端口被占用时启动失败
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	h = NewReceiptWebhook(ln.Addr().String(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), nil)
+	ast.NotNil(h.Start())
+}
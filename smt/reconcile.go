@@ -0,0 +1,174 @@
+package smt
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+Reconciler 定期对账,从ReceivedTransfer表和photon节点两个方向重新计算每个账户的到账总额,
+和账户中的TotalReceivedSmt比较,不一致的结果会记录下来,供report命令和/admin/reconcile接口查询
+*/
+type Reconciler struct {
+	db       *models.ModelDB
+	token    common.Address
+	node     *Query //为nil表示不和photon节点对账
+	interval time.Duration
+	quitChan chan struct{}
+}
+
+//NewReconciler create a reconciler, url can be empty if there is no photon node
+func NewReconciler(db *models.ModelDB, token common.Address, url string, interval time.Duration) *Reconciler {
+	r := &Reconciler{
+		db:       db,
+		token:    token,
+		interval: interval,
+		quitChan: make(chan struct{}),
+	}
+	if len(url) > 0 {
+		r.node = NewSmtQuery(url, token, db)
+	}
+	return r
+}
+
+//Start reconcile periodically
+func (r *Reconciler) Start() {
+	go func() {
+		for {
+			select {
+			case <-time.After(r.interval):
+				_, err := r.Reconcile()
+				if err != nil {
+					log.Error(fmt.Sprintf("reconcile err %s", err))
+				}
+			case <-r.quitChan:
+				return
+			}
+		}
+	}()
+}
+
+//Stop reconcile
+func (r *Reconciler) Stop() {
+	close(r.quitChan)
+}
+
+type reconcileEntry struct {
+	credited       *big.Int
+	recorded       *big.Int
+	recordedPhoton *big.Int
+	node           *big.Int
+}
+
+func isPhotonTransferKey(key string) bool {
+	return !strings.HasPrefix(key, erc20KeyPrefix) && !strings.HasPrefix(key, receiptKeyPrefix)
+}
+
+/*
+Reconcile 对账一次并保存结果,返回所有账户的对账结果
+photon节点不可用时只做本地对账
+*/
+func (r *Reconciler) Reconcile() (results []*models.ReconcileResult, err error) {
+	entries := make(map[common.Address]*reconcileEntry)
+	get := func(addr common.Address) *reconcileEntry {
+		e, ok := entries[addr]
+		if !ok {
+			e = &reconcileEntry{
+				credited:       new(big.Int),
+				recorded:       new(big.Int),
+				recordedPhoton: new(big.Int),
+			}
+			entries[addr] = e
+		}
+		return e
+	}
+	accounts, err := r.db.AccountGetAllAccounts()
+	if err != nil {
+		return
+	}
+	for _, a := range accounts {
+		get(common.BytesToAddress(a.Address)).credited.Set(a.TotalReceivedSmt)
+	}
+	trs, err := r.db.GetReceivedTransferInBlockRange(-1, -1)
+	if err != nil {
+		return
+	}
+	for _, tr := range trs {
+		// 人工调整补记的到账可以是负数,只和本地账户核对
+		if strings.HasPrefix(tr.Key, models.AdjustKeyPrefix) {
+			e := get(tr.FromAddress())
+			e.recorded.Add(e.recorded, tr.Amount())
+			continue
+		}
+		if validateTransfer(r.token, tr) != nil {
+			continue
+		}
+		e := get(tr.FromAddress())
+		e.recorded.Add(e.recorded, tr.Amount())
+		if isPhotonTransferKey(tr.Key) {
+			e.recordedPhoton.Add(e.recordedPhoton, tr.Amount())
+		}
+	}
+	nodeAvailable := false
+	if r.node != nil {
+		var nodeTrs []*models.ReceivedTransfer
+		r.node.from = 0
+		nodeTrs, err = r.node.queryWithRetry()
+		if err != nil {
+			log.Warn(fmt.Sprintf("reconcile query photon err %s, only reconcile with local records", err))
+			err = nil
+		} else {
+			nodeAvailable = true
+			for _, e := range entries {
+				e.node = new(big.Int)
+			}
+			keys := make(map[string]bool)
+			for _, tr := range nodeTrs {
+				if validateTransfer(r.token, tr) != nil || keys[tr.Key] {
+					continue
+				}
+				keys[tr.Key] = true
+				e := get(tr.FromAddress())
+				if e.node == nil {
+					e.node = new(big.Int)
+				}
+				e.node.Add(e.node, tr.Amount())
+			}
+		}
+	}
+	now := time.Now().Unix()
+	for addr, e := range entries {
+		res := &models.ReconcileResult{
+			AddressStr:        addr.String(),
+			CreditedStr:       e.credited.String(),
+			RecordedStr:       e.recorded.String(),
+			RecordedPhotonStr: e.recordedPhoton.String(),
+			Consistent:        true,
+			ReconcileTime:     now,
+		}
+		var reasons []string
+		if e.credited.Cmp(e.recorded) != 0 {
+			reasons = append(reasons, fmt.Sprintf("credited %s but recorded %s", e.credited, e.recorded))
+		}
+		if nodeAvailable {
+			res.NodeStr = e.node.String()
+			if e.node.Cmp(e.recordedPhoton) != 0 {
+				reasons = append(reasons, fmt.Sprintf("photon node has %s but recorded %s", e.node, e.recordedPhoton))
+			}
+		}
+		if len(reasons) > 0 {
+			res.Consistent = false
+			res.Reason = strings.Join(reasons, "; ")
+			log.Warn(fmt.Sprintf("reconcile discrepancy of %s : %s", res.AddressStr, res.Reason))
+		}
+		results = append(results, res)
+	}
+	err = r.db.SaveReconcileResults(results)
+	return
+}
@@ -0,0 +1,89 @@
+package smt
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertCredited(t *testing.T, db *models.ModelDB, token common.Address, tr *models.ReceivedTransfer) {
+	isNew, err := creditTransfer(db, token, tr)
+	assert.Nil(t, err)
+	assert.True(t, isNew)
+}
+
+func TestReconciler(t *testing.T) {
+	db := models.SetupTestDb(t)
+	token := utils.NewRandomAddress()
+	a1 := utils.NewRandomAddress()
+	a2 := utils.NewRandomAddress()
+	newTr := func(key string, from string, amount string) *models.ReceivedTransfer {
+		return &models.ReceivedTransfer{
+			Key:             key,
+			BlockNumber:     1,
+			TokenAddressStr: token.String(),
+			FromAddressStr:  from,
+			AmountStr:       amount,
+		}
+	}
+	assertCredited(t, db, token, newTr("p1", a1.String(), "10"))
+	assertCredited(t, db, token, newTr(erc20KeyPrefix+"e1", a1.String(), "5"))
+	//a2的到账记录了但是没有记账
+	assert.True(t, db.NewReceiveTransferFromReceiveTransfer(newTr("p2", a2.String(), "7")))
+	nodeTrs := []*models.ReceivedTransfer{
+		newTr("p1", a1.String(), "10"),
+		newTr("p2", a2.String(), "7"),
+		//节点上有,但是本地漏掉了
+		newTr("p3", a2.String(), "3"),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewEncoder(w).Encode(nodeTrs)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	rc := NewReconciler(db, token, ts.URL, 0)
+	results, err := rc.Reconcile()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, len(results))
+	ds, err := db.GetReconcileResults(true)
+	assert.Nil(t, err)
+	if assert.EqualValues(t, 1, len(ds)) {
+		assert.EqualValues(t, a2.String(), ds[0].AddressStr)
+		assert.EqualValues(t, "0", ds[0].CreditedStr)
+		assert.EqualValues(t, "7", ds[0].RecordedStr)
+		assert.EqualValues(t, "10", ds[0].NodeStr)
+	}
+
+	//补记以后再次对账,结果一致
+	db.AccountAddSmt(a2, big.NewInt(7))
+	assertCredited(t, db, token, newTr("p3", a2.String(), "3"))
+	_, err = rc.Reconcile()
+	assert.Nil(t, err)
+	ds, err = db.GetReconcileResults(true)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, len(ds))
+	all, err := db.GetReconcileResults(false)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, len(all))
+
+	//人工调整到账,包括负数的调整,对账仍然一致
+	_, err = db.AccountAdjust(a1, "received", big.NewInt(4), "ops", "missed deposit")
+	assert.Nil(t, err)
+	_, err = db.AccountAdjust(a1, "received", big.NewInt(-1), "ops", "duplicated deposit")
+	assert.Nil(t, err)
+	_, err = rc.Reconcile()
+	assert.Nil(t, err)
+	ds, err = db.GetReconcileResults(true)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, len(ds))
+}
@@ -0,0 +1,68 @@
+package smt
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+PaymentSource 用户给PMS支付服务费的渠道,每一种渠道负责发现新的到账并记入用户账户
+目前支持三种:
+1. Query 轮询关联的photon节点收到的转账
+2. TransferWatcher 监听链上smt token转给PMS的Transfer事件
+3. ReceiptWebhook 接收可信第三方签名的到账回执
+*/
+type PaymentSource interface {
+	Name() string
+	Start() error
+	Stop()
+}
+
+/*
+validateTransfer 不能信任任何渠道返回的数据,记账之前必须检查
+*/
+func validateTransfer(token common.Address, tr *models.ReceivedTransfer) error {
+	if tr == nil {
+		return errors.New("empty transfer")
+	}
+	if len(tr.Key) == 0 {
+		return errors.New("transfer without key")
+	}
+	if !common.IsHexAddress(tr.TokenAddressStr) || tr.TokenAddress() != token {
+		return fmt.Errorf("token mismatch, expect=%s,got=%s", token.String(), tr.TokenAddressStr)
+	}
+	if !common.IsHexAddress(tr.FromAddressStr) || tr.FromAddress() == utils.EmptyAddress {
+		return fmt.Errorf("invalid from address %s", tr.FromAddressStr)
+	}
+	amount, ok := new(big.Int).SetString(tr.AmountStr, 10)
+	if !ok || amount.Sign() <= 0 {
+		return fmt.Errorf("invalid amount %s", tr.AmountStr)
+	}
+	if tr.BlockNumber < 0 {
+		return fmt.Errorf("invalid block number %d", tr.BlockNumber)
+	}
+	return nil
+}
+
+/*
+creditTransfer 校验并记账,同一笔到账(Key相同)只会记一次,无效的到账直接忽略.
+returns true if it's a new transfer, err只表示数据库出错,此时调用者不能推进游标
+*/
+func creditTransfer(db *models.ModelDB, token common.Address, tr *models.ReceivedTransfer) (isNew bool, err error) {
+	err = validateTransfer(token, tr)
+	if err != nil {
+		log.Warn(fmt.Sprintf("ignore invalid transfer %s : %s", utils.StringInterface(tr, 2), err))
+		return false, nil
+	}
+	isNew, err = db.ReceiveDeposit(tr)
+	if err != nil {
+		err = fmt.Errorf("save deposit %s err %s", tr.Key, err)
+	}
+	return
+}
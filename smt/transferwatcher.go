@@ -0,0 +1,174 @@
+package smt
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/log"
+	smparams "github.com/SmartMeshFoundation/Photon/params"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// transferEventTopic is topic of erc20 event Transfer(address indexed from, address indexed to, uint256 value)
+var transferEventTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+// erc20KeyPrefix 链上到账的Key前缀,和photon节点返回的Key区分开
+const erc20KeyPrefix = "erc20-"
+
+// maxFilterBlockRange 单次查询日志的最大块数,避免节点拒绝过大的查询
+const maxFilterBlockRange = 5000
+
+/*
+LogFilterer 是TransferWatcher需要的链上接口,helper.SafeEthClient满足该接口,
+测试时可以用本地实现替代
+*/
+type LogFilterer interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+/*
+TransferWatcher 直接监听链上smt token转给PMS的Transfer事件,
+不依赖photon节点,只处理已经确认(不会分叉)的块
+*/
+type TransferWatcher struct {
+	client        LogFilterer
+	token         common.Address
+	receiver      common.Address
+	db            *models.ModelDB
+	from          int64
+	confirmations int64
+	interval      time.Duration
+	quitChan      chan struct{}
+}
+
+//NewTransferWatcher create a watcher of smt transfered to `receiver`, continue from the saved cursor
+func NewTransferWatcher(client LogFilterer, token, receiver common.Address, db *models.ModelDB) *TransferWatcher {
+	w := &TransferWatcher{
+		client:        client,
+		token:         token,
+		receiver:      receiver,
+		db:            db,
+		confirmations: smparams.ForkConfirmNumber,
+		interval:      time.Second * 10,
+		quitChan:      make(chan struct{}),
+	}
+	w.from = db.GetPaymentCursor(w.Name())
+	return w
+}
+
+//Name of this payment source
+func (w *TransferWatcher) Name() string {
+	return "erc20"
+}
+
+//Start watching
+func (w *TransferWatcher) Start() error {
+	go w.loop()
+	return nil
+}
+
+//Stop watching
+func (w *TransferWatcher) Stop() {
+	close(w.quitChan)
+}
+
+func (w *TransferWatcher) loop() {
+	for {
+		select {
+		case <-time.After(w.interval):
+			err := w.poll()
+			if err != nil {
+				log.Error(fmt.Sprintf("TransferWatcher poll err %s", err))
+			}
+		case <-w.quitChan:
+			return
+		}
+	}
+}
+
+func (w *TransferWatcher) poll() error {
+	ctx, cancel := context.WithTimeout(context.Background(), smparams.EthRPCTimeout)
+	h, err := w.client.HeaderByNumber(ctx, nil)
+	cancel()
+	if err != nil {
+		return err
+	}
+	confirmed := h.Number.Int64() - w.confirmations
+	for w.from <= confirmed {
+		to := w.from + maxFilterBlockRange - 1
+		if to > confirmed {
+			to = confirmed
+		}
+		err = w.processRange(w.from, to)
+		if err != nil {
+			return err
+		}
+		err = w.db.SavePaymentCursor(w.Name(), to+1)
+		if err != nil {
+			return err
+		}
+		w.from = to + 1
+	}
+	return nil
+}
+
+func (w *TransferWatcher) processRange(from, to int64) error {
+	q := ethereum.FilterQuery{
+		FromBlock: big.NewInt(from),
+		ToBlock:   big.NewInt(to),
+		Addresses: []common.Address{w.token},
+		Topics: [][]common.Hash{
+			{transferEventTopic},
+			nil,
+			{common.BytesToHash(w.receiver[:])},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), smparams.EthRPCTimeout)
+	logs, err := w.client.FilterLogs(ctx, q)
+	cancel()
+	if err != nil {
+		return err
+	}
+	for i := range logs {
+		tr, err := w.logToTransfer(&logs[i])
+		if err != nil {
+			log.Warn(fmt.Sprintf("ignore transfer log %s : %s", logs[i].TxHash.String(), err))
+			continue
+		}
+		_, err = creditTransfer(w.db, w.token, tr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *TransferWatcher) logToTransfer(l *types.Log) (*models.ReceivedTransfer, error) {
+	if l.Removed {
+		return nil, fmt.Errorf("log removed because of chain reorg")
+	}
+	if l.Address != w.token || len(l.Topics) != 3 || l.Topics[0] != transferEventTopic {
+		return nil, fmt.Errorf("not a transfer event of %s", w.token.String())
+	}
+	if common.BytesToAddress(l.Topics[2][:]) != w.receiver {
+		return nil, fmt.Errorf("receiver mismatch")
+	}
+	if len(l.Data) != 32 {
+		return nil, fmt.Errorf("invalid data length %d", len(l.Data))
+	}
+	return &models.ReceivedTransfer{
+		Key:             fmt.Sprintf("%s%s-%d", erc20KeyPrefix, l.TxHash.String(), l.Index),
+		BlockNumber:     int64(l.BlockNumber),
+		TokenAddressStr: w.token.String(),
+		FromAddressStr:  common.BytesToAddress(l.Topics[1][:]).String(),
+		Nonce:           int64(l.Index),
+		AmountStr:       new(big.Int).SetBytes(l.Data).String(),
+	}, nil
+}
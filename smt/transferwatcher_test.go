@@ -0,0 +1,83 @@
+package smt
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeFilterer struct {
+	head    int64
+	logs    []types.Log
+	queries []ethereum.FilterQuery
+}
+
+func (f *fakeFilterer) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: big.NewInt(f.head)}, nil
+}
+
+func (f *fakeFilterer) FilterLogs(ctx context.Context, q ethereum.FilterQuery) (logs []types.Log, err error) {
+	f.queries = append(f.queries, q)
+	for _, l := range f.logs {
+		if int64(l.BlockNumber) >= q.FromBlock.Int64() && int64(l.BlockNumber) <= q.ToBlock.Int64() {
+			logs = append(logs, l)
+		}
+	}
+	return
+}
+
+func newTransferLog(token, from, to common.Address, amount int64, blockNumber uint64, index uint) types.Log {
+	return types.Log{
+		Address:     token,
+		Topics:      []common.Hash{transferEventTopic, common.BytesToHash(from[:]), common.BytesToHash(to[:])},
+		Data:        utils.BigIntTo32Bytes(big.NewInt(amount)),
+		BlockNumber: blockNumber,
+		TxHash:      utils.NewRandomHash(),
+		Index:       index,
+	}
+}
+
+func TestTransferWatcher(t *testing.T) {
+	db := models.SetupTestDb(t)
+	token := utils.NewRandomAddress()
+	pms := utils.NewRandomAddress()
+	from := utils.NewRandomAddress()
+	removed := newTransferLog(token, from, pms, 100, 5, 1)
+	removed.Removed = true
+	f := &fakeFilterer{
+		head: 20,
+		logs: []types.Log{
+			newTransferLog(token, from, pms, 10, 2, 0),
+			removed,
+			//其他token的事件,不能记账
+			newTransferLog(utils.NewRandomAddress(), from, pms, 100, 2, 2),
+			//未确认的块,暂不处理
+			newTransferLog(token, from, pms, 7, 10, 0),
+		},
+	}
+	w := NewTransferWatcher(f, token, pms, db)
+	w.confirmations = 17
+	err := w.poll()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 4, w.from)
+	a := db.AccountGetAccount(from)
+	assert.EqualValues(t, "10", a.TotalReceivedSmt.String())
+
+	f.head = 27
+	err = w.poll()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 11, w.from)
+	a = db.AccountGetAccount(from)
+	assert.EqualValues(t, "17", a.TotalReceivedSmt.String())
+	assert.EqualValues(t, 11, NewTransferWatcher(f, token, pms, db).from)
+	for _, q := range f.queries {
+		assert.EqualValues(t, common.BytesToHash(pms[:]), q.Topics[2][0])
+	}
+}
@@ -0,0 +1,85 @@
+package verifier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+/*
+DelegationReceipt PMS接受委托以后返回的签名回执,
+证明PMS在BlockNumber接受了对ChannelIdentifier(OpenBlockNumber)的这个nonce的委托,并承诺执行.
+如果PMS之后没有执行,委托人可以用它作为证据
+*/
+type DelegationReceipt struct {
+	PMS               common.Address `json:"pms"`
+	ChainID           *big.Int       `json:"chain_id"`
+	ChannelIdentifier common.Hash    `json:"channel_identifier"`
+	OpenBlockNumber   int64          `json:"open_block_number"`
+	Delegator         common.Address `json:"delegator"`
+	Nonce             int64          `json:"nonce"`
+	Locksroot         common.Hash    `json:"locksroot"`
+	UnlockCount       int            `json:"unlock_count"`
+	PunishCount       int            `json:"punish_count"`
+	Fee               *big.Int       `json:"fee"`          // 这个委托总共需要的smt
+	BlockNumber       int64          `json:"block_number"` // 接受委托时PMS同步到的块
+	Signature         hexutil.Bytes  `json:"signature"`
+}
+
+//Pack the receipt without signature
+func (r *DelegationReceipt) Pack() []byte {
+	buf := new(bytes.Buffer)
+	chainID := r.ChainID
+	if chainID == nil {
+		chainID = big.NewInt(0)
+	}
+	fee := r.Fee
+	if fee == nil {
+		fee = big.NewInt(0)
+	}
+	_, err := buf.Write(r.PMS[:])
+	_, err = buf.Write(utils.BigIntTo32Bytes(chainID))
+	_, err = buf.Write(r.ChannelIdentifier[:])
+	err = binary.Write(buf, binary.BigEndian, r.OpenBlockNumber)
+	_, err = buf.Write(r.Delegator[:])
+	err = binary.Write(buf, binary.BigEndian, r.Nonce)
+	_, err = buf.Write(r.Locksroot[:])
+	err = binary.Write(buf, binary.BigEndian, int64(r.UnlockCount))
+	err = binary.Write(buf, binary.BigEndian, int64(r.PunishCount))
+	_, err = buf.Write(utils.BigIntTo32Bytes(fee))
+	err = binary.Write(buf, binary.BigEndian, r.BlockNumber)
+	if err != nil {
+		log.Error(fmt.Sprintf("buf write error %s", err))
+	}
+	return buf.Bytes()
+}
+
+//Sign the receipt by PMS's signer
+func (r *DelegationReceipt) Sign(s signer.Signer) (err error) {
+	r.Signature, err = s.SignData(r.Pack())
+	return
+}
+
+/*
+VerifyReceipt 校验回执确实是pms签发的,pms为空时只要求签名者和回执中的PMS一致
+*/
+func VerifyReceipt(r *DelegationReceipt, pms common.Address) error {
+	if pms != utils.EmptyAddress && r.PMS != pms {
+		return fmt.Errorf("receipt is issued by %s, not %s", r.PMS.String(), pms.String())
+	}
+	signer, err := utils.Ecrecover(utils.Sha3(r.Pack()), r.Signature)
+	if err != nil {
+		return fmt.Errorf("recover signer err %s", err)
+	}
+	if signer != r.PMS {
+		return fmt.Errorf("receipt signer %s is not %s", signer.String(), r.PMS.String())
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package verifier
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon-Monitoring/signer"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelegationReceipt(t *testing.T) {
+	ast := assert.New(t)
+	key, err := crypto.GenerateKey()
+	ast.Nil(err)
+	pms := crypto.PubkeyToAddress(key.PublicKey)
+	r := &DelegationReceipt{
+		PMS:               pms,
+		ChainID:           big.NewInt(8888),
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+		Delegator:         utils.NewRandomAddress(),
+		Nonce:             7,
+		Locksroot:         utils.NewRandomHash(),
+		UnlockCount:       2,
+		PunishCount:       1,
+		Fee:               big.NewInt(5),
+		BlockNumber:       100,
+	}
+	err = r.Sign(signer.NewKeystoreSigner(key))
+	ast.Nil(err)
+	ast.Nil(VerifyReceipt(r, pms))
+	ast.Nil(VerifyReceipt(r, utils.EmptyAddress))
+	ast.NotNil(VerifyReceipt(r, utils.NewRandomAddress()))
+
+	r.Nonce = 8
+	ast.NotNil(VerifyReceipt(r, pms))
+	r.Nonce = 7
+	r.Fee = big.NewInt(4)
+	ast.NotNil(VerifyReceipt(r, pms))
+}